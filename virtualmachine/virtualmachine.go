@@ -25,10 +25,16 @@ type VirtualMachine interface {
 }
 
 type NetworkSetting struct {
-	Ip         string `json:"ip_address"`
-	Gateway    string `json:"default_gateway"`
-	SubnetMask string `json:"subnet_mask"`
-	DnsServer  string `json:"dns_server"`
+	Ip               string `json:"ip_address"`
+	Gateway          string `json:"default_gateway"`
+	SubnetMask       string `json:"subnet_mask"`
+	DnsServer        string `json:"dns_server"`
+	IPv6Address      string `json:"ipv6_address"`
+	IPv6PrefixLength int32  `json:"ipv6_prefix_length"`
+	IPv6Gateway      string `json:"ipv6_gateway"`
+	// IsDefaultGateway applies the gateways of the setting to its NIC only,
+	// the gateways of the other NICs are dropped.
+	IsDefaultGateway bool `json:"is_default_gateway"`
 }
 
 const (
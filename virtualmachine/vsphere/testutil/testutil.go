@@ -0,0 +1,249 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+// Package testutil provides in-memory fakes of the vSphere inventory used by
+// the vsphere package, so that code provisioning VMs through it can be unit
+// tested without a vCenter. Install them with:
+//
+//	vsphere.SetupSession = vsphere.NewFakeSession(finder, collector)
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+
+	"github.com/apcera/libretto/virtualmachine/vsphere"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+var (
+	_ vsphere.Finder    = (*Finder)(nil)
+	_ vsphere.Collector = (*Collector)(nil)
+)
+
+// Finder is an in-memory vsphere.Finder. The lists return the objects whose
+// name matches the pattern, like path.Match, and an error when none does.
+type Finder struct {
+	Datacenters       []*object.Datacenter
+	Clusters          []*object.ClusterComputeResource
+	VirtualMachines   []*object.VirtualMachine
+	Networks          []object.NetworkReference
+	ResourcePools     []*object.ResourcePool
+	DatastoreClusters []*object.StoragePod
+	Datastores        []*object.Datastore
+	HostSystems       []*object.HostSystem
+	// Objects are returned by ObjectReference.
+	Objects map[types.ManagedObjectReference]object.Reference
+	// Datacenter is the last datacenter set by SetDatacenter.
+	Datacenter *object.Datacenter
+}
+
+// matches: returns true if the base name of the object matches the pattern
+func matches(pattern string, ref object.Reference) bool {
+	named, ok := ref.(interface {
+		Name() string
+	})
+	if !ok {
+		return false
+	}
+	ok, err := path.Match(path.Base(pattern), named.Name())
+	return err == nil && ok
+}
+
+// notFound: returns the error of the finder when no object matches
+func notFound(kind, pattern string) error {
+	return fmt.Errorf("%s '%s' not found", kind, pattern)
+}
+
+// DatacenterList returns the datacenters matching the pattern.
+func (f *Finder) DatacenterList(c context.Context, p string) ([]*object.Datacenter, error) {
+	var found []*object.Datacenter
+	for _, dc := range f.Datacenters {
+		if matches(p, dc) {
+			found = append(found, dc)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("datacenter", p)
+	}
+	return found, nil
+}
+
+// ClusterComputeResourceList returns the clusters matching the pattern.
+func (f *Finder) ClusterComputeResourceList(c context.Context, p string) ([]*object.ClusterComputeResource, error) {
+	var found []*object.ClusterComputeResource
+	for _, cluster := range f.Clusters {
+		if matches(p, cluster) {
+			found = append(found, cluster)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("cluster", p)
+	}
+	return found, nil
+}
+
+// VirtualMachineList returns the vms matching the pattern.
+func (f *Finder) VirtualMachineList(c context.Context, p string) ([]*object.VirtualMachine, error) {
+	var found []*object.VirtualMachine
+	for _, vm := range f.VirtualMachines {
+		if matches(p, vm) {
+			found = append(found, vm)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("vm", p)
+	}
+	return found, nil
+}
+
+// NetworkList returns the networks matching the pattern.
+func (f *Finder) NetworkList(c context.Context, p string) ([]object.NetworkReference, error) {
+	var found []object.NetworkReference
+	for _, network := range f.Networks {
+		if matches(p, network) {
+			found = append(found, network)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("network", p)
+	}
+	return found, nil
+}
+
+// ResourcePoolList returns the resource pools matching the pattern.
+func (f *Finder) ResourcePoolList(c context.Context, p string) ([]*object.ResourcePool, error) {
+	var found []*object.ResourcePool
+	for _, rp := range f.ResourcePools {
+		if matches(p, rp) {
+			found = append(found, rp)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("resource pool", p)
+	}
+	return found, nil
+}
+
+// DatastoreClusterList returns the datastore clusters matching the pattern.
+func (f *Finder) DatastoreClusterList(c context.Context, p string) ([]*object.StoragePod, error) {
+	var found []*object.StoragePod
+	for _, pod := range f.DatastoreClusters {
+		if matches(p, pod) {
+			found = append(found, pod)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("datastore cluster", p)
+	}
+	return found, nil
+}
+
+// DatastoreList returns the datastores matching the pattern.
+func (f *Finder) DatastoreList(c context.Context, p string) ([]*object.Datastore, error) {
+	var found []*object.Datastore
+	for _, ds := range f.Datastores {
+		if matches(p, ds) {
+			found = append(found, ds)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("datastore", p)
+	}
+	return found, nil
+}
+
+// HostSystemList returns the hosts matching the pattern.
+func (f *Finder) HostSystemList(c context.Context, p string) ([]*object.HostSystem, error) {
+	var found []*object.HostSystem
+	for _, host := range f.HostSystems {
+		if matches(p, host) {
+			found = append(found, host)
+		}
+	}
+	if len(found) == 0 {
+		return nil, notFound("host", p)
+	}
+	return found, nil
+}
+
+// SetDatacenter records the datacenter. It returns nil, there is no real
+// finder behind the fake.
+func (f *Finder) SetDatacenter(dc *object.Datacenter) *find.Finder {
+	f.Datacenter = dc
+	return nil
+}
+
+// ObjectReference returns the object with the reference from Objects.
+func (f *Finder) ObjectReference(c context.Context, ref types.ManagedObjectReference) (object.Reference, error) {
+	obj, ok := f.Objects[ref]
+	if !ok {
+		return nil, notFound(ref.Type, ref.Value)
+	}
+	return obj, nil
+}
+
+// Collector is an in-memory vsphere.Collector holding managed objects, like
+// mo.Datacenter or mo.VirtualMachine, by reference. The objects are returned
+// whole, the properties asked for aren't used to filter them. Retrieving an
+// unknown object fails with a ManagedObjectNotFound fault, like for a deleted
+// object.
+type Collector struct {
+	Objects map[types.ManagedObjectReference]interface{}
+}
+
+// NewCollector returns a collector holding the managed objects.
+func NewCollector(objects ...mo.Reference) *Collector {
+	c := &Collector{Objects: make(map[types.ManagedObjectReference]interface{})}
+	for _, obj := range objects {
+		c.Add(obj)
+	}
+	return c
+}
+
+// Add adds or replaces the managed object.
+func (c *Collector) Add(obj mo.Reference) {
+	if c.Objects == nil {
+		c.Objects = make(map[types.ManagedObjectReference]interface{})
+	}
+	c.Objects[obj.Reference()] = obj
+}
+
+// RetrieveOne copies the object with the reference into dst, a pointer to the
+// managed object or to a slice of them.
+func (c *Collector) RetrieveOne(ctx context.Context, ref types.ManagedObjectReference, ps []string, dst interface{}) error {
+	return c.Retrieve(ctx, []types.ManagedObjectReference{ref}, ps, dst)
+}
+
+// Retrieve appends the objects with the references to dst, a pointer to a
+// slice of managed objects.
+func (c *Collector) Retrieve(ctx context.Context, refs []types.ManagedObjectReference, ps []string, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("expected a pointer, got %T", dst)
+	}
+	rv = rv.Elem()
+	for _, ref := range refs {
+		obj, ok := c.Objects[ref]
+		if !ok {
+			fault := &soap.Fault{}
+			fault.Detail.Fault = types.ManagedObjectNotFound{Obj: ref}
+			return soap.WrapSoapFault(fault)
+		}
+		ov := reflect.ValueOf(obj)
+		switch {
+		case rv.Kind() == reflect.Slice && ov.Type().AssignableTo(rv.Type().Elem()):
+			rv.Set(reflect.Append(rv, ov))
+		case ov.Type().AssignableTo(rv.Type()):
+			rv.Set(ov)
+		default:
+			return fmt.Errorf("cannot retrieve %s into %T", ov.Type(), dst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Apcera Inc. All rights reserved.
+
+package testutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apcera/libretto/virtualmachine/vsphere"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestFakeSession(t *testing.T) {
+	dcRef := types.ManagedObjectReference{Type: "Datacenter", Value: "dc-1"}
+	dc := object.NewDatacenter(nil, dcRef)
+	dc.InventoryPath = "/dc1"
+	dcMo := mo.Datacenter{}
+	dcMo.Self = dcRef
+	dcMo.Name = "dc1"
+
+	oldSetupSession := vsphere.SetupSession
+	defer func() {
+		vsphere.SetupSession = oldSetupSession
+	}()
+	vsphere.SetupSession = vsphere.NewFakeSession(
+		&Finder{Datacenters: []*object.Datacenter{dc}},
+		NewCollector(dcMo))
+
+	vm := &vsphere.VM{Host: "vcenter", Datacenter: "dc1"}
+	if err := vsphere.SetupSession(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	actual, err := vsphere.GetDatacenter(vm)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if actual.Self != dcRef {
+		t.Fatalf("Expected datacenter %v, got %v", dcRef, actual.Self)
+	}
+
+	vm.Datacenter = "dc2"
+	if _, err := vsphere.GetDatacenter(vm); err == nil {
+		t.Fatal("Expected an error for an unknown datacenter")
+	}
+}
+
+func TestCollectorRetrieve(t *testing.T) {
+	vmMo := mo.VirtualMachine{}
+	vmMo.Self = types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	c := NewCollector(vmMo)
+
+	var vmMos []mo.VirtualMachine
+	if err := c.Retrieve(context.Background(), []types.ManagedObjectReference{vmMo.Self}, nil, &vmMos); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(vmMos) != 1 || vmMos[0].Self != vmMo.Self {
+		t.Fatalf("Expected the vm, got %v", vmMos)
+	}
+
+	var hsMo mo.HostSystem
+	if err := c.RetrieveOne(context.Background(), vmMo.Self, nil, &hsMo); err == nil {
+		t.Fatal("Expected an error retrieving a vm into a host")
+	}
+	missing := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+	if err := c.RetrieveOne(context.Background(), missing, nil, &vmMo); err == nil {
+		t.Fatal("Expected an error for a missing vm")
+	}
+}
@@ -4,8 +4,15 @@ package vsphere
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -14,19 +21,27 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/task"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 
 	"github.com/apcera/libretto/util"
@@ -38,9 +53,26 @@ const (
 	GRAY_STATUS_CHECK_TIMEOUT  = 1 * time.Minute
 	GREEN_STATUS_CHECK_TIMEOUT = 10 * time.Minute
 	IPWAIT_TIMEOUT             = 1 * time.Hour
+	UPLOAD_IDLE_TIMEOUT        = 5 * time.Minute
+	UPLOAD_RESPONSE_TIMEOUT    = 5 * time.Minute
+	LEASE_PROGRESS_INTERVAL    = 5 * time.Second
+	POST_CLONE_SCRIPT_TIMEOUT  = 10 * time.Minute
+	GUEST_PROCESS_POLL_PERIOD  = 2 * time.Second
+	TASK_WAIT_TIMEOUT          = 10 * time.Minute
+	OVA_DOWNLOAD_RETRIES       = 5
+	OVA_DOWNLOAD_BACKOFF       = 1 * time.Second
+	OVA_DOWNLOAD_MAX_BACKOFF   = 1 * time.Minute
+	OVA_MAX_REDIRECTS          = 10
+	SHUTDOWN_POLL_INTERVAL     = 5 * time.Second
+	MAX_NAME_SUFFIX            = 1000
+	SESSION_KEEPALIVE_INTERVAL = 5 * time.Minute
+	SOAP_SESSION_COOKIE        = "vmware_soap_session"
+	GUEST_DISK_TIMEOUT         = 5 * time.Minute
+	GUEST_DISK_POLL_PERIOD     = 5 * time.Second
 )
 
 const (
+	// Deprecated: resource pools are searched at any depth
 	RESOURCE_POOL_DEPTH = 8
 )
 
@@ -99,6 +131,122 @@ func getTempSearchFilter(template Template) VMSearchFilter {
 // mutex for custom spec creation
 var checkCustomSpecMutex sync.Mutex
 
+// operations in progress, keyed by vmOperationKey
+var (
+	vmOperationsMutex sync.Mutex
+	vmOperations      = map[string]string{}
+)
+
+// vmOperationKey: identifies the VM across VM structs
+func vmOperationKey(vm *VM) string {
+	return vm.Host + "/" + vm.Datacenter + "/" + vm.Name
+}
+
+// beginOperation: marks the operation as in progress on the VM. Returns
+// ErrorOperationInProgress if another operation is in progress on it, or the
+// func marking it as done otherwise. The VM is identified when the operation
+// begins, as its name may change while the operation runs.
+func beginOperation(vm *VM, operation string) (func(), error) {
+	vmOperationsMutex.Lock()
+	defer vmOperationsMutex.Unlock()
+	key := vmOperationKey(vm)
+	if current, ok := vmOperations[key]; ok {
+		return nil, NewErrorOperationInProgress(vm.Name, current)
+	}
+	vmOperations[key] = operation
+	return func() { endOperation(key) }, nil
+}
+
+// endOperation: marks the operation in progress under the key as done
+func endOperation(key string) {
+	vmOperationsMutex.Lock()
+	defer vmOperationsMutex.Unlock()
+	delete(vmOperations, key)
+}
+
+// beginProvision: marks the provision as in progress on the VM. The name of a
+// NameTemplate is only known at clone time, and marked by guardProvisionName
+// then. The returned func marks the provision as done on all the names.
+func beginProvision(vm *VM) (func(), error) {
+	vm.provisionDone = map[string]func(){}
+	if vm.NameTemplate == "" {
+		if err := guardProvisionName(vm); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		for _, done := range vm.provisionDone {
+			done()
+		}
+		vm.provisionDone = nil
+	}, nil
+}
+
+// guardProvisionName: marks the provision as in progress on the current name
+// of the VM, unless it already is
+func guardProvisionName(vm *VM) error {
+	key := vmOperationKey(vm)
+	if _, ok := vm.provisionDone[key]; ok {
+		return nil
+	}
+	done, err := beginOperation(vm, "provision")
+	if err != nil {
+		return err
+	}
+	vm.provisionDone[key] = done
+	return nil
+}
+
+// setLeaseState: records the state of the nfc lease of the upload
+func setLeaseState(vm *VM, state LeaseState) {
+	vm.leaseStateMutex.Lock()
+	defer vm.leaseStateMutex.Unlock()
+	vm.leaseState = state
+}
+
+// setProvisioningState: records the step of the provision in progress. Outside
+// of a provision, only ProvisioningStateConnecting is recorded, which starts
+// one, so that the steps shared with other operations are ignored.
+func setProvisioningState(vm *VM, state ProvisioningState) {
+	vm.stateMutex.Lock()
+	defer vm.stateMutex.Unlock()
+	switch vm.state {
+	case ProvisioningStateNone, ProvisioningStateDone, ProvisioningStateFailed:
+		if state != ProvisioningStateConnecting {
+			return
+		}
+	}
+	vm.state = state
+	sendEvent(vm, ProvisionEvent{State: state})
+}
+
+// sendEvent: sends the event on vm.Events, unless the channel is full
+func sendEvent(vm *VM, event ProvisionEvent) {
+	if vm.Events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case vm.Events <- event:
+	default:
+	}
+}
+
+// eventLease: a lease sending the upload progress reported on it as events
+type eventLease struct {
+	Lease
+	vm *VM
+}
+
+// HTTPNfcLeaseProgress reports the progress on the lease and sends it.
+func (l eventLease) HTTPNfcLeaseProgress(percent int32) {
+	l.Lease.HTTPNfcLeaseProgress(percent)
+	sendEvent(l.vm, ProvisionEvent{
+		State:   ProvisioningStateUploadingTemplate,
+		Percent: percent,
+	})
+}
+
 // Exists checks if the VM already exists.
 var Exists = func(vm *VM, searchFilter VMSearchFilter) (bool, error) {
 	_, err := findVM(vm, searchFilter)
@@ -116,10 +264,241 @@ var getURI = func(host string) string {
 }
 
 var newClient = func(vm *VM) (*govmomi.Client, error) {
-	return govmomi.NewClient(vm.ctx, vm.uri, vm.Insecure)
+	if vm.SessionCookie != "" {
+		return cookieClient(vm)
+	}
+	if vm.SharedSession {
+		return sharedClient(vm)
+	}
+	client, err := newVimClient(vm, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Login(vm.ctx, vm.uri.User); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newVimClient: returns a client for vm.uri which isn't logged in. The
+// certificate of vCenter is verified against vm.CACertPool if set. The
+// cookies are sent with every request.
+func newVimClient(vm *VM, cookies []*http.Cookie) (*govmomi.Client, error) {
+	soapClient := soap.NewClient(vm.uri, vm.Insecure && vm.CACertPool == nil)
+	if tr, ok := soapClient.Transport.(*http.Transport); ok && vm.CACertPool != nil {
+		tr.TLSClientConfig.RootCAs = vm.CACertPool
+	}
+	if len(cookies) > 0 {
+		soapClient.Jar.SetCookies(soapClient.URL(), cookies)
+	}
+	vimClient, err := vim25.NewClient(vm.ctx, soapClient)
+	if err != nil {
+		return nil, err
+	}
+	return &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}, nil
+}
+
+// tlsConfig: returns the TLS config of the http clients of the vm. It
+// verifies certificates against vm.CACertPool if set, else the system roots
+// unless vm.Insecure.
+func tlsConfig(vm *VM) *tls.Config {
+	if vm.CACertPool != nil {
+		return &tls.Config{RootCAs: vm.CACertPool}
+	}
+	return &tls.Config{InsecureSkipVerify: vm.Insecure}
+}
+
+// cookieClient: returns a client using the session of vm.SessionCookie. It
+// fails if the session isn't logged in.
+var cookieClient = func(vm *VM) (*govmomi.Client, error) {
+	client, err := newVimClient(vm, []*http.Cookie{{
+		Name:  SOAP_SESSION_COOKIE,
+		Value: vm.SessionCookie,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	userSession, err := client.SessionManager.UserSession(vm.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userSession == nil {
+		return nil, errors.New("the session of the session cookie is not " +
+			"logged in")
+	}
+	return client, nil
+}
+
+// sharedSession is a logged in client shared by the VMs with the same host,
+// credentials and TLS settings
+type sharedSession struct {
+	// mutex is held while checking the session and logging in, so that the
+	// VMs of other sessions don't wait on these round trips
+	mutex  sync.Mutex
+	client *govmomi.Client
+	// stopKeepAlive stops keeping the session of client alive
+	stopKeepAlive func()
+	// refs is the number of VMs using the session, guarded by
+	// sharedSessionsMutex
+	refs int
+}
+
+var (
+	sharedSessionsMutex sync.Mutex
+	sharedSessions      = map[string]*sharedSession{}
+)
+
+// sharedSessionKey: returns the key of the shared session of the vm. It has
+// a hash of the password, so that a session is only shared with the vms
+// logging in with the same credentials, and the TLS settings, so that a vm
+// verifying certificates never uses a session of one that doesn't.
+func sharedSessionKey(vm *VM) string {
+	password := sha256.Sum256([]byte(vm.Password))
+	return fmt.Sprintf("%s|%s|%x|%t|%p", vm.uri.Host, vm.Username, password,
+		vm.Insecure, vm.CACertPool)
+}
+
+// sharedClient: returns the shared client for the host, credentials and TLS
+// settings of the vm, logging in if there is none or its session expired. The
+// vm holds a reference to the session until CloseSession.
+func sharedClient(vm *VM) (*govmomi.Client, error) {
+	key := sharedSessionKey(vm)
+	s, held, old := holdSession(vm, key)
+	// The last vm of its previous session logs it out
+	logoutSession(old)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		if sessionActive(vm, s.client) {
+			return s.client, nil
+		}
+		// The session expired, drop its client before logging in again.
+		// Logging it out may fail as it expired.
+		s.logout()
+	}
+	client, err := loginClient(vm)
+	if err != nil {
+		if !held {
+			sharedSessionsMutex.Lock()
+			releaseSession(vm)
+			sharedSessionsMutex.Unlock()
+		}
+		return nil, err
+	}
+	s.client, s.stopKeepAlive = client, keepAlive(client)
+	return s.client, nil
+}
+
+// holdSession: returns the shared session with the key, creating it if there
+// is none, and makes the vm hold a reference to it. held is true if the vm
+// already held it. old is the previous session of the vm if no other vm uses
+// it anymore, see releaseSession.
+func holdSession(vm *VM, key string) (s *sharedSession, held bool, old *sharedSession) {
+	sharedSessionsMutex.Lock()
+	defer sharedSessionsMutex.Unlock()
+	if vm.sessionKey == key {
+		return sharedSessions[key], true, nil
+	}
+	old = releaseSession(vm)
+	s, ok := sharedSessions[key]
+	if !ok {
+		s = &sharedSession{}
+		sharedSessions[key] = s
+	}
+	vm.sessionKey = key
+	s.refs++
+	return s, false, old
+}
+
+// loginClient: returns a client logged in to vm.uri
+var loginClient = func(vm *VM) (*govmomi.Client, error) {
+	client, err := newVimClient(vm, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Login(vm.ctx, vm.uri.User); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// keepAlive: keeps the session of the client alive by getting the current
+// time every SESSION_KEEPALIVE_INTERVAL until the returned func is called.
+// Unlike session.KeepAlive, it also stops if the session expired and can't
+// be logged out anymore.
+var keepAlive = func(client *govmomi.Client) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(SESSION_KEEPALIVE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				methods.GetCurrentTime(context.Background(), client)
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// sessionActive: returns true if the client is still logged in
+var sessionActive = func(vm *VM, client *govmomi.Client) bool {
+	userSession, err := client.SessionManager.UserSession(vm.ctx)
+	return err == nil && userSession != nil
+}
+
+// logoutClient: logs the client out
+var logoutClient = func(client *govmomi.Client) error {
+	return client.Logout(context.Background())
+}
+
+// releaseSession: drops the reference of the vm to its shared session and
+// returns the session if no other vm uses it anymore, so that the caller logs
+// it out with logoutSession. sharedSessionsMutex has to be held.
+func releaseSession(vm *VM) *sharedSession {
+	key := vm.sessionKey
+	vm.sessionKey = ""
+	s, ok := sharedSessions[key]
+	if !ok {
+		return nil
+	}
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	delete(sharedSessions, key)
+	return s
+}
+
+// logoutSession: stops keeping the session alive and logs it out. It does
+// nothing if the session is nil or was never logged in.
+func logoutSession(s *sharedSession) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	return s.logout()
+}
+
+// logout: stops keeping the session of the client alive, drops the client and
+// logs it out. s.mutex has to be held.
+func (s *sharedSession) logout() error {
+	s.stopKeepAlive()
+	client := s.client
+	s.client, s.stopKeepAlive = nil, nil
+	return logoutClient(client)
 }
 
-var newFinder = func(c *vim25.Client) finder {
+var newFinder = func(c *vim25.Client) Finder {
 	return vmwareFinder{find.NewFinder(c, true)}
 }
 
@@ -134,9 +513,11 @@ var SetupSession = func(vm *VM) error {
 	if err != nil || u.String() == "" {
 		return NewErrorParsingURL(uri, err)
 	}
-	u.User = url.UserPassword(vm.Username, vm.Password)
+	if vm.SessionCookie == "" {
+		u.User = url.UserPassword(vm.Username, vm.Password)
+	}
 	vm.uri = u
-	vm.ctx, vm.cancel = context.WithCancel(context.Background())
+	vm.ctx, vm.cancel = sessionContext(vm)
 	client, err := newClient(vm)
 	if err != nil {
 		return NewErrorClientFailed(err)
@@ -145,12 +526,115 @@ var SetupSession = func(vm *VM) error {
 	vm.client = client
 	vm.finder = newFinder(vm.client.Client)
 	vm.collector = newCollector(vm.client.Client)
+	invalidateDatacenters(vm)
 	return nil
 }
 
+// SetupSessionWithContext sets up the session like SetupSession with ctx as
+// the parent of its context. The context is kept on the VM and is the parent
+// of the sessions of the later calls too, so that they are aborted once it is
+// cancelled or its deadline expires.
+func SetupSessionWithContext(ctx context.Context, vm *VM) error {
+	vm.cancelMutex.Lock()
+	vm.parentCtx = ctx
+	if vm.cancelAll != nil {
+		vm.cancelAll()
+		vm.cancelCtx, vm.cancelAll = nil, nil
+	}
+	vm.cancelMutex.Unlock()
+	return SetupSession(vm)
+}
+
+// sessionContext: returns the context of a new session of the vm. It is
+// derived from the context of SetupSessionWithContext and cancelled by
+// vm.Cancel.
+func sessionContext(vm *VM) (context.Context, context.CancelFunc) {
+	vm.cancelMutex.Lock()
+	defer vm.cancelMutex.Unlock()
+	if vm.cancelCtx == nil {
+		parent := vm.parentCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		vm.cancelCtx, vm.cancelAll = context.WithCancel(parent)
+	}
+	return context.WithCancel(vm.cancelCtx)
+}
+
+// sleepContext: sleeps for the duration or until the context is done, in
+// which case it returns the error of the context
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewFakeSession returns a replacement for SetupSession which looks up the
+// inventory with the given finder and collector instead of connecting to
+// vCenter. It lets the code using this package be tested against fakes, such
+// as the ones in the testutil package. Calls made through the client, like
+// tasks, aren't faked.
+func NewFakeSession(f Finder, c Collector) func(vm *VM) error {
+	return func(vm *VM) error {
+		uri := getURI(vm.Host)
+		u, err := url.Parse(uri)
+		if err != nil {
+			return NewErrorParsingURL(uri, err)
+		}
+		vm.uri = u
+		vm.ctx, vm.cancel = sessionContext(vm)
+		vm.client = &govmomi.Client{Client: &vim25.Client{}}
+		vm.finder = f
+		vm.collector = c
+		invalidateDatacenters(vm)
+		return nil
+	}
+}
+
 // GetDatacenter retrieves the datacenter that the provisioner was configured
-// against.
+// against. It is cached on the VM until the next SetupSession or
+// RefreshDatacenter.
 func GetDatacenter(vm *VM) (*mo.Datacenter, error) {
+	vm.datacenterMutex.Lock()
+	defer vm.datacenterMutex.Unlock()
+	if cached, ok := vm.datacenters[vm.Datacenter]; ok {
+		dcMo := *cached
+		return &dcMo, nil
+	}
+	dcMo, err := retrieveDatacenter(vm)
+	if err != nil {
+		return nil, err
+	}
+	if vm.datacenters == nil {
+		vm.datacenters = make(map[string]*mo.Datacenter)
+	}
+	vm.datacenters[vm.Datacenter] = dcMo
+	cached := *dcMo
+	return &cached, nil
+}
+
+// RefreshDatacenter drops the cached datacenters of the VM and retrieves the
+// datacenter again. Long-lived VMs reusing a session can use it to pick up
+// inventory changes.
+func RefreshDatacenter(vm *VM) (*mo.Datacenter, error) {
+	invalidateDatacenters(vm)
+	return GetDatacenter(vm)
+}
+
+// invalidateDatacenters: drops the datacenters cached on the VM
+func invalidateDatacenters(vm *VM) {
+	vm.datacenterMutex.Lock()
+	defer vm.datacenterMutex.Unlock()
+	vm.datacenters = nil
+}
+
+// retrieveDatacenter: looks up the datacenter named vm.Datacenter in vCenter
+func retrieveDatacenter(vm *VM) (*mo.Datacenter, error) {
 	dcList, err := vm.finder.DatacenterList(vm.ctx, "*")
 	if err != nil {
 		return nil, NewErrorObjectNotFound(err, vm.Datacenter)
@@ -177,10 +661,73 @@ var readAll = func(r io.Reader) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
+// ovaDigests holds the digests of a file extracted from an ova
+type ovaDigests struct {
+	sha1   string
+	sha256 string
+	sha512 string
+}
+
+// manifestEntry matches a line of an ova manifest, e.g. "SHA256(vm.ovf)= 4a..."
+var manifestEntry = regexp.MustCompile(`^(SHA1|SHA256|SHA512)\((.+)\)\s*=\s*([0-9a-fA-F]+)$`)
+
+// verifyManifest: checks the digests of the extracted files against the ova
+// manifest at manifestPath
+func verifyManifest(manifestPath string, digests map[string]ovaDigests) error {
+	manifest, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(manifest), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m := manifestEntry.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("invalid ova manifest entry: %q", line)
+		}
+		digest, ok := digests[m[2]]
+		if !ok {
+			return NewErrorManifestMismatch(m[2])
+		}
+		var expected string
+		switch m[1] {
+		case "SHA1":
+			expected = digest.sha1
+		case "SHA256":
+			expected = digest.sha256
+		case "SHA512":
+			expected = digest.sha512
+		}
+		if !strings.EqualFold(expected, m[3]) {
+			return NewErrorManifestMismatch(m[2])
+		}
+	}
+	return nil
+}
+
+// safeArchivePath: returns the path in basePath to extract the archive entry
+// name to, rejecting names which are absolute or escape basePath
+func safeArchivePath(basePath, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", NewErrorUnsafeArchivePath(name)
+	}
+	target := filepath.Join(basePath, name)
+	rel, err := filepath.Rel(basePath, target)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", NewErrorUnsafeArchivePath(name)
+	}
+	return target, nil
+}
+
 //Extract the tar pointed by 'body' to 'basePath' directory
-var extractOva = func(basePath string, body io.Reader) (string, error) {
+//The extracted files are checked against the ova manifest, if any, when 'verify' is set
+var extractOva = func(basePath string, body io.Reader, verify bool) (string, error) {
 	tarBallReader := tar.NewReader(body)
-	var ovfFileName string
+	var ovfFileName, manifestFileName string
+	digests := map[string]ovaDigests{}
 
 	//iterates through the files in .ova file[tar file]
 	for {
@@ -192,20 +739,36 @@ var extractOva = func(basePath string, body io.Reader) (string, error) {
 			return "", err
 		}
 		filename := header.Name
-		if filepath.Ext(filename) == ".ovf" {
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			return "", NewErrorUnsafeArchivePath(filename)
+		}
+		target, err := safeArchivePath(basePath, filename)
+		if err != nil {
+			return "", err
+		}
+		switch filepath.Ext(filename) {
+		case ".ovf":
 			ovfFileName = filename
+		case ".mf":
+			manifestFileName = filename
 		}
 		// writes the content of the file pointed to by tarBallReader to a local file with same name
 		err = func() error {
-			writer, err := os.Create(filepath.Join(basePath, filename))
+			writer, err := os.Create(target)
 			defer writer.Close()
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(writer, tarBallReader)
+			sha1Hash, sha256Hash, sha512Hash := sha1.New(), sha256.New(), sha512.New()
+			_, err = io.Copy(io.MultiWriter(writer, sha1Hash, sha256Hash, sha512Hash), tarBallReader)
 			if err != nil {
 				return err
 			}
+			digests[filename] = ovaDigests{
+				sha1:   hex.EncodeToString(sha1Hash.Sum(nil)),
+				sha256: hex.EncodeToString(sha256Hash.Sum(nil)),
+				sha512: hex.EncodeToString(sha512Hash.Sum(nil)),
+			}
 			return nil
 		}()
 		if err != nil {
@@ -215,100 +778,366 @@ var extractOva = func(basePath string, body io.Reader) (string, error) {
 	if ovfFileName == "" {
 		return "", errors.New("no ovf file found in the archive")
 	}
-	return filepath.Join(basePath, ovfFileName), nil
-}
-
-// Downloads the ova file from the 'url' (can be local path/remote http server) to 'basePath' directory
-// and returns the path to extracted ovf file
-var downloadOva = func(basePath, url string) (string, error) {
-	var ovaReader io.Reader
-	// if url is a remote url
-	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
-		resp, err := http.Get(url)
+	// An ova without a manifest has nothing to be verified against
+	if verify && manifestFileName != "" {
+		err := verifyManifest(filepath.Join(basePath, manifestFileName), digests)
 		if err != nil {
 			return "", err
 		}
-		ovaReader = resp.Body
-		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("can't download ova file from url: %s %s %d", url, "status: ", resp.StatusCode)
-		}
-		defer resp.Body.Close()
-	} else {
-		resp, err := os.Open(url)
-		if err != nil {
-			return "", err
-		}
-		ovaReader = resp
-		defer resp.Close()
-	}
-	ovfFilePath, err := extractOva(basePath, ovaReader)
-	if err != nil {
-		return "", err
 	}
-	return ovfFilePath, nil
+	return filepath.Join(basePath, ovfFileName), nil
 }
 
-var parseOvf = func(ovfLocation string) (string, error) {
-	ovf, err := open(ovfLocation)
-	if err != nil {
-		return "", fmt.Errorf("Failed to open the ovf file: %v", err)
+// OvaDownloadRetries is the number of times an ova download is retried after
+// a 500/503 response or an interrupted transfer.
+var OvaDownloadRetries = OVA_DOWNLOAD_RETRIES
+
+// ovaDownloadBackoff is the delay before the first retry of an ova download,
+// doubled on every following retry.
+var ovaDownloadBackoff = OVA_DOWNLOAD_BACKOFF
+
+// reportProgress: sends the bytes downloaded so far on progress without
+// blocking the download on a slow reader
+func reportProgress(progress chan<- int64, n int64) {
+	if progress == nil {
+		return
+	}
+	select {
+	case progress <- n:
+	default:
 	}
+}
 
-	ovfContent, err := readAll(ovf)
-	if err != nil {
-		return "", fmt.Errorf("Failed to open the ovf file: %v", err)
+// errOvaRedirects is returned by the client of ovaClient after
+// OVA_MAX_REDIRECTS redirects
+var errOvaRedirects = fmt.Errorf("stopped after %d redirects", OVA_MAX_REDIRECTS)
+
+// ovaClient: returns the client downloading an ova. It follows up to
+// OVA_MAX_REDIRECTS redirects and only sends the credentials to the host of
+// the ova url.
+func ovaClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= OVA_MAX_REDIRECTS {
+				return errOvaRedirects
+			}
+			if req.URL.Host != via[0].URL.Host {
+				req.Header.Del("Authorization")
+			}
+			return nil
+		},
 	}
-	return string(ovfContent), nil
 }
 
-// findComputeResource takes a data center and finds a compute resource on which the name
-// property matches the one passed in. Assumes that the dc has the hostfolder property populated.
-var findComputeResource = func(vm *VM, dc *mo.Datacenter, name string) (*mo.ComputeResource, error) {
-	mor, err := findMob(vm, dc.HostFolder, name)
+// ovaDownload is the state of an ova download, resumed across requests
+type ovaDownload struct {
+	// ctx aborts the requests and the waits between them
+	ctx    context.Context
+	f      *os.File
+	client *http.Client
+	// url is the ova url without the credentials, safe to log
+	url  string
+	auth *url.Userinfo
+	// resolved is the url the last request was redirected to, if any
+	resolved string
+	written  int64
+	expected int64
+	progress chan<- int64
+}
+
+// newOvaDownload: returns the download of the ova at ovaURL into f. The
+// credentials embedded in ovaURL are used unless auth is set.
+func newOvaDownload(ctx context.Context, f *os.File, ovaURL string, auth *url.Userinfo,
+	progress chan<- int64) (*ovaDownload, error) {
+	u, err := url.Parse(ovaURL)
 	if err != nil {
 		return nil, err
 	}
-	cr := mo.ComputeResource{}
-	err = vm.collector.RetrieveOne(vm.ctx, *mor, []string{"name", "host", "resourcePool", "datastore", "network"}, &cr)
-	if err != nil {
-		return nil, err
+	if auth == nil {
+		auth = u.User
+	}
+	u.User = nil
+	return &ovaDownload{
+		ctx:      ctx,
+		f:        f,
+		client:   ovaClient(),
+		url:      u.String(),
+		auth:     auth,
+		resolved: u.String(),
+		expected: -1,
+		progress: progress,
+	}, nil
+}
+
+// restart: drops what was downloaded so far
+func (d *ovaDownload) restart() error {
+	d.written = 0
+	if err := d.f.Truncate(0); err != nil {
+		return err
 	}
-	return &cr, nil
+	_, err := d.f.Seek(0, io.SeekStart)
+	return err
 }
 
-// findClusterComputeResource takes a data center and finds a compute resource on which the name
-// property matches the one passed in. Assumes that the dc has the hostfolder property populated.
-var findClusterComputeResource = func(vm *VM, dc *mo.Datacenter, name string) (*mo.ClusterComputeResource, error) {
-	mor, err := findMob(vm, dc.HostFolder, name)
+// fetchRange: fetches the ova from the offset already written, updating the
+// expected size. The returned bool reports whether the error is worth
+// retrying.
+func (d *ovaDownload) fetchRange() (bool, error) {
+	req, err := http.NewRequest("GET", d.url, nil)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	cr := mo.ClusterComputeResource{}
-	err = vm.collector.RetrieveOne(vm.ctx, *mor, []string{"name",
-		"configuration", "host", "resourcePool", "datastore",
-		"network"}, &cr)
+	req = req.WithContext(d.ctx)
+	if d.auth != nil {
+		password, _ := d.auth.Password()
+		req.SetBasicAuth(d.auth.Username(), password)
+	}
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+	}
+	resp, err := d.client.Do(req)
 	if err != nil {
-		return nil, err
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == errOvaRedirects {
+			return false, fmt.Errorf("can't download ova file from url: %s %v", d.url, errOvaRedirects)
+		}
+		return true, err
 	}
-	return &cr, nil
-}
-
-// findDatastore finds a datastore in the given dc
-var findDatastore = func(vm *VM, dc *mo.Datacenter, name string) (*mo.Datastore, error) {
-	for _, dsMor := range dc.Datastore {
-		dsMo := mo.Datastore{}
-		ps := []string{"name"}
-		err := vm.collector.RetrieveOne(vm.ctx, dsMor, ps, &dsMo)
-		if err != nil {
+	defer resp.Body.Close()
+	d.resolved = resp.Request.URL.String()
 
-			return nil, NewErrorPropertyRetrieval(dsMor, ps, err)
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		// A redirect to a login page ends up here, not with a 401
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			return false, fmt.Errorf("got an html page instead of the ova from url: %s, "+
+				"the server may need authentication", d.resolved)
 		}
-		if dsMo.Name == name {
-			return &dsMo, nil
+	}
+	switch status := resp.StatusCode; {
+	case status == http.StatusOK:
+		// Either the first request or the server ignored the range
+		if err := d.restart(); err != nil {
+			return false, err
+		}
+		d.expected = resp.ContentLength
+	case status == http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", d.written)) {
+			// The server resumed from elsewhere, start over
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+			return true, fmt.Errorf("unexpected content range %q downloading ova from url: %s",
+				contentRange, d.resolved)
+		}
+		// The total size, if known, tells a partial range from the whole ova
+		total, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+		if err == nil {
+			d.expected = total
+		} else if resp.ContentLength >= 0 {
+			d.expected = d.written + resp.ContentLength
 		}
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return false, NewErrorDownloadUnauthorized(d.resolved, status)
+	case status >= 300 && status < 400:
+		// The client follows redirects, these have no location to go to
+		return false, fmt.Errorf("can't follow redirect downloading ova from url: %s status: %d location: %q",
+			d.resolved, status, resp.Header.Get("Location"))
+	case status == http.StatusInternalServerError || status == http.StatusServiceUnavailable:
+		return true, fmt.Errorf("can't download ova file from url: %s status: %d", d.resolved, status)
+	default:
+		return false, fmt.Errorf("can't download ova file from url: %s status: %d", d.resolved, status)
 	}
-	return nil, NewErrorObjectNotFound(errors.New("datastore not found"), name)
-}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := d.f.Write(buf[:n]); err != nil {
+				return false, err
+			}
+			d.written += int64(n)
+			reportProgress(d.progress, d.written)
+		}
+		if rerr == io.EOF {
+			if d.expected >= 0 && d.written < d.expected {
+				// A partial range, resume after it
+				return true, fmt.Errorf("ova download from url: %s stopped at %d of %d bytes",
+					d.resolved, d.written, d.expected)
+			}
+			return false, nil
+		}
+		if rerr != nil {
+			return true, rerr
+		}
+	}
+}
+
+// ovaRetryDelay: returns the delay before retrying an ova download after the
+// attempt, ovaDownloadBackoff doubled on every attempt up to
+// OVA_DOWNLOAD_MAX_BACKOFF
+func ovaRetryDelay(attempt int) time.Duration {
+	delay := ovaDownloadBackoff
+	for i := 0; i < attempt && delay < OVA_DOWNLOAD_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > OVA_DOWNLOAD_MAX_BACKOFF {
+		delay = OVA_DOWNLOAD_MAX_BACKOFF
+	}
+	return delay
+}
+
+// fetchOva: downloads the ova at ovaURL into a temporary file, resuming
+// interrupted transfers with range requests, and returns the downloaded file
+// and the url it was downloaded from after redirects, without the
+// credentials. The file is kept apart from the extraction directory, so that
+// no entry of the ova overwrites it, and removed if the download fails. The
+// download is abandoned once ctx is done.
+func fetchOva(ctx context.Context, ovaURL string, auth *url.Userinfo, progress chan<- int64) (*os.File, string, error) {
+	f, err := ioutil.TempFile("", "download-ova")
+	if err != nil {
+		return nil, "", err
+	}
+	fail := func(err error) (*os.File, string, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	d, err := newOvaDownload(ctx, f, ovaURL, auth, progress)
+	if err != nil {
+		return fail(err)
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := d.fetchRange()
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= OvaDownloadRetries {
+			return fail(err)
+		}
+		if err = sleepContext(ctx, ovaRetryDelay(attempt)); err != nil {
+			return fail(err)
+		}
+	}
+	if d.expected >= 0 && d.written != d.expected {
+		return fail(fmt.Errorf("ova download from url: %s is truncated, "+
+			"got %d of %d bytes", d.resolved, d.written, d.expected))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return f, d.resolved, nil
+}
+
+// Downloads the ova file from the 'url' (can be local path/remote http server) to 'basePath' directory
+// and returns the path to extracted ovf file. Remote downloads send 'auth', if not nil, or the
+// credentials in the url as HTTP Basic auth. The bytes downloaded from a remote server are reported
+// on 'progress' if it isn't nil. The ova manifest, if any, is verified when 'verify' is set.
+// The url a remote ova was downloaded from after redirects is returned as well. A remote
+// download is abandoned once 'ctx' is done.
+var downloadOva = func(ctx context.Context, basePath, ovaURL string, auth *url.Userinfo,
+	progress chan<- int64, verify bool) (string, string, error) {
+	var ovaReader io.Reader
+	var resolved string
+	// if url is a remote url
+	if strings.HasPrefix(ovaURL, "http://") || strings.HasPrefix(ovaURL, "https://") {
+		f, fetched, err := fetchOva(ctx, ovaURL, auth, progress)
+		if err != nil {
+			return "", "", err
+		}
+		resolved = fetched
+		ovaReader = f
+		defer func() {
+			f.Close()
+			// The extracted files are all that's needed
+			os.Remove(f.Name())
+		}()
+	} else {
+		resp, err := os.Open(ovaURL)
+		if err != nil {
+			return "", "", err
+		}
+		ovaReader = resp
+		defer resp.Close()
+	}
+	ovfFilePath, err := extractOva(basePath, ovaReader, verify)
+	if err != nil {
+		return "", "", err
+	}
+	return ovfFilePath, resolved, nil
+}
+
+// DownloadOva downloads the ova file from url, a local path or an http(s) url,
+// extracts it into basePath and returns the path to the ovf file. Remote
+// downloads report the bytes downloaded so far on progress, if not nil, and
+// resume after interruptions. Credentials embedded in the url are sent as HTTP
+// Basic auth, a refused download fails with ErrorDownloadUnauthorized. The
+// extracted files are verified against the ova manifest, if any.
+func DownloadOva(basePath, url string, progress chan<- int64) (string, error) {
+	ovfFilePath, _, err := downloadOva(context.Background(), basePath, url, nil, progress, true)
+	return ovfFilePath, err
+}
+
+var parseOvf = func(ovfLocation string) (string, error) {
+	ovf, err := open(ovfLocation)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open the ovf file: %v", err)
+	}
+
+	ovfContent, err := readAll(ovf)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open the ovf file: %v", err)
+	}
+	return string(ovfContent), nil
+}
+
+// findComputeResource takes a data center and finds a compute resource on which the name
+// property matches the one passed in. Assumes that the dc has the hostfolder property populated.
+var findComputeResource = func(vm *VM, dc *mo.Datacenter, name string) (*mo.ComputeResource, error) {
+	mor, err := findMob(vm, dc.HostFolder, name)
+	if err != nil {
+		return nil, err
+	}
+	cr := mo.ComputeResource{}
+	err = vm.collector.RetrieveOne(vm.ctx, *mor, []string{"name", "host", "resourcePool", "datastore", "network"}, &cr)
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// findClusterComputeResource takes a data center and finds a compute resource on which the name
+// property matches the one passed in. Assumes that the dc has the hostfolder property populated.
+var findClusterComputeResource = func(vm *VM, dc *mo.Datacenter, name string) (*mo.ClusterComputeResource, error) {
+	mor, err := findMob(vm, dc.HostFolder, name)
+	if err != nil {
+		return nil, err
+	}
+	cr := mo.ClusterComputeResource{}
+	err = vm.collector.RetrieveOne(vm.ctx, *mor, []string{"name",
+		"configuration", "host", "resourcePool", "datastore",
+		"network"}, &cr)
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// findDatastore finds a datastore in the given dc
+var findDatastore = func(vm *VM, dc *mo.Datacenter, name string) (*mo.Datastore, error) {
+	for _, dsMor := range dc.Datastore {
+		dsMo := mo.Datastore{}
+		ps := []string{"name"}
+		err := vm.collector.RetrieveOne(vm.ctx, dsMor, ps, &dsMo)
+		if err != nil {
+
+			return nil, NewErrorPropertyRetrieval(dsMor, ps, err)
+		}
+		if dsMo.Name == name {
+			return &dsMo, nil
+		}
+	}
+	return nil, NewErrorObjectNotFound(errors.New("datastore not found"), name)
+}
 
 // findHostSystem finds a host system within a slice of mors to hostsystems
 var findHostSystem = func(vm *VM, hsMors []types.ManagedObjectReference, name string) (*mo.HostSystem, error) {
@@ -328,10 +1157,15 @@ var findHostSystem = func(vm *VM, hsMors []types.ManagedObjectReference, name st
 
 var findMob func(*VM, types.ManagedObjectReference, string) (*types.ManagedObjectReference, error)
 
+// createNetworkMapping: returns the mappings of the networks, in the same
+// order, and a map of the network names to mors. A network qualified with a
+// Folder or DVSwitch is mapped to the port group of that name in the folder or
+// on the switch, otherwise to the last network of that name.
 var createNetworkMapping = func(vm *VM, networks []Network,
 	networkMors []types.ManagedObjectReference) ([]types.OvfNetworkMapping,
 	map[string]types.ManagedObjectReference, error) {
 	nwMap := map[string]types.ManagedObjectReference{}
+	byName := map[string][]types.ManagedObjectReference{}
 	// Create a map between network name and mor for lookup
 	for _, network := range networkMors {
 		name, err := getNetworkName(vm, network)
@@ -342,171 +1176,744 @@ var createNetworkMapping = func(vm *VM, networks []Network,
 			return nil, nil, fmt.Errorf("Network name empty for: %s", network.Value)
 		}
 		nwMap[name] = network
+		byName[name] = append(byName[name], network)
 	}
 
 	var mappings []types.OvfNetworkMapping
 	for _, mapping := range networks {
 		nwName := mapping.Name
+		if mapping.Teaming != nil {
+			mor, err := teamingPortGroup(vm, mapping, networkMors)
+			if err != nil {
+				return nil, nwMap, err
+			}
+			mappings = append(mappings, types.OvfNetworkMapping{Name: nwName, Network: mor})
+			continue
+		}
 		mor, ok := nwMap[nwName]
 		if !ok {
 			return nil, nwMap, NewErrorObjectNotFound(errors.New("Could not find the network mapping"), nwName)
 		}
+		if mapping.Folder != "" || mapping.DVSwitch != "" {
+			var found []types.ManagedObjectReference
+			for _, candidate := range byName[nwName] {
+				ok, err := networkQualifies(vm, candidate, mapping)
+				if err != nil {
+					return nil, nwMap, err
+				}
+				if ok {
+					found = append(found, candidate)
+				}
+			}
+			switch len(found) {
+			case 0:
+				return nil, nwMap, NewErrorObjectNotFound(fmt.Errorf(
+					"Could not find the network mapping in folder '%s' "+
+						"on switch '%s'", mapping.Folder, mapping.DVSwitch),
+					nwName)
+			case 1:
+				mor = found[0]
+			default:
+				return nil, nwMap, fmt.Errorf("network %s is ambiguous in "+
+					"folder '%s' on switch '%s'", nwName, mapping.Folder,
+					mapping.DVSwitch)
+			}
+		}
 		mappings = append(mappings, types.OvfNetworkMapping{Name: nwName, Network: mor})
 	}
 	return mappings, nwMap, nil
 }
 
-var resetUnitNumbers = func(spec *types.OvfCreateImportSpecResult) {
-	s := &spec.ImportSpec.(*types.VirtualMachineImportSpec).ConfigSpec
-	for _, d := range s.DeviceChange {
-		n := d.GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().UnitNumber
-		if n != nil && *n == 0 {
-			*n = -1
+// networkQualifies: returns true if the network is in the folder and on the
+// distributed switch nw is qualified with, if any
+var networkQualifies = func(vm *VM, network types.ManagedObjectReference,
+	nw Network) (bool, error) {
+	var parent, dvs *types.ManagedObjectReference
+	switch network.Type {
+	case "Network":
+		dst := mo.Network{}
+		ps := []string{"parent"}
+		if err := vm.collector.RetrieveOne(vm.ctx, network, ps, &dst); err != nil {
+			return false, NewErrorPropertyRetrieval(network, ps, err)
+		}
+		parent = dst.Parent
+	case "DistributedVirtualPortgroup":
+		dst := mo.DistributedVirtualPortgroup{}
+		ps := []string{"parent", "config.distributedVirtualSwitch"}
+		if err := vm.collector.RetrieveOne(vm.ctx, network, ps, &dst); err != nil {
+			return false, NewErrorPropertyRetrieval(network, ps, err)
+		}
+		parent = dst.Parent
+		dvs = dst.Config.DistributedVirtualSwitch
+	default:
+		return false, nil
+	}
+	if nw.Folder != "" {
+		if parent == nil {
+			return false, nil
+		}
+		folder := mo.Folder{}
+		ps := []string{"name"}
+		if err := vm.collector.RetrieveOne(vm.ctx, *parent, ps, &folder); err != nil {
+			return false, NewErrorPropertyRetrieval(*parent, ps, err)
+		}
+		if folder.Name != nw.Folder {
+			return false, nil
+		}
+	}
+	if nw.DVSwitch != "" {
+		if dvs == nil {
+			return false, nil
+		}
+		sw := mo.DistributedVirtualSwitch{}
+		ps := []string{"name"}
+		if err := vm.collector.RetrieveOne(vm.ctx, *dvs, ps, &sw); err != nil {
+			return false, NewErrorPropertyRetrieval(*dvs, ps, err)
+		}
+		if sw.Name != nw.DVSwitch {
+			return false, nil
 		}
 	}
+	return true, nil
 }
 
-var uploadOvf = func(vm *VM, specResult *types.OvfCreateImportSpecResult, lease Lease) error {
-	// Ask the server to wait on the NFC lease
-	leaseInfo, err := lease.Wait()
+// teamingPortGroup: returns the port group of the network on its distributed
+// switch, creating it with the teaming policy of the network if it doesn't
+// exist. The switch is looked up among the switches of the port groups in
+// networkMors, the networks of the host.
+var teamingPortGroup = func(vm *VM, nw Network,
+	networkMors []types.ManagedObjectReference) (types.ManagedObjectReference,
+	error) {
+	var pgRef types.ManagedObjectReference
+	if nw.DVSwitch == "" {
+		return pgRef, fmt.Errorf("network %s needs a DVSwitch for the "+
+			"teaming policy", nw.Name)
+	}
+	dvsMo, err := findHostDVSwitch(vm, networkMors, nw.DVSwitch)
 	if err != nil {
-		return fmt.Errorf("error waiting on the nfc lease: %v", err)
+		return pgRef, err
 	}
-
-	//FIXME (Preet): Hard coded to just upload the first device.
-	url := leaseInfo.DeviceUrl[0].Url
-	if strings.Contains(url, "*") {
-		url = strings.Replace(url, "*", vm.Host, 1)
+	var uplinks []string
+	if dvsMo.Config != nil {
+		policy := dvsMo.Config.GetDVSConfigInfo().UplinkPortPolicy
+		if names, ok := policy.(*types.DVSNameArrayUplinkPortPolicy); ok {
+			uplinks = names.UplinkPortName
+		}
 	}
-
-	path := specResult.FileItem[0].Path
-	if !filepath.IsAbs(path) {
-		// If the path is not abs, convert it into an ABS path relative to the OVF file
-		dir := filepath.Dir(vm.OvfPath)
-		path = filepath.Join(dir, path)
+	if err = validateTeaming(nw.Teaming, uplinks); err != nil {
+		return pgRef, fmt.Errorf("invalid teaming policy for network %s on "+
+			"switch %s: %v", nw.Name, nw.DVSwitch, err)
 	}
-	file, err := open(path)
+
+	ref, err := findTeamingPortGroup(vm, dvsMo.Reference(), nw)
 	if err != nil {
-		return err
+		return pgRef, err
 	}
-	info, _ := file.Stat()
-	totalBytes := info.Size()
-	reader := NewProgressReader(file, totalBytes, lease)
-	reader.StartProgress()
-	err = createRequest(reader, "POST", vm.Insecure, totalBytes, url, "application/x-vnd.vmware-streamVmdk")
-	if err != nil {
-		return err
+	if ref != nil {
+		return *ref, nil
 	}
-	reader.Wait()
-	return nil
-}
-
-var clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
-	return c.Do(r)
-}
-
-var createRequest = func(r io.Reader, method string, insecure bool, length int64, url string, contentType string) error {
-	request, _ := http.NewRequest(method, url, r)
-	request.Header.Add("Connection", "Keep-Alive")
-	request.Header.Add("Content-Type", contentType)
-	request.Header.Add("Content-Length", fmt.Sprintf("%d", length))
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	dvsObj := object.NewDistributedVirtualSwitch(vm.client.Client, dvsMo.Reference())
+	task, err := dvsObj.AddPortgroup(vm.ctx,
+		[]types.DVPortgroupConfigSpec{teamingPortGroupSpec(nw)})
+	if err != nil {
+		return pgRef, fmt.Errorf("error creating an add port group task: %v", err)
 	}
-	client := &http.Client{
-		Transport: tr,
+	tInfo, taskErr := task.WaitForResult(vm.ctx, nil)
+	if taskErr == nil && tInfo.Error != nil {
+		taskErr = errors.New(tInfo.Error.LocalizedMessage)
 	}
-	resp, err := clientDo(client, request)
+	// The port group may have been created concurrently, in which case the
+	// task fails but the port group is there
+	ref, err = findTeamingPortGroup(vm, dvsMo.Reference(), nw)
 	if err != nil {
-		return err
+		return pgRef, err
 	}
-	if resp.StatusCode != http.StatusCreated {
-		return NewErrorBadResponse(resp)
+	if ref == nil {
+		if taskErr != nil {
+			return pgRef, fmt.Errorf("error adding port group %s: %v",
+				nw.Name, taskErr)
+		}
+		return pgRef, NewErrorObjectNotFound(errors.New(
+			"created port group not found"), nw.Name)
 	}
-	return nil
+	return *ref, nil
 }
 
-// findVM finds the vm Managed Object referenced by the name/instanceUuid
-// or returns an error if it is not found.
-var findVM = func(vm *VM, searchFilter VMSearchFilter) (*mo.VirtualMachine,
-	error) {
-	var (
-		moVM *mo.VirtualMachine
-		dc   *mo.Datacenter
-		err  error
-	)
-
-	if searchFilter.InstanceUuid != "" {
-		moVM, err = searchVmByUuid(vm, searchFilter)
-	} else {
-		dc, err = GetDatacenter(vm)
-		if err != nil {
-			return nil, err
+// findHostDVSwitch: returns the distributed switch of that name among the
+// switches of the port groups in networkMors
+func findHostDVSwitch(vm *VM, networkMors []types.ManagedObjectReference,
+	name string) (*mo.DistributedVirtualSwitch, error) {
+	var pgRefs []types.ManagedObjectReference
+	for _, ref := range networkMors {
+		if ref.Type == "DistributedVirtualPortgroup" {
+			pgRefs = append(pgRefs, ref)
 		}
-		moVM, err = searchTree(vm, &dc.VmFolder, searchFilter.Name)
 	}
+	var pgMos []mo.DistributedVirtualPortgroup
+	err := retrieveChildren(vm, pgRefs,
+		[]string{"config.distributedVirtualSwitch"}, &pgMos)
 	if err != nil {
-		return moVM, err
+		return nil, err
 	}
-	// Having a question pending during operations usually cause errors forcing
-	// manual resolution. Anytime we look up a VM try first to resolve any
-	// questions that we know how to answer.
-	return moVM, vm.answerQuestion(moVM)
+	seen := map[types.ManagedObjectReference]bool{}
+	for _, pgMo := range pgMos {
+		dvsRef := pgMo.Config.DistributedVirtualSwitch
+		if dvsRef == nil || seen[*dvsRef] {
+			continue
+		}
+		seen[*dvsRef] = true
+		dvsMo := mo.DistributedVirtualSwitch{}
+		ps := []string{"name", "config"}
+		if err = vm.collector.RetrieveOne(vm.ctx, *dvsRef, ps, &dvsMo); err != nil {
+			return nil, NewErrorPropertyRetrieval(*dvsRef, ps, err)
+		}
+		if dvsMo.Name == name {
+			return &dvsMo, nil
+		}
+	}
+	return nil, NewErrorObjectNotFound(errors.New(
+		"distributed switch not found on the host"), name)
 }
 
-// addCustomField: adds custom field for given field name
-func addCustomField(vm *VM, fieldName string, moType string) (int32, error) {
-	fieldsManager, err := object.GetCustomFieldsManager(vm.client.Client)
+// findTeamingPortGroup: returns the port group of the network on the switch,
+// nil if there is none. Returns an error if the port group has another teaming
+// policy.
+func findTeamingPortGroup(vm *VM, dvsRef types.ManagedObjectReference,
+	nw Network) (*types.ManagedObjectReference, error) {
+	dvsMo := mo.DistributedVirtualSwitch{}
+	ps := []string{"portgroup"}
+	if err := vm.collector.RetrieveOne(vm.ctx, dvsRef, ps, &dvsMo); err != nil {
+		return nil, NewErrorPropertyRetrieval(dvsRef, ps, err)
+	}
+	var pgMos []mo.DistributedVirtualPortgroup
+	err := retrieveChildren(vm, dvsMo.Portgroup, []string{"name", "config"}, &pgMos)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-
-	key, err := fieldsManager.FindKey(vm.ctx, fieldName)
-	if err != nil {
-		if err == object.ErrKeyNameNotFound {
-			field, err := fieldsManager.Add(vm.ctx, fieldName, moType,
-				nil, nil)
-			if err != nil {
-				return -1, err
-			}
-			key = field.Key
-		} else {
-			return -1, err
+	for _, pgMo := range pgMos {
+		if pgMo.Name != nw.Name {
+			continue
 		}
+		if !teamingMatches(pgMo.Config.DefaultPortConfig, nw.Teaming) {
+			return nil, fmt.Errorf("port group %s exists on switch %s with "+
+				"another teaming policy", nw.Name, nw.DVSwitch)
+		}
+		ref := pgMo.Reference()
+		return &ref, nil
 	}
-
-	return key, nil
+	return nil, nil
 }
 
-// setCustomField: sets custom field and value for given vm/template
-func setCustomField(vm *VM, vmMo *mo.VirtualMachine, fieldName string,
-	moType string, fieldValue string) error {
-	fieldsManager, err := object.GetCustomFieldsManager(vm.client.Client)
-	if err != nil {
-		return err
+// validateTeaming: returns an error if the policy is unknown or the uplinks
+// aren't uplinks of the switch
+func validateTeaming(teaming *Teaming, uplinks []string) error {
+	switch teaming.Policy {
+	case "loadbalance_srcid", "loadbalance_ip", "loadbalance_srcmac",
+		"loadbalance_loadbased", "failover_explicit":
+	default:
+		return fmt.Errorf("unsupported policy %q", teaming.Policy)
 	}
-
-	key, err := addCustomField(vm, fieldName, moType)
-	if err != nil {
-		return err
+	if len(teaming.ActiveUplinks) == 0 {
+		return errors.New("at least one active uplink is needed")
 	}
-
-	err = fieldsManager.Set(vm.ctx, vmMo.Reference(), key, fieldValue)
-	if err != nil {
-		return err
+	available := map[string]bool{}
+	for _, uplink := range uplinks {
+		available[uplink] = true
+	}
+	used := map[string]bool{}
+	for _, uplink := range append(append([]string{}, teaming.ActiveUplinks...),
+		teaming.StandbyUplinks...) {
+		if !available[uplink] {
+			return fmt.Errorf("the switch has no uplink %s", uplink)
+		}
+		if used[uplink] {
+			return fmt.Errorf("uplink %s is listed twice", uplink)
+		}
+		used[uplink] = true
 	}
-
 	return nil
 }
 
-// splitPathToList: splits path containing special character including delimiter
-// for slash "/" (\/) and return slice of strings containing folder/vm names
-// for eg:  "vms\/test\/rec/rec\/1/rhel\/template\/vm"	: [vms/test/rec rec/1 rhel/template/vm]
-// Directory structure: vm/test/rec -> rec/1 -> rhel/template/vm
-func splitPathToList(path string) []string {
-	pathList := make([]string, 0)
-
-	// split at escaped '/'
+// teamingPortGroupSpec: returns the spec of the ephemeral port group of the
+// network with its teaming policy
+func teamingPortGroupSpec(nw Network) types.DVPortgroupConfigSpec {
+	teaming := nw.Teaming
+	policy := &types.VmwareUplinkPortTeamingPolicy{
+		Policy: &types.StringPolicy{Value: teaming.Policy},
+		UplinkPortOrder: &types.VMwareUplinkPortOrderPolicy{
+			ActiveUplinkPort:  teaming.ActiveUplinks,
+			StandbyUplinkPort: teaming.StandbyUplinks,
+		},
+	}
+	if teaming.NotifySwitches != nil {
+		policy.NotifySwitches = &types.BoolPolicy{Value: teaming.NotifySwitches}
+	}
+	// A rolling order doesn't fail back to the active uplinks
+	if teaming.Failback != nil {
+		rollingOrder := !*teaming.Failback
+		policy.RollingOrder = &types.BoolPolicy{Value: &rollingOrder}
+	}
+	return types.DVPortgroupConfigSpec{
+		Name: nw.Name,
+		Type: string(types.DistributedVirtualPortgroupPortgroupTypeEphemeral),
+		DefaultPortConfig: &types.VMwareDVSPortSetting{
+			UplinkTeamingPolicy: policy,
+		},
+	}
+}
+
+// teamingMatches: returns true if the port setting has the teaming policy.
+// NotifySwitches and Failback are only compared when set.
+func teamingMatches(setting types.BaseDVPortSetting, teaming *Teaming) bool {
+	vmwareSetting, ok := setting.(*types.VMwareDVSPortSetting)
+	if !ok || vmwareSetting.UplinkTeamingPolicy == nil {
+		return false
+	}
+	policy := vmwareSetting.UplinkTeamingPolicy
+	if policy.Policy == nil || policy.Policy.Value != teaming.Policy ||
+		policy.UplinkPortOrder == nil {
+		return false
+	}
+	if !equalStrings(policy.UplinkPortOrder.ActiveUplinkPort, teaming.ActiveUplinks) ||
+		!equalStrings(policy.UplinkPortOrder.StandbyUplinkPort, teaming.StandbyUplinks) {
+		return false
+	}
+	if teaming.NotifySwitches != nil && (policy.NotifySwitches == nil ||
+		policy.NotifySwitches.Value == nil ||
+		*policy.NotifySwitches.Value != *teaming.NotifySwitches) {
+		return false
+	}
+	if teaming.Failback != nil && (policy.RollingOrder == nil ||
+		policy.RollingOrder.Value == nil ||
+		*policy.RollingOrder.Value == *teaming.Failback) {
+		return false
+	}
+	return true
+}
+
+// equalStrings: returns true if the slices have the same strings in the same
+// order, nil and empty being equal
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var resetUnitNumbers = func(spec *types.OvfCreateImportSpecResult) {
+	s := &spec.ImportSpec.(*types.VirtualMachineImportSpec).ConfigSpec
+	for _, d := range s.DeviceChange {
+		n := d.GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().UnitNumber
+		if n != nil && *n == 0 {
+			*n = -1
+		}
+	}
+}
+
+// uploadOvf: uploads the disk of the ovf to the nfc lease. If the lease or
+// the upload fails, the lease is aborted so that vSphere releases it and
+// removes the partially imported VM. The final state of the lease is recorded
+// on the vm, see VM.LeaseState.
+var uploadOvf = func(vm *VM, specResult *types.OvfCreateImportSpecResult, lease Lease) (err error) {
+	setLeaseState(vm, LeaseStateNone)
+	defer func() {
+		if err == nil {
+			setLeaseState(vm, LeaseStateCompleted)
+			return
+		}
+		if abortErr := lease.Abort(err); abortErr != nil {
+			setLeaseState(vm, LeaseStateAbortFailed)
+			err = fmt.Errorf("%v (failed to abort the nfc lease: %v)", err, abortErr)
+			return
+		}
+		setLeaseState(vm, LeaseStateAborted)
+	}()
+	// Ask the server to wait on the NFC lease
+	leaseInfo, err := lease.Wait()
+	if err != nil {
+		return fmt.Errorf("error waiting on the nfc lease: %v", err)
+	}
+
+	// Open all the files first, so the lease progress covers their total size
+	var (
+		uploads    []ovfFileUpload
+		totalBytes int64
+	)
+	defer func() {
+		for _, u := range uploads {
+			u.file.Close()
+		}
+	}()
+	for _, item := range specResult.FileItem {
+		deviceURL := findDeviceURL(leaseInfo.DeviceUrl, item.DeviceId)
+		if deviceURL == nil {
+			return fmt.Errorf("no nfc lease url for the ovf file %s", item.Path)
+		}
+		url, err := substituteHost(deviceURL.Url, vm.Host)
+		if err != nil {
+			return err
+		}
+		if err = validateLeaseURL(url); err != nil {
+			return err
+		}
+
+		path := item.Path
+		if !filepath.IsAbs(path) {
+			// If the path is not abs, convert it into an ABS path relative to the OVF file
+			dir := filepath.Dir(vm.OvfPath)
+			path = filepath.Join(dir, path)
+		}
+		file, err := open(path)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		uploads = append(uploads, ovfFileUpload{item: item, url: url,
+			file: file, size: info.Size()})
+		totalBytes += info.Size()
+	}
+
+	parent := vm.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	// Cancelled on the first failed upload to stop the ones in flight
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	defer closeUploadTransport(vm)
+
+	// The files are read through the readers returned by Track
+	reader := NewProgressReader(nil, totalBytes, lease)
+	reader.StartProgress()
+	workers := vm.MaxConcurrentUploads
+	if workers <= 0 {
+		workers = 1
+	}
+	var (
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		uploadErr error
+	)
+	jobs := make(chan ovfFileUpload)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				method := "POST"
+				if u.item.Create {
+					method = "PUT"
+				}
+				err := createRequest(ctx, vm, reader.Track(u.file), method, u.size, u.url,
+					"application/x-vnd.vmware-streamVmdk")
+				if err != nil {
+					errOnce.Do(func() {
+						uploadErr = fmt.Errorf("error uploading the ovf file %s: %v",
+							u.item.Path, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for _, u := range uploads {
+		jobs <- u
+	}
+	close(jobs)
+	wg.Wait()
+	if uploadErr != nil {
+		reader.Stop()
+		return uploadErr
+	}
+	reader.Wait()
+	if err = lease.Complete(); err != nil {
+		return fmt.Errorf("error completing the nfc lease: %v", err)
+	}
+	return nil
+}
+
+// ovfFileUpload is a file of an ovf and the nfc lease url to upload it to
+type ovfFileUpload struct {
+	item types.OvfFileItem
+	url  string
+	file *os.File
+	size int64
+}
+
+// findDeviceURL: returns the nfc lease url of the device with the import key
+func findDeviceURL(deviceURLs []types.HttpNfcLeaseDeviceUrl, importKey string) *types.HttpNfcLeaseDeviceUrl {
+	for i := range deviceURLs {
+		if deviceURLs[i].ImportKey == importKey {
+			return &deviceURLs[i]
+		}
+	}
+	return nil
+}
+
+// substituteHost: replaces the `*` placeholder in the host component of an
+// nfc lease or guest file transfer url with the given host, preserving the
+// scheme, port and path. Urls that already contain a resolvable host are
+// returned unchanged.
+func substituteHost(rawURL string, host string) (string, error) {
+	if !strings.Contains(rawURL, "*") {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %v", rawURL, err)
+	}
+	if u.Hostname() != "*" {
+		return rawURL, nil
+	}
+	// vm.Host may carry the vCenter port, which doesn't apply to the nfc
+	// endpoint
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	return u.String(), nil
+}
+
+// validateLeaseURL: returns an error if the lease device url can't be used
+// for uploading
+func validateLeaseURL(leaseURL string) error {
+	u, err := url.Parse(leaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid lease url %q: %v", leaseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid lease url %q: unsupported scheme %q",
+			leaseURL, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid lease url %q: host is empty", leaseURL)
+	}
+	return nil
+}
+
+var clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
+	return c.Do(r)
+}
+
+// idleTimeoutConn pushes the deadline of the connection forward on every read
+// and write, so a connection on which no data moves for the timeout fails
+// instead of hanging forever.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// uploadContext: returns the context for an upload which is cancelled with
+// the vm context or after vm.UploadTimeout
+func uploadContext(ctx context.Context, vm *VM) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if vm.UploadTimeout > 0 {
+		return context.WithTimeout(ctx, vm.UploadTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+var createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
+	ctx, cancel := uploadContext(ctx, vm)
+	defer cancel()
+
+	request, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return fmt.Errorf("error creating %s request for %s: %v",
+			method, url, err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Add("Connection", "Keep-Alive")
+	request.Header.Add("Content-Type", contentType)
+	request.Header.Add("Content-Length", fmt.Sprintf("%d", length))
+
+	client := &http.Client{
+		Transport: uploadTransport(vm),
+	}
+	resp, err := clientDo(client, request)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("upload to %s timed out after %v: %v",
+				url, vm.UploadTimeout, err)
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("upload to %s stalled: %v", url, err)
+		}
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return NewErrorBadResponse(resp)
+	}
+	// The connection is only reused once the body is read and closed
+	if resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// uploadTransport: returns the transport of the uploads of the vm, created on
+// the first upload, so that the files of an ovf reuse the connections to the
+// host. A connection on which no data moves for vm.UploadIdleTimeout fails,
+// as does a host not answering within vm.UploadResponseTimeout once a file
+// is sent.
+func uploadTransport(vm *VM) *http.Transport {
+	vm.uploadTransportMutex.Lock()
+	defer vm.uploadTransportMutex.Unlock()
+	if vm.uploadTransport != nil {
+		return vm.uploadTransport
+	}
+	idleTimeout := vm.UploadIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = UPLOAD_IDLE_TIMEOUT
+	}
+	responseTimeout := vm.UploadResponseTimeout
+	if responseTimeout <= 0 {
+		responseTimeout = UPLOAD_RESPONSE_TIMEOUT
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	vm.uploadTransport = &http.Transport{
+		TLSClientConfig: tlsConfig(vm),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+		},
+		MaxIdleConnsPerHost:   vm.MaxConcurrentUploads,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: responseTimeout,
+	}
+	return vm.uploadTransport
+}
+
+// closeUploadTransport: closes the idle connections of the uploads of the vm
+// and drops the transport, the next upload creates a new one
+func closeUploadTransport(vm *VM) {
+	vm.uploadTransportMutex.Lock()
+	defer vm.uploadTransportMutex.Unlock()
+	if vm.uploadTransport != nil {
+		vm.uploadTransport.CloseIdleConnections()
+		vm.uploadTransport = nil
+	}
+}
+
+// findVM finds the vm Managed Object referenced by the name/instanceUuid
+// or returns an error if it is not found.
+var findVM = func(vm *VM, searchFilter VMSearchFilter) (*mo.VirtualMachine,
+	error) {
+	var (
+		moVM *mo.VirtualMachine
+		dc   *mo.Datacenter
+		err  error
+	)
+
+	if searchFilter.InstanceUuid != "" {
+		moVM, err = searchVmByUuid(vm, searchFilter)
+	} else {
+		dc, err = GetDatacenter(vm)
+		if err != nil {
+			return nil, err
+		}
+		moVM, err = searchTree(vm, &dc.VmFolder, searchFilter.Name)
+	}
+	if err != nil {
+		return moVM, err
+	}
+	// Having a question pending during operations usually cause errors forcing
+	// manual resolution. Anytime we look up a VM try first to resolve any
+	// questions that we know how to answer.
+	return moVM, vm.answerQuestion(moVM)
+}
+
+// addCustomField: adds custom field for given field name
+func addCustomField(vm *VM, fieldName string, moType string) (int32, error) {
+	fieldsManager, err := object.GetCustomFieldsManager(vm.client.Client)
+	if err != nil {
+		return -1, err
+	}
+
+	key, err := fieldsManager.FindKey(vm.ctx, fieldName)
+	if err != nil {
+		if err == object.ErrKeyNameNotFound {
+			field, err := fieldsManager.Add(vm.ctx, fieldName, moType,
+				nil, nil)
+			if err != nil {
+				return -1, err
+			}
+			key = field.Key
+		} else {
+			return -1, err
+		}
+	}
+
+	return key, nil
+}
+
+// setCustomField: sets custom field and value for given vm/template
+func setCustomField(vm *VM, vmMo *mo.VirtualMachine, fieldName string,
+	moType string, fieldValue string) error {
+	fieldsManager, err := object.GetCustomFieldsManager(vm.client.Client)
+	if err != nil {
+		return err
+	}
+
+	key, err := addCustomField(vm, fieldName, moType)
+	if err != nil {
+		return err
+	}
+
+	err = fieldsManager.Set(vm.ctx, vmMo.Reference(), key, fieldValue)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// splitPathToList: splits path containing special character including delimiter
+// for slash "/" (\/) and return slice of strings containing folder/vm names
+// for eg:  "vms\/test\/rec/rec\/1/rhel\/template\/vm"	: [vms/test/rec rec/1 rhel/template/vm]
+// Directory structure: vm/test/rec -> rec/1 -> rhel/template/vm
+func splitPathToList(path string) []string {
+	pathList := make([]string, 0)
+
+	// split at escaped '/'
 	// if no escaped '/' are present length of returned slice will be 1
 	slashInName := strings.SplitN(path, "\\/", 2)
 
@@ -690,18 +2097,59 @@ func getEthernetBacking(vm *VM, nwMor types.ManagedObjectReference,
 	return backing, nil
 }
 
+// createEthernetCard: creates an ethernet card of the adapter type, vmxnet3 by
+// default
+func createEthernetCard(adapterType string,
+	backing types.BaseVirtualDeviceBackingInfo) (types.BaseVirtualDevice, error) {
+	switch adapterType {
+	case "":
+		adapterType = "vmxnet3"
+	case "sriov":
+		// The vendored govmomi doesn't list sriov in EthernetCardTypes
+		card := &types.VirtualSriovEthernetCard{}
+		card.Key = -1
+		card.Backing = backing
+		return card, nil
+	}
+	return object.EthernetCardTypes().CreateEthernetCard(adapterType, backing)
+}
+
+// Range of the device keys of NICs
+const (
+	minNicDeviceKey = 4000
+	maxNicDeviceKey = 4999
+)
+
+// validateNicDeviceKey: returns an error if key isn't a NIC device key or is
+// one of the used keys
+func validateNicDeviceKey(key int32, used map[int32]bool) error {
+	if key < minNicDeviceKey || key > maxNicDeviceKey {
+		return fmt.Errorf("device key %d is out of the range %d-%d",
+			key, minNicDeviceKey, maxNicDeviceKey)
+	}
+	if used[key] {
+		return fmt.Errorf("device key %d is already in use", key)
+	}
+	return nil
+}
+
 // createNetworkDeviceSpec : createNetworkDeviceSpec creates the device spec for the network nwMor
-func addNetworkDeviceSpec(vm *VM, nwMor types.ManagedObjectReference, name string) (*types.VirtualDeviceConfigSpec, error) {
+// with the device key, if not nil
+func addNetworkDeviceSpec(vm *VM, nwMor types.ManagedObjectReference, name string,
+	adapterType string, key *int32) (*types.VirtualDeviceConfigSpec, error) {
 	// create backing object
 	backing, err := getEthernetBacking(vm, nwMor, name)
 	if err != nil {
 		return nil, err
 	}
 	// create ethernet card with the backing info
-	device, err := object.EthernetCardTypes().CreateEthernetCard("vmxnet3", backing)
+	device, err := createEthernetCard(adapterType, backing)
 	if err != nil {
 		return nil, err
 	}
+	if key != nil {
+		device.GetVirtualDevice().Key = *key
+	}
 	// connect to the network when the nic is connected to vm
 	device.GetVirtualDevice().Connectable = &types.VirtualDeviceConnectInfo{
 		StartConnected:    true,
@@ -716,12 +2164,49 @@ func addNetworkDeviceSpec(vm *VM, nwMor types.ManagedObjectReference, name strin
 	return spec, nil
 }
 
+// byUnitNumber sorts devices by unit number, falling back to the device key.
+type byUnitNumber []types.BaseVirtualDevice
+
+func (d byUnitNumber) Len() int      { return len(d) }
+func (d byUnitNumber) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byUnitNumber) Less(i, j int) bool {
+	a, b := d[i].GetVirtualDevice(), d[j].GetVirtualDevice()
+	var ua, ub int32 = -1, -1
+	if a.UnitNumber != nil {
+		ua = *a.UnitNumber
+	}
+	if b.UnitNumber != nil {
+		ub = *b.UnitNumber
+	}
+	if ua != ub {
+		return ua < ub
+	}
+	return a.Key < b.Key
+}
+
+// sortedEthernetDevices: returns the ethernet cards in devices sorted by unit
+// number and key
+func sortedEthernetDevices(devices object.VirtualDeviceList) []types.BaseVirtualDevice {
+	var nics []types.BaseVirtualDevice
+	for _, device := range devices {
+		switch device.(type) {
+		case *types.VirtualE1000, *types.VirtualE1000e, *types.VirtualVmxnet3,
+			*types.VirtualSriovEthernetCard:
+			nics = append(nics, device)
+		}
+	}
+	sort.Stable(byUnitNumber(nics))
+	return nics
+}
+
 // reconfigureNetworks : reconfigureNetworks configures the vm and attach it to the
-// networks in the vm structure
+// networks in the vm structure. A template NIC whose key differs from the
+// DeviceKey requested for its network is replaced by a NIC with that key.
 func reconfigureNetworks(vm *VM, vmObj *object.VirtualMachine) ([]types.BaseVirtualDeviceConfigSpec, error) {
 	var (
 		deviceSpecs []types.BaseVirtualDeviceConfigSpec
 		nw          Network
+		toAdd       []int
 	)
 	dcMo, err := GetDatacenter(vm)
 	if err != nil {
@@ -743,57 +2228,79 @@ func reconfigureNetworks(vm *VM, vmObj *object.VirtualMachine) ([]types.BaseVirt
 		return nil, err
 	}
 
-	idx := 0
-	// Modify existing networks in template with provided networks list
+	// Keys of the devices kept on the vm
+	used := make(map[int32]bool)
 	for _, device := range devices {
-		switch device.(type) {
-		case *types.VirtualE1000, *types.VirtualE1000e, *types.VirtualVmxnet3:
-			if idx >= len(vm.Networks) {
-				// Remove extra networks
-				spec := &types.VirtualDeviceConfigSpec{
-					Operation: types.VirtualDeviceConfigSpecOperationRemove,
-					Device:    device,
-				}
-				deviceSpecs = append(deviceSpecs, spec)
-				continue
+		used[device.GetVirtualDevice().Key] = true
+	}
+
+	idx := 0
+	// Modify existing networks in template with provided networks list. The
+	// NICs are edited in unit number order so that the same requested network
+	// lands on the same NIC across runs.
+	for _, device := range sortedEthernetDevices(devices) {
+		key := device.GetVirtualDevice().Key
+		if idx >= len(vm.Networks) {
+			// Remove extra networks
+			spec := &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    device,
 			}
+			deviceSpecs = append(deviceSpecs, spec)
+			delete(used, key)
+			continue
+		}
 
-			// Edit device
-			nw = vm.Networks[idx]
-			for _, nwMappingObj := range networkMapping {
-				if nwMappingObj.Name != nw.Name {
-					continue
-				}
-				backing, err := getEthernetBacking(vm,
-					nwMappingObj.Network, nwMappingObj.Name)
-				if err != nil {
-					return nil, err
-				}
-				device.GetVirtualDevice().Backing = backing
-				spec := &types.VirtualDeviceConfigSpec{
-					Operation: types.VirtualDeviceConfigSpecOperationEdit,
-					Device:    device,
-				}
-				deviceSpecs = append(deviceSpecs, spec)
-				break
+		nw = vm.Networks[idx]
+		if nw.DeviceKey != nil && *nw.DeviceKey != key {
+			// Replace the NIC by one with the requested key
+			spec := &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    device,
 			}
+			deviceSpecs = append(deviceSpecs, spec)
+			delete(used, key)
+			toAdd = append(toAdd, idx)
 			idx++
+			continue
+		}
+
+		// Edit device, the mappings are in the order of the networks
+		mapping := networkMapping[idx]
+		backing, err := getEthernetBacking(vm, mapping.Network, mapping.Name)
+		if err != nil {
+			return nil, err
+		}
+		device.GetVirtualDevice().Backing = backing
+		spec := &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    device,
 		}
+		deviceSpecs = append(deviceSpecs, spec)
+		idx++
 	}
 
 	// Add extra networks if any
-	for _, nw = range vm.Networks[idx:] {
-		for _, mapping := range networkMapping {
-			if mapping.Name == nw.Name {
-				spec, err := addNetworkDeviceSpec(vm, mapping.Network, mapping.Name)
-				if err != nil {
-					return nil, err
-				}
-				// add spec to array of the devices to be added/removed
-				deviceSpecs = append(deviceSpecs, spec)
-				break
+	for ; idx < len(vm.Networks); idx++ {
+		toAdd = append(toAdd, idx)
+	}
+	for _, i := range toAdd {
+		nw = vm.Networks[i]
+		if nw.DeviceKey != nil {
+			if err := validateNicDeviceKey(*nw.DeviceKey, used); err != nil {
+				return nil, fmt.Errorf("invalid device key for network %s: %v",
+					nw.Name, err)
 			}
+			used[*nw.DeviceKey] = true
 		}
+		mapping := networkMapping[i]
+		spec, err := addNetworkDeviceSpec(vm, mapping.Network,
+			mapping.Name, nw.AdapterType, nw.DeviceKey)
+		if err != nil {
+			return nil, err
+		}
+		// add spec to array of the devices to be added/removed
+		deviceSpecs = append(deviceSpecs, spec)
 	}
 	return deviceSpecs, nil
 }
@@ -808,9 +2315,14 @@ func findByVirtualDeviceFileName(disks []Disk, name string) *Disk {
 	return nil
 }
 
-// Function which will resize or delete the existing volume in vmware template
-func resizeAndDeleteVols(vmMo mo.VirtualMachine, disks []Disk) ([]types.BaseVirtualDeviceConfigSpec, error) {
+// Function which will resize or delete the existing volume in vmware template.
+// Shrinking a disk fails, with ErrorDiskShrinkNotSupported if shrinkRequested
+// is set and ErrorDiskShrinkNotAllowed otherwise.
+func resizeAndDeleteVols(vmMo mo.VirtualMachine, disks []Disk, shrinkRequested bool) ([]types.BaseVirtualDeviceConfigSpec, error) {
 	var deviceSpecs []types.BaseVirtualDeviceConfigSpec
+	if vmMo.Config == nil {
+		return nil, NewErrorConfigNotAvailable(vmMo.Name)
+	}
 	devices := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
 	for _, device := range devices {
 		if editdisk, ok := device.(*types.VirtualDisk); ok {
@@ -829,7 +2341,11 @@ func resizeAndDeleteVols(vmMo mo.VirtualMachine, disks []Disk) ([]types.BaseVirt
 				capacityInKB := int64(disk.Size * 1024 * 1024)
 				if editdisk.CapacityInKB > capacityInKB {
 					// If user wants to shrink the disk capacity
-					return nil, fmt.Errorf("error : Shrinking Virtual Disks is not supported")
+					if !shrinkRequested {
+						return nil, NewErrorDiskShrinkNotAllowed(fileBackingInfo.FileName,
+							editdisk.CapacityInKB, capacityInKB)
+					}
+					return nil, NewErrorDiskShrinkNotSupported(fileBackingInfo.FileName)
 				} else if editdisk.CapacityInKB < capacityInKB {
 					// If user wants to expand the virtual disk capacity
 					editdisk.CapacityInKB = capacityInKB
@@ -846,56 +2362,311 @@ func resizeAndDeleteVols(vmMo mo.VirtualMachine, disks []Disk) ([]types.BaseVirt
 	return deviceSpecs, nil
 }
 
-func findResourcePoolListAtPath(vm *VM, path string, properties []string) ([]mo.ResourcePool, error) {
-	var (
-		rpMor   []types.ManagedObjectReference
-		allRpMo []mo.ResourcePool
-	)
-	// get resource pool list in the vcenter server
-	allRps, err := vm.finder.ResourcePoolList(vm.ctx, path)
+// findAllResourcePools: returns the resource pools under the root resource
+// pools of the clusters and hosts of the datacenter set on the finder, at any
+// depth, with the properties. The pools are walked level by level from the
+// root pools.
+func findAllResourcePools(vm *VM, properties []string) ([]mo.ResourcePool, error) {
+	roots, err := vm.finder.ResourcePoolList(vm.ctx, "*/Resources")
 	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, nil
+		}
 		return nil, err
 	}
-
-	for _, rp := range allRps {
-		rpMor = append(rpMor, rp.Reference())
-	}
-
-	if len(rpMor) == 0 {
-		return allRpMo, nil
+	var refs []types.ManagedObjectReference
+	for _, rp := range roots {
+		refs = append(refs, rp.Reference())
 	}
-	err = vm.collector.Retrieve(vm.ctx, rpMor, properties, &allRpMo)
+	var rootMos []mo.ResourcePool
+	err = retrieveChildren(vm, refs, []string{"resourcePool"}, &rootMos)
 	if err != nil {
 		return nil, err
 	}
 
+	props := append([]string{"resourcePool"}, properties...)
+	var allRpMo []mo.ResourcePool
+	for refs = childResourcePools(rootMos); len(refs) > 0; {
+		var level []mo.ResourcePool
+		if err = retrieveChildren(vm, refs, props, &level); err != nil {
+			return nil, err
+		}
+		allRpMo = append(allRpMo, level...)
+		refs = childResourcePools(level)
+	}
 	return allRpMo, nil
 }
 
+// childResourcePools: returns the child resource pools of the pools
+func childResourcePools(rps []mo.ResourcePool) []types.ManagedObjectReference {
+	var refs []types.ManagedObjectReference
+	for _, rp := range rps {
+		refs = append(refs, rp.ResourcePool...)
+	}
+	return refs
+}
+
 func findResourcePoolByMOID(vm *VM, moid string) (*mo.ResourcePool, error) {
 	// get resource pool list in the vcenter server
-	rpListPath := "*/Resources"
-	for n := 0; n < RESOURCE_POOL_DEPTH; n++ {
-		rpListPath = rpListPath + "/*"
-		prop := []string{"name", "owner"}
-		rpList, _ := findResourcePoolListAtPath(vm, rpListPath, prop)
-		for _, rp := range rpList {
-			if moid == rp.Self.Value {
-				return &rp, nil
-			}
+	rpList, err := findAllResourcePools(vm, []string{"name", "owner"})
+	if err != nil {
+		return nil, err
+	}
+	for _, rp := range rpList {
+		if moid == rp.Self.Value {
+			return &rp, nil
 		}
 	}
 	return nil, NewErrorObjectNotFound(errors.New("could not find the resourcepool with moref id"),
 		moid)
 }
 
+// findParentResourcePool: returns the resource pool at the path. A path to a
+// cluster or host resolves to its root resource pool.
+func findParentResourcePool(vm *VM, path string) (types.ManagedObjectReference, error) {
+	for _, p := range []string{path, path + "/Resources"} {
+		rps, err := vm.finder.ResourcePoolList(vm.ctx, p)
+		if err != nil {
+			if _, ok := err.(*find.NotFoundError); ok {
+				continue
+			}
+			return types.ManagedObjectReference{}, err
+		}
+		if len(rps) > 1 {
+			return types.ManagedObjectReference{}, fmt.Errorf("path %s matches %d resource pools", p, len(rps))
+		}
+		if len(rps) == 1 {
+			return rps[0].Reference(), nil
+		}
+	}
+	return types.ManagedObjectReference{}, NewErrorObjectNotFound(errors.New("could not find the resource pool"), path)
+}
+
+// findChildResourcePool: returns the child resource pool with the name, nil if
+// the parent has no such child
+func findChildResourcePool(vm *VM, parent types.ManagedObjectReference, name string) (*types.ManagedObjectReference, error) {
+	parentMo := mo.ResourcePool{}
+	err := vm.collector.RetrieveOne(vm.ctx, parent, []string{"resourcePool"}, &parentMo)
+	if err != nil {
+		return nil, err
+	}
+	if len(parentMo.ResourcePool) == 0 {
+		return nil, nil
+	}
+	var children []mo.ResourcePool
+	err = vm.collector.Retrieve(vm.ctx, parentMo.ResourcePool, []string{"name"}, &children)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.Name == name {
+			ref := child.Reference()
+			return &ref, nil
+		}
+	}
+	return nil, nil
+}
+
+// resourceAllocation: returns the allocation info for a reservation and limit.
+// A zero limit means unlimited.
+func resourceAllocation(reservation, limit int64, expandable bool) *types.ResourceAllocationInfo {
+	if limit == 0 {
+		limit = -1
+	}
+	return &types.ResourceAllocationInfo{
+		Reservation:           reservation,
+		ExpandableReservation: &expandable,
+		Limit:                 limit,
+		Shares: &types.SharesInfo{
+			Level: types.SharesLevelNormal,
+		},
+	}
+}
+
+// flavorAllocation: returns the allocation info of a vm for a reservation,
+// limit and shares, nil if none is set
+func flavorAllocation(reservation, limit int64, shares Shares) (
+	*types.ResourceAllocationInfo, error) {
+	if reservation < 0 || limit < 0 {
+		return nil, fmt.Errorf("negative reservation %d or limit %d",
+			reservation, limit)
+	}
+	if limit != 0 && reservation > limit {
+		return nil, fmt.Errorf("reservation %d is above the limit %d",
+			reservation, limit)
+	}
+	info := &types.ResourceAllocationInfo{
+		Reservation: reservation,
+		Limit:       limit,
+	}
+	switch types.SharesLevel(shares.Level) {
+	case "":
+	case types.SharesLevelLow, types.SharesLevelNormal, types.SharesLevelHigh:
+		if shares.Count != 0 {
+			return nil, fmt.Errorf("shares count %d needs the custom "+
+				"level, got %s", shares.Count, shares.Level)
+		}
+		info.Shares = &types.SharesInfo{Level: types.SharesLevel(shares.Level)}
+	case types.SharesLevelCustom:
+		if shares.Count <= 0 {
+			return nil, errors.New("custom shares need a positive count")
+		}
+		info.Shares = &types.SharesInfo{
+			Level:  types.SharesLevelCustom,
+			Shares: shares.Count,
+		}
+	default:
+		return nil, fmt.Errorf("invalid shares level: %s", shares.Level)
+	}
+	if reservation == 0 && limit == 0 && info.Shares == nil {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// setFlavorAllocation: sets the CPU and memory allocations of the flavor in
+// the config spec
+func setFlavorAllocation(config *types.VirtualMachineConfigSpec,
+	flavor Flavor) error {
+	cpu, err := flavorAllocation(flavor.CPUReservationMHz,
+		flavor.CPULimitMHz, flavor.CPUShares)
+	if err != nil {
+		return fmt.Errorf("invalid CPU allocation: %v", err)
+	}
+	memory, err := flavorAllocation(flavor.MemoryReservationMB,
+		flavor.MemoryLimitMB, flavor.MemoryShares)
+	if err != nil {
+		return fmt.Errorf("invalid memory allocation: %v", err)
+	}
+	if cpu != nil {
+		config.CpuAllocation = cpu
+	}
+	if memory != nil {
+		config.MemoryAllocation = memory
+	}
+	return nil
+}
+
+// resourceUsage: combines the allocation and the runtime usage of a resource
+// pool. The runtime usage is divided by unit to match the allocation, as
+// memory usage is reported in bytes while the allocation is in MB.
+func resourceUsage(allocation types.BaseResourceAllocationInfo,
+	usage types.ResourcePoolResourceUsage, unit int64) ResourceUsage {
+	u := ResourceUsage{
+		ReservationUsed:      usage.ReservationUsed / unit,
+		ReservationUsedForVm: usage.ReservationUsedForVm / unit,
+		UnreservedForPool:    usage.UnreservedForPool / unit,
+		UnreservedForVm:      usage.UnreservedForVm / unit,
+		OverallUsage:         usage.OverallUsage / unit,
+		MaxUsage:             usage.MaxUsage / unit,
+	}
+	if allocation == nil {
+		return u
+	}
+	info := allocation.GetResourceAllocationInfo()
+	u.Reservation = info.Reservation
+	u.Limit = info.Limit
+	if info.ExpandableReservation != nil {
+		u.ExpandableReservation = *info.ExpandableReservation
+	}
+	return u
+}
+
+// findResourcePoolParent: returns the resource pool with the moref id, or the
+// root resource pool of the cluster or host with the moref id
+func findResourcePoolParent(vm *VM, moid string) (types.ManagedObjectReference, error) {
+	ref := types.ManagedObjectReference{Type: "ResourcePool", Value: moid}
+	rpMo := mo.ResourcePool{}
+	err := vm.collector.RetrieveOne(vm.ctx, ref, []string{"name"}, &rpMo)
+	if err == nil {
+		return ref, nil
+	}
+	if !soap.IsSoapFault(err) || !isObjectDeleted(err) {
+		return ref, err
+	}
+
+	// Standalone hosts are ComputeResources, clustered hosts are found
+	// through their cluster
+	computeRef := types.ManagedObjectReference{Value: moid}
+	hsMo := mo.HostSystem{}
+	ref = types.ManagedObjectReference{Type: "HostSystem", Value: moid}
+	err = vm.collector.RetrieveOne(vm.ctx, ref, []string{"parent"}, &hsMo)
+	switch {
+	case err == nil && hsMo.Parent != nil:
+		computeRef = *hsMo.Parent
+	case err == nil || soap.IsSoapFault(err) && isObjectDeleted(err):
+	default:
+		return ref, err
+	}
+	for _, t := range []string{"ClusterComputeResource", "ComputeResource"} {
+		if computeRef.Type != "" && computeRef.Type != t {
+			continue
+		}
+		ref = types.ManagedObjectReference{Type: t, Value: computeRef.Value}
+		crMo := mo.ComputeResource{}
+		err = vm.collector.RetrieveOne(vm.ctx, ref, []string{"resourcePool"}, &crMo)
+		if err == nil && crMo.ResourcePool != nil {
+			return *crMo.ResourcePool, nil
+		}
+		if err != nil && (!soap.IsSoapFault(err) || !isObjectDeleted(err)) {
+			return ref, err
+		}
+	}
+	return ref, NewErrorObjectNotFound(errors.New(
+		"could not find the cluster, host or resource pool with moref id"),
+		moid)
+}
+
+// createResourcePool: creates a child resource pool under the parent
+var createResourcePool = func(vm *VM, parent types.ManagedObjectReference, name string, spec ResourcePoolSpec) (*types.ManagedObjectReference, error) {
+	configSpec := types.ResourceConfigSpec{
+		CpuAllocation: resourceAllocation(spec.CPUReservationMHz,
+			spec.CPULimitMHz, spec.ExpandableReservation),
+		MemoryAllocation: resourceAllocation(spec.MemoryReservationMB,
+			spec.MemoryLimitMB, spec.ExpandableReservation),
+	}
+	rpo := object.NewResourcePool(vm.client.Client, parent)
+	rp, err := rpo.Create(vm.ctx, name, configSpec)
+	if err != nil {
+		return nil, err
+	}
+	ref := rp.Reference()
+	return &ref, nil
+}
+
+// chooseDatastore: picks the datastore of the vm at random out of datastores
+// and reports it to OnDatastoreSelected, whose error is returned
+func chooseDatastore(vm *VM, datastores []string) error {
+	vm.datastore = util.ChooseRandomString(datastores)
+	if vm.datastore == "" || vm.OnDatastoreSelected == nil {
+		return nil
+	}
+	if err := vm.OnDatastoreSelected(vm.datastore); err != nil {
+		return fmt.Errorf("datastore %s was rejected: %v", vm.datastore, err)
+	}
+	return nil
+}
+
 var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []string) error {
 	var (
 		err   error
 		dsMo  *mo.Datastore
 		dsMor types.ManagedObjectReference
 	)
-	vm.datastore = util.ChooseRandomString(usableDatastores)
+	if vm.PostCloneScript != nil {
+		if vm.SkipPowerOn {
+			return errors.New("a post clone script can't be run when the power on is skipped")
+		}
+		if vm.PostCloneScript.Credentials.Username == "" {
+			return errors.New("a post clone script needs the credentials of a guest user")
+		}
+	}
+	if vm.SkipPowerOn && vm.VerifyGuestDisks {
+		return errors.New("the guest disks can't be verified when the power on is skipped")
+	}
+	if err = chooseDatastore(vm, usableDatastores); err != nil {
+		return err
+	}
 	if vm.datastore != "" {
 		dsMo, err = findDatastore(vm, dcMo, vm.datastore)
 		if err != nil {
@@ -906,16 +2677,32 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 	if vm.UseLocalTemplates {
 		vm.Template.Name = createTemplateName(vm.Template.Name, vm.datastore)
 	}
+	setProvisioningState(vm, ProvisioningStateLocatingTemplate)
 	vmMo, err := findVM(vm, getTempSearchFilter(vm.Template))
 	if err != nil {
 		return fmt.Errorf("error retrieving template: %v", err)
 	}
+	if vmMo.Config == nil {
+		return NewErrorConfigNotAvailable(vm.Template.Name)
+	}
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 
 	l, err := getVMLocation(vm, dcMo)
 	if err != nil {
 		return err
 	}
+	if vm.NameTemplate != "" {
+		reuse, err := renderVMName(vm, l.Host)
+		if err != nil {
+			return err
+		}
+		if reuse {
+			return nil
+		}
+		if err = guardProvisionName(vm); err != nil {
+			return err
+		}
+	}
 
 	// TODO: If the network needs to be reconfigured as well then this needs
 	// to delete all the network cards and create VirtualDevice specs.
@@ -932,10 +2719,25 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 		if vm.Destination.HostSystem != "" || !isDrsEnabled {
 			relocateSpec.Host = &l.Host
 		}
+	} else if vm.Destination.HostSystem != "" &&
+		(vm.Destination.DestinationType == DestinationTypeResourcePool ||
+			vm.Destination.DestinationType == DestinationTypeDatastoreCluster) {
+		relocateSpec.Host = &l.Host
 	}
 	if dsMo != nil {
 		relocateSpec.Datastore = &dsMor
 	}
+	if vm.CloneDiskProvisioning != "" && !vm.UseLinkedClones {
+		err = setCloneDiskProvisioning(vm, vmMo, &relocateSpec)
+		if err != nil {
+			return err
+		}
+	}
+	if !vm.UseLinkedClones {
+		if err = setFixedDiskDatastores(vm, dcMo, vmMo, &relocateSpec); err != nil {
+			return err
+		}
+	}
 
 	deviceChangeSpec, err := reconfigureNetworks(vm, vmObj)
 	if err != nil {
@@ -959,36 +2761,104 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 		CpuHotAddEnabled:    &hotAddCpu,
 		NestedHVEnabled:     &vm.NestedHV,
 	}
+	if err = setFlavorAllocation(&config, vm.Flavor); err != nil {
+		return err
+	}
 	config.DeviceChange = deviceChangeSpec
 
 	if len(vm.FixedDisks) != 0 {
 		// Resize (increase)/delete existing volumes in VM template
-		conf, err := resizeAndDeleteVols(*vmMo, vm.FixedDisks)
+		conf, err := resizeAndDeleteVols(*vmMo, vm.FixedDisks, vm.DiskShrinkRequested)
 		if err != nil {
 			return err
 		}
 		config.DeviceChange = append(config.DeviceChange, conf...)
 	}
 
-	checkCustomSpecMutex.Lock()
-	// Critical section - Only one thread should create custom spec
-	// if not present
-	err = checkAndCreateCustomSpec(vm)
-	if err != nil {
-		checkCustomSpecMutex.Unlock()
-		return fmt.Errorf("Error creating custom spec: %v", err)
+	if vm.AddVTPM {
+		if err = validateVTPMPrerequisites(vm, vmMo); err != nil {
+			return err
+		}
+		config.DeviceChange = append(config.DeviceChange, vtpmDeviceSpec())
 	}
 
-	customizationSpecManager := object.NewCustomizationSpecManager(
-		vm.client.Client)
-	customSpecItem, err := customizationSpecManager.GetCustomizationSpec(
-		vm.ctx, STATICIP_CUSTOM_SPEC_NAME)
+	if vm.VideoCard != nil {
+		videoSpec, err := videoCardDeviceSpec(vmMo, vm.VideoCard)
+		if err != nil {
+			return err
+		}
+		config.DeviceChange = append(config.DeviceChange, videoSpec)
+	}
+
+	// The clone keeps the hardware version of the template, so the clone is
+	// upgraded before it's powered on.
+	minVersion, err := minHardwareVersion(vm, l)
 	if err != nil {
-		checkCustomSpecMutex.Unlock()
-		return fmt.Errorf("Error retrieving custom spec: %v", err)
+		return err
+	}
+	upgradeHardware := minVersion > 0 &&
+		hardwareVersionBelow(vmMo.Config.Version, minVersion)
+
+	var customSpec *types.CustomizationSpec
+	if !vm.SkipCustomization {
+		if err = validateSysprep(vm.Sysprep); err != nil {
+			return err
+		}
+		for _, setting := range append([]lvm.NetworkSetting{vm.NetworkSetting},
+			vm.NetworkSettings...) {
+			if err = validateNetworkSetting(setting); err != nil {
+				return err
+			}
+		}
+		if err = validateDefaultGateway(vm.NetworkSettings); err != nil {
+			return err
+		}
+		switch {
+		case vm.InMemoryCustomization && vm.CustomizationSpecName != "":
+			return errors.New("a named customization spec can't be " +
+				"used with an in memory customization")
+		case vm.CustomizationSpecName != "":
+			customSpec, err = namedCustomSpec(vm, vmMo)
+			if err != nil {
+				return err
+			}
+		case vm.InMemoryCustomization:
+			customSpec, err = staticIPCustomSpec()
+			if err != nil {
+				return err
+			}
+			customSpec = updateCustomSpec(vm, vmMo, customSpec)
+		default:
+			checkCustomSpecMutex.Lock()
+			// Critical section - Only one thread should create custom
+			// spec if not present
+			err = checkAndCreateCustomSpec(vm)
+			if err != nil {
+				checkCustomSpecMutex.Unlock()
+				return fmt.Errorf("Error creating custom spec: %v", err)
+			}
+
+			customizationSpecManager := object.NewCustomizationSpecManager(
+				vm.client.Client)
+			customSpecItem, err := customizationSpecManager.GetCustomizationSpec(
+				vm.ctx, STATICIP_CUSTOM_SPEC_NAME)
+			if err != nil {
+				checkCustomSpecMutex.Unlock()
+				return fmt.Errorf("Error retrieving custom spec: %v", err)
+			}
+			customSpec = updateCustomSpec(vm, vmMo, &customSpecItem.Spec)
+			checkCustomSpecMutex.Unlock()
+		}
+		if vm.Sysprep != nil {
+			customSpec = sysprepCustomSpec(vm.Sysprep, customSpec)
+		}
+		if customSpec != nil {
+			err = validateCustomizationOS(customSpec, vmMo.Config.GuestId)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	customSpec := updateCustomSpec(vm, vmMo, &customSpecItem.Spec)
-	checkCustomSpecMutex.Unlock()
 
 	cisp := types.VirtualMachineCloneSpec{
 		Location:      relocateSpec,
@@ -1020,8 +2890,14 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 		}
 	}
 
-	folderObj := object.NewFolder(vm.client.Client, dcMo.VmFolder)
-	t, err := vmObj.Clone(vm.ctx, folderObj, vm.Name, cisp)
+	setProvisioningState(vm, ProvisioningStateCloning)
+	var t *object.Task
+	if vm.Destination.DestinationType == DestinationTypeDatastoreCluster {
+		t, err = cloneWithStorageDrs(vm, dcMo, vmMo, cisp)
+	} else {
+		folderObj := object.NewFolder(vm.client.Client, dcMo.VmFolder)
+		t, err = vmObj.Clone(vm.ctx, folderObj, vm.Name, cisp)
+	}
 	if err != nil {
 		return fmt.Errorf("error cloning vm from template: %v", err)
 	}
@@ -1036,53 +2912,209 @@ var cloneFromTemplate = func(vm *VM, dcMo *mo.Datacenter, usableDatastores []str
 	if err != nil {
 		return fmt.Errorf("failed to retrieve cloned VM: %v", err)
 	}
+	setProvisioningState(vm, ProvisioningStateReconfiguring)
+	if upgradeHardware {
+		if err = upgradeHardwareVersion(vm, vmMo.Reference(), minVersion); err != nil {
+			return err
+		}
+	}
+	if len(vm.Controllers) > 0 {
+		if err = addControllers(vm, vmMo); err != nil {
+			return err
+		}
+	}
 	if len(vm.Disks) > 0 {
 		if err = reconfigureVM(vm, vmMo); err != nil {
 			return err
 		}
 	}
+	if len(vm.Controllers) > 0 || len(vm.Disks) > 0 {
+		vmMo, err = findVM(vm, getVMSearchFilter(vm.Name))
+		if err != nil {
+			return fmt.Errorf("failed to retrieve reconfigured VM: %v", err)
+		}
+	}
+	vm.diskDatastores = make(map[string]string)
+	for _, disk := range getDisksInfo(*vmMo) {
+		vm.diskDatastores[disk.DiskFile] = disk.Datastore
+	}
+	// The caller powers on the VM later
+	if vm.SkipPowerOn {
+		return nil
+	}
 	// power on
+	setProvisioningState(vm, ProvisioningStatePoweringOn)
+	var warning error
 	if err = start(vm); err != nil {
-		return err
+		if _, ok := err.(ErrorIPWaitSkipped); !ok {
+			return err
+		}
+		warning = err
 	}
-	if !vm.SkipIPWait {
-		if err = waitForIP(vm, vmMo); err != nil {
+	if !vm.SkipIPWait && warning == nil {
+		if warning, err = waitForIPOrSkip(vm, vmMo); err != nil {
 			return err
 		}
 	}
-	return nil
+	verifyDisks := vm.VerifyGuestDisks && len(vm.Disks) > 0
+	if (vm.PostCloneScript != nil || verifyDisks) && vm.SkipIPWait {
+		// The guest commands need VMware Tools to be running in the guest
+		err = waitForGuestStatus(vm, vmMo, GREEN_HEART_BEAT,
+			GREEN_STATUS_CHECK_TIMEOUT)
+		if err != nil {
+			return err
+		}
+	}
+	if verifyDisks {
+		if err = verifyGuestDisks(vm, vmMo); err != nil {
+			return err
+		}
+	}
+	if vm.PostCloneScript != nil {
+		if err = runPostCloneScript(vm, vmMo); err != nil {
+			return err
+		}
+	}
+	return warning
 }
 
-// diffDisks : diffDisks takes the devicelists as parameter and returns the
-// file backing info of the disks (devList2 - devList1)
-func diffDisks(devList2, devList1 object.VirtualDeviceList) []string {
-	m := map[int32]int{}
-	disks := make([]string, 0)
-	for _, v := range devList1 {
-		m[v.GetVirtualDevice().Key] = 0
+// findDatastoreCluster: finds the datastore cluster named by the destination
+func findDatastoreCluster(vm *VM, dcMo *mo.Datacenter) (*object.StoragePod, error) {
+	dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
+	vm.finder.SetDatacenter(dc)
+	pods, err := vm.finder.DatastoreClusterList(vm.ctx, vm.Destination.DestinationName)
+	if err != nil {
+		return nil, NewErrorObjectNotFound(err, vm.Destination.DestinationName)
 	}
+	if len(pods) != 1 {
+		return nil, NewErrorObjectNotFound(fmt.Errorf(
+			"found %d datastore clusters", len(pods)), vm.Destination.DestinationName)
+	}
+	return pods[0], nil
+}
 
-	for _, v := range devList2 {
-		if _, ok := m[v.GetVirtualDevice().Key]; !ok {
-			vmdkFile := v.GetVirtualDevice().Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName
-			disks = append(disks, vmdkFile)
-		}
+// recommendDatastores: returns the top Storage DRS recommendation for the
+// placement spec
+var recommendDatastores = func(vm *VM, spec types.StoragePlacementSpec) (*types.ClusterRecommendation, error) {
+	srm := object.NewStorageResourceManager(vm.client.Client)
+	result, err := srm.RecommendDatastores(vm.ctx, spec)
+	if err != nil {
+		return nil, fmt.Errorf("error getting storage drs recommendations: %v", err)
 	}
-	return disks
+	if len(result.Recommendations) == 0 {
+		return nil, fmt.Errorf("no storage drs recommendations for the datastore cluster %s: %v",
+			vm.Destination.DestinationName, result.DrsFault)
+	}
+	return &result.Recommendations[0], nil
 }
 
-// CreateDisk creates a new VirtualDisk device which can be added to a VM.
-func CreateDisk(l object.VirtualDeviceList, c types.BaseVirtualController, ds types.ManagedObjectReference, name string, thinProvisioned bool) *types.VirtualDisk {
-	// If name is not specified, one will be chosen for you.
-	// But if when given, make sure it ends in .vmdk, otherwise it will be treated as a directory.
-	if len(name) > 0 && filepath.Ext(name) != ".vmdk" {
-		name += ".vmdk"
+// cloneWithStorageDrs: clones the template on the datastore recommended by
+// Storage DRS and returns the clone task
+func cloneWithStorageDrs(vm *VM, dcMo *mo.Datacenter, tempMo *mo.VirtualMachine,
+	cisp types.VirtualMachineCloneSpec) (*object.Task, error) {
+	pod, err := findDatastoreCluster(vm, dcMo)
+	if err != nil {
+		return nil, err
+	}
+	podMor := pod.Reference()
+	tempMor := tempMo.Reference()
+	spec := types.StoragePlacementSpec{
+		Type:         string(types.StoragePlacementSpecPlacementTypeClone),
+		Vm:           &tempMor,
+		CloneName:    vm.Name,
+		CloneSpec:    &cisp,
+		Folder:       &dcMo.VmFolder,
+		ResourcePool: cisp.Location.Pool,
+		PodSelectionSpec: types.StorageDrsPodSelectionSpec{
+			StoragePod: &podMor,
+		},
 	}
+	rec, err := recommendDatastores(vm, spec)
+	if err != nil {
+		return nil, err
+	}
+	srm := object.NewStorageResourceManager(vm.client.Client)
+	return srm.ApplyStorageDrsRecommendation(vm.ctx, []string{rec.Key})
+}
 
+// recommendImportDatastore: returns the name of the datastore recommended by
+// Storage DRS for importing the template
+func recommendImportDatastore(vm *VM, dcMo *mo.Datacenter, l location,
+	template string) (string, error) {
+	pod, err := findDatastoreCluster(vm, dcMo)
+	if err != nil {
+		return "", err
+	}
+	podMor := pod.Reference()
+	spec := types.StoragePlacementSpec{
+		Type: string(types.StoragePlacementSpecPlacementTypeCreate),
+		ConfigSpec: &types.VirtualMachineConfigSpec{
+			Name:  template,
+			Files: &types.VirtualMachineFileInfo{},
+		},
+		Folder:       &dcMo.VmFolder,
+		ResourcePool: &l.ResourcePool,
+		PodSelectionSpec: types.StorageDrsPodSelectionSpec{
+			StoragePod: &podMor,
+		},
+	}
+	rec, err := recommendDatastores(vm, spec)
+	if err != nil {
+		return "", err
+	}
+	// The import isn't done through the recommendation, so it's only used to
+	// pick the datastore and then dropped
+	srm := object.NewStorageResourceManager(vm.client.Client)
+	defer srm.CancelStorageDrsRecommendation(vm.ctx, []string{rec.Key})
+	for _, action := range rec.Action {
+		placement, ok := action.(*types.StoragePlacementAction)
+		if !ok {
+			continue
+		}
+		dsMo := mo.Datastore{}
+		err = vm.collector.RetrieveOne(vm.ctx, placement.Destination, []string{"name"}, &dsMo)
+		if err != nil {
+			return "", NewErrorPropertyRetrieval(placement.Destination, []string{"name"}, err)
+		}
+		return dsMo.Name, nil
+	}
+	return "", fmt.Errorf("no datastore in the storage drs recommendation %s", rec.Key)
+}
+
+// diffDisks : diffDisks takes the devicelists as parameter and returns the
+// file backing info of the disks (devList2 - devList1)
+func diffDisks(devList2, devList1 object.VirtualDeviceList) []string {
+	m := map[int32]int{}
+	disks := make([]string, 0)
+	for _, v := range devList1 {
+		m[v.GetVirtualDevice().Key] = 0
+	}
+
+	for _, v := range devList2 {
+		if _, ok := m[v.GetVirtualDevice().Key]; !ok {
+			vmdkFile := v.GetVirtualDevice().Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName
+			disks = append(disks, vmdkFile)
+		}
+	}
+	return disks
+}
+
+// CreateDisk creates a new VirtualDisk device which can be added to a VM.
+// The disk mode defaults to persistent when empty.
+func CreateDisk(l object.VirtualDeviceList, c types.BaseVirtualController, ds types.ManagedObjectReference, name string, thinProvisioned bool, mode string) *types.VirtualDisk {
+	// If name is not specified, one will be chosen for you.
+	// But if when given, make sure it ends in .vmdk, otherwise it will be treated as a directory.
+	if len(name) > 0 && filepath.Ext(name) != ".vmdk" {
+		name += ".vmdk"
+	}
+
+	if mode == "" {
+		mode = string(types.VirtualDiskModePersistent)
+	}
 	device := &types.VirtualDisk{
 		VirtualDevice: types.VirtualDevice{
 			Backing: &types.VirtualDiskFlatVer2BackingInfo{
-				DiskMode:        string(types.VirtualDiskModePersistent),
+				DiskMode:        mode,
 				ThinProvisioned: types.NewBool(thinProvisioned),
 				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
 					FileName:  name,
@@ -1124,9 +3156,8 @@ var getDatastoreForVm = func(vm *VM, vmMo *mo.VirtualMachine) ([]string,
 // root disk datastore is used by default
 var reconfigureVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	var (
-		vDisk           *types.VirtualDisk
-		thinProvisioned bool
-		datastore       string
+		vDisk     *types.VirtualDisk
+		datastore string
 	)
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 
@@ -1140,7 +3171,9 @@ var reconfigureVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
 		if err != nil {
 			return err
 		}
-		vm.datastore = util.ChooseRandomString(datastores)
+		if err = chooseDatastore(vm, datastores); err != nil {
+			return err
+		}
 	}
 
 	for index, disk := range vm.Disks {
@@ -1155,28 +3188,41 @@ var reconfigureVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
 			return fmt.Errorf("Failed to get devices while creating "+
 				"Disks[%d] {%v} : %v", index, disk, err)
 		}
-		controller, err := devices.FindDiskController(disk.Controller)
+		controller, err := devices.FindDiskController(
+			controllerDeviceName(vm, disk.Controller))
 		if err != nil {
 			return fmt.Errorf("Failed to get controller while creating "+
 				"Disks[%d] {%v} : %v", index, disk, err)
 		}
+		if err = validateDiskSharing(disk, controller); err != nil {
+			return fmt.Errorf("Invalid controller for Disks[%d] {%v} : %v",
+				index, disk, err)
+		}
+		if err = validateDiskMode(disk.Mode); err != nil {
+			return fmt.Errorf("Invalid mode for Disks[%d] {%v} : %v",
+				index, disk, err)
+		}
+		thinProvisioned, eagerlyScrub, err := diskProvisioning(disk.Provisioning)
+		if err != nil {
+			return fmt.Errorf("Invalid provisioning for Disks[%d] {%v} : %v",
+				index, disk, err)
+		}
 		dsMo, err := findDatastore(vm, dcMo, datastore)
 		if err != nil {
 			return fmt.Errorf("Failed to get datastore while creating "+
 				"Disks[%d] {%v} : %v", index, disk, err)
 		}
-		if strings.ToLower(disk.Provisioning) == "thick" {
-			thinProvisioned = false
-		} else {
-			thinProvisioned = true
-		}
-
 		// getting device list before adding this disk
 		devListBefore := devices
 
 		vDisk = CreateDisk(devices, controller, dsMo.Reference(), "",
-			thinProvisioned)
+			thinProvisioned, disk.Mode)
 		vDisk.CapacityInKB = int64(disk.Size)
+		backing := vDisk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		backing.EagerlyScrub = types.NewBool(eagerlyScrub)
+		if disk.Sharing != "" {
+			backing.Sharing = disk.Sharing
+		}
 		if err := vmObj.AddDevice(vm.ctx, vDisk); err != nil {
 			return fmt.Errorf("Failed to add device while creating "+
 				"Disks[%d] {%v} : %v", index, disk, err)
@@ -1196,9 +3242,382 @@ var reconfigureVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	return nil
 }
 
-var waitForIP = func(vm *VM, vmMo *mo.VirtualMachine) error {
+// diskDeviceChangeSpec: returns the device change spec creating the disks in
+// add and deleting the disks in remove, matched on their vmdk file names. The
+// vmdk files of the removed disks are deleted from the datastore.
+func diskDeviceChangeSpec(vm *VM, vmMo *mo.VirtualMachine, add, remove []Disk) (
+	[]types.BaseVirtualDeviceConfigSpec, error) {
+	if vmMo.Config == nil {
+		return nil, NewErrorConfigNotAvailable(vm.Name)
+	}
+	devices := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
+
+	var removed object.VirtualDeviceList
+	for _, disk := range remove {
+		var device types.BaseVirtualDevice
+		for _, d := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+			backing, ok := d.GetVirtualDevice().Backing.(types.BaseVirtualDeviceFileBackingInfo)
+			if ok && backing.GetVirtualDeviceFileBackingInfo().FileName == disk.DiskFile {
+				device = d
+				break
+			}
+		}
+		if device == nil {
+			return nil, NewErrorObjectNotFound(
+				errors.New("no disk with the file name"), disk.DiskFile)
+		}
+		removed = append(removed, device)
+	}
+
+	var added object.VirtualDeviceList
+	if len(add) > 0 {
+		dcMo, err := GetDatacenter(vm)
+		if err != nil {
+			return nil, err
+		}
+		if vm.datastore == "" {
+			datastores, err := getDatastoreForVm(vm, vmMo)
+			if err != nil {
+				return nil, err
+			}
+			if err = chooseDatastore(vm, datastores); err != nil {
+				return nil, err
+			}
+		}
+		for index, disk := range add {
+			datastore := disk.Datastore
+			if datastore == "" {
+				datastore = vm.datastore
+			}
+			controller, err := devices.FindDiskController(
+				controllerDeviceName(vm, disk.Controller))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get controller for "+
+					"Disks[%d] {%v} : %v", index, disk, err)
+			}
+			if err = validateDiskSharing(disk, controller); err != nil {
+				return nil, fmt.Errorf("Invalid controller for "+
+					"Disks[%d] {%v} : %v", index, disk, err)
+			}
+			if err = validateDiskMode(disk.Mode); err != nil {
+				return nil, fmt.Errorf("Invalid mode for "+
+					"Disks[%d] {%v} : %v", index, disk, err)
+			}
+			thinProvisioned, eagerlyScrub, err := diskProvisioning(disk.Provisioning)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid provisioning for "+
+					"Disks[%d] {%v} : %v", index, disk, err)
+			}
+			dsMo, err := findDatastore(vm, dcMo, datastore)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get datastore for "+
+					"Disks[%d] {%v} : %v", index, disk, err)
+			}
+			vDisk := CreateDisk(devices, controller, dsMo.Reference(), "",
+				thinProvisioned, disk.Mode)
+			vDisk.CapacityInKB = int64(disk.Size)
+			backing := vDisk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+			backing.EagerlyScrub = types.NewBool(eagerlyScrub)
+			if disk.Sharing != "" {
+				backing.Sharing = disk.Sharing
+			}
+			// The next disk needs another unit number on the controller
+			devices = append(devices, vDisk)
+			added = append(added, vDisk)
+		}
+	}
+
+	addSpecs, err := added.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return nil, err
+	}
+	removeSpecs, err := removed.ConfigSpec(types.VirtualDeviceConfigSpecOperationRemove)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range removeSpecs {
+		spec.GetVirtualDeviceConfigSpec().FileOperation =
+			types.VirtualDeviceConfigSpecFileOperationDestroy
+	}
+	return append(addSpecs, removeSpecs...), nil
+}
+
+// addControllers: adds vm.Controllers to the vm and sets their device names
+var addControllers = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
-	// second parameter is to list v4 ips only and ignore v6 ips
+	for index, c := range vm.Controllers {
+		sharing := types.VirtualSCSISharing(c.BusSharing)
+		switch sharing {
+		case "":
+			sharing = types.VirtualSCSISharingNoSharing
+		case types.VirtualSCSISharingNoSharing,
+			types.VirtualSCSISharingVirtualSharing,
+			types.VirtualSCSISharingPhysicalSharing:
+		default:
+			return fmt.Errorf("Invalid bus sharing for Controllers[%d] {%v}",
+				index, c)
+		}
+		devices, err := vmObj.Device(vm.ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to get devices while creating "+
+				"Controllers[%d] {%v} : %v", index, c, err)
+		}
+		device, err := devices.CreateSCSIController(c.Type)
+		if err != nil {
+			return fmt.Errorf("Failed to create Controllers[%d] {%v} : %v",
+				index, c, err)
+		}
+		scsi := device.(types.BaseVirtualSCSIController).GetVirtualSCSIController()
+		if scsi.BusNumber < 0 {
+			return fmt.Errorf("No free SCSI bus for Controllers[%d] {%v}",
+				index, c)
+		}
+		scsi.SharedBus = sharing
+		if err = vmObj.AddDevice(vm.ctx, device); err != nil {
+			return fmt.Errorf("Failed to add device while creating "+
+				"Controllers[%d] {%v} : %v", index, c, err)
+		}
+
+		// The key is assigned by the server, the bus number identifies the
+		// controller
+		devices, err = vmObj.Device(vm.ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to get devices after creating "+
+				"Controllers[%d] {%v} : %v", index, c, err)
+		}
+		for _, d := range devices.SelectByType((*types.VirtualSCSIController)(nil)) {
+			added := d.(types.BaseVirtualSCSIController).GetVirtualSCSIController()
+			if added.BusNumber == scsi.BusNumber {
+				vm.Controllers[index].DeviceName = devices.Name(d)
+			}
+		}
+	}
+	return nil
+}
+
+// controllerDeviceName: returns the device name of the controller in
+// vm.Controllers with the name, or the name itself for existing controllers
+func controllerDeviceName(vm *VM, name string) string {
+	for _, c := range vm.Controllers {
+		if c.Name != "" && c.Name == name && c.DeviceName != "" {
+			return c.DeviceName
+		}
+	}
+	return name
+}
+
+// asciiKeyEvents: key strokes typing the printable ASCII characters on a US
+// keyboard
+var asciiKeyEvents = func() map[byte]KeyEvent {
+	keys := map[byte]KeyEvent{
+		'\n': {Code: 0x28},
+		'\b': {Code: 0x2a},
+		'\t': {Code: 0x2b},
+		' ':  {Code: 0x2c},
+		0x1b: {Code: 0x29},
+	}
+	for c := byte('a'); c <= 'z'; c++ {
+		keys[c] = KeyEvent{Code: int32(0x04 + c - 'a')}
+		keys[c-'a'+'A'] = KeyEvent{Code: int32(0x04 + c - 'a'), Shift: true}
+	}
+	// The digits and symbols share keys, unshifted and shifted
+	for i, pair := range []string{"1!", "2@", "3#", "4$", "5%", "6^", "7&",
+		"8*", "9(", "0)"} {
+		keys[pair[0]] = KeyEvent{Code: int32(0x1e + i)}
+		keys[pair[1]] = KeyEvent{Code: int32(0x1e + i), Shift: true}
+	}
+	punctuation := map[int32]string{
+		0x2d: "-_", 0x2e: "=+", 0x2f: "[{", 0x30: "]}", 0x31: "\\|",
+		0x33: ";:", 0x34: "'\"", 0x35: "`~", 0x36: ",<", 0x37: ".>",
+		0x38: "/?",
+	}
+	for code, pair := range punctuation {
+		keys[pair[0]] = KeyEvent{Code: code}
+		keys[pair[1]] = KeyEvent{Code: code, Shift: true}
+	}
+	return keys
+}()
+
+// diskProvisioning: returns the ThinProvisioned and EagerlyScrub backing flags
+// for the provisioning of a disk. Thin is the default.
+func diskProvisioning(provisioning string) (bool, bool, error) {
+	switch strings.ToLower(provisioning) {
+	case "", "thin":
+		return true, false, nil
+	case "thick":
+		return false, false, nil
+	case "eagerzeroedthick":
+		return false, true, nil
+	}
+	return false, false, fmt.Errorf("invalid disk provisioning: %s", provisioning)
+}
+
+// setCloneDiskProvisioning: sets the disks of the template in the relocate
+// spec of the clone to vm.CloneDiskProvisioning. The disks are moved to the
+// datastore of the spec, or stay on theirs. Storage DRS places the disks
+// itself, so the whole vm is transformed instead, which has no eager zeroing.
+func setCloneDiskProvisioning(vm *VM, vmMo *mo.VirtualMachine,
+	spec *types.VirtualMachineRelocateSpec) error {
+	thin, eager, err := diskProvisioning(vm.CloneDiskProvisioning)
+	if err != nil {
+		return err
+	}
+	if vm.Destination.DestinationType == DestinationTypeDatastoreCluster {
+		if eager {
+			return errors.New("eagerzeroedthick clones aren't supported on " +
+				"datastore clusters")
+		}
+		spec.Transform = types.VirtualMachineRelocateTransformationFlat
+		if thin {
+			spec.Transform = types.VirtualMachineRelocateTransformationSparse
+		}
+		return nil
+	}
+	for _, device := range vmMo.Config.Hardware.Device {
+		disk, ok := device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if !ok {
+			return fmt.Errorf("disk %d of the template can't be converted, "+
+				"it isn't a flat disk", disk.Key)
+		}
+		datastore := spec.Datastore
+		if datastore == nil {
+			datastore = backing.Datastore
+		}
+		if datastore == nil {
+			return fmt.Errorf("datastore of disk %d of the template is unknown",
+				disk.Key)
+		}
+		thinProvisioned, eagerlyScrub := thin, eager
+		spec.Disk = append(spec.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+			DiskId:    disk.Key,
+			Datastore: *datastore,
+			DiskBackingInfo: &types.VirtualDiskFlatVer2BackingInfo{
+				DiskMode:        backing.DiskMode,
+				ThinProvisioned: &thinProvisioned,
+				EagerlyScrub:    &eagerlyScrub,
+			},
+		})
+	}
+	return nil
+}
+
+// setFixedDiskDatastores: places the disks of the template in vm.FixedDisks
+// which have a Datastore on it in the relocate spec of the clone. The other
+// disks go to the datastore of the spec.
+func setFixedDiskDatastores(vm *VM, dcMo *mo.Datacenter, vmMo *mo.VirtualMachine,
+	spec *types.VirtualMachineRelocateSpec) error {
+	datastores := map[string]types.ManagedObjectReference{}
+	for _, disk := range vm.FixedDisks {
+		if disk.Datastore == "" {
+			continue
+		}
+		if vm.Destination.DestinationType == DestinationTypeDatastoreCluster {
+			return errors.New("fixed disk datastores aren't supported on " +
+				"datastore clusters, Storage DRS places the disks")
+		}
+		if _, ok := datastores[disk.Datastore]; ok {
+			continue
+		}
+		dsMo, err := findDatastore(vm, dcMo, disk.Datastore)
+		if err != nil {
+			return err
+		}
+		datastores[disk.Datastore] = dsMo.Reference()
+	}
+	if len(datastores) == 0 {
+		return nil
+	}
+	placeFixedDisks(vmMo, vm.FixedDisks, datastores, spec)
+	return nil
+}
+
+// placeFixedDisks: sets the datastore of the locators of the template disks
+// matching the fixed disks with a datastore, adding the missing locators
+func placeFixedDisks(vmMo *mo.VirtualMachine, disks []Disk,
+	datastores map[string]types.ManagedObjectReference,
+	spec *types.VirtualMachineRelocateSpec) {
+	for _, device := range vmMo.Config.Hardware.Device {
+		vdisk, ok := device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		backing, ok := vdisk.Backing.(types.BaseVirtualDeviceFileBackingInfo)
+		if !ok {
+			continue
+		}
+		disk := findByVirtualDeviceFileName(disks,
+			backing.GetVirtualDeviceFileBackingInfo().FileName)
+		if disk == nil || disk.Datastore == "" {
+			continue
+		}
+		dsMor := datastores[disk.Datastore]
+		found := false
+		for i := range spec.Disk {
+			if spec.Disk[i].DiskId == vdisk.Key {
+				spec.Disk[i].Datastore = dsMor
+				found = true
+			}
+		}
+		if !found {
+			spec.Disk = append(spec.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+				DiskId:    vdisk.Key,
+				Datastore: dsMor,
+			})
+		}
+	}
+}
+
+// validateDiskMode: returns an error if mode isn't empty or a vSphere disk mode
+func validateDiskMode(mode string) error {
+	switch types.VirtualDiskMode(mode) {
+	case "", types.VirtualDiskModePersistent, types.VirtualDiskModeNonpersistent,
+		types.VirtualDiskModeUndoable, types.VirtualDiskModeIndependent_persistent,
+		types.VirtualDiskModeIndependent_nonpersistent, types.VirtualDiskModeAppend:
+		return nil
+	}
+	return fmt.Errorf("invalid disk mode: %s", mode)
+}
+
+// validateDiskSharing: returns an error if a shared disk isn't placed on a
+// SCSI controller with bus sharing
+func validateDiskSharing(disk Disk, controller types.BaseVirtualController) error {
+	switch types.VirtualDiskSharing(disk.Sharing) {
+	case "", types.VirtualDiskSharingSharingNone:
+		return nil
+	case types.VirtualDiskSharingSharingMultiWriter:
+	default:
+		return fmt.Errorf("invalid disk sharing: %s", disk.Sharing)
+	}
+	scsi, ok := controller.(types.BaseVirtualSCSIController)
+	if !ok {
+		return errors.New("shared disks need a SCSI controller")
+	}
+	if scsi.GetVirtualSCSIController().SharedBus == types.VirtualSCSISharingNoSharing {
+		return errors.New("shared disks need a controller with bus sharing")
+	}
+	return nil
+}
+
+// waitForIP waits until the ips of every NIC of the vm meet vm.IPWaitPolicy
+// and returns them by NIC MAC address. With vm.PreferredIPNetwork, it waits
+// for an ip inside the network, stores it on the vm and returns only it.
+var waitForIP = func(vm *VM, vmMo *mo.VirtualMachine) (map[string][]string, error) {
+	var network *net.IPNet
+	if vm.PreferredIPNetwork != "" {
+		var err error
+		_, network, err = net.ParseCIDR(vm.PreferredIPNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preferred ip network: %v", err)
+		}
+	}
+	// Without Tools the IP is never reported, don't wait for the timeout
+	if toolsNotInstalled(vmMo) {
+		return nil, NewErrorIPWaitSkipped(vm.Name)
+	}
 	timeout := IPWAIT_TIMEOUT
 	if value := os.Getenv("IPWAIT_TIMEOUT"); value != "" {
 		// valid time units are "ns", "us", "ms", "s", "m", "h"
@@ -1209,22 +3628,176 @@ var waitForIP = func(vm *VM, vmMo *mo.VirtualMachine) error {
 	}
 	ctx, cancel := context.WithTimeout(vm.ctx, timeout)
 	defer cancel()
-	ipMap, err := vmObj.WaitForNetIP(ctx, true)
+	ipMap, err := waitForNetIPs(ctx, vm, vmMo.Reference(), vm.IPWaitPolicy,
+		network)
 	if err != nil {
-		return fmt.Errorf("failed to wait for VM to get ips: %v", err)
+		if ctx.Err() == context.DeadlineExceeded && vm.ctx.Err() == nil {
+			if network != nil {
+				return nil, NewErrorNoIPInNetwork(vm.PreferredIPNetwork,
+					ipMap)
+			}
+			return nil, noValidIPError(vm, vmMo, ipMap)
+		}
+		return nil, fmt.Errorf("failed to wait for VM to get ips: %v", err)
+	}
+	if network != nil {
+		mac, ip := ipInNetwork(ipMap, network)
+		vm.preferredIP = ip
+		return map[string][]string{mac: {ip.String()}}, nil
 	}
+	return ipMap, nil
+}
+
+// ipInNetwork: returns the first ip inside the network, skipping the link
+// local ones, and the MAC address of its NIC
+func ipInNetwork(ipMap map[string][]string, network *net.IPNet) (string, net.IP) {
+	macs := make([]string, 0, len(ipMap))
+	for mac := range ipMap {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		for _, s := range ipMap[mac] {
+			ip := net.ParseIP(s)
+			if ip != nil && !ip.IsLinkLocalUnicast() && network.Contains(ip) {
+				return mac, ip
+			}
+		}
+	}
+	return "", nil
+}
 
-	// Parse the IP to make sure tools was running
-	for _, ips := range ipMap {
-		if len(ips) == 0 {
+// ipsMeetPolicy: reports whether the ips of a NIC meet the ip wait policy.
+// Link local addresses, 169.254/16 and fe80::/10, don't count.
+func ipsMeetPolicy(ips []string, policy string) bool {
+	var v4, v6 bool
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.IsLinkLocalUnicast() {
 			continue
 		}
-		ip := net.ParseIP(ips[0])
-		if ip != nil {
-			return nil
+		if ip.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
 		}
 	}
-	return fmt.Errorf("no valid ip assigned: %v", ipMap)
+	switch policy {
+	case IPWaitPolicyAny:
+		return v4 || v6
+	case IPWaitPolicyBoth:
+		return v4 && v6
+	case IPWaitPolicyV6:
+		return v6
+	default:
+		return v4
+	}
+}
+
+// waitForNetIPs: waits until the ips of every NIC of the vm meet the policy,
+// or until a NIC has an ip inside the network if given, and returns them by
+// NIC MAC address. Only IPv4 addresses are returned for the v4 policy. The ips
+// seen so far are returned on errors.
+func waitForNetIPs(ctx context.Context, vm *VM, vmMor types.ManagedObjectReference,
+	policy string, network *net.IPNet) (map[string][]string, error) {
+	macs := map[string][]string{}
+	pc := property.DefaultCollector(vm.client.Client)
+
+	// Wait for all NICs to have a MAC address, which may not be generated yet
+	err := property.Wait(ctx, pc, vmMor, []string{"config.hardware.device"},
+		func(changes []types.PropertyChange) bool {
+			for _, c := range changes {
+				if c.Op != types.PropertyChangeOpAssign {
+					continue
+				}
+				devices := c.Val.(types.ArrayOfVirtualDevice).VirtualDevice
+				for _, device := range devices {
+					if nic, ok := device.(types.BaseVirtualEthernetCard); ok {
+						mac := nic.GetVirtualEthernetCard().MacAddress
+						if mac == "" {
+							return false
+						}
+						macs[mac] = nil
+					}
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return macs, err
+	}
+
+	v4Only := network == nil && (policy == "" || policy == IPWaitPolicyV4)
+	err = property.Wait(ctx, pc, vmMor, []string{"guest.net"},
+		func(changes []types.PropertyChange) bool {
+			for _, c := range changes {
+				if c.Op != types.PropertyChangeOpAssign {
+					continue
+				}
+				nics := c.Val.(types.ArrayOfGuestNicInfo).GuestNicInfo
+				for _, nic := range nics {
+					// Ignore any that don't correspond to a VM device
+					if _, ok := macs[nic.MacAddress]; !ok || nic.IpConfig == nil {
+						continue
+					}
+					var ips []string
+					for _, ip := range nic.IpConfig.IpAddress {
+						if v4Only && net.ParseIP(ip.IpAddress).To4() == nil {
+							continue
+						}
+						ips = append(ips, ip.IpAddress)
+					}
+					macs[nic.MacAddress] = ips
+				}
+			}
+			if network != nil {
+				_, ip := ipInNetwork(macs, network)
+				return ip != nil
+			}
+			for _, ips := range macs {
+				if !ipsMeetPolicy(ips, policy) {
+					return false
+				}
+			}
+			return true
+		})
+	return macs, err
+}
+
+// noValidIPError: returns an ErrorNoValidIP with the current guest state of
+// the vm
+func noValidIPError(vm *VM, vmMo *mo.VirtualMachine, ipMap map[string][]string) error {
+	guestMo := mo.VirtualMachine{}
+	err := vm.collector.RetrieveOne(vm.ctx, vmMo.Reference(), []string{"guest"}, &guestMo)
+	if err != nil {
+		return NewErrorPropertyRetrieval(vmMo.Reference(), []string{"guest"}, err)
+	}
+	if guestMo.Guest == nil {
+		return NewErrorNoValidIP(ipMap, "", "")
+	}
+	return NewErrorNoValidIP(ipMap, guestMo.Guest.ToolsRunningStatus,
+		guestMo.Guest.GuestState)
+}
+
+// toolsNotInstalled: reports whether VMware Tools are known not to be
+// installed in the guest of the vm
+func toolsNotInstalled(vmMo *mo.VirtualMachine) bool {
+	if vmMo.Guest == nil {
+		return false
+	}
+	return vmMo.Guest.ToolsVersionStatus2 == string(types.VirtualMachineToolsVersionStatusGuestToolsNotInstalled) ||
+		vmMo.Guest.ToolsStatus == types.VirtualMachineToolsStatusToolsNotInstalled
+}
+
+// waitForIPOrSkip: waits for the ip of the vm. The ErrorIPWaitSkipped warning
+// is returned apart from the errors, for the caller to go on and return it
+// once done.
+func waitForIPOrSkip(vm *VM, vmMo *mo.VirtualMachine) (warning error, err error) {
+	_, err = waitForIP(vm, vmMo)
+	if _, ok := err.(ErrorIPWaitSkipped); ok {
+		return err, nil
+	}
+	return nil, err
 }
 
 var halt = func(vm *VM) error {
@@ -1235,7 +3808,7 @@ var halt = func(vm *VM) error {
 	}
 	if state == "standby" {
 		err = start(vm)
-		if err != nil {
+		if _, ok := err.(ErrorIPWaitSkipped); err != nil && !ok {
 			return err
 		}
 	}
@@ -1243,6 +3816,9 @@ var halt = func(vm *VM) error {
 	if err != nil {
 		return err
 	}
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return err
+	}
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	poweroffTask, err := vmo.PowerOff(vm.ctx)
 	if err != nil {
@@ -1259,36 +3835,69 @@ var halt = func(vm *VM) error {
 	return nil
 }
 
-// shutDown Initiates guest shut down of this VM.
-var shutDown = func(vm *VM) error {
+// shutDown Initiates guest shut down of this VM. When the guest doesn't shut
+// down in time the vm is powered off if ForcePowerOffOnShutdownTimeout is set,
+// otherwise ErrorGuestShutdownTimeout is returned.
+var shutDown = func(vm *VM) (ShutdownResult, error) {
 	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
-		return err
+		return "", err
 	}
-	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
-	err = vmo.ShutdownGuest(vm.ctx)
-	if err != nil {
-		return fmt.Errorf("error initiating shutDown on the vm: %v", err)
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return "", err
+	}
+	if err = shutdownGuest(vm, vmMo.Reference()); err != nil {
+		return "", fmt.Errorf("error initiating shutDown on the vm: %v", err)
 	}
 
 	state, err := getState(vm)
 	if err != nil {
-		return fmt.Errorf("Error getting state of vm : %v", err)
-	}
-	retry := RETRY_COUNT
-	for state != "notRunning" && retry > 0 {
+		return "", fmt.Errorf("Error getting state of vm : %v", err)
+	}
+	timeout, interval := shutdownTimeouts(vm)
+	deadline := time.Now().Add(timeout)
+	for state != "notRunning" {
+		if !time.Now().Before(deadline) {
+			if !vm.ForcePowerOffOnShutdownTimeout {
+				return "", NewErrorGuestShutdownTimeout(vm.Name, timeout)
+			}
+			// ShutdownForced tells the caller the guest was powered off
+			if err = halt(vm); err != nil {
+				return "", fmt.Errorf("error powering off the vm after "+
+					"the shutdown timed out: %v", err)
+			}
+			return ShutdownForced, nil
+		}
+		if err = sleepContext(vm.ctx, interval); err != nil {
+			return "", err
+		}
 		state, _ = getState(vm)
-		time.Sleep(5 * time.Second)
-		retry--
 	}
-	if retry == 0 {
-		return fmt.Errorf("Shutting down vm: %s timed out", vm.Name)
-	}
-	return nil
+	return ShutdownGraceful, nil
 }
 
-// waitForGuestStatus: wait for guest vm status to turn to either of the
-// statuses sent as 'status'
+// shutdownGuest: asks the guest of the vm to shut down, without waiting for it
+var shutdownGuest = func(vm *VM, vmMor types.ManagedObjectReference) error {
+	vmo := object.NewVirtualMachine(vm.client.Client, vmMor)
+	return vmo.ShutdownGuest(vm.ctx)
+}
+
+// shutdownTimeouts: returns how long to wait for the guest of the vm to shut
+// down and how often to check its state
+func shutdownTimeouts(vm *VM) (timeout, interval time.Duration) {
+	interval = vm.ShutdownPollInterval
+	if interval <= 0 {
+		interval = SHUTDOWN_POLL_INTERVAL
+	}
+	timeout = vm.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = RETRY_COUNT * SHUTDOWN_POLL_INTERVAL
+	}
+	return timeout, interval
+}
+
+// waitForGuestStatus: wait for guest vm status to turn to either of the
+// statuses sent as 'status'
 func waitForGuestStatus(vm *VM, vmMo *mo.VirtualMachine, status int,
 	timeout ...time.Duration) error {
 	var (
@@ -1342,32 +3951,218 @@ var restart = func(vm *VM) error {
 	if err != nil {
 		return err
 	}
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return err
+	}
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	err = vmo.RebootGuest(vm.ctx)
 	if err != nil {
 		return fmt.Errorf("error initiating reboot on the vm: %v", err)
 	}
 	// wait for machine to shutdown - status will turn to gray
-	// ignoring the error if timeout waiting for gray status
-	waitForGuestStatus(vm, vmMo, GRAY_HEART_BEAT, GRAY_STATUS_CHECK_TIMEOUT)
-	// wait for machine to come up again - status will turn to green
-	err = waitForGuestStatus(vm, vmMo, GREEN_HEART_BEAT|YELLOW_HEART_BEAT,
-		GREEN_STATUS_CHECK_TIMEOUT)
+	err = waitForReboot(vm, vmMo, GRAY_HEART_BEAT)
 	if err != nil {
 		return fmt.Errorf("error wating for vm to reboot : %v", err)
 	}
 	return nil
 }
 
-var start = func(vm *VM) error {
+// waitForReboot: waits for the heartbeat of the guest to go down to one of
+// the statuses, ignoring the timeout as the guest may be back already, and
+// then to come up again - status will turn to green
+func waitForReboot(vm *VM, vmMo *mo.VirtualMachine, down int) error {
+	waitForGuestStatus(vm, vmMo, down, GRAY_STATUS_CHECK_TIMEOUT)
+	return waitForGuestStatus(vm, vmMo, GREEN_HEART_BEAT|YELLOW_HEART_BEAT,
+		GREEN_STATUS_CHECK_TIMEOUT)
+}
+
+// reboot: restarts the vm with the method, RebootMethodAuto reboots the guest
+// if VMware Tools are running and resets the vm otherwise
+var reboot = func(vm *VM, method RebootMethod) error {
+	switch method {
+	case RebootMethodGraceful:
+		return restart(vm)
+	case RebootMethodHard:
+		return reset(vm)
+	case RebootMethodAuto, "":
+	default:
+		return fmt.Errorf("invalid reboot method: %s", method)
+	}
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	if vmMo.Guest != nil && vmMo.Guest.ToolsRunningStatus ==
+		string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+		return restart(vm)
+	}
+	return reset(vm)
+}
+
+// suspend: suspends the vm, the inverse of start on a suspended vm. Returns
+// ErrorVMPowerStateChanging if the vm is shutting down or resetting.
+var suspend = func(vm *VM) error {
 	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
 		return err
 	}
-	state := vmMo.Guest.GuestState
-	if state == "shuttingdown" || state == "resetting" {
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return err
+	}
+	if vmMo.Runtime.PowerState == types.VirtualMachinePowerStateSuspended {
+		return nil
+	}
+	if err = checkPowerStateChanging(vmMo); err != nil {
+		return err
+	}
+	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	suspendTask, err := vmo.Suspend(vm.ctx)
+	if err != nil {
+		return fmt.Errorf("error creating a suspend task on the vm: %v", err)
+	}
+	tInfo, err := suspendTask.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for suspend task: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("suspend task returned an error: %s",
+			tInfo.Error.LocalizedMessage)
+	}
+	return nil
+}
+
+// renderVMName: sets vm.Name from vm.NameTemplate for the datastore and host
+// picked for the clone, and resolves a collision of the name like
+// resolveNameCollision.
+func renderVMName(vm *VM, host types.ManagedObjectReference) (bool, error) {
+	nameCtx := NameContext{
+		Index:     vm.NameIndex,
+		Datastore: vm.datastore,
+		Host:      vm.Destination.HostSystem,
+	}
+	if host.Value != "" {
+		hsMo := mo.HostSystem{}
+		ps := []string{"name"}
+		if err := vm.collector.RetrieveOne(vm.ctx, host, ps, &hsMo); err != nil {
+			return false, NewErrorPropertyRetrieval(host, ps, err)
+		}
+		nameCtx.Host = hsMo.Name
+	}
+	name, err := executeNameTemplate(vm.NameTemplate, nameCtx)
+	if err != nil {
+		return false, err
+	}
+	vm.Name = name
+	return resolveNameCollision(vm)
+}
+
+// validateNameCollision: returns an error for an unknown collision strategy
+func validateNameCollision(onCollision NameCollision) error {
+	switch onCollision {
+	case "", NameCollisionFail, NameCollisionSuffix, NameCollisionReuse:
+		return nil
+	}
+	return fmt.Errorf("unsupported value for OnNameCollision: %q", onCollision)
+}
+
+// resolveNameCollision: checks if a vm of the name exists and applies
+// vm.OnNameCollision. Returns true if the existing vm is to be reused, and
+// ErrorVMExists if the collision isn't resolved. A suffixed name is set on
+// the vm. It may still be taken by a concurrent clone.
+func resolveNameCollision(vm *VM) (bool, error) {
+	e, err := Exists(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return false, fmt.Errorf("failed to check if the vm already exists: %v", err)
+	}
+	if !e {
+		return false, nil
+	}
+	switch vm.OnNameCollision {
+	case NameCollisionReuse:
+		return true, nil
+	case NameCollisionSuffix:
+		for i := 1; i <= MAX_NAME_SUFFIX; i++ {
+			name := fmt.Sprintf("%s-%d", vm.Name, i)
+			e, err = Exists(vm, getVMSearchFilter(name))
+			if err != nil {
+				return false, fmt.Errorf("failed to check if the vm already exists: %v", err)
+			}
+			if !e {
+				vm.Name = name
+				return false, nil
+			}
+		}
+	}
+	return false, ErrorVMExists
+}
+
+// executeNameTemplate: returns the vm name rendered from the template
+func executeNameTemplate(nameTemplate string, nameCtx NameContext) (string,
+	error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template %q: %v", nameTemplate, err)
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, nameCtx); err != nil {
+		return "", fmt.Errorf("error rendering name template %q: %v",
+			nameTemplate, err)
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" {
+		return "", fmt.Errorf("name template %q rendered an empty name",
+			nameTemplate)
+	}
+	return name, nil
+}
+
+// forEachVM: runs op on the vms, at most concurrency at a time, and returns
+// the errors in the order of the vms
+func forEachVM(vms []*VM, concurrency int, op func(*VM) error) []error {
+	if concurrency <= 0 || concurrency > len(vms) {
+		concurrency = len(vms)
+	}
+	errs := make([]error, len(vms))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, vm *VM) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = op(vm)
+		}(i, vm)
+	}
+	wg.Wait()
+	return errs
+}
+
+// checkPowerStateChanging: returns ErrorVMPowerStateChanging if the guest of
+// the vm is shutting down or resetting
+func checkPowerStateChanging(vmMo *mo.VirtualMachine) error {
+	if vmMo.Guest == nil {
+		return nil
+	}
+	switch types.VirtualMachineGuestState(vmMo.Guest.GuestState) {
+	case types.VirtualMachineGuestStateShuttingDown,
+		types.VirtualMachineGuestStateResetting:
 		return ErrorVMPowerStateChanging
 	}
+	return nil
+}
+
+var start = func(vm *VM) error {
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return err
+	}
+	if err = checkPowerStateChanging(vmMo); err != nil {
+		return err
+	}
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	poweronTask, err := vmo.PowerOn(vm.ctx)
 	if err != nil {
@@ -1381,9 +4176,12 @@ var start = func(vm *VM) error {
 		return fmt.Errorf("poweron task returned an error: %v", err)
 	}
 	if !vm.SkipIPWait {
-		if err = waitForIP(vm, vmMo); err != nil {
+		setProvisioningState(vm, ProvisioningStateWaitingForIP)
+		warning, err := waitForIPOrSkip(vm, vmMo)
+		if err != nil {
 			return err
 		}
+		return warning
 	}
 	return nil
 }
@@ -1393,6 +4191,9 @@ var reset = func(vm *VM) error {
 	if err != nil {
 		return err
 	}
+	if err = waitForActiveTasks(vm, vmMo); err != nil {
+		return err
+	}
 	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
 	toolsRunning, err := vmo.IsToolsRunning(vm.ctx)
 	if err != nil {
@@ -1413,14 +4214,7 @@ var reset = func(vm *VM) error {
 	// wait for machine to reset - status will turn to red
 	if toolsRunning {
 		// wait for machine to shutdown - status will turn to gray
-		err = waitForGuestStatus(vm, vmMo,
-			GRAY_HEART_BEAT|RED_HEART_BEAT)
-		if err != nil {
-			return fmt.Errorf("error wating for vm to reset: %v",
-				err)
-		}
-		err = waitForGuestStatus(vm, vmMo,
-			GREEN_HEART_BEAT|YELLOW_HEART_BEAT)
+		err = waitForReboot(vm, vmMo, GRAY_HEART_BEAT|RED_HEART_BEAT)
 		if err != nil {
 			return fmt.Errorf("error wating for vm to reset : %v",
 				err)
@@ -1514,7 +4308,7 @@ var getVMLocation = func(vm *VM, dcMo *mo.Datacenter) (l location, err error) {
 		}
 		l.ResourcePool = *crMo.ResourcePool
 		l.Networks = crMo.Network
-	case DestinationTypeResourcePool:
+	case DestinationTypeResourcePool, DestinationTypeDatastoreCluster:
 		var rp *mo.ResourcePool
 		dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
 		// Set datacenter
@@ -1525,10 +4319,28 @@ var getVMLocation = func(vm *VM, dcMo *mo.Datacenter) (l location, err error) {
 			return
 		}
 		cr := mo.ClusterComputeResource{}
-		err = vm.collector.RetrieveOne(vm.ctx, rp.Owner, []string{"network"}, &cr)
+		err = vm.collector.RetrieveOne(vm.ctx, rp.Owner, []string{"network", "host"}, &cr)
 		if err != nil {
 			return
 		}
+		// If a host name was passed in try to find it within the pool's cluster
+		if vm.Destination.HostSystem != "" {
+			var hsMo *mo.HostSystem
+			hsMo, err = findHostSystem(vm, cr.Host, vm.Destination.HostSystem)
+			if err != nil {
+				return
+			}
+			var valid bool
+			valid, err = validateHost(vm, hsMo.Reference())
+			if err != nil {
+				return
+			}
+			if !valid {
+				err = NewErrorInvalidHost(vm.Destination.HostSystem, vm.datastore, vm.Networks)
+				return
+			}
+			l.Host = hsMo.Reference()
+		}
 		l.ResourcePool = rp.Reference()
 		l.Networks = cr.Network
 	default:
@@ -1550,32 +4362,52 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 	}
 
 	vm.datastore = selectedDatastore
+	setProvisioningState(vm, ProvisioningStateUploadingTemplate)
 	downloadOvaPath, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := os.RemoveAll(downloadOvaPath); err != nil {
-			fmt.Errorf("can't remove temp directory, error: %v", err.Error())
-		}
-	}()
+	// Failing to remove the temp directory shouldn't fail the upload
+	defer os.RemoveAll(downloadOvaPath)
 	// Read the ovf file
 	if vm.OvaPathUrl != "" {
-		vm.OvfPath, err = downloadOva(downloadOvaPath, vm.OvaPathUrl)
+		var resolved string
+		vm.OvfPath, resolved, err = downloadOva(vm.ctx, downloadOvaPath,
+			vm.OvaPathUrl, vm.OvaAuth, nil, !vm.SkipManifestVerification)
 		if err != nil {
 			return err
 		}
+		if resolved != "" {
+			sendEvent(vm, ProvisionEvent{
+				State: ProvisioningStateUploadingTemplate,
+				URL:   resolved,
+			})
+		}
 	}
 	ovfContent, err := parseOvf(vm.OvfPath)
 	if err != nil {
 		return err
 	}
+	if vm.OvfTransform != nil {
+		ovfContent, err = vm.OvfTransform(ovfContent)
+		if err != nil {
+			return fmt.Errorf("error transforming the ovf descriptor: %v", err)
+		}
+	}
 
-	dsMo, err := findDatastore(vm, dcMo, selectedDatastore)
+	l, err := getVMLocation(vm, dcMo)
 	if err != nil {
 		return err
 	}
-	l, err := getVMLocation(vm, dcMo)
+	if selectedDatastore == "" &&
+		vm.Destination.DestinationType == DestinationTypeDatastoreCluster {
+		selectedDatastore, err = recommendImportDatastore(vm, dcMo, l, template)
+		if err != nil {
+			return err
+		}
+		vm.datastore = selectedDatastore
+	}
+	dsMo, err := findDatastore(vm, dcMo, selectedDatastore)
 	if err != nil {
 		return err
 	}
@@ -1604,6 +4436,17 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 	// If any of the unit numbers in the spec are 0, they need to be reset to -1
 	resetUnitNumbers(specResult)
 
+	minVersion, err := minHardwareVersion(vm, l)
+	if err != nil {
+		return err
+	}
+	if minVersion > 0 {
+		configSpec := &specResult.ImportSpec.(*types.VirtualMachineImportSpec).ConfigSpec
+		if hardwareVersionBelow(configSpec.Version, minVersion) {
+			configSpec.Version = fmt.Sprintf("vmx-%d", minVersion)
+		}
+	}
+
 	hso := object.NewHostSystem(vm.client.Client, l.Host)
 	// Import into the DC's vm folder for now. We can make it user configurable later.
 	fo := object.NewFolder(vm.client.Client, dcMo.VmFolder)
@@ -1612,7 +4455,7 @@ var uploadTemplate = func(vm *VM, dcMo *mo.Datacenter, selectedDatastore string)
 		return fmt.Errorf("error getting an nfc lease: %v", err)
 	}
 
-	err = uploadOvf(vm, specResult, NewLease(vm.ctx, lease))
+	err = uploadOvf(vm, specResult, eventLease{Lease: NewLease(vm.ctx, lease), vm: vm})
 	if err != nil {
 		return fmt.Errorf("error uploading the ovf template: %v", err)
 	}
@@ -1676,16 +4519,176 @@ var getNetworkName = func(vm *VM, network types.ManagedObjectReference) (string,
 	return "", fmt.Errorf("Could not retrieve the network name for: %s", network.Value)
 }
 
+// getNetworkBacking: returns the network backing of the nic with the device
+// key
+func getNetworkBacking(vm *VM, vmMo *mo.VirtualMachine, deviceKey int32) (NetworkBacking, error) {
+	if vmMo.Config == nil {
+		return NetworkBacking{}, NewErrorConfigNotAvailable(vm.Name)
+	}
+	var nic types.BaseVirtualEthernetCard
+	for _, device := range vmMo.Config.Hardware.Device {
+		if device.GetVirtualDevice().Key != deviceKey {
+			continue
+		}
+		if card, ok := device.(types.BaseVirtualEthernetCard); ok {
+			nic = card
+		}
+	}
+	if nic == nil {
+		return NetworkBacking{}, NewErrorObjectNotFound(
+			errors.New("could not find the network adapter"),
+			strconv.Itoa(int(deviceKey)))
+	}
+
+	switch backing := nic.GetVirtualEthernetCard().Backing.(type) {
+	case *types.VirtualEthernetCardNetworkBackingInfo:
+		return getStandardNetworkBacking(vm, vmMo, backing)
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		return getDistributedNetworkBacking(vm, backing)
+	case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+		return NetworkBacking{
+			Type:        "opaque",
+			NetworkName: backing.OpaqueNetworkId,
+		}, nil
+	}
+	return NetworkBacking{}, fmt.Errorf("unsupported backing for network adapter %d", deviceKey)
+}
+
+// getStandardNetworkBacking: returns the vSwitch and VLAN of the port group
+// on the host of the vm
+func getStandardNetworkBacking(vm *VM, vmMo *mo.VirtualMachine,
+	backing *types.VirtualEthernetCardNetworkBackingInfo) (NetworkBacking, error) {
+	nb := NetworkBacking{
+		Type:        "standard",
+		NetworkName: backing.DeviceName,
+	}
+	if vmMo.Runtime.Host == nil {
+		return nb, errors.New("host associated with vm not found")
+	}
+	hsMo := mo.HostSystem{}
+	err := vm.collector.RetrieveOne(vm.ctx, *vmMo.Runtime.Host,
+		[]string{"config.network.portgroup"}, &hsMo)
+	if err != nil {
+		return nb, fmt.Errorf("error retrieving the port groups of the host: %v", err)
+	}
+	if hsMo.Config == nil || hsMo.Config.Network == nil {
+		return nb, nil
+	}
+	for _, pg := range hsMo.Config.Network.Portgroup {
+		if pg.Spec.Name != backing.DeviceName {
+			continue
+		}
+		nb.VSwitch = pg.Spec.VswitchName
+		nb.VlanId = pg.Spec.VlanId
+		if nb.VlanId != 0 {
+			nb.VlanType = "vlan"
+		}
+	}
+	return nb, nil
+}
+
+// getDistributedNetworkBacking: returns the switch and VLAN of the
+// distributed port group
+func getDistributedNetworkBacking(vm *VM,
+	backing *types.VirtualEthernetCardDistributedVirtualPortBackingInfo) (NetworkBacking, error) {
+	nb := NetworkBacking{
+		Type:         "distributed",
+		SwitchUuid:   backing.Port.SwitchUuid,
+		PortgroupKey: backing.Port.PortgroupKey,
+	}
+	pgMor := types.ManagedObjectReference{
+		Type:  "DistributedVirtualPortgroup",
+		Value: backing.Port.PortgroupKey,
+	}
+	pgMo := mo.DistributedVirtualPortgroup{}
+	err := vm.collector.RetrieveOne(vm.ctx, pgMor, []string{"name", "config"}, &pgMo)
+	if err != nil {
+		return nb, fmt.Errorf("error retrieving the port group: %v", err)
+	}
+	nb.NetworkName = pgMo.Name
+	if dvs := pgMo.Config.DistributedVirtualSwitch; dvs != nil {
+		dvsMo := mo.DistributedVirtualSwitch{}
+		err = vm.collector.RetrieveOne(vm.ctx, *dvs, []string{"name"}, &dvsMo)
+		if err != nil {
+			return nb, fmt.Errorf("error retrieving the distributed switch: %v", err)
+		}
+		nb.SwitchName = dvsMo.Name
+	}
+	setting, ok := pgMo.Config.DefaultPortConfig.(*types.VMwareDVSPortSetting)
+	if !ok {
+		return nb, nil
+	}
+	switch vlan := setting.Vlan.(type) {
+	case *types.VmwareDistributedVirtualSwitchVlanIdSpec:
+		nb.VlanId = vlan.VlanId
+		if nb.VlanId != 0 {
+			nb.VlanType = "vlan"
+		}
+	case *types.VmwareDistributedVirtualSwitchPvlanSpec:
+		nb.VlanType = "pvlan"
+		nb.VlanId = vlan.PvlanId
+	case *types.VmwareDistributedVirtualSwitchTrunkVlanSpec:
+		nb.VlanType = "trunk"
+		for _, r := range vlan.VlanId {
+			nb.VlanRanges = append(nb.VlanRanges,
+				fmt.Sprintf("%d-%d", r.Start, r.End))
+		}
+	}
+	return nb, nil
+}
+
+// isHostUsable: reports whether VMs can be placed on the host, i.e. it's
+// connected and not in maintenance mode
+func isHostUsable(hsMo mo.HostSystem) bool {
+	return !hsMo.Runtime.InMaintenanceMode &&
+		hsMo.Runtime.ConnectionState == types.HostSystemConnectionStateConnected
+}
+
+// hostHasCapacity: reports whether the unused CPU and memory of the host can
+// accommodate the flavor. The flavor's CPUs are counted at the host's core
+// speed.
+func hostHasCapacity(summary types.HostListSummary, flavor Flavor) bool {
+	hw := summary.Hardware
+	if hw == nil {
+		return false
+	}
+	stats := summary.QuickStats
+	if flavor.NumCPUs > 0 {
+		freeMhz := int64(hw.CpuMhz)*int64(hw.NumCpuCores) - int64(stats.OverallCpuUsage)
+		if int32(hw.NumCpuThreads) < flavor.NumCPUs ||
+			freeMhz < int64(flavor.NumCPUs)*int64(hw.CpuMhz) {
+			return false
+		}
+	}
+	if flavor.MemoryMB > 0 {
+		freeMB := hw.MemorySize/(1024*1024) - int64(stats.OverallMemoryUsage)
+		if freeMB < flavor.MemoryMB {
+			return false
+		}
+	}
+	return true
+}
+
 // validateHost validates that the host-system contains the network and the datastore passed in
 func validateHost(vm *VM, hsMor types.ManagedObjectReference) (bool, error) {
 	nwValid := true
 	dsValid := false
 	// Fetch the managed object for the host system to populate the datastore and the network folders
 	hsMo := mo.HostSystem{}
-	err := vm.collector.RetrieveOne(vm.ctx, hsMor, []string{"network", "datastore"}, &hsMo)
+	ps := []string{"network", "datastore", "runtime"}
+	if vm.CheckHostCapacity {
+		ps = append(ps, "summary")
+	}
+	err := vm.collector.RetrieveOne(vm.ctx, hsMor, ps, &hsMo)
 	if err != nil {
 		return false, err
 	}
+	if !isHostUsable(hsMo) {
+		return false, nil
+	}
+	if vm.CheckHostCapacity && !hostHasCapacity(hsMo.Summary, vm.Flavor) {
+		return false, nil
+	}
 	hostNetworks := map[string]struct{}{}
 	for _, nw := range hsMo.Network {
 		name, err := getNetworkName(vm, nw)
@@ -1727,6 +4730,10 @@ func getState(vm *VM) (state string, err error) {
 	if err != nil {
 		return "", lvm.ErrVMInfoFailed
 	}
+	// The guest of a suspended vm is reported as not running
+	if vmMo.Runtime.PowerState == types.VirtualMachinePowerStateSuspended {
+		return "suspended", nil
+	}
 
 	return vmMo.Guest.GuestState, nil
 }
@@ -1741,29 +4748,257 @@ func getPowerState(vm *VM) (state string, err error) {
 	return fmt.Sprintf("%s", vmMo.Runtime.PowerState), nil
 }
 
+// getHostName: returns the name of the host the vm is running on, or
+// registered to if it is powered off
+func getHostName(vm *VM, vmMo *mo.VirtualMachine) (string, error) {
+	if vmMo.Runtime.Host == nil {
+		return "", errors.New("host associated with vm not found")
+	}
+	hsMo := mo.HostSystem{}
+	ps := []string{"name"}
+	err := vm.collector.RetrieveOne(vm.ctx, *vmMo.Runtime.Host, ps, &hsMo)
+	if err != nil {
+		return "", NewErrorPropertyRetrieval(*vmMo.Runtime.Host, ps, err)
+	}
+	return hsMo.Name, nil
+}
+
+// getFolderPath: returns the inventory path of the folder of the managed
+// entity, like /dc1/vm/folder1
+func getFolderPath(vm *VM, ref types.ManagedObjectReference) (string, error) {
+	entity := mo.ManagedEntity{}
+	ps := []string{"parent"}
+	if err := vm.collector.RetrieveOne(vm.ctx, ref, ps, &entity); err != nil {
+		return "", NewErrorPropertyRetrieval(ref, ps, err)
+	}
+	var names []string
+	for parent := entity.Parent; parent != nil; parent = entity.Parent {
+		entity = mo.ManagedEntity{}
+		ps = []string{"name", "parent"}
+		err := vm.collector.RetrieveOne(vm.ctx, *parent, ps, &entity)
+		if err != nil {
+			return "", NewErrorPropertyRetrieval(*parent, ps, err)
+		}
+		// the root folder is the parent of the datacenters
+		if entity.Parent == nil && parent.Type == "Folder" {
+			break
+		}
+		names = append([]string{entity.Name}, names...)
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// validateBiosUUID: returns an error if uuid isn't 32 hex digits, optionally
+// grouped with dashes or spaces
+func validateBiosUUID(uuid string) error {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(uuid)
+	if _, err := hex.DecodeString(digits); err != nil || len(digits) != 32 {
+		return fmt.Errorf("invalid BIOS UUID: %q", uuid)
+	}
+	return nil
+}
+
+// consolidateRelocateSpec: returns the relocate spec moving the vm files and
+// every disk of the vm to the datastore
+func consolidateRelocateSpec(vmMo *mo.VirtualMachine,
+	dsMor types.ManagedObjectReference) (types.VirtualMachineRelocateSpec,
+	error) {
+	spec := types.VirtualMachineRelocateSpec{Datastore: &dsMor}
+	if vmMo.Config == nil {
+		return spec, NewErrorConfigNotAvailable(vmMo.Name)
+	}
+	devices := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		spec.Disk = append(spec.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+			DiskId:    device.GetVirtualDevice().Key,
+			Datastore: dsMor,
+		})
+	}
+	return spec, nil
+}
+
+// findTemplateSnapshot: returns the snapshot of the template with the name
+var findTemplateSnapshot = func(vm *VM, templateMo *mo.VirtualMachine,
+	name string) (*mo.VirtualMachineSnapshot, error) {
+	snapshotMo := mo.VirtualMachine{}
+	ps := []string{"snapshot"}
+	err := vm.collector.RetrieveOne(vm.ctx, templateMo.Reference(), ps, &snapshotMo)
+	if err != nil {
+		return nil, NewErrorPropertyRetrieval(templateMo.Reference(), ps, err)
+	}
+	var ref *types.ManagedObjectReference
+	if snapshotMo.Snapshot != nil {
+		ref = findSnapshotByName(snapshotMo.Snapshot.RootSnapshotList, name)
+	}
+	if ref == nil {
+		return nil, NewErrorObjectNotFound(errors.New(
+			"snapshot not found on the template"), name)
+	}
+	snapMo := mo.VirtualMachineSnapshot{}
+	ps = []string{"config"}
+	if err = vm.collector.RetrieveOne(vm.ctx, *ref, ps, &snapMo); err != nil {
+		return nil, NewErrorPropertyRetrieval(*ref, ps, err)
+	}
+	return &snapMo, nil
+}
+
+// findSnapshotByName: returns the first snapshot with the name in the snapshot
+// trees, depth first
+func findSnapshotByName(trees []types.VirtualMachineSnapshotTree,
+	name string) *types.ManagedObjectReference {
+	for _, tree := range trees {
+		if tree.Name == name {
+			ref := tree.Snapshot
+			return &ref
+		}
+		if ref := findSnapshotByName(tree.ChildSnapshotList, name); ref != nil {
+			return ref
+		}
+	}
+	return nil
+}
+
+// rebaseCloneSpec: returns the spec of the linked clone from the snapshot
+// replacing the vm. The clone is placed like the vm and gets its CPUs, memory
+// and, in order, the networks and MAC addresses of its NICs.
+func rebaseCloneSpec(vmMo *mo.VirtualMachine,
+	snapshotMo *mo.VirtualMachineSnapshot) (types.VirtualMachineCloneSpec,
+	error) {
+	if vmMo.Config == nil {
+		return types.VirtualMachineCloneSpec{}, NewErrorConfigNotAvailable(vmMo.Name)
+	}
+	relocateSpec := types.VirtualMachineRelocateSpec{
+		Pool:         vmMo.ResourcePool,
+		Host:         vmMo.Runtime.Host,
+		DiskMoveType: string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking),
+	}
+	if len(vmMo.Datastore) > 0 {
+		relocateSpec.Datastore = &vmMo.Datastore[0]
+	}
+	config := types.VirtualMachineConfigSpec{
+		NumCPUs:  vmMo.Config.Hardware.NumCPU,
+		MemoryMB: int64(vmMo.Config.Hardware.MemoryMB),
+	}
+	var oldNICs []*types.VirtualEthernetCard
+	for _, device := range vmMo.Config.Hardware.Device {
+		if nic, ok := device.(types.BaseVirtualEthernetCard); ok {
+			oldNICs = append(oldNICs, nic.GetVirtualEthernetCard())
+		}
+	}
+	i := 0
+	for _, device := range snapshotMo.Config.Hardware.Device {
+		nic, ok := device.(types.BaseVirtualEthernetCard)
+		if !ok || i >= len(oldNICs) {
+			continue
+		}
+		card := nic.GetVirtualEthernetCard()
+		card.Backing = oldNICs[i].Backing
+		card.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+		card.MacAddress = oldNICs[i].MacAddress
+		config.DeviceChange = append(config.DeviceChange,
+			&types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationEdit,
+				Device:    device,
+			})
+		i++
+	}
+	snapshotRef := snapshotMo.Reference()
+	return types.VirtualMachineCloneSpec{
+		Location: relocateSpec,
+		PowerOn:  false,
+		Config:   &config,
+		Snapshot: &snapshotRef,
+	}, nil
+}
+
+// flavorConfigSpec: returns the config spec resizing the vm to flavor. The
+// memory has to be a multiple of 4MB. A powered on vm can only grow the CPUs or
+// memory that have hot add enabled.
+func flavorConfigSpec(vmMo *mo.VirtualMachine, flavor Flavor) (
+	types.VirtualMachineConfigSpec, error) {
+	config := types.VirtualMachineConfigSpec{
+		NumCPUs:  flavor.NumCPUs,
+		MemoryMB: flavor.MemoryMB,
+	}
+	if flavor.NumCPUs < 0 || flavor.MemoryMB < 0 {
+		return config, fmt.Errorf("invalid flavor %+v", flavor)
+	}
+	if flavor.MemoryMB%4 != 0 {
+		return config, fmt.Errorf("memory of %d MB is not a multiple of 4 MB",
+			flavor.MemoryMB)
+	}
+	if err := setFlavorAllocation(&config, flavor); err != nil {
+		return config, err
+	}
+	if vmMo.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		return config, nil
+	}
+	if vmMo.Config == nil {
+		return config, NewErrorConfigNotAvailable(vmMo.Name)
+	}
+	hw := vmMo.Config.Hardware
+	if flavor.NumCPUs != 0 && flavor.NumCPUs != hw.NumCPU {
+		if flavor.NumCPUs < hw.NumCPU {
+			return config, fmt.Errorf("the CPUs of powered on vm %s can't "+
+				"be reduced from %d to %d", vmMo.Name, hw.NumCPU,
+				flavor.NumCPUs)
+		}
+		if vmMo.Config.CpuHotAddEnabled == nil || !*vmMo.Config.CpuHotAddEnabled {
+			return config, fmt.Errorf("CPU hot add isn't enabled on "+
+				"powered on vm %s", vmMo.Name)
+		}
+	}
+	if flavor.MemoryMB != 0 && flavor.MemoryMB != int64(hw.MemoryMB) {
+		if flavor.MemoryMB < int64(hw.MemoryMB) {
+			return config, fmt.Errorf("the memory of powered on vm %s "+
+				"can't be reduced from %d MB to %d MB", vmMo.Name,
+				hw.MemoryMB, flavor.MemoryMB)
+		}
+		if vmMo.Config.MemoryHotAddEnabled == nil || !*vmMo.Config.MemoryHotAddEnabled {
+			return config, fmt.Errorf("memory hot add isn't enabled on "+
+				"powered on vm %s", vmMo.Name)
+		}
+	}
+	return config, nil
+}
+
 // answerQuestion checks to see if there are currently pending questions on the
 // VM which prevent further actions. If so, it automatically responds to the
-// question based on the the vm.QuestionResponses map. If there is a problem
+// question based on the the vm.QuestionResponses map, or with
+// vm.DefaultQuestionResponse if none matches. If there is a problem
 // responding to the question, the error is returned. If there are no pending
-// questions or it does not map to any predefined response, nil is returned.
+// questions, nil is returned. A question without a response returns
+// ErrorUnansweredQuestion if vm.FailOnUnansweredQuestion is set and nil
+// otherwise.
 func (vm *VM) answerQuestion(vmMo *mo.VirtualMachine) error {
 	q := vmMo.Runtime.Question
 	if q == nil {
 		return nil
 	}
 
+	answer := ""
 	for qre, ans := range vm.QuestionResponses {
 		if match, err := regexp.MatchString(qre, q.Text); err != nil {
 			return fmt.Errorf("error while parsing automated responses: %v", err)
 		} else if match {
-			ans, validOptions := resolveAnswerAndOptions(q.Choice.ChoiceInfo, ans)
-			err = answerVSphereQuestion(vm, vmMo, q.Id, ans)
-			if err != nil {
-				return fmt.Errorf("error with answer %q to question %q: %v. Valid answers: %v", ans, q.Text, err, validOptions)
-			}
+			answer = ans
+			break
 		}
 	}
-
+	if answer == "" {
+		answer = vm.DefaultQuestionResponse
+	}
+	ans, validOptions := resolveAnswerAndOptions(q.Choice.ChoiceInfo, answer)
+	if answer == "" {
+		if vm.FailOnUnansweredQuestion {
+			return NewErrorUnansweredQuestion(vm.Name, q.Text, validOptions)
+		}
+		return nil
+	}
+	err := answerVSphereQuestion(vm, vmMo, q.Id, ans)
+	if err != nil {
+		return fmt.Errorf("error with answer %q to question %q: %v. Valid answers: %v", ans, q.Text, err, validOptions)
+	}
 	return nil
 }
 
@@ -1771,13 +5006,14 @@ func (vm *VM) answerQuestion(vmMo *mo.VirtualMachine) error {
 // intended answer (index string or summary text) and returns the matching
 // answer index as a string along with a human readable representation of the
 // valid options. If the given answer does not match any of the choices summary
-// text, the given answer is returned.
+// text or label, the given answer is returned.
 func resolveAnswerAndOptions(choiceInfo []types.BaseElementDescription, answer string) (resolvedAnswer, validOptions string) {
 	resolvedAnswer = answer
 	for _, e := range choiceInfo {
 		ed := e.(*types.ElementDescription)
 		validOptions = fmt.Sprintf("%s(%s) %s ", validOptions, ed.Key, ed.Description.Summary)
-		if strings.EqualFold(ed.Description.Summary, answer) {
+		if strings.EqualFold(ed.Description.Summary, answer) ||
+			strings.EqualFold(ed.Description.Label, answer) {
 			resolvedAnswer = ed.Key
 		}
 	}
@@ -1842,7 +5078,52 @@ func init() {
 	}
 }
 
-// createCustomSpecStaticIp: creates custom spec for static ip from xml
+// staticIPSpecXML is the part of XML_STATIC_IP_SPEC read by staticIPCustomSpec
+type staticIPSpecXML struct {
+	Spec struct {
+		DNSServerList []string `xml:"globalIPSettings>dnsServerList>e"`
+		DNSSuffixList []string `xml:"globalIPSettings>dnsSuffixList>e"`
+		Domain        string   `xml:"identity>domain"`
+		NicSettingMap []struct {
+			Gateway    []string `xml:"adapter>gateway>e"`
+			IPAddress  string   `xml:"adapter>ip>ipAddress"`
+			SubnetMask string   `xml:"adapter>subnetMask"`
+		} `xml:"nicSettingMap>e"`
+	} `xml:"spec"`
+}
+
+// staticIPCustomSpec: returns the spec of XML_STATIC_IP_SPEC built in memory,
+// for clones that don't go through the CustomizationSpecManager
+func staticIPCustomSpec() (*types.CustomizationSpec, error) {
+	var specXML staticIPSpecXML
+	if err := xml.Unmarshal([]byte(XML_STATIC_IP_SPEC), &specXML); err != nil {
+		return nil, fmt.Errorf("error parsing the static ip spec: %v", err)
+	}
+	customSpec := &types.CustomizationSpec{
+		Options: &types.CustomizationLinuxOptions{},
+		Identity: &types.CustomizationLinuxPrep{
+			HostName: &types.CustomizationVirtualMachineName{},
+			Domain:   specXML.Spec.Domain,
+		},
+		GlobalIPSettings: types.CustomizationGlobalIPSettings{
+			DnsServerList: specXML.Spec.DNSServerList,
+			DnsSuffixList: specXML.Spec.DNSSuffixList,
+		},
+	}
+	for _, nic := range specXML.Spec.NicSettingMap {
+		customSpec.NicSettingMap = append(customSpec.NicSettingMap,
+			types.CustomizationAdapterMapping{
+				Adapter: types.CustomizationIPSettings{
+					Ip:         &types.CustomizationFixedIp{IpAddress: nic.IPAddress},
+					SubnetMask: nic.SubnetMask,
+					Gateway:    nic.Gateway,
+				},
+			})
+	}
+	return customSpec, nil
+}
+
+// createCustomSpecStaticIp: creates custom spec for static ip from xml
 func createCustomSpecStaticIp(vm *VM) error {
 	csMgr := object.NewCustomizationSpecManager(vm.client.Client)
 	csSpec, err := csMgr.XmlToCustomizationSpecItem(vm.ctx,
@@ -1857,24 +5138,64 @@ func createCustomSpecStaticIp(vm *VM) error {
 	return nil
 }
 
+// namedCustomSpec: returns the customization spec vm.CustomizationSpecName
+// with the network settings of the vm applied
+func namedCustomSpec(vm *VM, vmMo *mo.VirtualMachine) (*types.CustomizationSpec, error) {
+	customizationSpecManager := object.NewCustomizationSpecManager(
+		vm.client.Client)
+	customSpecItem, err := customizationSpecManager.GetCustomizationSpec(
+		vm.ctx, vm.CustomizationSpecName)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving custom spec %s: %v",
+			vm.CustomizationSpecName, err)
+	}
+	customSpec := &customSpecItem.Spec
+	if updated := updateCustomSpec(vm, vmMo, customSpec); updated != nil {
+		return updated, nil
+	}
+	return customSpec, nil
+}
+
 // updateCustomSpec: updates custom spec structure with the ip settings
 func updateCustomSpec(vm *VM, tempMo *mo.VirtualMachine,
 	customSpec *types.CustomizationSpec) *types.CustomizationSpec {
-	// if ip or subnet is not passed return nil
-	if vm.NetworkSetting.Ip == "" || vm.NetworkSetting.SubnetMask == "" {
+	if len(vm.NetworkSettings) > 0 {
+		return updateCustomSpecNics(vm, tempMo, customSpec)
+	}
+	hasIPv4 := vm.NetworkSetting.Ip != "" && vm.NetworkSetting.SubnetMask != ""
+	ipv6 := ipv6Spec(vm.NetworkSetting)
+	// if neither ipv4 nor ipv6 settings are passed return nil
+	if !hasIPv4 && ipv6 == nil {
 		return nil
 	}
-	// set ip address, subnet mask, default gateway
-	nicSetting := customSpec.NicSettingMap[0]
-	ip := nicSetting.Adapter.Ip
-	ipValue := reflect.ValueOf(ip).Elem()
-	ipAddress := ipValue.FieldByName("IpAddress")
-	if ipAddress.CanSet() || ipAddress.IsValid() {
-		ipAddress.SetString(vm.NetworkSetting.Ip)
+	if len(customSpec.NicSettingMap) == 0 {
+		customSpec.NicSettingMap = []types.CustomizationAdapterMapping{{
+			Adapter: types.CustomizationIPSettings{
+				Ip: &types.CustomizationFixedIp{},
+			},
+		}}
+	}
+	nicSetting := &customSpec.NicSettingMap[0]
+	if hasIPv4 {
+		// set ip address, subnet mask, default gateway
+		ip := nicSetting.Adapter.Ip
+		ipValue := reflect.ValueOf(ip).Elem()
+		ipAddress := ipValue.FieldByName("IpAddress")
+		if ipAddress.CanSet() || ipAddress.IsValid() {
+			ipAddress.SetString(vm.NetworkSetting.Ip)
+		}
+		nicSetting.Adapter.SubnetMask = vm.NetworkSetting.SubnetMask
+		nicSetting.Adapter.Gateway = nil
+		if vm.NetworkSetting.Gateway != "" {
+			nicSetting.Adapter.Gateway = []string{vm.NetworkSetting.Gateway}
+		}
+	} else {
+		// ipv6 only, ipv4 is left to DHCP
+		nicSetting.Adapter.Ip = &types.CustomizationDhcpIpGenerator{}
+		nicSetting.Adapter.SubnetMask = ""
+		nicSetting.Adapter.Gateway = nil
 	}
-	nicSetting.Adapter.SubnetMask = vm.NetworkSetting.SubnetMask
-	gateway := vm.NetworkSetting.Gateway
-	nicSetting.Adapter.Gateway = append(nicSetting.Adapter.Gateway, gateway)
+	nicSetting.Adapter.IpV6Spec = ipv6
 
 	// set dns server
 	if vm.NetworkSetting.DnsServer != "" {
@@ -1891,6 +5212,593 @@ func updateCustomSpec(vm *VM, tempMo *mo.VirtualMachine,
 	return customSpec
 }
 
+// updateCustomSpecNics: updates custom spec structure with one adapter mapping
+// per nic from vm.NetworkSettings, in the order of the nics. The nics without
+// ip settings use DHCP. Returns nil if no nic has a static ip.
+func updateCustomSpecNics(vm *VM, tempMo *mo.VirtualMachine,
+	customSpec *types.CustomizationSpec) *types.CustomizationSpec {
+	nics := len(vm.Networks)
+	if len(vm.NetworkSettings) > nics {
+		nics = len(vm.NetworkSettings)
+	}
+	var (
+		staticIP       bool
+		dnsServers     []string
+		defaultGateway bool
+	)
+	for _, setting := range vm.NetworkSettings {
+		defaultGateway = defaultGateway || setting.IsDefaultGateway
+	}
+	nicSettings := make([]types.CustomizationAdapterMapping, nics)
+	for i := range nicSettings {
+		adapter := types.CustomizationIPSettings{
+			Ip: &types.CustomizationDhcpIpGenerator{},
+		}
+		if i < len(vm.NetworkSettings) {
+			setting := vm.NetworkSettings[i]
+			if defaultGateway && !setting.IsDefaultGateway {
+				// Only the default gateway NIC routes
+				setting.Gateway = ""
+				setting.IPv6Gateway = ""
+			}
+			if setting.Ip != "" && setting.SubnetMask != "" {
+				adapter.Ip = &types.CustomizationFixedIp{
+					IpAddress: setting.Ip,
+				}
+				adapter.SubnetMask = setting.SubnetMask
+				if setting.Gateway != "" {
+					adapter.Gateway = []string{setting.Gateway}
+				}
+				staticIP = true
+			}
+			if ipv6 := ipv6Spec(setting); ipv6 != nil {
+				adapter.IpV6Spec = ipv6
+				staticIP = true
+			}
+			if setting.DnsServer != "" {
+				dnsServers = append(dnsServers, setting.DnsServer)
+			}
+		}
+		nicSettings[i] = types.CustomizationAdapterMapping{Adapter: adapter}
+	}
+	if !staticIP {
+		return nil
+	}
+	customSpec.NicSettingMap = nicSettings
+
+	// set dns servers
+	if len(dnsServers) > 0 {
+		for _, ip := range tempMo.Guest.IpStack {
+			dnsServers = append(dnsServers, ip.DnsConfig.IpAddress...)
+		}
+		customSpec.GlobalIPSettings.DnsServerList = append(
+			customSpec.GlobalIPSettings.DnsServerList, dnsServers...)
+	}
+	return customSpec
+}
+
+// ipv6Spec: returns the static ipv6 settings of a nic, nil if it has none
+func ipv6Spec(setting lvm.NetworkSetting) *types.CustomizationIPSettingsIpV6AddressSpec {
+	if setting.IPv6Address == "" || setting.IPv6PrefixLength == 0 {
+		return nil
+	}
+	spec := &types.CustomizationIPSettingsIpV6AddressSpec{
+		Ip: []types.BaseCustomizationIpV6Generator{
+			&types.CustomizationFixedIpV6{
+				IpAddress:  setting.IPv6Address,
+				SubnetMask: setting.IPv6PrefixLength,
+			},
+		},
+	}
+	if setting.IPv6Gateway != "" {
+		spec.Gateway = []string{setting.IPv6Gateway}
+	}
+	return spec
+}
+
+// validateDefaultGateway: returns an error if more than one of the settings is
+// the default gateway, or if the default gateway setting has no gateway
+func validateDefaultGateway(settings []lvm.NetworkSetting) error {
+	defaults := 0
+	for i, setting := range settings {
+		if !setting.IsDefaultGateway {
+			continue
+		}
+		defaults++
+		if setting.Gateway == "" && setting.IPv6Gateway == "" {
+			return fmt.Errorf("NetworkSettings[%d] is the default gateway "+
+				"but has no gateway", i)
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("expected one default gateway across the "+
+			"network settings, got %d", defaults)
+	}
+	return nil
+}
+
+// validateNetworkSetting: returns an error if the ipv4 or ipv6 settings are
+// given partially. An empty setting leaves the nic to DHCP.
+func validateNetworkSetting(setting lvm.NetworkSetting) error {
+	if (setting.Ip != "" || setting.SubnetMask != "" || setting.Gateway != "") &&
+		(setting.Ip == "" || setting.SubnetMask == "") {
+		return fmt.Errorf("ipv4 settings need an ip address and a subnet "+
+			"mask: %+v", setting)
+	}
+	if (setting.IPv6Address != "" || setting.IPv6PrefixLength != 0 ||
+		setting.IPv6Gateway != "") &&
+		(setting.IPv6Address == "" || setting.IPv6PrefixLength == 0) {
+		return fmt.Errorf("ipv6 settings need an ipv6 address and a prefix "+
+			"length: %+v", setting)
+	}
+	if setting.IPv6PrefixLength < 0 || setting.IPv6PrefixLength > 128 {
+		return fmt.Errorf("invalid ipv6 prefix length: %d",
+			setting.IPv6PrefixLength)
+	}
+	return nil
+}
+
+// validateSysprep: returns an error if the sysprep settings are inconsistent
+func validateSysprep(sysprep *Sysprep) error {
+	if sysprep == nil {
+		return nil
+	}
+	if sysprep.JoinDomain != "" && sysprep.JoinWorkgroup != "" {
+		return errors.New("sysprep can join either a domain or a workgroup")
+	}
+	if sysprep.JoinDomain != "" && (sysprep.DomainAdmin == "" ||
+		sysprep.DomainAdminPassword == "") {
+		return errors.New("sysprep needs the domain admin credentials to " +
+			"join a domain")
+	}
+	return nil
+}
+
+// sysprepCustomSpec: replaces the Linux identity of the custom spec with the
+// sysprep one. Without ip settings the nic is customized with DHCP.
+func sysprepCustomSpec(sysprep *Sysprep,
+	customSpec *types.CustomizationSpec) *types.CustomizationSpec {
+	if customSpec == nil {
+		customSpec = &types.CustomizationSpec{
+			NicSettingMap: []types.CustomizationAdapterMapping{{
+				Adapter: types.CustomizationIPSettings{
+					Ip: &types.CustomizationDhcpIpGenerator{},
+				},
+			}},
+		}
+	}
+	var computerName types.BaseCustomizationName = &types.CustomizationVirtualMachineName{}
+	if sysprep.ComputerName != "" {
+		computerName = &types.CustomizationFixedName{
+			Name: sysprep.ComputerName,
+		}
+	}
+	identity := &types.CustomizationSysprep{
+		GuiUnattended: types.CustomizationGuiUnattended{
+			TimeZone: sysprep.TimeZone,
+		},
+		UserData: types.CustomizationUserData{
+			FullName:     sysprep.FullName,
+			OrgName:      sysprep.OrgName,
+			ComputerName: computerName,
+			ProductId:    sysprep.ProductKey,
+		},
+		Identification: types.CustomizationIdentification{
+			JoinWorkgroup: sysprep.JoinWorkgroup,
+			JoinDomain:    sysprep.JoinDomain,
+			DomainAdmin:   sysprep.DomainAdmin,
+		},
+	}
+	if sysprep.AdminPassword != "" {
+		identity.GuiUnattended.Password = &types.CustomizationPassword{
+			Value:     sysprep.AdminPassword,
+			PlainText: true,
+		}
+	}
+	if sysprep.JoinDomain != "" {
+		identity.Identification.DomainAdminPassword = &types.CustomizationPassword{
+			Value:     sysprep.DomainAdminPassword,
+			PlainText: true,
+		}
+	}
+	customSpec.Identity = identity
+	customSpec.Options = &types.CustomizationWinOptions{
+		ChangeSID: true,
+	}
+	return customSpec
+}
+
+// validateCustomizationOS: returns ErrorCustomizationOSMismatch if the identity
+// of the spec is for Windows and the guest isn't or the other way around. An
+// unknown guest id isn't checked.
+func validateCustomizationOS(customSpec *types.CustomizationSpec, guestID string) error {
+	if guestID == "" || guestID == string(types.VirtualMachineGuestOsIdentifierOtherGuest) ||
+		guestID == string(types.VirtualMachineGuestOsIdentifierOtherGuest64) {
+		return nil
+	}
+	windowsGuest := strings.HasPrefix(guestID, "win")
+	switch customSpec.Identity.(type) {
+	case *types.CustomizationLinuxPrep:
+		if windowsGuest {
+			return NewErrorCustomizationOSMismatch("LinuxPrep", guestID)
+		}
+	case *types.CustomizationSysprep, *types.CustomizationSysprepText:
+		if !windowsGuest {
+			return NewErrorCustomizationOSMismatch("Sysprep", guestID)
+		}
+	}
+	return nil
+}
+
+// addClusterRule: adds an affinity or anti affinity rule for the vms to the
+// cluster
+func addClusterRule(vm *VM, cluster string, vmNames []string, ruleName string,
+	antiAffinity bool) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
+		return err
+	}
+	crMo, err := findClusterComputeResource(vm, dcMo, cluster)
+	if err != nil {
+		return err
+	}
+	var vmRefs []types.ManagedObjectReference
+	for _, name := range vmNames {
+		vmMo, err := findVM(vm, getVMSearchFilter(name))
+		if err != nil {
+			return err
+		}
+		vmRefs = append(vmRefs, vmMo.Reference())
+	}
+	spec, err := clusterRuleSpec(crMo, ruleName, vmRefs, antiAffinity)
+	if err != nil {
+		return err
+	}
+	return reconfigureCluster(vm, crMo, spec)
+}
+
+// reconfigureCluster: applies the spec to the cluster and waits for the task
+var reconfigureCluster = func(vm *VM, crMo *mo.ClusterComputeResource,
+	spec *types.ClusterConfigSpecEx) error {
+	crObj := object.NewClusterComputeResource(vm.client.Client, crMo.Reference())
+	task, err := crObj.Reconfigure(vm.ctx, spec, true)
+	if err != nil {
+		return fmt.Errorf("error creating a reconfigure task on cluster "+
+			"%s: %v", crMo.Name, err)
+	}
+	tInfo, err := task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for the cluster reconfigure "+
+			"task: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("cluster reconfigure task returned an error: %s",
+			tInfo.Error.LocalizedMessage)
+	}
+	return nil
+}
+
+// findClusterConfig: returns the cluster and its extended configuration,
+// which holds the DRS groups. Expects the session to be set up.
+var findClusterConfig = func(vm *VM, cluster string) (
+	*mo.ClusterComputeResource, *types.ClusterConfigInfoEx, error) {
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
+		return nil, nil, err
+	}
+	crMo, err := findClusterComputeResource(vm, dcMo, cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+	ps := []string{"configurationEx"}
+	if err = vm.collector.RetrieveOne(vm.ctx, crMo.Reference(), ps, crMo); err != nil {
+		return nil, nil, NewErrorPropertyRetrieval(crMo.Reference(), ps, err)
+	}
+	config, ok := crMo.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected configuration %T on cluster %s",
+			crMo.ConfigurationEx, cluster)
+	}
+	return crMo, config, nil
+}
+
+// addClusterGroup: adds the host or vm group to the cluster
+func addClusterGroup(vm *VM, cluster string, group types.BaseClusterGroupInfo,
+	members []string) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	crMo, config, err := findClusterConfig(vm, cluster)
+	if err != nil {
+		return err
+	}
+	switch g := group.(type) {
+	case *types.ClusterHostGroup:
+		for _, name := range members {
+			hsMo, err := findHostSystem(vm, crMo.Host, name)
+			if err != nil {
+				return err
+			}
+			g.Host = append(g.Host, hsMo.Reference())
+		}
+	case *types.ClusterVmGroup:
+		for _, name := range members {
+			vmMo, err := findVM(vm, getVMSearchFilter(name))
+			if err != nil {
+				return err
+			}
+			g.Vm = append(g.Vm, vmMo.Reference())
+		}
+	}
+	spec, err := clusterGroupSpec(config, crMo.Name, group)
+	if err != nil {
+		return err
+	}
+	return reconfigureCluster(vm, crMo, spec)
+}
+
+// clusterGroupSpec: returns the spec adding the group to the cluster. Returns
+// an error if the group has no name or members, or if a group of that name
+// exists.
+func clusterGroupSpec(config *types.ClusterConfigInfoEx, cluster string,
+	group types.BaseClusterGroupInfo) (*types.ClusterConfigSpecEx, error) {
+	name := group.GetClusterGroupInfo().Name
+	if name == "" {
+		return nil, errors.New("the group needs a name")
+	}
+	var members int
+	switch g := group.(type) {
+	case *types.ClusterHostGroup:
+		members = len(g.Host)
+	case *types.ClusterVmGroup:
+		members = len(g.Vm)
+	}
+	if members == 0 {
+		return nil, fmt.Errorf("group %s needs at least 1 member", name)
+	}
+	if findClusterGroup(config, name) != nil {
+		return nil, fmt.Errorf("group %s already exists on cluster %s",
+			name, cluster)
+	}
+	return &types.ClusterConfigSpecEx{
+		GroupSpec: []types.ClusterGroupSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationAdd,
+			},
+			Info: group,
+		}},
+	}, nil
+}
+
+// findClusterGroup: returns the group of that name on the cluster, nil if
+// there is none
+func findClusterGroup(config *types.ClusterConfigInfoEx,
+	name string) types.BaseClusterGroupInfo {
+	for _, group := range config.Group {
+		if group.GetClusterGroupInfo().Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// findClusterRule: returns the rule of that name on the cluster, nil if there
+// is none
+func findClusterRule(config *types.ClusterConfigInfoEx,
+	name string) types.BaseClusterRuleInfo {
+	for _, rule := range config.Rule {
+		if rule.GetClusterRuleInfo().Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// vmHostRuleSpec: returns the spec adding the rule binding the vm group to the
+// host group. A mandatory rule makes the vms run on the hosts of the group,
+// otherwise DRS keeps them there when it can. Returns an error if DRS is
+// disabled, if a group is missing or of the wrong kind, or if a rule of that
+// name exists.
+func vmHostRuleSpec(config *types.ClusterConfigInfoEx, cluster string,
+	ruleName string, vmGroup string, hostGroup string, mandatory bool) (
+	*types.ClusterConfigSpecEx, error) {
+	drsEnabled := config.DrsConfig.Enabled
+	if drsEnabled == nil || !*drsEnabled {
+		return nil, fmt.Errorf("DRS is disabled on cluster %s", cluster)
+	}
+	if ruleName == "" {
+		return nil, errors.New("the rule needs a name")
+	}
+	if _, ok := findClusterGroup(config, vmGroup).(*types.ClusterVmGroup); !ok {
+		return nil, fmt.Errorf("vm group %s not found on cluster %s",
+			vmGroup, cluster)
+	}
+	if _, ok := findClusterGroup(config, hostGroup).(*types.ClusterHostGroup); !ok {
+		return nil, fmt.Errorf("host group %s not found on cluster %s",
+			hostGroup, cluster)
+	}
+	if findClusterRule(config, ruleName) != nil {
+		return nil, fmt.Errorf("rule %s already exists on cluster %s",
+			ruleName, cluster)
+	}
+
+	enabled := true
+	return &types.ClusterConfigSpecEx{
+		RulesSpec: []types.ClusterRuleSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationAdd,
+			},
+			Info: &types.ClusterVmHostRuleInfo{
+				ClusterRuleInfo: types.ClusterRuleInfo{
+					Name:      ruleName,
+					Enabled:   &enabled,
+					Mandatory: &mandatory,
+				},
+				VmGroupName:         vmGroup,
+				AffineHostGroupName: hostGroup,
+			},
+		}},
+	}, nil
+}
+
+// clusterGroups: returns the host and vm groups of the cluster config
+func clusterGroups(config *types.ClusterConfigInfoEx) []ClusterGroup {
+	groups := []ClusterGroup{}
+	for _, group := range config.Group {
+		var (
+			kind string
+			refs []types.ManagedObjectReference
+		)
+		switch g := group.(type) {
+		case *types.ClusterHostGroup:
+			kind, refs = "host", g.Host
+		case *types.ClusterVmGroup:
+			kind, refs = "vm", g.Vm
+		default:
+			continue
+		}
+		members := []string{}
+		for _, ref := range refs {
+			members = append(members, ref.Value)
+		}
+		groups = append(groups, ClusterGroup{
+			Name:    group.GetClusterGroupInfo().Name,
+			Type:    kind,
+			Members: members,
+		})
+	}
+	return groups
+}
+
+// clusterRules: returns the affinity, anti affinity and vm host rules of the
+// cluster config
+func clusterRules(config *types.ClusterConfigInfoEx) []ClusterRule {
+	rules := []ClusterRule{}
+	for _, rule := range config.Rule {
+		info := rule.GetClusterRuleInfo()
+		r := ClusterRule{
+			Name:      info.Name,
+			Enabled:   info.Enabled != nil && *info.Enabled,
+			Mandatory: info.Mandatory != nil && *info.Mandatory,
+		}
+		switch ru := rule.(type) {
+		case *types.ClusterAffinityRuleSpec:
+			r.Type = "affinity"
+		case *types.ClusterAntiAffinityRuleSpec:
+			r.Type = "anti_affinity"
+		case *types.ClusterVmHostRuleInfo:
+			r.Type = "vm_host"
+			r.VMGroup = ru.VmGroupName
+			r.HostGroup = ru.AffineHostGroupName
+			r.AntiHostGroup = ru.AntiAffineHostGroupName
+		default:
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// removeClusterGroupSpec: returns the spec removing the group of that name.
+// Returns an error if there is no such group, or if a rule still uses it.
+func removeClusterGroupSpec(config *types.ClusterConfigInfoEx, cluster string,
+	name string) (*types.ClusterConfigSpecEx, error) {
+	if findClusterGroup(config, name) == nil {
+		return nil, fmt.Errorf("group %s not found on cluster %s", name,
+			cluster)
+	}
+	for _, rule := range config.Rule {
+		vmHost, ok := rule.(*types.ClusterVmHostRuleInfo)
+		if !ok {
+			continue
+		}
+		if vmHost.VmGroupName == name || vmHost.AffineHostGroupName == name ||
+			vmHost.AntiAffineHostGroupName == name {
+			return nil, fmt.Errorf("group %s is used by rule %s", name,
+				vmHost.Name)
+		}
+	}
+	return &types.ClusterConfigSpecEx{
+		GroupSpec: []types.ClusterGroupSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationRemove,
+				RemoveKey: name,
+			},
+		}},
+	}, nil
+}
+
+// removeClusterRuleSpec: returns the spec removing the rule of that name
+func removeClusterRuleSpec(config *types.ClusterConfigInfoEx, cluster string,
+	name string) (*types.ClusterConfigSpecEx, error) {
+	rule := findClusterRule(config, name)
+	if rule == nil {
+		return nil, fmt.Errorf("rule %s not found on cluster %s", name,
+			cluster)
+	}
+	return &types.ClusterConfigSpecEx{
+		RulesSpec: []types.ClusterRuleSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationRemove,
+				RemoveKey: rule.GetClusterRuleInfo().Key,
+			},
+		}},
+	}, nil
+}
+
+// clusterRuleSpec: returns the spec adding the rule for the vms to the
+// cluster. Returns an error if DRS is disabled on the cluster, since the rule
+// wouldn't be enforced, or if a rule of that name exists.
+func clusterRuleSpec(crMo *mo.ClusterComputeResource, ruleName string,
+	vmRefs []types.ManagedObjectReference, antiAffinity bool) (
+	*types.ClusterConfigSpecEx, error) {
+	drsEnabled := crMo.Configuration.DrsConfig.Enabled
+	if drsEnabled == nil || !*drsEnabled {
+		return nil, fmt.Errorf("DRS is disabled on cluster %s", crMo.Name)
+	}
+	if ruleName == "" {
+		return nil, errors.New("the rule needs a name")
+	}
+	if len(vmRefs) < 2 {
+		return nil, fmt.Errorf("rule %s needs at least 2 vms, got %d",
+			ruleName, len(vmRefs))
+	}
+	for _, rule := range crMo.Configuration.Rule {
+		if rule.GetClusterRuleInfo().Name == ruleName {
+			return nil, fmt.Errorf("rule %s already exists on cluster %s",
+				ruleName, crMo.Name)
+		}
+	}
+
+	enabled := true
+	info := types.ClusterRuleInfo{Name: ruleName, Enabled: &enabled}
+	var rule types.BaseClusterRuleInfo = &types.ClusterAffinityRuleSpec{
+		ClusterRuleInfo: info,
+		Vm:              vmRefs,
+	}
+	if antiAffinity {
+		rule = &types.ClusterAntiAffinityRuleSpec{
+			ClusterRuleInfo: info,
+			Vm:              vmRefs,
+		}
+	}
+	return &types.ClusterConfigSpecEx{
+		RulesSpec: []types.ClusterRuleSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{
+				Operation: types.ArrayUpdateOperationAdd,
+			},
+			Info: rule,
+		}},
+	}, nil
+}
+
 // IsClusterDrsEnabled: returns true if the cluster is drs enabled
 func IsClusterDrsEnabled(vm *VM) (bool, error) {
 	dcMo, err := GetDatacenter(vm)
@@ -2048,6 +5956,72 @@ func getVirtualMachines(vm *VM, allDCs bool) ([]VmProperties, error) {
 	return vmsInCluster, nil
 }
 
+// getVMProperties: returns the properties of the vms, leaving out the ones
+// deleted meanwhile
+func getVMProperties(vm *VM, refs []types.ManagedObjectReference) (
+	[]VmProperties, error) {
+	var vmMos []mo.VirtualMachine
+	err := retrieveChildren(vm, refs, []string{"name", "guest", "config",
+		"runtime", "summary", "resourcePool"}, &vmMos)
+	if err != nil {
+		return nil, err
+	}
+	vmProps := make([]VmProperties, 0, len(vmMos))
+	for _, vmMo := range vmMos {
+		vmProps = append(vmProps, VmProperties{
+			Name:       vmMo.Name,
+			Properties: vmMo})
+	}
+	return vmProps, nil
+}
+
+// filterByCustomField: returns the vms whose custom field has the value. The
+// custom values of the vms are retrieved in one call.
+func filterByCustomField(vm *VM, vmProps []VmProperties, field string,
+	value string) ([]VmProperties, error) {
+	refs := make([]types.ManagedObjectReference, 0, len(vmProps))
+	for _, vmProp := range vmProps {
+		refs = append(refs, vmProp.Properties.Reference())
+	}
+	var vmMos []mo.VirtualMachine
+	err := retrieveChildren(vm, refs, []string{"customValue",
+		"availableField"}, &vmMos)
+	if err != nil {
+		return nil, err
+	}
+	matching := make(map[types.ManagedObjectReference]bool)
+	for _, vmMo := range vmMos {
+		if hasCustomFieldValue(vmMo, field, value) {
+			matching[vmMo.Reference()] = true
+		}
+	}
+	filtered := make([]VmProperties, 0)
+	for _, vmProp := range vmProps {
+		if matching[vmProp.Properties.Reference()] {
+			filtered = append(filtered, vmProp)
+		}
+	}
+	return filtered, nil
+}
+
+// hasCustomFieldValue: returns true if the custom field of the vm has the
+// value. The key of the field is resolved from the available fields of the vm.
+func hasCustomFieldValue(vmMo mo.VirtualMachine, field string,
+	value string) bool {
+	for _, def := range vmMo.AvailableField {
+		if def.Name != field {
+			continue
+		}
+		for _, v := range vmMo.CustomValue {
+			sv, ok := v.(*types.CustomFieldStringValue)
+			if ok && sv.Key == def.Key && sv.Value == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // getDcVMList : returns list of VirtualMachine objects in a Datacenter
 func getDcVMList(vm *VM, datacenter *object.Datacenter) (
 	[]VmProperties, error) {
@@ -2063,7 +6037,8 @@ func getDcVMList(vm *VM, datacenter *object.Datacenter) (
 }
 
 // getVmsInFolder: returns list of VmProperties which has full path and
-// mo.Virtualmachine struct of vms in a vcenter vm folder
+// mo.Virtualmachine struct of vms in a vcenter vm folder. The properties of
+// the children of a folder are retrieved in one call per kind.
 func getVmsInFolder(vm *VM, folder *object.Folder, path string) (
 	[]VmProperties, error) {
 	allVms := make([]VmProperties, 0)
@@ -2072,29 +6047,56 @@ func getVmsInFolder(vm *VM, folder *object.Folder, path string) (
 	if err != nil {
 		return nil, err
 	}
+	var folderRefs, vmRefs []types.ManagedObjectReference
 	for _, entity := range children {
 		mor := entity.Reference()
 		switch mor.Type {
-		// if child is a folder, look for vms in the folder recursively
-		// and add to the hash
 		case "Folder":
-			// Fetch the childEntity property of the folder
-			folderMo := mo.Folder{}
-			err := vm.collector.RetrieveOne(vm.ctx, mor, []string{
-				"name"}, &folderMo)
-			if err != nil {
-				if isObjectDeleted(err) {
-					continue
-				}
-				return nil, err
-			}
-			// unescaping to convert any escaped character
-			folderName, err := url.QueryUnescape(folderMo.Name)
-			if err != nil {
-				return nil, err
-			}
-			// Adding delimitter in case "/" is present in name
-			folderName = strings.Replace(folderName, "/", "\\/",
+			folderRefs = append(folderRefs, mor)
+		case "VirtualMachine":
+			vmRefs = append(vmRefs, mor)
+		}
+	}
+	var (
+		folderMos []mo.Folder
+		vmMos     []mo.VirtualMachine
+	)
+	err = retrieveChildren(vm, folderRefs, []string{"name"}, &folderMos)
+	if err != nil {
+		return nil, err
+	}
+	err = retrieveChildren(vm, vmRefs, []string{"name", "guest", "config",
+		"runtime", "summary", "resourcePool"}, &vmMos)
+	if err != nil {
+		return nil, err
+	}
+	foldersByRef := make(map[types.ManagedObjectReference]mo.Folder)
+	for _, folderMo := range folderMos {
+		foldersByRef[folderMo.Reference()] = folderMo
+	}
+	vmsByRef := make(map[types.ManagedObjectReference]mo.VirtualMachine)
+	for _, vmMo := range vmMos {
+		vmsByRef[vmMo.Reference()] = vmMo
+	}
+
+	// walking the children in order, skipping the ones deleted meanwhile
+	for _, entity := range children {
+		mor := entity.Reference()
+		switch mor.Type {
+		// if child is a folder, look for vms in the folder recursively
+		// and add to the hash
+		case "Folder":
+			folderMo, ok := foldersByRef[mor]
+			if !ok {
+				continue
+			}
+			// unescaping to convert any escaped character
+			folderName, err := url.QueryUnescape(folderMo.Name)
+			if err != nil {
+				return nil, err
+			}
+			// Adding delimitter in case "/" is present in name
+			folderName = strings.Replace(folderName, "/", "\\/",
 				-1)
 			folder := object.NewFolder(vm.client.Client,
 				mor)
@@ -2109,15 +6111,9 @@ func getVmsInFolder(vm *VM, folder *object.Folder, path string) (
 		case "VirtualMachine":
 			// if child is vm/template, return the full path and
 			// mo of the vm
-			vmMo := mo.VirtualMachine{}
-			err := vm.collector.RetrieveOne(vm.ctx, mor, []string{
-				"name", "guest", "config", "runtime",
-				"summary", "resourcePool"}, &vmMo)
-			if err != nil {
-				if isObjectDeleted(err) {
-					continue
-				}
-				return nil, err
+			vmMo, ok := vmsByRef[mor]
+			if !ok {
+				continue
 			}
 			// unescaping to convert any escaped character
 			vmName, err := url.QueryUnescape(vmMo.Name)
@@ -2132,94 +6128,907 @@ func getVmsInFolder(vm *VM, folder *object.Folder, path string) (
 				Properties: vmMo})
 		}
 	}
-	return allVms, nil
+	return allVms, nil
+}
+
+// retrieveChildren: retrieves the properties of the objects in one call into
+// dst, a pointer to a slice of managed objects. If one of the objects was
+// deleted meanwhile, the objects are retrieved one by one and the deleted
+// ones are left out.
+func retrieveChildren(vm *VM, refs []types.ManagedObjectReference,
+	props []string, dst interface{}) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	err := vm.collector.Retrieve(vm.ctx, refs, props, dst)
+	if err == nil || !soap.IsSoapFault(err) || !isObjectDeleted(err) {
+		return err
+	}
+	mos := reflect.ValueOf(dst).Elem()
+	mos.Set(reflect.MakeSlice(mos.Type(), 0, len(refs)))
+	for _, ref := range refs {
+		objMo := reflect.New(mos.Type().Elem())
+		err := vm.collector.RetrieveOne(vm.ctx, ref, props,
+			objMo.Interface())
+		if err != nil {
+			if soap.IsSoapFault(err) && isObjectDeleted(err) {
+				continue
+			}
+			return err
+		}
+		mos.Set(reflect.Append(mos, objMo.Elem()))
+	}
+	return nil
+}
+
+// getDatastoreInHost: lists datastores in a host in a cluster
+func getDatastoreInHost(vm *VM, crMo *mo.ClusterComputeResource) ([]types.ManagedObjectReference, error) {
+	var (
+		err  error
+		hsMo mo.HostSystem
+	)
+	for _, host := range crMo.Host {
+		err = vm.collector.RetrieveOne(vm.ctx, host, []string{"name", "datastore"}, &hsMo)
+		if err != nil {
+			return nil, err
+		}
+		if hsMo.Name == vm.Destination.HostSystem {
+			return hsMo.Datastore, nil
+		}
+	}
+	return nil, fmt.Errorf("Host: %s not found in cluster: %s", vm.Destination.HostSystem, crMo.Name)
+}
+
+// getSharedDatastoreInCluster: get the datastores shared accross all the
+// hosts in cluster
+func getSharedDatastoreInCluster(vm *VM, crMo *mo.ClusterComputeResource) (
+	[]types.ManagedObjectReference, error) {
+	var (
+		hsMos  []mo.HostSystem
+		dsMors []types.ManagedObjectReference
+		err    error
+	)
+
+	dsList := make(map[types.ManagedObjectReference]int)
+	if len(crMo.Host) == 0 {
+		return dsMors, nil
+	}
+	err = vm.collector.Retrieve(vm.ctx, crMo.Host, []string{
+		"name", "datastore"}, &hsMos)
+	if err != nil {
+		return nil, err
+	}
+	for _, hsMo := range hsMos {
+		for _, ds := range hsMo.Datastore {
+			_, ok := dsList[ds]
+			if ok {
+				dsList[ds]++
+			} else {
+				dsList[ds] = 1
+			}
+		}
+	}
+
+	nHosts := len(hsMos)
+	for key, value := range dsList {
+		if value == nHosts {
+			dsMors = append(dsMors, key)
+		}
+	}
+	return dsMors, nil
+}
+
+// isTaskInProgress: returns true if any of the recent tasks on the vm is
+// queued or running
+func isTaskInProgress(vm *VM, vmMo *mo.VirtualMachine) bool {
+	var (
+		taskMo mo.Task
+		err    error
+	)
+	for _, task := range vmMo.RecentTask {
+		err = vm.collector.RetrieveOne(vm.ctx, task, []string{
+			"info"}, &taskMo)
+		if err != nil {
+			continue
+		}
+		switch taskMo.Info.State {
+		// available states queued, running, success, error
+		case types.TaskInfoStateQueued, types.TaskInfoStateRunning:
+			return true
+		}
+	}
+	return false
+}
+
+// activeTasks: returns the tasks which are queued or running. Tasks whose
+// info can't be retrieved are left out.
+func activeTasks(vm *VM, tasks []types.ManagedObjectReference) []types.ManagedObjectReference {
+	var active []types.ManagedObjectReference
+	for _, task := range tasks {
+		taskMo := mo.Task{}
+		err := vm.collector.RetrieveOne(vm.ctx, task, []string{"info"}, &taskMo)
+		if err != nil {
+			continue
+		}
+		switch taskMo.Info.State {
+		case types.TaskInfoStateQueued, types.TaskInfoStateRunning:
+			active = append(active, task)
+		}
+	}
+	return active
+}
+
+// waitForTask: waits for the task to finish and returns its error
+var waitForTask = func(ctx context.Context, vm *VM, task types.ManagedObjectReference) error {
+	return object.NewTask(vm.client.Client, task).Wait(ctx)
+}
+
+// waitForTasksToFinish: waits up to timeout for the tasks to finish. Returns
+// ErrorTasksInProgress if they are still active after the timeout.
+func waitForTasksToFinish(vm *VM, tasks []types.ManagedObjectReference,
+	timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(vm.ctx, timeout)
+	defer cancel()
+	for _, task := range tasks {
+		tObj := object.NewTask(vm.client.Client, task)
+		// Failed tasks are finished as well, so their error is ignored
+		tObj.Wait(ctx)
+		if ctx.Err() == context.DeadlineExceeded {
+			return NewErrorTasksInProgress(vm.Name)
+		}
+		if err := vm.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForActiveTasks: waits for the active tasks on the vm to finish before
+// starting an operation which would collide with them
+var waitForActiveTasks = func(vm *VM, vmMo *mo.VirtualMachine) error {
+	if !isTaskInProgress(vm, vmMo) {
+		return nil
+	}
+	return waitForTasksToFinish(vm, vmMo.RecentTask, TASK_WAIT_TIMEOUT)
+}
+
+// getNvramPath: returns the datastore path of the nvram file of the vm
+func getNvramPath(vmMo *mo.VirtualMachine) (string, error) {
+	if vmMo.Config == nil {
+		return "", NewErrorConfigNotAvailable(vmMo.Name)
+	}
+	vmxPath := object.DatastorePath{}
+	if !vmxPath.FromString(vmMo.Config.Files.VmPathName) {
+		return "", fmt.Errorf("invalid vmx path: %s",
+			vmMo.Config.Files.VmPathName)
+	}
+	dir := path.Dir(vmxPath.Path)
+	nvram := strings.TrimSuffix(path.Base(vmxPath.Path), ".vmx") + ".nvram"
+	for _, option := range vmMo.Config.ExtraConfig {
+		value := option.GetOptionValue()
+		if value.Key != "nvram" {
+			continue
+		}
+		if name, ok := value.Value.(string); ok && name != "" {
+			nvram = name
+		}
+	}
+	nvramPath := object.DatastorePath{
+		Datastore: vmxPath.Datastore,
+		Path:      path.Join(dir, nvram),
+	}
+	return nvramPath.String(), nil
+}
+
+// isFileNotFound: returns true if the task error is a FileNotFound fault
+func isFileNotFound(err error) bool {
+	taskErr, ok := err.(task.Error)
+	if !ok {
+		return false
+	}
+	_, ok = taskErr.Fault().(*types.FileNotFound)
+	return ok
+}
+
+// validateVTPMPrerequisites: returns an error if a virtual TPM can't be added
+// to vms cloned from the template. A vTPM needs EFI firmware with secure boot
+// and a key provider configured in vCenter to encrypt the vm config.
+func validateVTPMPrerequisites(vm *VM, tempMo *mo.VirtualMachine) error {
+	if tempMo.Config == nil {
+		return NewErrorVTPMPrerequisite("template config is not available")
+	}
+	if tempMo.Config.Firmware != string(types.GuestOsDescriptorFirmwareTypeEfi) {
+		return NewErrorVTPMPrerequisite("template does not use EFI firmware")
+	}
+	bootOptions := tempMo.Config.BootOptions
+	if bootOptions == nil || bootOptions.EfiSecureBootEnabled == nil ||
+		!*bootOptions.EfiSecureBootEnabled {
+		return NewErrorVTPMPrerequisite(
+			"secure boot is not enabled on the template")
+	}
+	cryptoManager := vm.client.Client.ServiceContent.CryptoManager
+	if cryptoManager == nil {
+		return NewErrorVTPMPrerequisite(
+			"vCenter does not support VM encryption")
+	}
+	req := &types.ListKmipServers{
+		This: *cryptoManager,
+	}
+	res, err := methods.ListKmipServers(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return fmt.Errorf("error listing key providers: %v", err)
+	}
+	if len(res.Returnval) == 0 {
+		return NewErrorVTPMPrerequisite(
+			"no key provider is configured in vCenter")
+	}
+	return nil
+}
+
+// vtpmDeviceSpec: returns the device spec for adding a virtual TPM
+func vtpmDeviceSpec() *types.VirtualDeviceConfigSpec {
+	return &types.VirtualDeviceConfigSpec{
+		Operation: types.VirtualDeviceConfigSpecOperationAdd,
+		Device: &VirtualTPM{
+			VirtualDevice: types.VirtualDevice{
+				Key: -1,
+			},
+		},
+	}
+}
+
+// videoCardDeviceSpec: returns the device spec editing the video card of the
+// vm with the settings given
+func videoCardDeviceSpec(vmMo *mo.VirtualMachine,
+	videoCard *VideoCard) (*types.VirtualDeviceConfigSpec, error) {
+	switch types.VirtualMachineVideoCardUse3dRenderer(videoCard.Renderer) {
+	case "", types.VirtualMachineVideoCardUse3dRendererAutomatic,
+		types.VirtualMachineVideoCardUse3dRendererSoftware,
+		types.VirtualMachineVideoCardUse3dRendererHardware:
+	default:
+		return nil, fmt.Errorf("invalid 3D renderer: %s", videoCard.Renderer)
+	}
+	var current *types.VirtualMachineVideoCard
+	for _, device := range vmMo.Config.Hardware.Device {
+		if card, ok := device.(*types.VirtualMachineVideoCard); ok {
+			current = card
+			break
+		}
+	}
+	if current == nil {
+		return nil, errors.New("the vm has no video card")
+	}
+	card := *current
+	if videoCard.MemoryKB > 0 || videoCard.NumDisplays > 0 {
+		// the settings are ignored when they are auto detected
+		card.UseAutoDetect = types.NewBool(false)
+	}
+	if videoCard.MemoryKB > 0 {
+		card.VideoRamSizeInKB = videoCard.MemoryKB
+	}
+	if videoCard.NumDisplays > 0 {
+		card.NumDisplays = videoCard.NumDisplays
+	}
+	if videoCard.Enable3D != nil {
+		card.Enable3DSupport = videoCard.Enable3D
+	}
+	if videoCard.Renderer != "" {
+		card.Use3dRenderer = videoCard.Renderer
+	}
+	return &types.VirtualDeviceConfigSpec{
+		Operation: types.VirtualDeviceConfigSpecOperationEdit,
+		Device:    &card,
+	}, nil
+}
+
+// hardwareVersionNumber: returns the number of a hardware version given as
+// "vmx-13" or "13"
+func hardwareVersionNumber(version string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "vmx-"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid hardware version: %q", version)
+	}
+	return n, nil
+}
+
+// locationComputeResource: returns the compute resource of the host of the
+// location or, when no host is set, the owner of its resource pool
+func locationComputeResource(vm *VM, l location) (types.ManagedObjectReference, error) {
+	if l.Host.Value != "" {
+		hsMo := mo.HostSystem{}
+		err := vm.collector.RetrieveOne(vm.ctx, l.Host, []string{"parent"}, &hsMo)
+		if err != nil {
+			return types.ManagedObjectReference{}, fmt.Errorf("error retrieving the host: %v", err)
+		}
+		if hsMo.Parent == nil {
+			return types.ManagedObjectReference{}, fmt.Errorf(
+				"host %s is not part of a compute resource", l.Host.Value)
+		}
+		return *hsMo.Parent, nil
+	}
+	rpMo := mo.ResourcePool{}
+	err := vm.collector.RetrieveOne(vm.ctx, l.ResourcePool, []string{"owner"}, &rpMo)
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("error retrieving the resource pool: %v", err)
+	}
+	return rpMo.Owner, nil
+}
+
+// queryConfigOptionDescriptors: returns the hardware versions known to the
+// environment browser
+var queryConfigOptionDescriptors = func(vm *VM, browser types.ManagedObjectReference) (
+	[]types.VirtualMachineConfigOptionDescriptor, error) {
+	req := &types.QueryConfigOptionDescriptor{
+		This: browser,
+	}
+	res, err := methods.QueryConfigOptionDescriptor(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the supported hardware versions: %v", err)
+	}
+	return res.Returnval, nil
+}
+
+// getMaxHardwareVersion: returns the newest hardware version with which VMs
+// can be created on the host of the location, or on the compute resource of
+// its resource pool when no host is set
+var getMaxHardwareVersion = func(vm *VM, l location) (int, error) {
+	crRef, err := locationComputeResource(vm, l)
+	if err != nil {
+		return 0, err
+	}
+	crMo := mo.ComputeResource{}
+	err = vm.collector.RetrieveOne(vm.ctx, crRef, []string{"environmentBrowser"}, &crMo)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving the compute resource %s: %v", crRef.Value, err)
+	}
+	if crMo.EnvironmentBrowser == nil {
+		return 0, fmt.Errorf("no environment browser for compute resource %s", crRef.Value)
+	}
+	descriptors, err := queryConfigOptionDescriptors(vm, *crMo.EnvironmentBrowser)
+	if err != nil {
+		return 0, err
+	}
+	max := 0
+	for _, d := range descriptors {
+		if d.CreateSupported != nil && !*d.CreateSupported {
+			continue
+		}
+		if l.Host.Value != "" && len(d.Host) > 0 && !containsMor(d.Host, l.Host) {
+			continue
+		}
+		n, err := hardwareVersionNumber(d.Key)
+		if err != nil {
+			continue
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if max == 0 {
+		return 0, fmt.Errorf("no supported hardware versions found on compute resource %s", crRef.Value)
+	}
+	return max, nil
+}
+
+// minHardwareVersion: validates vm.MinHardwareVersion against the location
+// and returns it as a number, 0 if it's not set
+func minHardwareVersion(vm *VM, l location) (int, error) {
+	if vm.MinHardwareVersion == "" {
+		return 0, nil
+	}
+	min, err := hardwareVersionNumber(vm.MinHardwareVersion)
+	if err != nil {
+		return 0, err
+	}
+	max, err := getMaxHardwareVersion(vm, l)
+	if err != nil {
+		return 0, err
+	}
+	if min > max {
+		return 0, NewErrorHardwareVersionNotSupported(vm.MinHardwareVersion,
+			fmt.Sprintf("vmx-%d", max))
+	}
+	return min, nil
+}
+
+// hardwareVersionBelow: returns true if the version is older than min. Versions
+// that can't be parsed are treated as older.
+func hardwareVersionBelow(version string, min int) bool {
+	n, err := hardwareVersionNumber(version)
+	return err != nil || n < min
+}
+
+// upgradeHardwareVersion: upgrades the VM to the given hardware version
+var upgradeHardwareVersion = func(vm *VM, vmMor types.ManagedObjectReference, version int) error {
+	req := &types.UpgradeVM_Task{
+		This:    vmMor,
+		Version: fmt.Sprintf("vmx-%d", version),
+	}
+	res, err := methods.UpgradeVM_Task(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return fmt.Errorf("error upgrading the hardware version: %v", err)
+	}
+	t := object.NewTask(vm.client.Client, res.Returnval)
+	tInfo, err := t.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for the hardware upgrade task: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("hardware upgrade task finished with error: %v", tInfo.Error)
+	}
+	return nil
+}
+
+// containsMor: returns true if the managed object reference is in mors
+func containsMor(mors []types.ManagedObjectReference, mor types.ManagedObjectReference) bool {
+	for _, m := range mors {
+		if m == mor {
+			return true
+		}
+	}
+	return false
+}
+
+// guestAuth: returns the guest authentication for the credentials
+func guestAuth(auth GuestCredentials) types.BaseGuestAuthentication {
+	return &types.NamePasswordAuthentication{
+		Username: auth.Username,
+		Password: auth.Password,
+	}
+}
+
+// getGuestOperationsManager: returns the guest operations manager with its
+// file and process managers populated
+func getGuestOperationsManager(vm *VM) (*mo.GuestOperationsManager, error) {
+	gomMor := vm.client.Client.ServiceContent.GuestOperationsManager
+	if gomMor == nil {
+		return nil, errors.New("guest operations are not supported by the server")
+	}
+	gomMo := mo.GuestOperationsManager{}
+	err := vm.collector.RetrieveOne(vm.ctx, *gomMor,
+		[]string{"fileManager", "processManager"}, &gomMo)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving the guest operations manager: %v", err)
+	}
+	if gomMo.FileManager == nil || gomMo.ProcessManager == nil {
+		return nil, errors.New("guest operations are not supported by the server")
+	}
+	return &gomMo, nil
+}
+
+// startGuestProgram: starts the program in the guest and returns its pid
+var startGuestProgram = func(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, spec types.GuestProgramSpec) (int64, error) {
+	gomMo, err := getGuestOperationsManager(vm)
+	if err != nil {
+		return 0, err
+	}
+	req := &types.StartProgramInGuest{
+		This: *gomMo.ProcessManager,
+		Vm:   vmMor,
+		Auth: guestAuth(auth),
+		Spec: &spec,
+	}
+	res, err := methods.StartProgramInGuest(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return 0, fmt.Errorf("error starting %s in the guest: %v", spec.ProgramPath, err)
+	}
+	return res.Returnval, nil
+}
+
+// waitForGuestProcess: polls the guest process until it exits and returns its
+// exit code
+var waitForGuestProcess = func(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, pid int64, timeout time.Duration) (int32, error) {
+	ctx, cancel := context.WithTimeout(vm.ctx, timeout)
+	defer cancel()
+	exitCode, err := pollGuestProcess(ctx, vm, vmMor, auth, pid)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return 0, fmt.Errorf("timed out after %v waiting for guest process %d", timeout, pid)
+	}
+	return exitCode, err
+}
+
+// pollGuestProcess: polls the guest process until it exits and returns its
+// exit code, or until ctx is done
+func pollGuestProcess(ctx context.Context, vm *VM,
+	vmMor types.ManagedObjectReference, auth GuestCredentials, pid int64) (
+	int32, error) {
+	tick := time.NewTicker(GUEST_PROCESS_POLL_PERIOD)
+	defer tick.Stop()
+	for {
+		process, err := getGuestProcess(ctx, vm, vmMor, auth, pid)
+		if err != nil && ctx.Err() == nil {
+			return 0, err
+		}
+		if err == nil && process.EndTime != nil {
+			return process.ExitCode, nil
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return 0, fmt.Errorf("stopped waiting for guest process %d: %v", pid, ctx.Err())
+		}
+	}
+}
+
+// getGuestProcess: returns the status of the guest process. The EndTime is
+// only set once it exited.
+var getGuestProcess = func(ctx context.Context, vm *VM,
+	vmMor types.ManagedObjectReference, auth GuestCredentials, pid int64) (
+	*types.GuestProcessInfo, error) {
+	gomMo, err := getGuestOperationsManager(vm)
+	if err != nil {
+		return nil, err
+	}
+	req := &types.ListProcessesInGuest{
+		This: *gomMo.ProcessManager,
+		Vm:   vmMor,
+		Auth: guestAuth(auth),
+		Pids: []int64{pid},
+	}
+	res, err := methods.ListProcessesInGuest(ctx, vm.client.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the status of guest process %d: %v", pid, err)
+	}
+	if len(res.Returnval) == 0 {
+		return nil, fmt.Errorf("guest process %d not found", pid)
+	}
+	return &res.Returnval[0], nil
+}
+
+// findGuestVM: returns the vm, or ErrorToolsNotRunning if VMware Tools aren't
+// running in its guest
+func findGuestVM(vm *VM) (*mo.VirtualMachine, error) {
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return nil, err
+	}
+	if vmMo.Guest == nil {
+		return nil, NewErrorToolsNotRunning(vm.Name, "")
+	}
+	if toolsRunning, _ := getToolsStatus(vmMo); !toolsRunning {
+		return nil, NewErrorToolsNotRunning(vm.Name,
+			vmMo.Guest.ToolsRunningStatus)
+	}
+	return vmMo, nil
+}
+
+// createGuestTempFile: creates a temporary file in the guest and returns its
+// path
+func createGuestTempFile(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, prefix string, suffix string) (string, error) {
+	gomMo, err := getGuestOperationsManager(vm)
+	if err != nil {
+		return "", err
+	}
+	req := &types.CreateTemporaryFileInGuest{
+		This:   *gomMo.FileManager,
+		Vm:     vmMor,
+		Auth:   guestAuth(auth),
+		Prefix: prefix,
+		Suffix: suffix,
+	}
+	res, err := methods.CreateTemporaryFileInGuest(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return "", fmt.Errorf("error creating a temporary file in the guest: %v", err)
+	}
+	return res.Returnval, nil
+}
+
+// deleteGuestFile: deletes the file from the guest
+func deleteGuestFile(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, guestPath string) error {
+	gomMo, err := getGuestOperationsManager(vm)
+	if err != nil {
+		return err
+	}
+	req := &types.DeleteFileInGuest{
+		This:     *gomMo.FileManager,
+		Vm:       vmMor,
+		Auth:     guestAuth(auth),
+		FilePath: guestPath,
+	}
+	_, err = methods.DeleteFileInGuest(vm.ctx, vm.client.Client, req)
+	return err
 }
 
-// getDatastoreInHost: lists datastores in a host in a cluster
-func getDatastoreInHost(vm *VM, crMo *mo.ClusterComputeResource) ([]types.ManagedObjectReference, error) {
-	var (
-		err  error
-		hsMo mo.HostSystem
-	)
-	for _, host := range crMo.Host {
-		err = vm.collector.RetrieveOne(vm.ctx, host, []string{"name", "datastore"}, &hsMo)
-		if err != nil {
-			return nil, err
-		}
-		if hsMo.Name == vm.Destination.HostSystem {
-			return hsMo.Datastore, nil
+// guestTransferClient: returns the http client for guest file transfers. Its
+// transport is created on the first transfer and shared by the next ones, so
+// that they reuse the connections to the host.
+func guestTransferClient(vm *VM) *http.Client {
+	vm.guestTransportMutex.Lock()
+	defer vm.guestTransportMutex.Unlock()
+	if vm.guestTransport == nil {
+		vm.guestTransport = &http.Transport{
+			TLSClientConfig: tlsConfig(vm),
 		}
 	}
-	return nil, fmt.Errorf("Host: %s not found in cluster: %s", vm.Destination.HostSystem, crMo.Name)
+	return &http.Client{Transport: vm.guestTransport}
 }
 
-// getSharedDatastoreInCluster: get the datastores shared accross all the
-// hosts in cluster
-func getSharedDatastoreInCluster(vm *VM, crMo *mo.ClusterComputeResource) (
-	[]types.ManagedObjectReference, error) {
-	var (
-		hsMos  []mo.HostSystem
-		dsMors []types.ManagedObjectReference
-		err    error
-	)
+// closeGuestTransport: closes the idle connections of the guest file
+// transfers of the vm and drops the transport, the next transfer creates a
+// new one
+func closeGuestTransport(vm *VM) {
+	vm.guestTransportMutex.Lock()
+	defer vm.guestTransportMutex.Unlock()
+	if vm.guestTransport != nil {
+		vm.guestTransport.CloseIdleConnections()
+		vm.guestTransport = nil
+	}
+}
 
-	dsList := make(map[types.ManagedObjectReference]int)
-	if len(crMo.Host) == 0 {
-		return dsMors, nil
+// uploadToGuest: writes the data to the file in the guest, overwriting it
+var uploadToGuest = func(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, guestPath string, data []byte) error {
+	gomMo, err := getGuestOperationsManager(vm)
+	if err != nil {
+		return err
 	}
-	err = vm.collector.Retrieve(vm.ctx, crMo.Host, []string{
-		"name", "datastore"}, &hsMos)
+	req := &types.InitiateFileTransferToGuest{
+		This:           *gomMo.FileManager,
+		Vm:             vmMor,
+		Auth:           guestAuth(auth),
+		GuestFilePath:  guestPath,
+		FileAttributes: &types.GuestFileAttributes{},
+		FileSize:       int64(len(data)),
+		Overwrite:      true,
+	}
+	res, err := methods.InitiateFileTransferToGuest(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return fmt.Errorf("error initiating the transfer to %s: %v", guestPath, err)
+	}
+	transferURL, err := substituteHost(res.Returnval, vm.Host)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("PUT", transferURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error creating the transfer request for %s: %v", guestPath, err)
+	}
+	request = request.WithContext(vm.ctx)
+	request.ContentLength = int64(len(data))
+	resp, err := clientDo(guestTransferClient(vm), request)
+	if err != nil {
+		return fmt.Errorf("error transferring %s to the guest: %v", guestPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewErrorBadResponse(resp)
+	}
+	// The connection is only reused once the body is read and closed
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// downloadFromGuest: returns the content of the file in the guest
+var downloadFromGuest = func(vm *VM, vmMor types.ManagedObjectReference,
+	auth GuestCredentials, guestPath string) ([]byte, error) {
+	gomMo, err := getGuestOperationsManager(vm)
 	if err != nil {
 		return nil, err
 	}
-	for _, hsMo := range hsMos {
-		for _, ds := range hsMo.Datastore {
-			_, ok := dsList[ds]
-			if ok {
-				dsList[ds]++
-			} else {
-				dsList[ds] = 1
-			}
+	req := &types.InitiateFileTransferFromGuest{
+		This:          *gomMo.FileManager,
+		Vm:            vmMor,
+		Auth:          guestAuth(auth),
+		GuestFilePath: guestPath,
+	}
+	res, err := methods.InitiateFileTransferFromGuest(vm.ctx, vm.client.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("error initiating the transfer of %s: %v", guestPath, err)
+	}
+	transferURL, err := substituteHost(res.Returnval.Url, vm.Host)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", transferURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the transfer request for %s: %v", guestPath, err)
+	}
+	request = request.WithContext(vm.ctx)
+	resp, err := clientDo(guestTransferClient(vm), request)
+	if err != nil {
+		return nil, fmt.Errorf("error transferring %s from the guest: %v", guestPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewErrorBadResponse(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// guestDiskPollPeriod is the delay between two checks of the disks seen by
+// the guest.
+var guestDiskPollPeriod = GUEST_DISK_POLL_PERIOD
+
+// verifyGuestDisks: waits until the guest of the vm sees as many disks as the
+// vm has, or returns ErrorGuestDisksMissing after vm.GuestDiskTimeout
+var verifyGuestDisks = func(vm *VM, vmMo *mo.VirtualMachine) error {
+	if vmMo.Config == nil {
+		return NewErrorConfigNotAvailable(vm.Name)
+	}
+	devices := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
+	disks := len(devices.SelectByType((*types.VirtualDisk)(nil)))
+	spec := guestDiskCheck(vmMo, disks)
+	auth := GuestCredentials{
+		Username: vm.Credentials.SSHUser,
+		Password: vm.Credentials.SSHPassword,
+	}
+	timeout := vm.GuestDiskTimeout
+	if timeout <= 0 {
+		timeout = GUEST_DISK_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		pid, err := startGuestProgram(vm, vmMo.Reference(), auth, spec)
+		if err != nil {
+			return err
+		}
+		exitCode, err := waitForGuestProcess(vm, vmMo.Reference(), auth, pid,
+			timeout)
+		if err != nil {
+			return err
+		}
+		if exitCode == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return NewErrorGuestDisksMissing(vm.Name, disks, timeout)
+		}
+		if err = sleepContext(vm.ctx, guestDiskPollPeriod); err != nil {
+			return err
 		}
 	}
+}
 
-	nHosts := len(hsMos)
-	for key, value := range dsList {
-		if value == nHosts {
-			dsMors = append(dsMors, key)
+// isWindowsGuest: returns true if the guest of the vm is Windows, as reported
+// by VMware Tools or else by the configured guest id
+func isWindowsGuest(vmMo *mo.VirtualMachine) bool {
+	if vmMo.Guest != nil && vmMo.Guest.GuestFamily != "" {
+		return vmMo.Guest.GuestFamily ==
+			string(types.VirtualMachineGuestOsFamilyWindowsGuest)
+	}
+	return vmMo.Config != nil && strings.HasPrefix(vmMo.Config.GuestId, "win")
+}
+
+// guestDiskCheck: returns the guest program exiting with 0 if the guest sees
+// at least that many disks. Linux guests count the block devices which aren't
+// loop, ram, optical, floppy or device mapper devices.
+func guestDiskCheck(vmMo *mo.VirtualMachine, disks int) types.GuestProgramSpec {
+	if isWindowsGuest(vmMo) {
+		return types.GuestProgramSpec{
+			ProgramPath: `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`,
+			Arguments: fmt.Sprintf("-NoProfile -NonInteractive -Command "+
+				"\"if (@(Get-Disk).Count -ge %d) { exit 0 } else { exit 1 }\"", disks),
 		}
 	}
-	return dsMors, nil
+	return types.GuestProgramSpec{
+		ProgramPath: "/bin/sh",
+		Arguments: fmt.Sprintf("-c 'test $(ls /sys/block | grep -cvE "+
+			"\"^(loop|ram|zram|sr|fd|dm-|md)\") -ge %d'", disks),
+	}
 }
 
-// existActiveTasks: returns true if any active tasks done on vm are active
-func isTaskInProgress(vm *VM, vmMo *mo.VirtualMachine) bool {
-	var (
-		taskMo mo.Task
-		err    error
-	)
-	for _, task := range vmMo.RecentTask {
-		err = vm.collector.RetrieveOne(vm.ctx, task, []string{
-			"info"}, &taskMo)
-		if err != nil {
-			continue
+// shellQuote: quotes the argument for a POSIX shell
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// cmdQuote: quotes the argument for cmd.exe. Double quotes, which Windows
+// paths can't contain, and variable expansions can't be quoted.
+func cmdQuote(arg string) (string, error) {
+	if strings.ContainsAny(arg, `"%`) {
+		return "", fmt.Errorf("can't quote %q for cmd.exe", arg)
+	}
+	return `"` + arg + `"`, nil
+}
+
+// postCloneScriptSuffix: returns the suffix of the script file for the
+// interpreter of the guest
+func postCloneScriptSuffix(windows bool, interpreter string) string {
+	switch {
+	case !windows:
+		return ".sh"
+	case interpreter == "":
+		return ".ps1"
+	}
+	return ".cmd"
+}
+
+// postCloneScriptSpec: returns the guest program running the script at
+// scriptPath with the interpreter, through a shell redirecting its output to
+// outputPath. The interpreter defaults to /bin/sh, or PowerShell on Windows.
+func postCloneScriptSpec(windows bool, interpreter string, scriptPath string,
+	outputPath string) (types.GuestProgramSpec, error) {
+	if !windows {
+		if interpreter == "" {
+			interpreter = "/bin/sh"
 		}
-		switch taskMo.Info.State {
-		// available states queued, running, success, error
-		case types.TaskInfoStateQueued, types.TaskInfoStateRunning:
-			return false
+		// The paths are passed as arguments of the shell, not in its command
+		return types.GuestProgramSpec{
+			ProgramPath: "/bin/sh",
+			Arguments: `-c 'exec "$0" "$1" > "$2" 2>&1' ` + shellQuote(interpreter) +
+				" " + shellQuote(scriptPath) + " " + shellQuote(outputPath),
+		}, nil
+	}
+	var args []string
+	if interpreter == "" {
+		interpreter = `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`
+		args = []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}
+	}
+	command := make([]string, 0, len(args)+4)
+	quoted, err := cmdQuote(interpreter)
+	if err != nil {
+		return types.GuestProgramSpec{}, err
+	}
+	command = append(append(command, quoted), args...)
+	for _, path := range []string{scriptPath, ">", outputPath} {
+		if path != ">" {
+			if path, err = cmdQuote(path); err != nil {
+				return types.GuestProgramSpec{}, err
+			}
 		}
+		command = append(command, path)
 	}
-	return true
+	// With /s cmd.exe runs what is between the outer quotes as is
+	return types.GuestProgramSpec{
+		ProgramPath: `C:\Windows\System32\cmd.exe`,
+		Arguments:   `/s /c "` + strings.Join(command, " ") + ` 2>&1"`,
+	}, nil
 }
 
-// waitForTasksToFinish: waits for any active tasks on vm
-func waitForTasksToFinish(vm *VM, tasks []types.ManagedObjectReference) {
-	// wait for tasks to finish
-	for _, task := range tasks {
-		tObj := object.NewTask(vm.client.Client, task)
-		tObj.Wait(vm.ctx)
+// runPostCloneScript: runs vm.PostCloneScript in the guest with its
+// credentials. The output of the script is captured in a temporary file in
+// the guest and returned in the error if the script fails.
+var runPostCloneScript = func(vm *VM, vmMo *mo.VirtualMachine) error {
+	script := vm.PostCloneScript
+	auth := script.Credentials
+	vmMor := vmMo.Reference()
+	defer closeGuestTransport(vm)
+	windows := isWindowsGuest(vmMo)
+	timeout := script.Timeout
+	if timeout <= 0 {
+		timeout = POST_CLONE_SCRIPT_TIMEOUT
+	}
+
+	scriptPath, err := createGuestTempFile(vm, vmMor, auth, "libretto-",
+		postCloneScriptSuffix(windows, script.Interpreter))
+	if err != nil {
+		return err
+	}
+	defer deleteGuestFile(vm, vmMor, auth, scriptPath)
+	outputPath, err := createGuestTempFile(vm, vmMor, auth, "libretto-", ".out")
+	if err != nil {
+		return err
+	}
+	defer deleteGuestFile(vm, vmMor, auth, outputPath)
+
+	if err = uploadToGuest(vm, vmMor, auth, scriptPath, []byte(script.Script)); err != nil {
+		return err
+	}
+	spec, err := postCloneScriptSpec(windows, script.Interpreter, scriptPath, outputPath)
+	if err != nil {
+		return err
+	}
+	spec.EnvVariables = script.Env
+	pid, err := startGuestProgram(vm, vmMor, auth, spec)
+	if err != nil {
+		return err
+	}
+	exitCode, err := waitForGuestProcess(vm, vmMor, auth, pid, timeout)
+	if err != nil {
+		return err
+	}
+	if exitCode == 0 {
+		return nil
+	}
+	output, err := downloadFromGuest(vm, vmMor, auth, outputPath)
+	if err != nil {
+		output = []byte(fmt.Sprintf("<failed to retrieve the output: %v>", err))
 	}
+	return NewErrorGuestScriptFailed(exitCode, string(output))
 }
 
 // tagsHasKey: returns true if any of the tags has 'key'
@@ -2232,9 +7041,9 @@ func tagsHasKey(tags []types.Tag, key string) bool {
 	return false
 }
 
-// networkDeviceChangeSpec: returns network device change spec based on vm.Networks
-func networkDeviceChangeSpec(vm *VM, vmMo *mo.VirtualMachine) (
-	[]types.BaseVirtualDeviceConfigSpec, error) {
+// networkDeviceChangeSpec: returns network device change spec based on networks
+func networkDeviceChangeSpec(vm *VM, vmMo *mo.VirtualMachine,
+	networks []Network) ([]types.BaseVirtualDeviceConfigSpec, error) {
 	var (
 		addDeviceSpecs    []types.BaseVirtualDeviceConfigSpec
 		removeDeviceSpecs []types.BaseVirtualDeviceConfigSpec
@@ -2254,15 +7063,32 @@ func networkDeviceChangeSpec(vm *VM, vmMo *mo.VirtualMachine) (
 	}
 
 	// create map of network name and network mors
-	_, nwMap, err := createNetworkMapping(vm, vm.Networks, hsMo.Network)
+	mappings, _, err := createNetworkMapping(vm, networks, hsMo.Network)
+	if err != nil {
+		return nil, err
+	}
+	if vmMo.Config == nil {
+		return nil, NewErrorConfigNotAvailable(vm.Name)
+	}
 	devices := vmMo.Config.Hardware.Device
+	used := make(map[int32]bool)
+	for _, device := range devices {
+		used[device.GetVirtualDevice().Key] = true
+	}
 
-	for _, nw := range vm.Networks {
+	for i, nw := range networks {
 		spec := new(types.VirtualDeviceConfigSpec)
 		switch nw.Operation {
 		case "", "add":
-			spec, err = addNetworkDeviceSpec(vm, nwMap[nw.Name],
-				nw.Name)
+			if nw.DeviceKey != nil {
+				if err = validateNicDeviceKey(*nw.DeviceKey, used); err != nil {
+					return nil, fmt.Errorf("invalid device key for "+
+						"network %s: %v", nw.Name, err)
+				}
+				used[*nw.DeviceKey] = true
+			}
+			spec, err = addNetworkDeviceSpec(vm, mappings[i].Network,
+				nw.Name, nw.AdapterType, nw.DeviceKey)
 			addDeviceSpecs = append(addDeviceSpecs, spec)
 		case "remove":
 			if nw.DeviceKey == nil {
@@ -2270,7 +7096,7 @@ func networkDeviceChangeSpec(vm *VM, vmMo *mo.VirtualMachine) (
 					"Device key not specified for network: %v",
 					nw.Name)
 			}
-			spec, err = removeNetworkDeviceSpec(vm, nwMap[nw.Name],
+			spec, err = removeNetworkDeviceSpec(vm, mappings[i].Network,
 				nw.Name, *nw.DeviceKey, devices)
 			removeDeviceSpecs = append(removeDeviceSpecs, spec)
 		default:
@@ -2314,3 +7140,255 @@ func removeNetworkDeviceSpec(vm *VM, nwMor types.ManagedObjectReference,
 	}
 	return spec, nil
 }
+
+// tagClient is a client of the vSphere Automation REST API, which manages the
+// tag categories and tags of vCenter. It is logged in with the credentials of
+// the VM.
+type tagClient struct {
+	vm        *VM
+	client    *http.Client
+	transport *http.Transport
+	baseURL   string
+	session   string
+}
+
+// tagObject is the id of a managed object in the REST API
+type tagObject struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// restTag is a tag, or tag category, in the REST API
+type restTag struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	CategoryID string `json:"category_id"`
+}
+
+// restURL: returns the base url of the REST API of the vCenter host
+func restURL(host string) string {
+	return "https://" + host + "/rest"
+}
+
+// newTagClient: returns a tag client logged in to the REST API at baseURL.
+// The requests of the client share its transport. The client has to be
+// logged out, which closes the connections of the transport.
+var newTagClient = func(vm *VM, baseURL string) (*tagClient, error) {
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig(vm),
+	}
+	c := &tagClient{
+		vm:        vm,
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		baseURL:   baseURL,
+	}
+	var session string
+	if err := c.do("POST", "/com/vmware/cis/session", nil, &session); err != nil {
+		transport.CloseIdleConnections()
+		return nil, fmt.Errorf("error logging in to the REST API: %v", err)
+	}
+	c.session = session
+	return c, nil
+}
+
+// do: sends the request with the body encoded as json and decodes the value of
+// the response into result, if not nil
+func (c *tagClient) do(method string, path string, body interface{},
+	result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if c.vm.ctx != nil {
+		request = request.WithContext(c.vm.ctx)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.session == "" && c.vm.SessionCookie != "":
+		// The REST session is created from the SOAP one
+		request.Header.Set("vmware-use-header-authn", "true")
+		request.Header.Set("vmware-api-session-id", c.vm.SessionCookie)
+	case c.session == "":
+		request.SetBasicAuth(c.vm.Username, c.vm.Password)
+	default:
+		request.Header.Set("vmware-api-session-id", c.session)
+	}
+	resp, err := clientDo(c.client, request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The connection is only reused once the body is read and closed
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return NewErrorBadResponse(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	value := struct {
+		Value interface{} `json:"value"`
+	}{Value: result}
+	return json.NewDecoder(resp.Body).Decode(&value)
+}
+
+// logout: ends the session of the client and closes its connections. A
+// failure isn't reported, the session expires on its own.
+func (c *tagClient) logout() {
+	c.do("DELETE", "/com/vmware/cis/session", nil, nil)
+	c.transport.CloseIdleConnections()
+}
+
+// category: returns the tag category of that name
+func (c *tagClient) category(name string) (*restTag, error) {
+	var ids []string
+	if err := c.do("GET", "/com/vmware/cis/tagging/category", nil, &ids); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		var category restTag
+		err := c.do("GET", "/com/vmware/cis/tagging/category/id:"+url.PathEscape(id), nil, &category)
+		if err != nil {
+			return nil, err
+		}
+		if category.Name == name {
+			return &category, nil
+		}
+	}
+	return nil, NewErrorTagNotFound(name, "")
+}
+
+// tag: returns the id of the tag of that name in the category
+func (c *tagClient) tag(category string, name string) (string, error) {
+	cat, err := c.category(category)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	err = c.do("POST", "/com/vmware/cis/tagging/tag/id:"+url.PathEscape(cat.ID)+
+		"?~action=list-tags-for-category", nil, &ids)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		t, err := c.getTag(id)
+		if err != nil {
+			return "", err
+		}
+		if t.Name == name {
+			return id, nil
+		}
+	}
+	return "", NewErrorTagNotFound(category, name)
+}
+
+// getTag: returns the tag with the id
+func (c *tagClient) getTag(id string) (*restTag, error) {
+	var t restTag
+	err := c.do("GET", "/com/vmware/cis/tagging/tag/id:"+url.PathEscape(id), nil, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// associate: attaches or detaches the tag to the object, action is attach or
+// detach
+func (c *tagClient) associate(action string, tagID string,
+	ref types.ManagedObjectReference) error {
+	body := map[string]tagObject{
+		"object_id": {ID: ref.Value, Type: ref.Type},
+	}
+	return c.do("POST", "/com/vmware/cis/tagging/tag-association/id:"+
+		url.PathEscape(tagID)+"?~action="+action, body, nil)
+}
+
+// attachedTags: returns the tags attached to the object, with the names of
+// their categories
+func (c *tagClient) attachedTags(ref types.ManagedObjectReference) ([]Tag, error) {
+	body := map[string]tagObject{
+		"object_id": {ID: ref.Value, Type: ref.Type},
+	}
+	var ids []string
+	err := c.do("POST", "/com/vmware/cis/tagging/tag-association?~action=list-attached-tags",
+		body, &ids)
+	if err != nil {
+		return nil, err
+	}
+	tags := []Tag{}
+	categories := map[string]string{}
+	for _, id := range ids {
+		t, err := c.getTag(id)
+		if err != nil {
+			return nil, err
+		}
+		category, ok := categories[t.CategoryID]
+		if !ok {
+			var cat restTag
+			err = c.do("GET", "/com/vmware/cis/tagging/category/id:"+
+				url.PathEscape(t.CategoryID), nil, &cat)
+			if err != nil {
+				return nil, err
+			}
+			category = cat.Name
+			categories[t.CategoryID] = category
+		}
+		tags = append(tags, Tag{ID: t.ID, Name: t.Name, Category: category})
+	}
+	return tags, nil
+}
+
+// attachedObjects: returns the objects of the type the tag is attached to
+func (c *tagClient) attachedObjects(tagID string, objType string) (
+	[]types.ManagedObjectReference, error) {
+	var objects []tagObject
+	err := c.do("POST", "/com/vmware/cis/tagging/tag-association/id:"+
+		url.PathEscape(tagID)+"?~action=list-attached-objects", nil, &objects)
+	if err != nil {
+		return nil, err
+	}
+	var refs []types.ManagedObjectReference
+	for _, obj := range objects {
+		if obj.Type == objType {
+			refs = append(refs, types.ManagedObjectReference{
+				Type: obj.Type, Value: obj.ID})
+		}
+	}
+	return refs, nil
+}
+
+// changeTag: attaches or detaches the tag of the category to the VM
+func changeTag(vm *VM, action string, category string, tag string) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	c, err := newTagClient(vm, restURL(vm.Host))
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+	tagID, err := c.tag(category, tag)
+	if err != nil {
+		return err
+	}
+	return c.associate(action, tagID, vmMo.Reference())
+}
@@ -4,6 +4,7 @@ package vsphere
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -84,10 +86,22 @@ func (v vmwareFinder) NetworkList(c context.Context, p string) ([]object.Network
 	return v.finder.NetworkList(c, p)
 }
 
+func (v vmwareFinder) DatastoreClusterList(c context.Context, p string) ([]*object.StoragePod, error) {
+	return v.finder.DatastoreClusterList(c, p)
+}
+
 func (v vmwareFinder) ResourcePoolList(c context.Context, p string) ([]*object.ResourcePool, error) {
 	return v.finder.ResourcePoolList(c, p)
 }
 
+func (v vmwareFinder) DatastoreList(c context.Context, p string) ([]*object.Datastore, error) {
+	return v.finder.DatastoreList(c, p)
+}
+
+func (v vmwareFinder) HostSystemList(c context.Context, p string) ([]*object.HostSystem, error) {
+	return v.finder.HostSystemList(c, p)
+}
+
 // NewLease creates a VMwareLease.
 var NewLease = func(ctx context.Context, lease *object.HttpNfcLease) Lease {
 	return VMwareLease{
@@ -118,6 +132,19 @@ func (v VMwareLease) Complete() error {
 	return v.Lease.HttpNfcLeaseComplete(v.Ctx)
 }
 
+// Abort aborts the underlying lease with the given error as the reason. vSphere
+// releases the lease and removes the entity that was being imported.
+func (v VMwareLease) Abort(reason error) error {
+	var fault *types.LocalizedMethodFault
+	if reason != nil {
+		fault = &types.LocalizedMethodFault{
+			Fault:            &types.SystemError{Reason: reason.Error()},
+			LocalizedMessage: reason.Error(),
+		}
+	}
+	return v.Lease.HttpNfcLeaseAbort(v.Ctx, fault)
+}
+
 type Datastore struct {
 	Name               string `json:"name"`
 	Type               string `json:"type"`
@@ -246,16 +273,21 @@ var NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
 		TotalBytes: t,
 		Lease:      l,
 		ch:         make(chan int64, 1),
+		stop:       make(chan struct{}),
+		once:       &sync.Once{},
 		wg:         &sync.WaitGroup{},
 	}
 }
 
 // ProgressReader is an interface for interacting with the vSphere SDK. It provides a
 // `Start` method to start a monitoring go-routine which monitors the progress of the
-// upload as well as a `Wait` method to wait until the upload is complete.
+// upload as well as a `Wait` method to wait until the upload is complete. `Stop`
+// stops the monitoring go-routine when the upload is abandoned.
 type ProgressReader interface {
 	StartProgress()
 	Wait()
+	Stop()
+	Track(src io.Reader) io.Reader
 	Read(p []byte) (n int, err error)
 }
 
@@ -265,50 +297,77 @@ type ReadProgress struct {
 	TotalBytes int64
 	Lease      Lease
 
-	wg *sync.WaitGroup
-	ch chan int64 //Channel for getting progress reports
+	wg   *sync.WaitGroup
+	ch   chan int64 //Channel for getting progress reports
+	stop chan struct{}
+	once *sync.Once
 }
 
 // Read implements the Reader interface.
 func (r ReadProgress) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
-	if err != nil {
-		return
+	// The last chunk may be returned together with io.EOF
+	if n > 0 {
+		select {
+		case r.ch <- int64(n):
+		case <-r.stop:
+		}
 	}
-	r.ch <- int64(n)
 	return
 }
 
 // StartProgress starts a goroutine that updates local progress on the lease as
-// well as pass it down to the underlying lease.
+// well as pass it down to the underlying lease. The last known percentage is
+// re-sent every LEASE_PROGRESS_INTERVAL even when no data has been read, so
+// the server doesn't time out the lease while an upload is stalled.
 func (r ReadProgress) StartProgress() {
 	r.wg.Add(1)
 	go func() {
 		var bytesReceived int64
 		var percent int32
-		tick := time.NewTicker(5 * time.Second)
+		tick := time.NewTicker(LEASE_PROGRESS_INTERVAL)
 		defer tick.Stop()
 		defer r.wg.Done()
 		for {
 			select {
 			case b := <-r.ch:
 				bytesReceived += b
-				percent = int32((float32(bytesReceived) / float32(r.TotalBytes)) * 100)
+				if r.TotalBytes > 0 {
+					percent = int32(bytesReceived * 100 / r.TotalBytes)
+				}
 			case <-tick.C:
 				// TODO: Preet This can return an error as well, should return it
 				r.Lease.HTTPNfcLeaseProgress(percent)
-				if percent == 100 {
+				if percent >= 100 {
 					return
 				}
+			case <-r.stop:
+				return
 			}
 		}
 	}()
 }
 
-// Wait waits for the underlying waitgroup to be complete.
+// Wait waits for the underlying waitgroup to be complete. Completing the lease
+// is left to the caller.
 func (r ReadProgress) Wait() {
 	r.wg.Wait()
-	r.Lease.Complete()
+}
+
+// Track returns a reader reading from src whose progress is reported together
+// with the other readers of r, so concurrent uploads share the lease progress.
+func (r ReadProgress) Track(src io.Reader) io.Reader {
+	r.Reader = src
+	return r
+}
+
+// Stop stops the progress updates without waiting for the upload to complete.
+// It is safe to call Stop more than once.
+func (r ReadProgress) Stop() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+	r.wg.Wait()
 }
 
 var (
@@ -320,6 +379,10 @@ var (
 	// The VM can't be started in this state
 	ErrorVMPowerStateChanging = errors.New("the power state of the vm is changing, try again later")
 	errNoHostsInCluster       = errors.New("the cluster does not have any hosts in it")
+	// ErrorVMNotPoweredOff is returned when an operation requires the VM to be powered off
+	ErrorVMNotPoweredOff = errors.New("the vm must be powered off for this operation")
+	// ErrorVMFirmwareNotEfi is returned when an EFI specific operation is done on a BIOS VM
+	ErrorVMFirmwareNotEfi = errors.New("the vm does not use EFI firmware")
 )
 
 // ErrorParsingURL is returned when the sdk url passed to the vSphere provider is not valid
@@ -379,6 +442,256 @@ func (e ErrorPropertyRetrieval) Error() string {
 	return fmt.Sprintf("Could not retrieve '%s' for object '%s': %s", e.ps, e.mor, e.err)
 }
 
+// ErrorVTPMPrerequisite is returned when a virtual TPM is requested for a VM
+// which doesn't meet the prerequisites for it
+type ErrorVTPMPrerequisite struct {
+	reason string
+}
+
+func (e ErrorVTPMPrerequisite) Error() string {
+	return fmt.Sprintf("Cannot add a virtual TPM to the vm: %s", e.reason)
+}
+
+// ErrorHardwareVersionNotSupported is returned when the requested minimum
+// hardware version is newer than the host supports
+type ErrorHardwareVersionNotSupported struct {
+	version string
+	max     string
+}
+
+func (e ErrorHardwareVersionNotSupported) Error() string {
+	return fmt.Sprintf("Hardware version %s is not supported by the host, the maximum supported version is %s",
+		e.version, e.max)
+}
+
+// ErrorConfigNotAvailable is returned when the config of a VM can't be read,
+// e.g. while the VM is being created or is inaccessible
+type ErrorConfigNotAvailable struct {
+	vm string
+}
+
+func (e ErrorConfigNotAvailable) Error() string {
+	return fmt.Sprintf("Config of the vm %s is not available", e.vm)
+}
+
+// ErrorTasksInProgress is returned when the tasks on a VM don't finish in
+// time for another operation on it
+type ErrorTasksInProgress struct {
+	vm string
+}
+
+func (e ErrorTasksInProgress) Error() string {
+	return fmt.Sprintf("Timed out waiting for the tasks on the vm %s to finish", e.vm)
+}
+
+// ErrorOperationInProgress is returned when an operation is started on a VM
+// while another operation on the same VM is in progress
+type ErrorOperationInProgress struct {
+	vm        string
+	operation string
+}
+
+func (e ErrorOperationInProgress) Error() string {
+	return fmt.Sprintf("Operation '%s' is in progress on the vm %s", e.operation, e.vm)
+}
+
+// ErrorGuestScriptFailed is returned when a script run in the guest exits
+// with a non-zero exit code
+type ErrorGuestScriptFailed struct {
+	ExitCode int32
+	Output   string
+}
+
+func (e ErrorGuestScriptFailed) Error() string {
+	return fmt.Sprintf("Guest script exited with code %d: %s", e.ExitCode, e.Output)
+}
+
+// ErrorManifestMismatch is returned when a file extracted from an ova doesn't
+// match its digest in the ova manifest
+type ErrorManifestMismatch struct {
+	file string
+}
+
+func (e ErrorManifestMismatch) Error() string {
+	return fmt.Sprintf("Digest of the ova file %s doesn't match the manifest", e.file)
+}
+
+// ErrorIPWaitSkipped is a warning returned when waiting for the IP of a VM is
+// skipped because VMware Tools aren't installed in the guest to report it
+type ErrorIPWaitSkipped struct {
+	vm string
+}
+
+func (e ErrorIPWaitSkipped) Error() string {
+	return fmt.Sprintf("Skipped waiting for the ip of the vm %s, VMware Tools are not installed in the guest", e.vm)
+}
+
+// ErrorUnsafeArchivePath is returned when an entry of an ova would be
+// extracted outside of the destination directory or is a link
+type ErrorUnsafeArchivePath struct {
+	entry string
+}
+
+func (e ErrorUnsafeArchivePath) Error() string {
+	return fmt.Sprintf("Unsafe path of the ova entry %s", e.entry)
+}
+
+// ErrorNoValidIP is returned when a VM doesn't get a valid IP in time. The
+// tools status and guest state tell a guest without a DHCP lease apart from
+// a guest in which VMware Tools never started.
+type ErrorNoValidIP struct {
+	// IPs are the ips reported by the guest by NIC MAC address
+	IPs                map[string][]string
+	ToolsRunningStatus string
+	GuestState         string
+}
+
+func (e ErrorNoValidIP) Error() string {
+	return fmt.Sprintf("No valid ip assigned: %v, tools running status: '%s', guest state: '%s'",
+		e.IPs, e.ToolsRunningStatus, e.GuestState)
+}
+
+// ErrorDiskShrinkNotAllowed is returned when a disk would be shrunk without
+// VM.DiskShrinkRequested set
+type ErrorDiskShrinkNotAllowed struct {
+	disk      string
+	current   int64
+	requested int64
+}
+
+func (e ErrorDiskShrinkNotAllowed) Error() string {
+	return fmt.Sprintf("Shrinking the disk %s from %d KB to %d KB is not allowed",
+		e.disk, e.current, e.requested)
+}
+
+// ErrorDiskShrinkNotSupported is returned when shrinking a disk is requested
+// with VM.DiskShrinkRequested, as vSphere can't reduce the capacity of a disk
+type ErrorDiskShrinkNotSupported struct {
+	disk string
+}
+
+func (e ErrorDiskShrinkNotSupported) Error() string {
+	return fmt.Sprintf("Shrinking the disk %s is not supported by vSphere. Data beyond the new size would be lost, "+
+		"so shrink the guest filesystem and copy it to a smaller disk instead", e.disk)
+}
+
+// ErrorNoIPInNetwork is returned when a VM doesn't get an ip inside
+// VM.PreferredIPNetwork in time
+type ErrorNoIPInNetwork struct {
+	Network string
+	// IPs are the ips reported by the guest by NIC MAC address
+	IPs map[string][]string
+}
+
+func (e ErrorNoIPInNetwork) Error() string {
+	return fmt.Sprintf("No ip assigned in the network %s, ips seen: %v",
+		e.Network, e.IPs)
+}
+
+// ErrorGuestShutdownTimeout is returned when the guest of the vm didn't shut
+// down within the shutdown timeout.
+type ErrorGuestShutdownTimeout struct {
+	vm      string
+	timeout time.Duration
+}
+
+func (e ErrorGuestShutdownTimeout) Error() string {
+	return fmt.Sprintf("Shutting down vm: %s timed out after %v", e.vm, e.timeout)
+}
+
+// ErrorUnansweredQuestion is returned when the vm has a pending question that
+// no response matches and FailOnUnansweredQuestion is set.
+type ErrorUnansweredQuestion struct {
+	vm       string
+	question string
+	options  string
+}
+
+func (e ErrorUnansweredQuestion) Error() string {
+	return fmt.Sprintf("vm '%s' has an unanswered question %q. Valid answers: %s", e.vm, e.question, e.options)
+}
+
+// ErrorResourcePoolExists is returned when a resource pool of that name
+// already exists under the parent.
+type ErrorResourcePoolExists struct {
+	name   string
+	parent string
+}
+
+func (e ErrorResourcePoolExists) Error() string {
+	return fmt.Sprintf("resource pool '%s' already exists under '%s'", e.name, e.parent)
+}
+
+// ErrorCustomizationOSMismatch is returned when the identity of the
+// customization spec doesn't fit the guest OS of the template, e.g. a Linux
+// spec for a Windows guest.
+type ErrorCustomizationOSMismatch struct {
+	identity string
+	guestID  string
+}
+
+func (e ErrorCustomizationOSMismatch) Error() string {
+	return fmt.Sprintf("customization identity %s doesn't match the guest OS '%s'", e.identity, e.guestID)
+}
+
+// ErrorTagNotFound is returned when a tag category, or a tag in the category,
+// doesn't exist. Categories and tags aren't created implicitly.
+type ErrorTagNotFound struct {
+	category string
+	tag      string
+}
+
+func (e ErrorTagNotFound) Error() string {
+	if e.tag == "" {
+		return fmt.Sprintf("tag category '%s' not found", e.category)
+	}
+	return fmt.Sprintf("tag '%s' not found in category '%s'", e.tag, e.category)
+}
+
+// ErrorGuestProcessRunning is returned when the exit code of a guest process
+// is asked for before it exited.
+type ErrorGuestProcessRunning struct {
+	pid int64
+}
+
+func (e ErrorGuestProcessRunning) Error() string {
+	return fmt.Sprintf("guest process %d is still running", e.pid)
+}
+
+// ErrorGuestDisksMissing is returned when the guest doesn't see all the disks
+// of the VM in time, e.g. for a disk on a controller it has no driver for.
+type ErrorGuestDisksMissing struct {
+	vm      string
+	disks   int
+	timeout time.Duration
+}
+
+func (e ErrorGuestDisksMissing) Error() string {
+	return fmt.Sprintf("the guest of vm '%s' didn't see its %d disks after %v", e.vm, e.disks, e.timeout)
+}
+
+// ErrorDownloadUnauthorized is returned when the server of an ova refuses the
+// download with a 401 or a 403, see VM.OvaAuth.
+type ErrorDownloadUnauthorized struct {
+	url    string
+	status int
+}
+
+func (e ErrorDownloadUnauthorized) Error() string {
+	return fmt.Sprintf("not authorized to download ova from url: %s status: %d", e.url, e.status)
+}
+
+// ErrorToolsNotRunning is returned when an operation needs VMware Tools to be
+// running in the guest and it is not.
+type ErrorToolsNotRunning struct {
+	vm     string
+	status string
+}
+
+func (e ErrorToolsNotRunning) Error() string {
+	return fmt.Sprintf("VMware Tools is not running in the guest of vm '%s'. Tools running status: '%s'", e.vm, e.status)
+}
+
 func (e ErrorParsingURL) Error() string {
 	if e.err != nil {
 		return fmt.Sprintf("Error parsing sdk uri. Url: %s, Error: %s", e.uri, e.err)
@@ -414,6 +727,118 @@ func NewErrorPropertyRetrieval(m types.ManagedObjectReference, p []string, e err
 	return ErrorPropertyRetrieval{err: e, mor: m, ps: p}
 }
 
+// NewErrorVTPMPrerequisite returns an ErrorVTPMPrerequisite error.
+func NewErrorVTPMPrerequisite(r string) ErrorVTPMPrerequisite {
+	return ErrorVTPMPrerequisite{reason: r}
+}
+
+// NewErrorHardwareVersionNotSupported returns an
+// ErrorHardwareVersionNotSupported error.
+func NewErrorHardwareVersionNotSupported(v string, m string) ErrorHardwareVersionNotSupported {
+	return ErrorHardwareVersionNotSupported{version: v, max: m}
+}
+
+// NewErrorConfigNotAvailable returns an ErrorConfigNotAvailable error.
+func NewErrorConfigNotAvailable(v string) ErrorConfigNotAvailable {
+	return ErrorConfigNotAvailable{vm: v}
+}
+
+// NewErrorTasksInProgress returns an ErrorTasksInProgress error.
+func NewErrorTasksInProgress(v string) ErrorTasksInProgress {
+	return ErrorTasksInProgress{vm: v}
+}
+
+// NewErrorOperationInProgress returns an ErrorOperationInProgress error.
+func NewErrorOperationInProgress(v string, o string) ErrorOperationInProgress {
+	return ErrorOperationInProgress{vm: v, operation: o}
+}
+
+// NewErrorGuestScriptFailed returns an ErrorGuestScriptFailed error.
+func NewErrorGuestScriptFailed(c int32, o string) ErrorGuestScriptFailed {
+	return ErrorGuestScriptFailed{ExitCode: c, Output: o}
+}
+
+// NewErrorManifestMismatch returns an ErrorManifestMismatch error.
+func NewErrorManifestMismatch(f string) ErrorManifestMismatch {
+	return ErrorManifestMismatch{file: f}
+}
+
+// NewErrorIPWaitSkipped returns an ErrorIPWaitSkipped error.
+func NewErrorIPWaitSkipped(v string) ErrorIPWaitSkipped {
+	return ErrorIPWaitSkipped{vm: v}
+}
+
+// NewErrorUnsafeArchivePath returns an ErrorUnsafeArchivePath error.
+func NewErrorUnsafeArchivePath(e string) ErrorUnsafeArchivePath {
+	return ErrorUnsafeArchivePath{entry: e}
+}
+
+// NewErrorNoValidIP returns an ErrorNoValidIP error.
+func NewErrorNoValidIP(i map[string][]string, t string, g string) ErrorNoValidIP {
+	return ErrorNoValidIP{IPs: i, ToolsRunningStatus: t, GuestState: g}
+}
+
+// NewErrorDiskShrinkNotAllowed returns an ErrorDiskShrinkNotAllowed error.
+func NewErrorDiskShrinkNotAllowed(d string, c int64, r int64) ErrorDiskShrinkNotAllowed {
+	return ErrorDiskShrinkNotAllowed{disk: d, current: c, requested: r}
+}
+
+// NewErrorDiskShrinkNotSupported returns an ErrorDiskShrinkNotSupported error.
+func NewErrorDiskShrinkNotSupported(d string) ErrorDiskShrinkNotSupported {
+	return ErrorDiskShrinkNotSupported{disk: d}
+}
+
+// NewErrorNoIPInNetwork returns an ErrorNoIPInNetwork error.
+func NewErrorNoIPInNetwork(n string, i map[string][]string) ErrorNoIPInNetwork {
+	return ErrorNoIPInNetwork{Network: n, IPs: i}
+}
+
+// NewErrorGuestShutdownTimeout returns an ErrorGuestShutdownTimeout error.
+func NewErrorGuestShutdownTimeout(v string, t time.Duration) ErrorGuestShutdownTimeout {
+	return ErrorGuestShutdownTimeout{vm: v, timeout: t}
+}
+
+// NewErrorUnansweredQuestion returns an ErrorUnansweredQuestion error.
+func NewErrorUnansweredQuestion(v string, q string, o string) ErrorUnansweredQuestion {
+	return ErrorUnansweredQuestion{vm: v, question: q, options: o}
+}
+
+// NewErrorResourcePoolExists returns an ErrorResourcePoolExists error.
+func NewErrorResourcePoolExists(n string, p string) ErrorResourcePoolExists {
+	return ErrorResourcePoolExists{name: n, parent: p}
+}
+
+// NewErrorCustomizationOSMismatch returns an ErrorCustomizationOSMismatch error.
+func NewErrorCustomizationOSMismatch(i string, g string) ErrorCustomizationOSMismatch {
+	return ErrorCustomizationOSMismatch{identity: i, guestID: g}
+}
+
+// NewErrorTagNotFound returns an ErrorTagNotFound error, the tag is empty if
+// the category wasn't found.
+func NewErrorTagNotFound(c string, t string) ErrorTagNotFound {
+	return ErrorTagNotFound{category: c, tag: t}
+}
+
+// NewErrorGuestProcessRunning returns an ErrorGuestProcessRunning error.
+func NewErrorGuestProcessRunning(p int64) ErrorGuestProcessRunning {
+	return ErrorGuestProcessRunning{pid: p}
+}
+
+// NewErrorGuestDisksMissing returns an ErrorGuestDisksMissing error.
+func NewErrorGuestDisksMissing(v string, d int, t time.Duration) ErrorGuestDisksMissing {
+	return ErrorGuestDisksMissing{vm: v, disks: d, timeout: t}
+}
+
+// NewErrorDownloadUnauthorized returns an ErrorDownloadUnauthorized error.
+func NewErrorDownloadUnauthorized(u string, s int) ErrorDownloadUnauthorized {
+	return ErrorDownloadUnauthorized{url: u, status: s}
+}
+
+// NewErrorToolsNotRunning returns an ErrorToolsNotRunning error.
+func NewErrorToolsNotRunning(v string, s string) ErrorToolsNotRunning {
+	return ErrorToolsNotRunning{vm: v, status: s}
+}
+
 // NewErrorBadResponse returns an  ErrorBadResponse error.
 func NewErrorBadResponse(r *http.Response) ErrorBadResponse {
 	return ErrorBadResponse{resp: r}
@@ -426,6 +851,14 @@ func isObjectOfType(object interface{}, objectType string) bool {
 	return false
 }
 
+func isDuplicateName(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	fault := soap.ToSoapFault(err).Detail.Fault
+	return isObjectOfType(fault, "DuplicateName")
+}
+
 func isObjectDeleted(err error) bool {
 	fault := soap.ToSoapFault(err).Detail.Fault
 	return isObjectOfType(fault, "ManagedObjectNotFound")
@@ -438,20 +871,160 @@ const (
 	DestinationTypeCluster = "cluster"
 	// DestinationTypeResourcePool represents a resource pool in the vSphere inventory.
 	DestinationTypeResourcePool = "resource_pool"
+	// DestinationTypeDatastoreCluster represents a datastore cluster, named by
+	// DestinationName, on which Storage DRS places the VM. The VM runs in the
+	// resource pool with the MOID.
+	DestinationTypeDatastoreCluster = "datastore_cluster"
+)
+
+const (
+	// IPWaitPolicyV4 waits for an IPv4 address on every NIC.
+	IPWaitPolicyV4 = "v4"
+	// IPWaitPolicyV6 waits for a non link local IPv6 address on every NIC.
+	IPWaitPolicyV6 = "v6"
+	// IPWaitPolicyBoth waits for an IPv4 and an IPv6 address on every NIC.
+	IPWaitPolicyBoth = "both"
+	// IPWaitPolicyAny waits for an address of either family on every NIC.
+	IPWaitPolicyAny = "any"
+)
+
+// RebootMethod is how Reboot restarts a VM
+type RebootMethod string
+
+const (
+	// RebootMethodGraceful reboots the guest OS, VMware Tools need to be
+	// running.
+	RebootMethodGraceful RebootMethod = "graceful"
+	// RebootMethodHard resets the VM like a power cycle.
+	RebootMethodHard RebootMethod = "hard"
+	// RebootMethodAuto reboots the guest OS if VMware Tools are running and
+	// resets the VM otherwise.
+	RebootMethodAuto RebootMethod = "auto"
+)
+
+// ShutdownResult is how a VM was stopped by ShutDownWithResult
+type ShutdownResult string
+
+const (
+	// ShutdownGraceful is returned when the guest OS shut down.
+	ShutdownGraceful ShutdownResult = "graceful"
+	// ShutdownForced is returned when the VM was powered off after its guest
+	// didn't shut down in time.
+	ShutdownForced ShutdownResult = "forced"
+)
+
+// NameCollision is what Provision does when a VM of the name exists, see
+// VM.OnNameCollision
+type NameCollision string
+
+const (
+	// NameCollisionFail fails the Provision with ErrorVMExists.
+	NameCollisionFail NameCollision = "fail"
+	// NameCollisionSuffix provisions the VM with the name suffixed by the
+	// first free number, like web-1.
+	NameCollisionSuffix NameCollision = "suffix"
+	// NameCollisionReuse keeps the existing VM, Provision succeeds without
+	// cloning.
+	NameCollisionReuse NameCollision = "reuse"
+)
+
+// ProvisioningState is the step a Provision is at, see VM.State
+type ProvisioningState string
+
+const (
+	// ProvisioningStateNone is the state of a VM that was never provisioned
+	ProvisioningStateNone              ProvisioningState = ""
+	ProvisioningStateConnecting        ProvisioningState = "connecting"
+	ProvisioningStateUploadingTemplate ProvisioningState = "uploading_template"
+	ProvisioningStateLocatingTemplate  ProvisioningState = "locating_template"
+	ProvisioningStateCloning           ProvisioningState = "cloning"
+	ProvisioningStateReconfiguring     ProvisioningState = "reconfiguring"
+	ProvisioningStatePoweringOn        ProvisioningState = "powering_on"
+	ProvisioningStateWaitingForIP      ProvisioningState = "waiting_for_ip"
+	ProvisioningStateDone              ProvisioningState = "done"
+	ProvisioningStateFailed            ProvisioningState = "failed"
+)
+
+// LeaseState is the final state of the nfc lease of a template upload, see
+// VM.LeaseState
+type LeaseState string
+
+const (
+	// LeaseStateNone is the state while no upload finished
+	LeaseStateNone LeaseState = ""
+	// LeaseStateCompleted is the state of a lease whose upload succeeded
+	LeaseStateCompleted LeaseState = "completed"
+	// LeaseStateAborted is the state of a lease aborted after a failure,
+	// vSphere removed the partially imported VM
+	LeaseStateAborted LeaseState = "aborted"
+	// LeaseStateAbortFailed is the state of a lease which couldn't be
+	// aborted, the partially imported VM may be left until it times out
+	LeaseStateAbortFailed LeaseState = "abort_failed"
 )
 
-type collector interface {
+// Collector retrieves the properties of managed objects. It is implemented by
+// property.Collector.
+type Collector interface {
 	RetrieveOne(context.Context, types.ManagedObjectReference, []string, interface{}) error
 	Retrieve(context.Context, []types.ManagedObjectReference, []string, interface{}) error
 }
 
-// Disk represents a vSphere Disk to attach to the VM
+// DeviceInfo describes a virtual device of a VM. Type is the short device
+// type, e.g. "disk", "cdrom" or "ethernet", and Backing summarizes what backs
+// the device, e.g. the file, host device or network.
+type DeviceInfo struct {
+	Key           int32  `json:"key"`
+	Type          string `json:"type"`
+	Label         string `json:"label"`
+	Summary       string `json:"summary"`
+	ControllerKey int32  `json:"controller_key"`
+	UnitNumber    *int32 `json:"unit_number,omitempty"`
+	Backing       string `json:"backing"`
+}
+
+// KeyEvent is a key stroke sent to the guest. Code is the USB HID usage id
+// of the key, the modifiers are held down while the key is pressed.
+type KeyEvent struct {
+	Code    int32 `json:"code"`
+	Control bool  `json:"control,omitempty"`
+	Shift   bool  `json:"shift,omitempty"`
+	Alt     bool  `json:"alt,omitempty"`
+	Gui     bool  `json:"gui,omitempty"`
+}
+
+// Disk represents a vSphere Disk to attach to the VM. Provisioning is thin
+// (default), thick (lazy zeroed) or eagerzeroedthick.
 type Disk struct {
 	Size         float32 `json:"size,omitempty"`
 	Controller   string  `json:"controller,omitempty"`
 	Provisioning string  `json:"provisioning,omitempty"`
 	Datastore    string  `json:"datastore,omitempty"`
 	DiskFile     string  `json:"disk_file,omitempty"`
+	// Sharing is sharingNone (default) or sharingMultiWriter. Shared disks
+	// need a controller with bus sharing.
+	Sharing string `json:"sharing,omitempty"`
+	// Mode is persistent (default), nonpersistent, undoable,
+	// independent_persistent, independent_nonpersistent or append.
+	// Independent disks are left out of snapshots.
+	Mode string `json:"mode,omitempty"`
+}
+
+// Controller is a SCSI controller added to the VM before its disks. Disks
+// refer to it by Name in Disk.Controller.
+type Controller struct {
+	Name string `json:"name"`
+	// Type is lsilogic (default), lsilogic-sas, pvscsi or buslogic
+	Type string `json:"type,omitempty"`
+	// BusSharing is noSharing (default), virtualSharing or physicalSharing
+	BusSharing string `json:"bus_sharing,omitempty"`
+	// DeviceName is the name of the controller device once it's added
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+// VirtualTPM represents a virtual Trusted Platform Module device. The vim25
+// types vendored with this package predate the device, so it is declared here.
+type VirtualTPM struct {
+	types.VirtualDevice
 }
 
 // Snapshot represents a vSphere snapshot to create
@@ -462,12 +1035,17 @@ type snapshot struct {
 	Quiesce     bool
 }
 
-type finder interface {
+// Finder looks up the objects in the vSphere inventory. It is implemented by
+// find.Finder.
+type Finder interface {
 	DatacenterList(context.Context, string) ([]*object.Datacenter, error)
 	ClusterComputeResourceList(context.Context, string) ([]*object.ClusterComputeResource, error)
 	VirtualMachineList(context.Context, string) ([]*object.VirtualMachine, error)
 	NetworkList(context.Context, string) ([]object.NetworkReference, error)
 	ResourcePoolList(context.Context, string) ([]*object.ResourcePool, error)
+	DatastoreClusterList(context.Context, string) ([]*object.StoragePod, error)
+	DatastoreList(context.Context, string) ([]*object.Datastore, error)
+	HostSystemList(context.Context, string) ([]*object.HostSystem, error)
 	SetDatacenter(*object.Datacenter) *find.Finder
 	ObjectReference(context.Context, types.ManagedObjectReference) (object.Reference, error)
 }
@@ -498,7 +1076,8 @@ type Destination struct {
 	// and resource pool.
 	DestinationType string
 	// HostSystem specifies the name of the host to run the VM on. DestinationType ESXi
-	// will have one host system. A cluster will have more than one,
+	// will have one host system. A cluster will have more than one, as will the
+	// cluster owning a resource pool destination.
 	HostSystem string
 	// MorefID of managed object [Currently only use with resource pool]
 	MOID string `json:"MOID"`
@@ -509,6 +1088,7 @@ type Lease interface {
 	HTTPNfcLeaseProgress(int32)
 	Wait() (*types.HttpNfcLeaseInfo, error)
 	Complete() error
+	Abort(error) error
 }
 
 type VirtualEthernetCard struct {
@@ -533,6 +1113,165 @@ type VMInfo struct {
 	MemorySizeMB       int32
 	DisksInfo          []Disk
 	NicInfo            []VirtualEthernetCard `json:"nic_info"`
+	// The fields below are only set by GetProperties
+	GuestState   string   `json:"guest_state"`
+	ToolsVersion string   `json:"tools_version"`
+	Datastores   []string `json:"datastores"`
+	Networks     []string `json:"networks"`
+	// FolderPath is the inventory path of the folder of the VM, like
+	// /dc1/vm/folder1
+	FolderPath string `json:"folder_path"`
+}
+
+// GuestDisk represents a filesystem as reported by VMware Tools in the guest
+type GuestDisk struct {
+	DiskPath  string `json:"disk_path"`
+	Capacity  int64  `json:"capacity"`
+	FreeSpace int64  `json:"free_space"`
+}
+
+// GuestNic represents a network adapter as reported by VMware Tools in the guest
+type GuestNic struct {
+	Network     string   `json:"network"`
+	MacAddress  string   `json:"mac_address"`
+	Connected   bool     `json:"connected"`
+	IpAddresses []string `json:"ip_addresses"`
+	IPv4        []net.IP `json:"ipv4"`
+	IPv6        []net.IP `json:"ipv6"`
+}
+
+// GuestIPStack represents the DNS and routing configuration of an IP stack
+// in the guest
+type GuestIPStack struct {
+	HostName        string   `json:"hostname"`
+	DomainName      string   `json:"domain_name"`
+	DnsServers      []string `json:"dns_servers"`
+	SearchDomains   []string `json:"search_domains"`
+	DefaultGateways []string `json:"default_gateways"`
+}
+
+// GuestInfo is a summary of the identity and network configuration that the
+// guest reports about itself
+type GuestInfo struct {
+	HostName      string         `json:"hostname"`
+	GuestId       string         `json:"guest_id"`
+	GuestFullName string         `json:"guest_full_name"`
+	IpStack       []GuestIPStack `json:"ip_stack"`
+	Nics          []GuestNic     `json:"nics"`
+}
+
+// ResourcePoolSpec is the CPU and memory allocation of a resource pool. A zero
+// limit means unlimited.
+type ResourcePoolSpec struct {
+	CPUReservationMHz     int64 `json:"cpu_reservation_mhz"`
+	CPULimitMHz           int64 `json:"cpu_limit_mhz"`
+	MemoryReservationMB   int64 `json:"memory_reservation_mb"`
+	MemoryLimitMB         int64 `json:"memory_limit_mb"`
+	ExpandableReservation bool  `json:"expandable_reservation"`
+}
+
+// ResourceUsage is the configured allocation and the usage of a resource of a
+// resource pool. CPU values are in MHz and memory values in MB.
+type ResourceUsage struct {
+	Reservation           int64 `json:"reservation"`
+	Limit                 int64 `json:"limit"`
+	ExpandableReservation bool  `json:"expandable_reservation"`
+	ReservationUsed       int64 `json:"reservation_used"`
+	ReservationUsedForVm  int64 `json:"reservation_used_for_vm"`
+	UnreservedForPool     int64 `json:"unreserved_for_pool"`
+	UnreservedForVm       int64 `json:"unreserved_for_vm"`
+	OverallUsage          int64 `json:"overall_usage"`
+	MaxUsage              int64 `json:"max_usage"`
+}
+
+// PoolUsage is the CPU and memory utilization of a resource pool
+type PoolUsage struct {
+	Name   string        `json:"name"`
+	CPU    ResourceUsage `json:"cpu"`
+	Memory ResourceUsage `json:"memory"`
+}
+
+// GuestCredentials are the credentials of a user in the guest, used for
+// operations through VMware Tools
+type GuestCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PostCloneScript is a script run in the guest after a VM is cloned
+type PostCloneScript struct {
+	// Interpreter is the path of the program running the script, e.g.
+	// "/bin/bash". It is given the path of the script as its only argument.
+	// Defaults to "/bin/sh", or to PowerShell on Windows guests.
+	Interpreter string `json:"interpreter"`
+	// Credentials are those of the guest user running the script
+	Credentials GuestCredentials `json:"credentials"`
+	// Script is the content of the script
+	Script string `json:"script"`
+	// Env is a list of environment variables in the form "NAME=value"
+	Env []string `json:"env"`
+	// Timeout is how long to wait for the script to exit. Defaults to
+	// POST_CLONE_SCRIPT_TIMEOUT.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Sysprep is the Windows guest customization of a cloned VM. The computer
+// joins either JoinDomain, with the domain admin credentials, or
+// JoinWorkgroup.
+type Sysprep struct {
+	// ComputerName defaults to the name of the VM
+	ComputerName  string `json:"computer_name"`
+	FullName      string `json:"full_name"`
+	OrgName       string `json:"org_name"`
+	AdminPassword string `json:"admin_password"`
+	// TimeZone is the Microsoft time zone index, e.g. 4 for Pacific Time
+	TimeZone            int32  `json:"time_zone"`
+	ProductKey          string `json:"product_key"`
+	JoinWorkgroup       string `json:"join_workgroup"`
+	JoinDomain          string `json:"join_domain"`
+	DomainAdmin         string `json:"domain_admin"`
+	DomainAdminPassword string `json:"domain_admin_password"`
+}
+
+// VideoCard configures the video card of a cloned VM. The fields left unset
+// keep the values of the template.
+type VideoCard struct {
+	MemoryKB    int64 `json:"memory_kb"`
+	NumDisplays int32 `json:"num_displays"`
+	Enable3D    *bool `json:"enable_3d"`
+	// Renderer is the 3D renderer: automatic, software or hardware
+	Renderer string `json:"renderer"`
+}
+
+// TaskInfo is the state of a vSphere task on a VM
+type TaskInfo struct {
+	Moref         string     `json:"moref"`
+	Name          string     `json:"name"`
+	DescriptionId string     `json:"description_id"`
+	State         string     `json:"state"`
+	Progress      int32      `json:"progress"`
+	QueueTime     time.Time  `json:"queue_time"`
+	StartTime     *time.Time `json:"start_time"`
+	CompleteTime  *time.Time `json:"complete_time"`
+	Error         string     `json:"error"`
+}
+
+// NetworkBacking is the network a NIC of a VM is connected to. SwitchUuid,
+// SwitchName and PortgroupKey are set for distributed port groups, VSwitch for
+// standard networks.
+type NetworkBacking struct {
+	Type         string `json:"type"`
+	NetworkName  string `json:"network_name"`
+	SwitchName   string `json:"switch_name"`
+	SwitchUuid   string `json:"switch_uuid"`
+	PortgroupKey string `json:"portgroup_key"`
+	VSwitch      string `json:"vswitch"`
+	// VlanType is vlan, trunk or pvlan
+	VlanType string `json:"vlan_type"`
+	// VlanId is the VLAN or private VLAN id, 0 if the network isn't tagged
+	VlanId int32 `json:"vlan_id"`
+	// VlanRanges are the ranges of VLAN ids of a trunk, e.g. "100-200"
+	VlanRanges []string `json:"vlan_ranges"`
 }
 
 type Flavor struct {
@@ -543,6 +1282,103 @@ type Flavor struct {
 	NumCPUs int32 `json:"cpu"`
 	// Represents the size of main memory in MB
 	MemoryMB int64 `json:"memory"`
+	// Reservations and limits of the VM. Zero values are left unset, which
+	// means no reservation and unlimited for a new VM.
+	CPUReservationMHz   int64 `json:"cpu_reservation_mhz"`
+	CPULimitMHz         int64 `json:"cpu_limit_mhz"`
+	MemoryReservationMB int64 `json:"memory_reservation_mb"`
+	MemoryLimitMB       int64 `json:"memory_limit_mb"`
+	// Shares of the CPU and memory, left unset when the level is empty
+	CPUShares    Shares `json:"cpu_shares"`
+	MemoryShares Shares `json:"memory_shares"`
+}
+
+// Shares is the relative share of a resource a VM gets under contention. The
+// Level is low, normal, high or custom, Count is the number of shares of the
+// custom level.
+type Shares struct {
+	Level string `json:"level"`
+	Count int32  `json:"count"`
+}
+
+// ClusterGroup is a DRS group of a cluster. The Type is host or vm, the
+// Members are the managed object ids of the hosts or vms in the group.
+type ClusterGroup struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+}
+
+// ClusterRule is a DRS rule of a cluster. The Type is affinity, anti_affinity
+// or vm_host. A vm_host rule binds the vms of VMGroup to the hosts of
+// HostGroup, or keeps them off the hosts of AntiHostGroup.
+type ClusterRule struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Enabled       bool   `json:"enabled"`
+	Mandatory     bool   `json:"mandatory"`
+	VMGroup       string `json:"vm_group,omitempty"`
+	HostGroup     string `json:"host_group,omitempty"`
+	AntiHostGroup string `json:"anti_host_group,omitempty"`
+}
+
+// ProvisionEvent is a step of a Provision sent on VM.Events.
+type ProvisionEvent struct {
+	State ProvisioningState `json:"state"`
+	// Percent is the progress of the template upload during
+	// ProvisioningStateUploadingTemplate
+	Percent int32 `json:"percent,omitempty"`
+	// URL is the url a remote OvaPathUrl was downloaded from, after
+	// redirects and without the credentials, sent once it is downloaded
+	// during ProvisioningStateUploadingTemplate
+	URL  string    `json:"url,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// ReadyDetails is what IsReady checked on a VM.
+type ReadyDetails struct {
+	PowerState   string `json:"power_state"`
+	ToolsRunning bool   `json:"tools_running"`
+	// HeartbeatStatus is the guest heartbeat of VMware Tools, green when
+	// the guest is healthy
+	HeartbeatStatus string   `json:"heartbeat_status"`
+	IPs             []net.IP `json:"ips"`
+}
+
+// NameContext is what a VM.NameTemplate is rendered with.
+type NameContext struct {
+	// Index is the NameIndex of the VM
+	Index int
+	// Datastore is the datastore picked for the VM
+	Datastore string
+	// Host is the name of the host picked for the VM, empty if DRS picks
+	// it
+	Host string
+}
+
+// Tag is a vSphere tag attached to a VM.
+type Tag struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// ReconfigureSpec is a batch of changes applied by Reconfigure in a single
+// reconfigure task. Zero values are left unchanged.
+type ReconfigureSpec struct {
+	NumCPUs    int32  `json:"cpu"`
+	MemoryMB   int64  `json:"memory"`
+	Annotation string `json:"annotation"`
+	// ExtraConfig options to set, an empty value removes the option
+	ExtraConfig map[string]string `json:"extra_config"`
+	// AddDisks are created like vm.Disks in AddDisk, their DiskFile is set
+	// to the vmdk file of the created disk
+	AddDisks []Disk `json:"add_disks"`
+	// RemoveDisks are matched on DiskFile, detached and their vmdk files
+	// deleted from the datastore
+	RemoveDisks []Disk `json:"remove_disks"`
+	// Networks are added or removed according to Network.Operation
+	Networks []Network `json:"networks"`
 }
 
 type Template struct {
@@ -550,11 +1386,56 @@ type Template struct {
 	InstanceUuid string `json:"instance_uuid"`
 }
 
+// TemplateInfo is the hardware of a template, see GetTemplateInfo. The size
+// of the disks is in bytes.
+type TemplateInfo struct {
+	Name            string   `json:"name"`
+	GuestID         string   `json:"guest_id"`
+	HardwareVersion string   `json:"hardware_version"`
+	Firmware        string   `json:"firmware"`
+	NumCPUs         int32    `json:"num_cpus"`
+	MemoryMB        int32    `json:"memory_mb"`
+	Disks           []Disk   `json:"disks"`
+	Networks        []string `json:"networks"`
+	// IsTemplate is false for the VMs used as templates of linked clones
+	IsTemplate bool `json:"is_template"`
+}
+
 type Network struct {
 	Name        string
 	Description string
 	Operation   string
-	DeviceKey   *int32 `json:"device_key"`
+	// Folder and DVSwitch, if set, select the port group of that name in
+	// the network folder or on the distributed switch when port groups of
+	// other folders or switches share its name.
+	Folder   string `json:"folder,omitempty"`
+	DVSwitch string `json:"dv_switch,omitempty"`
+	// DeviceKey is the key of the NIC to remove, or the key requested for
+	// the NIC added for the network so that the guest sees the same
+	// interface across re-provisions. Keys range from 4000 to 4999.
+	DeviceKey *int32 `json:"device_key"`
+	// AdapterType of the NICs added for the network: vmxnet3 (default),
+	// e1000, e1000e or sriov
+	AdapterType string `json:"adapter_type"`
+	// Teaming, if set, attaches the NICs to the ephemeral port group of
+	// that name on DVSwitch with the teaming policy. The port group is
+	// created unless it exists, it must then have the same policy.
+	Teaming *Teaming `json:"teaming,omitempty"`
+}
+
+// Teaming is the NIC teaming and failover policy of a port group on a
+// distributed switch.
+type Teaming struct {
+	// Policy is loadbalance_srcid, loadbalance_ip, loadbalance_srcmac,
+	// loadbalance_loadbased or failover_explicit
+	Policy string `json:"policy"`
+	// ActiveUplinks and StandbyUplinks are uplinks of the switch, like
+	// dvUplink1. The other uplinks are unused.
+	ActiveUplinks  []string `json:"active_uplinks"`
+	StandbyUplinks []string `json:"standby_uplinks,omitempty"`
+	// NotifySwitches and Failback are left to the switch when nil
+	NotifySwitches *bool `json:"notify_switches,omitempty"`
+	Failback       *bool `json:"failback,omitempty"`
 }
 
 var _ lvm.VirtualMachine = (*VM)(nil)
@@ -571,6 +1452,21 @@ type VM struct {
 	Password string
 	// Insecure allows connecting without cert validation when set to true.
 	Insecure bool
+	// CACertPool, if set, holds the CAs the certificates of vCenter and the
+	// hosts are verified against, instead of the system roots. Insecure is
+	// then ignored.
+	CACertPool *x509.CertPool `json:"-"`
+	// SessionCookie is the vmware_soap_session cookie of a session already
+	// logged in, e.g. by the application using libretto. It is used instead
+	// of Username and Password and is never logged out. A SAML token has to
+	// be exchanged for a session first, the SOAP client can't sign the
+	// LoginByToken request.
+	SessionCookie string `json:"-"`
+	// SharedSession reuses one logged in session for the VMs with the same
+	// Host and Username instead of logging in on every call. The session is
+	// kept alive while idle and logged out by CloseSession on the last VM
+	// using it.
+	SharedSession bool `json:"shared_session"`
 	// Datacenter configures the datacenter onto which to import the VM.
 	Datacenter string
 	//Flavor for the number of CPUs and size of main memory
@@ -581,11 +1477,42 @@ type VM struct {
 	// If OvaPathUrl is given then OvaPathUrl will be used, if not then OvfPath will be used
 	// If Both are given preference will be given to OvaPathUrl.
 	OvaPathUrl string
+	// OvaAuth, if set, are the HTTP Basic auth credentials sent to download
+	// the ova at OvaPathUrl, instead of those embedded in the url. They are
+	// only sent to the host of the url, not to the hosts it redirects to.
+	OvaAuth *url.Userinfo `json:"-"`
+	// OvfTransform, if set, rewrites the OVF descriptor before it is
+	// imported, e.g. to strip an unsupported controller.
+	OvfTransform func(string) (string, error) `json:"-"`
+	// OnDatastoreSelected, if set, is called with the datastore picked for
+	// the vm or its disks before the clone or reconfigure task is started.
+	// Returning an error aborts the operation.
+	OnDatastoreSelected func(datastore string) error `json:"-"`
+	// Events, if set, receives the steps of Provision, see State, and the
+	// progress of the template upload. An event is dropped when the channel
+	// is full, so a slow consumer never stalls the Provision. The channel
+	// isn't closed.
+	Events chan<- ProvisionEvent `json:"-"`
+	// SkipManifestVerification skips checking the files extracted from the
+	// ova against the digests in its manifest, for trusted sources. An ova
+	// without a manifest isn't checked either way.
+	SkipManifestVerification bool `json:"skip_manifest_verification"`
 	// Networks defines a slice of networks to be attached to the VM
 	// They must be available on the host or deploy will fail.
 	Networks []Network
 	// Name is the name to use for the VM on vSphere and internally.
 	Name string
+	// NameTemplate, if set, is a text/template rendered with a NameContext
+	// into Name once the datastore and host of the clone are picked, e.g.
+	// web-{{.Index}}-{{.Datastore}}. A VM of the rendered name is handled
+	// like set by OnNameCollision.
+	NameTemplate string `json:"name_template"`
+	// NameIndex is the Index of the NameContext. ProvisionAll sets it to the
+	// position of the VM.
+	NameIndex int `json:"name_index"`
+	// OnNameCollision is what Provision does when a VM of the name, or of
+	// the rendered NameTemplate, exists. Defaults to NameCollisionFail.
+	OnNameCollision NameCollision `json:"on_name_collision"`
 	// InstanceUuids is the list of instance uuids for the VMs on vcenter server
 	InstanceUuids []string
 	// Template is the name to use for the VM's template
@@ -600,33 +1527,229 @@ type VM struct {
 	// Credentials are the credentials to use when connecting to the VM over SSH
 	Credentials ssh.Credentials
 	// FixedDisks is a slice of existing disks which user wants to either expand/delete from VM
+	// A fixed disk with a Datastore is cloned to that datastore instead of
+	// the one of the VM, except for linked clones.
 	FixedDisks []Disk
+	// DiskShrinkRequested marks FixedDisks smaller than the template disks as
+	// intended. It doesn't shrink them, vSphere can't reduce the capacity of
+	// a vmdk: it only makes the clone fail with ErrorDiskShrinkNotSupported,
+	// which explains the risk of data loss, instead of
+	// ErrorDiskShrinkNotAllowed.
+	DiskShrinkRequested bool `json:"disk_shrink_requested"`
 	// Disks is a slice of extra disks to attach to the VM
 	Disks []Disk
+	// VerifyGuestDisks waits after the power on of a clone with Disks until
+	// the guest sees every disk of the VM, checking with a command run in
+	// the guest with Credentials. It fails with ErrorGuestDisksMissing after
+	// GuestDiskTimeout, which defaults to GUEST_DISK_TIMEOUT.
+	VerifyGuestDisks bool          `json:"verify_guest_disks"`
+	GuestDiskTimeout time.Duration `json:"guest_disk_timeout"`
+	// Controllers is a slice of SCSI controllers to add to the cloned VM
+	// before the extra disks
+	Controllers []Controller
 	// QuestionResponses is a map of regular expressions to match question text
 	// to responses when a VM encounters a questions which would otherwise
 	// prevent normal operation. The response strings should be the string value
 	// of the intended response index.
 	QuestionResponses map[string]string
+	// DefaultQuestionResponse answers the questions no regular expression of
+	// QuestionResponses matches, e.g. "button.uuid.copiedTheVM". It is an
+	// index, a summary or a label of the choices.
+	DefaultQuestionResponse string `json:"default_question_response"`
+	// FailOnUnansweredQuestion returns ErrorUnansweredQuestion for a question
+	// that no response answers, instead of leaving the VM blocked on it.
+	FailOnUnansweredQuestion bool `json:"fail_on_unanswered_question"`
+	// CheckHostCapacity skips hosts whose unused CPU or memory can't
+	// accommodate the Flavor when picking a host
+	CheckHostCapacity bool `json:"check_host_capacity"`
 	// UseLinkedClones is a flag to indicate whether VMs cloned from templates should be
 	// linked clones.
 	UseLinkedClones bool
+	// CloneDiskProvisioning converts the disks of the template to thin, thick
+	// or eagerzeroedthick disks when cloning. The disks keep the provisioning
+	// of the template by default. It is ignored for linked clones, whose disks
+	// are children of the disks of the template. Datastore cluster
+	// destinations only support thin and thick.
+	CloneDiskProvisioning string `json:"clone_disk_provisioning"`
+	// UploadTimeout is the maximum duration of a single file upload to the
+	// NFC lease. Zero means no limit.
+	UploadTimeout time.Duration `json:"upload_timeout"`
+	// MaxConcurrentUploads is the number of files of an ovf uploaded at
+	// once. Defaults to 1.
+	MaxConcurrentUploads int `json:"max_concurrent_uploads"`
+	// UploadIdleTimeout aborts an upload on which no data moved for the
+	// duration. Defaults to UPLOAD_IDLE_TIMEOUT.
+	UploadIdleTimeout time.Duration `json:"upload_idle_timeout"`
+	// UploadResponseTimeout aborts an upload whose host doesn't answer for
+	// the duration once the file is sent. Defaults to
+	// UPLOAD_RESPONSE_TIMEOUT.
+	UploadResponseTimeout time.Duration `json:"upload_response_timeout"`
+	// ShutdownTimeout is how long to wait for the guest to shut down.
+	// Defaults to RETRY_COUNT polls of SHUTDOWN_POLL_INTERVAL.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+	// ShutdownPollInterval is the period at which the state of a shutting
+	// down guest is checked. Defaults to SHUTDOWN_POLL_INTERVAL.
+	ShutdownPollInterval time.Duration `json:"shutdown_poll_interval"`
+	// ForcePowerOffOnShutdownTimeout powers the vm off when its guest didn't
+	// shut down within ShutdownTimeout, instead of returning
+	// ErrorGuestShutdownTimeout.
+	ForcePowerOffOnShutdownTimeout bool `json:"force_power_off_on_shutdown_timeout"`
 	// Skip waiting for IP to be assigned to VM in create/start actions
 	SkipIPWait bool `json:"skip_ip_wait"`
+	// IPWaitPolicy is the family of the IPs every NIC needs before the IP
+	// wait succeeds: IPWaitPolicyV4 (default), IPWaitPolicyV6, IPWaitPolicyBoth
+	// or IPWaitPolicyAny
+	IPWaitPolicy string `json:"ip_wait_policy"`
+	// PreferredIPNetwork is a CIDR, e.g. "10.0.0.0/8". When set, the IP
+	// wait only returns an IP inside it, instead of applying IPWaitPolicy,
+	// and GetIPs only returns the IPs inside it.
+	PreferredIPNetwork string `json:"preferred_ip_network"`
+	// SkipPowerOn leaves the cloned VM powered off, so the caller controls
+	// when it is started. Waiting for the IP is skipped as well.
+	SkipPowerOn bool `json:"skip_power_on"`
 	// NestedHV is a flag to enable nested hardware-assisted virtualization
-	NestedHV       bool `json:"nested_hv"`
-	uri            *url.URL
-	ctx            context.Context
-	cancel         context.CancelFunc
-	client         *govmomi.Client
-	finder         finder
-	collector      collector
-	datastore      string
-	NetworkSetting lvm.NetworkSetting
-}
-
-// Provision provisions this VM.
+	NestedHV bool `json:"nested_hv"`
+	// AddVTPM is a flag to add a virtual TPM to the cloned VM. The template
+	// needs EFI firmware with secure boot and vCenter needs a key provider.
+	AddVTPM bool `json:"add_vtpm"`
+	// VideoCard changes the video memory, displays and 3D support of the
+	// cloned VM.
+	VideoCard *VideoCard `json:"video_card"`
+	// SkipCustomization is a flag to clone without guest customization, e.g.
+	// for DHCP templates that configure themselves.
+	SkipCustomization bool `json:"skip_customization"`
+	// InMemoryCustomization builds the customization spec of the clone in
+	// memory instead of storing it in the CustomizationSpecManager, which
+	// leaves no spec in vCenter and doesn't serialize clones.
+	InMemoryCustomization bool `json:"in_memory_customization"`
+	// CustomizationSpecName is the name of an existing customization spec in
+	// vCenter used instead of the built-in static ip one. The network
+	// settings are applied on top of it.
+	CustomizationSpecName string `json:"customization_spec_name"`
+	// Sysprep customizes Windows clones. The network settings apply as for
+	// Linux clones.
+	Sysprep *Sysprep `json:"sysprep"`
+	// PostCloneScript is run in the guest with its credentials after the
+	// cloned VM is started. VMware Tools need to be running in the guest.
+	PostCloneScript *PostCloneScript `json:"post_clone_script"`
+	// MinHardwareVersion is the lowest hardware version (e.g. "vmx-13") of
+	// the imported or cloned VM. Older VMs are upgraded during creation.
+	MinHardwareVersion string `json:"min_hardware_version"`
+	uri                *url.URL
+	ctx                context.Context
+	cancel             context.CancelFunc
+	client             *govmomi.Client
+	finder             Finder
+	collector          Collector
+	datastore          string
+	preferredIP        net.IP
+	NetworkSetting     lvm.NetworkSetting
+	// NetworkSettings are the ip settings of the nics, in the order of
+	// Networks, and take precedence over NetworkSetting. The nics without
+	// settings use DHCP.
+	NetworkSettings []lvm.NetworkSetting
+	// datacenters caches GetDatacenter by name for the session
+	datacenterMutex sync.Mutex
+	datacenters     map[string]*mo.Datacenter
+	// state is the step of the last Provision
+	stateMutex sync.Mutex
+	state      ProvisioningState
+	// leaseState is the final state of the nfc lease of the last upload
+	leaseStateMutex sync.Mutex
+	leaseState      LeaseState
+	// diskDatastores maps the vmdk files of the disks of the cloned vm to
+	// their datastore
+	diskDatastores map[string]string
+	// uploadTransport is shared by the uploads of the files of an ovf
+	uploadTransportMutex sync.Mutex
+	uploadTransport      *http.Transport
+	// guestTransport is shared by the file transfers to and from the guest
+	guestTransportMutex sync.Mutex
+	guestTransport      *http.Transport
+	// sessionKey is the key of the shared session used by the vm
+	sessionKey string
+	// provisionDone marks the Provision in progress as done on each of the
+	// names it is marked on, by their operation key
+	provisionDone map[string]func()
+	// parentCtx is the context of SetupSessionWithContext, the parent of the
+	// contexts of the sessions
+	parentCtx context.Context
+	// cancelCtx is cancelled by Cancel, it is the parent of the contexts of
+	// the sessions until then
+	cancelMutex sync.Mutex
+	cancelCtx   context.Context
+	cancelAll   context.CancelFunc
+}
+
+// Cancel aborts the calls in progress on the VM, like a Provision waiting for
+// the clone task or for the IP. They return once the wait they are in sees
+// the context cancelled. The calls made after Cancel aren't affected.
+func (vm *VM) Cancel() {
+	vm.cancelMutex.Lock()
+	defer vm.cancelMutex.Unlock()
+	if vm.cancelAll != nil {
+		vm.cancelAll()
+		vm.cancelCtx, vm.cancelAll = nil, nil
+	}
+}
+
+// CloseSession releases the shared session of the VM, see SharedSession. The
+// session is logged out once no VM uses it anymore. The next call on the VM
+// shares or opens a session again.
+func (vm *VM) CloseSession() error {
+	sharedSessionsMutex.Lock()
+	s := releaseSession(vm)
+	sharedSessionsMutex.Unlock()
+	return logoutSession(s)
+}
+
+// DiskDatastores returns the datastore of each disk of the VM created by the
+// last Provision, by vmdk file. The disks of the template and the added disks
+// may be on different datastores.
+func (vm *VM) DiskDatastores() map[string]string {
+	datastores := make(map[string]string, len(vm.diskDatastores))
+	for file, ds := range vm.diskDatastores {
+		datastores[file] = ds
+	}
+	return datastores
+}
+
+// State returns the step the provision of the VM is at. It can be polled
+// while Provision runs, and is ProvisioningStateDone or
+// ProvisioningStateFailed once it returned.
+func (vm *VM) State() ProvisioningState {
+	vm.stateMutex.Lock()
+	defer vm.stateMutex.Unlock()
+	return vm.state
+}
+
+// LeaseState returns the final state of the nfc lease of the last template
+// upload of the VM, LeaseStateNone while no upload finished.
+func (vm *VM) LeaseState() LeaseState {
+	vm.leaseStateMutex.Lock()
+	defer vm.leaseStateMutex.Unlock()
+	return vm.leaseState
+}
+
+// Provision provisions this VM. It returns the ErrorIPWaitSkipped warning
+// once done if the IP of the VM couldn't be waited for.
 func (vm *VM) Provision() (err error) {
+	if err := validateNameCollision(vm.OnNameCollision); err != nil {
+		return err
+	}
+	done, err := beginProvision(vm)
+	if err != nil {
+		return err
+	}
+	defer done()
+	setProvisioningState(vm, ProvisioningStateConnecting)
+	defer func() {
+		if _, ok := err.(ErrorIPWaitSkipped); err != nil && !ok {
+			setProvisioningState(vm, ProvisioningStateFailed)
+		} else {
+			setProvisioningState(vm, ProvisioningStateDone)
+		}
+	}()
 	if err := SetupSession(vm); err != nil {
 		return fmt.Errorf("Error setting up vSphere session: %v", err)
 	}
@@ -646,6 +1769,11 @@ func (vm *VM) Provision() (err error) {
 	if !vm.UseLocalTemplates && len(vm.Datastores) != 0 {
 		datastores = []string{util.ChooseRandomString(vm.Datastores)}
 	}
+	// Storage DRS picks the datastore when none is given
+	if vm.Destination.DestinationType == DestinationTypeDatastoreCluster &&
+		len(datastores) == 0 {
+		datastores = []string{""}
+	}
 
 	var template string
 	template = vm.Template.Name
@@ -689,22 +1817,43 @@ func (vm *VM) Provision() (err error) {
 		usableDatastores = append(usableDatastores, d)
 	}
 
-	// Does the VM already exist?
-	e, err := Exists(vm, getVMSearchFilter(vm.Name))
-	if err != nil {
-		return fmt.Errorf("failed to check if the vm already exists: %v", err)
-	}
-	if e {
-		return ErrorVMExists
+	// Does the VM already exist? The name of a NameTemplate is only known
+	// at clone time, when it is checked.
+	if vm.NameTemplate == "" {
+		reuse, err := resolveNameCollision(vm)
+		if err != nil {
+			return err
+		}
+		if reuse {
+			return nil
+		}
+		// A suffixed name is guarded as well
+		if err = guardProvisionName(vm); err != nil {
+			return err
+		}
 	}
 
 	err = cloneFromTemplate(vm, dcMo, usableDatastores)
+	if _, ok := err.(ErrorIPWaitSkipped); ok {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("error while cloning vm from template: %v", err)
 	}
 	return
 }
 
+// ProvisionAll provisions the VMs, at most concurrency at a time, or all of
+// them at once if concurrency isn't positive. The NameIndex of each VM is set
+// to its position, for its NameTemplate. The errors are aligned with the VMs,
+// nil for the ones provisioned.
+func ProvisionAll(vms []*VM, concurrency int) []error {
+	for i, vm := range vms {
+		vm.NameIndex = i
+	}
+	return forEachVM(vms, concurrency, (*VM).Provision)
+}
+
 // GetName returns the name of this VM.
 func (vm *VM) GetName() string {
 	return vm.Name
@@ -712,6 +1861,11 @@ func (vm *VM) GetName() string {
 
 // AddDisk: adds given list of disks to the vm
 func (vm *VM) AddDisk() error {
+	done, err := beginOperation(vm, "add disk")
+	if err != nil {
+		return err
+	}
+	defer done()
 	if err := SetupSession(vm); err != nil {
 		return fmt.Errorf("Error setting up vSphere session: %v", err)
 	}
@@ -727,7 +1881,9 @@ func (vm *VM) AddDisk() error {
 	}
 
 	// Gets a random datastore from the list of datastores to create disk
-	vm.datastore = util.ChooseRandomString(vm.Datastores)
+	if err = chooseDatastore(vm, vm.Datastores); err != nil {
+		return err
+	}
 
 	// Reconfigures vm with the new Disk
 	err = reconfigureVM(vm, vmMo)
@@ -742,6 +1898,11 @@ func (vm *VM) AddDisk() error {
 // disk.DiskFile is the name of the vmdk file for the disk
 func (vm *VM) RemoveDisk() error {
 	var errorMessage string
+	done, err := beginOperation(vm, "remove disk")
+	if err != nil {
+		return err
+	}
+	defer done()
 	if err := SetupSession(vm); err != nil {
 		return fmt.Errorf("Error setting up vSphere session: %v", err)
 	}
@@ -756,6 +1917,9 @@ func (vm *VM) RemoveDisk() error {
 			vm.Name, err)
 	}
 
+	if vmMo.Config == nil {
+		return NewErrorConfigNotAvailable(vm.Name)
+	}
 	for _, disk := range vm.Disks {
 		// find the virtual disk to be removed from the vm
 		var deviceMo *types.VirtualDisk
@@ -946,13 +2110,36 @@ func (vm *VM) GetIPsAndIds() (VMInfo, error) {
 
 // GetIPs returns the IPs of this VM. Returns all the IPs known to the API for
 // the different network cards for this VM. Includes IPV4 and IPV6 addresses.
+// With PreferredIPNetwork only the IPs inside it are returned, or else the
+// one the IP wait resolved.
 func (vm *VM) GetIPs() ([]net.IP, error) {
 	vmInfo, err := vm.GetIPsAndIds()
-	return vmInfo.IpAddress, err
+	if err != nil || vm.PreferredIPNetwork == "" {
+		return vmInfo.IpAddress, err
+	}
+	_, network, err := net.ParseCIDR(vm.PreferredIPNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preferred ip network: %v", err)
+	}
+	var ips []net.IP
+	for _, ip := range vmInfo.IpAddress {
+		if network.Contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 && vm.preferredIP != nil {
+		ips = append(ips, vm.preferredIP)
+	}
+	return ips, nil
 }
 
 // Destroy deletes this VM from vSphere.
 func (vm *VM) Destroy() (err error) {
+	done, err := beginOperation(vm, "destroy")
+	if err != nil {
+		return err
+	}
+	defer done()
 	if err := SetupSession(vm); err != nil {
 		return err
 	}
@@ -979,8 +2166,11 @@ func (vm *VM) Destroy() (err error) {
 
 	for powerState != "poweredOff" {
 		// Only possible states are poweredOff, poweredOn, suspended
-		if !isTaskInProgress(vm, vmMo) {
-			waitForTasksToFinish(vm, vmMo.RecentTask)
+		if isTaskInProgress(vm, vmMo) {
+			err = waitForTasksToFinish(vm, vmMo.RecentTask, TASK_WAIT_TIMEOUT)
+			if err != nil {
+				break
+			}
 		} else {
 			e := halt(vm)
 			if e != nil {
@@ -994,7 +2184,9 @@ func (vm *VM) Destroy() (err error) {
 			}
 		}
 
-		time.Sleep(time.Second)
+		if err = sleepContext(vm.ctx, time.Second); err != nil {
+			break
+		}
 		powerState, err = getPowerState(vm)
 		if err != nil {
 			break
@@ -1034,6 +2226,50 @@ func getToolsStatus(vmMo *mo.VirtualMachine) (bool, bool) {
 	return toolsRunning, toolsInstalled
 }
 
+// getDevicesInfo: returns the info of all the devices of this VM
+func getDevicesInfo(vmMo mo.VirtualMachine) []DeviceInfo {
+	var devicesInfo []DeviceInfo
+	if vmMo.Config == nil {
+		return devicesInfo
+	}
+	devices := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
+	for _, device := range devices {
+		d := device.GetVirtualDevice()
+		info := DeviceInfo{
+			Key:           d.Key,
+			Type:          devices.Type(device),
+			ControllerKey: d.ControllerKey,
+			UnitNumber:    d.UnitNumber,
+			Backing:       backingSummary(d.Backing),
+		}
+		if d.DeviceInfo != nil {
+			desc := d.DeviceInfo.GetDescription()
+			info.Label = desc.Label
+			info.Summary = desc.Summary
+		}
+		devicesInfo = append(devicesInfo, info)
+	}
+	return devicesInfo
+}
+
+// backingSummary: returns what backs a device, the file, host device, uri or
+// network, or the type of the backing
+func backingSummary(backing types.BaseVirtualDeviceBackingInfo) string {
+	switch b := backing.(type) {
+	case nil:
+		return ""
+	case types.BaseVirtualDeviceFileBackingInfo:
+		return b.GetVirtualDeviceFileBackingInfo().FileName
+	case types.BaseVirtualDeviceDeviceBackingInfo:
+		return b.GetVirtualDeviceDeviceBackingInfo().DeviceName
+	case types.BaseVirtualDeviceURIBackingInfo:
+		return b.GetVirtualDeviceURIBackingInfo().ServiceURI
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		return b.Port.PortgroupKey
+	}
+	return reflect.TypeOf(backing).Elem().Name()
+}
+
 //getDisksInfo  returns the disks info of this VM.
 func getDisksInfo(vmMo mo.VirtualMachine) []Disk {
 	var disksInfo []Disk
@@ -1061,8 +2297,16 @@ func getDisksInfo(vmMo mo.VirtualMachine) []Disk {
 				backing := disk.Backing
 				fileBackingInfo := backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo()
 				diskInfo.DiskFile = fileBackingInfo.FileName
-				if *(backing.(*types.VirtualDiskFlatVer2BackingInfo)).ThinProvisioned {
+				var dsPath object.DatastorePath
+				if dsPath.FromString(diskInfo.DiskFile) {
+					diskInfo.Datastore = dsPath.Datastore
+				}
+				diskInfo.Mode = backing.(*types.VirtualDiskFlatVer2BackingInfo).DiskMode
+				flatBacking := backing.(*types.VirtualDiskFlatVer2BackingInfo)
+				if *flatBacking.ThinProvisioned {
 					diskInfo.Provisioning = "thin"
+				} else if flatBacking.EagerlyScrub != nil && *flatBacking.EagerlyScrub {
+					diskInfo.Provisioning = "eagerzeroedthick"
 				} else {
 					diskInfo.Provisioning = "thick"
 				}
@@ -1075,6 +2319,96 @@ func getDisksInfo(vmMo mo.VirtualMachine) []Disk {
 	return disksInfo
 }
 
+// getVMSummary: returns the properties of the vm managed object in a VMInfo
+func getVMSummary(vmMo *mo.VirtualMachine) *VMInfo {
+	info := &VMInfo{
+		VMId:             vmMo.Self.Value,
+		InstanceId:       vmMo.Summary.Config.InstanceUuid,
+		IpAddress:        getIpFromVmMo(vmMo),
+		OverallCpuUsage:  int64(vmMo.Summary.QuickStats.OverallCpuUsage),
+		GuestMemoryUsage: int64(vmMo.Summary.QuickStats.GuestMemoryUsage),
+		MaxCpuUsage:      vmMo.Runtime.MaxCpuUsage,
+		MaxMemoryUsage:   vmMo.Runtime.MaxMemoryUsage,
+		NumCpu:           vmMo.Summary.Config.NumCpu,
+		PowerState:       string(vmMo.Runtime.PowerState),
+		MemorySizeMB:     vmMo.Summary.Config.MemorySizeMB,
+		DisksInfo:        getDisksInfo(*vmMo),
+	}
+	// Templates and newly registered vms have no guest info
+	if vmMo.Guest != nil {
+		info.ToolsRunningStatus, info.ToolsInstalled = getToolsStatus(vmMo)
+		info.GuestState = vmMo.Guest.GuestState
+		info.ToolsVersion = vmMo.Guest.ToolsVersion
+	}
+	return info
+}
+
+// GetProperties returns a summary of this VM: its power and guest state,
+// CPUs and memory, the status and version of VMware Tools, the names of its
+// datastores and networks, its IPs, instance UUID and folder.
+func (vm *VM) GetProperties() (*VMInfo, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return nil, err
+	}
+	info := getVMSummary(vmMo)
+	info.NicInfo = getNicInfo(vm, *vmMo)
+	for _, nic := range info.NicInfo {
+		info.Networks = append(info.Networks, nic.NetworkName)
+	}
+	info.Datastores, err = getDatastoreForVm(vm, vmMo)
+	if err != nil {
+		return nil, err
+	}
+	info.FolderPath, err = getFolderPath(vm, vmMo.Reference())
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetTemplateInfo returns the hardware of vm.Template and the networks of its
+// NICs, so that the Flavor, Disks and Networks of the VM can be checked
+// against it before cloning.
+func GetTemplateInfo(vm *VM) (TemplateInfo, error) {
+	if err := SetupSession(vm); err != nil {
+		return TemplateInfo{}, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getTempSearchFilter(vm.Template))
+	if err != nil {
+		return TemplateInfo{}, err
+	}
+	return getTemplateInfo(vm, vmMo)
+}
+
+// getTemplateInfo: returns the hardware of the template managed object
+func getTemplateInfo(vm *VM, vmMo *mo.VirtualMachine) (TemplateInfo, error) {
+	if vmMo.Config == nil {
+		return TemplateInfo{}, NewErrorConfigNotAvailable(vmMo.Name)
+	}
+	info := TemplateInfo{
+		Name:            vmMo.Name,
+		GuestID:         vmMo.Config.GuestId,
+		HardwareVersion: vmMo.Config.Version,
+		Firmware:        vmMo.Config.Firmware,
+		NumCPUs:         vmMo.Config.Hardware.NumCPU,
+		MemoryMB:        vmMo.Config.Hardware.MemoryMB,
+		Disks:           getDisksInfo(*vmMo),
+		IsTemplate:      vmMo.Config.Template,
+	}
+	for _, nic := range getNicInfo(vm, *vmMo) {
+		info.Networks = append(info.Networks, nic.NetworkName)
+	}
+	return info, nil
+}
+
 //GetVMInfo returns information of this VM.
 func (vm *VM) GetVMInfo() (VMInfo, error) {
 	var vmInfo VMInfo
@@ -1116,160 +2450,884 @@ func (vm *VM) GetVMInfo() (VMInfo, error) {
 	return vmInfo, nil
 }
 
-// GetState returns the power state of this VM.
-func (vm *VM) GetState() (state string, err error) {
+// GetGuestDiskUsage returns the capacity and free space of every filesystem
+// mounted in the guest. VMware Tools needs to be running in the guest.
+func GetGuestDiskUsage(vm *VM) ([]GuestDisk, error) {
 	if err := SetupSession(vm); err != nil {
-		return "", lvm.ErrVMInfoFailed
+		return nil, err
 	}
 	defer vm.cancel()
 
-	state, err = getState(vm)
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if vmMo.Guest == nil {
+		return nil, NewErrorToolsNotRunning(vm.Name, "")
+	}
+	if toolsRunning, _ := getToolsStatus(vmMo); !toolsRunning {
+		return nil, NewErrorToolsNotRunning(vm.Name,
+			vmMo.Guest.ToolsRunningStatus)
 	}
 
-	if state == "running" {
-		return lvm.VMRunning, nil
-	} else if state == "standby" {
-		return lvm.VMSuspended, nil
-	} else if state == "shuttingDown" || state == "resetting" || state == "notRunning" {
-		return lvm.VMHalted, nil
+	guestDisks := make([]GuestDisk, 0)
+	for _, disk := range vmMo.Guest.Disk {
+		guestDisks = append(guestDisks, GuestDisk{
+			DiskPath:  disk.DiskPath,
+			Capacity:  disk.Capacity,
+			FreeSpace: disk.FreeSpace,
+		})
 	}
-	// VM state "unknown"
-	return "", lvm.ErrVMInfoFailed
+	return guestDisks, nil
 }
 
-// Suspend suspends this VM.
-func (vm *VM) Suspend() (err error) {
+// GetGuestInfo returns the hostname, operating system and IP stack reported
+// by the guest of this VM.
+func GetGuestInfo(vm *VM) (GuestInfo, error) {
+	var guestInfo GuestInfo
 	if err := SetupSession(vm); err != nil {
-		return err
+		return guestInfo, err
 	}
 	defer vm.cancel()
 
 	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
-		return err
+		return guestInfo, err
 	}
-	vmo := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
-	suspendTask, err := vmo.Suspend(vm.ctx)
-	if err != nil {
-		return fmt.Errorf("error creating a suspend task on the vm: %v", err)
+	if vmMo.Guest == nil {
+		return guestInfo, NewErrorToolsNotRunning(vm.Name, "")
 	}
-	tInfo, err := suspendTask.WaitForResult(vm.ctx, nil)
-	if err != nil {
-		return fmt.Errorf("error waiting for suspend task: %v", err)
+
+	guestInfo = GuestInfo{
+		HostName:      vmMo.Guest.HostName,
+		GuestId:       vmMo.Guest.GuestId,
+		GuestFullName: vmMo.Guest.GuestFullName,
+		IpStack:       getGuestIPStack(vmMo.Guest.IpStack),
+		Nics:          getGuestNics(vmMo.Guest.Net),
 	}
-	if tInfo.Error != nil {
-		return fmt.Errorf("suspend task returned an error: %v", err)
+	return guestInfo, nil
+}
+
+// getGuestNics: converts the nics reported by the guest to GuestNic
+func getGuestNics(nics []types.GuestNicInfo) []GuestNic {
+	guestNics := make([]GuestNic, 0)
+	for _, nic := range nics {
+		guestNic := GuestNic{
+			Network:     nic.Network,
+			MacAddress:  nic.MacAddress,
+			Connected:   nic.Connected,
+			IpAddresses: nic.IpAddress,
+		}
+		for _, s := range nic.IpAddress {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				guestNic.IPv4 = append(guestNic.IPv4, ip)
+			} else {
+				guestNic.IPv6 = append(guestNic.IPv6, ip)
+			}
+		}
+		guestNics = append(guestNics, guestNic)
 	}
-	return nil
+	return guestNics
 }
 
-// Halt halts this VM.
-func (vm *VM) Halt() (err error) {
+// IsReady returns true if this VM is ready for use: powered on, with VMware
+// Tools running, a green guest heartbeat and an IP. The details tell which
+// check failed.
+func IsReady(vm *VM) (bool, ReadyDetails, error) {
 	if err := SetupSession(vm); err != nil {
-		return err
+		return false, ReadyDetails{}, err
 	}
 	defer vm.cancel()
-	return halt(vm)
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return false, ReadyDetails{}, err
+	}
+	ps := []string{GUEST_HEART_BEAT_STATUS}
+	err = vm.collector.RetrieveOne(vm.ctx, vmMo.Reference(), ps, vmMo)
+	if err != nil {
+		return false, ReadyDetails{}, NewErrorPropertyRetrieval(vmMo.Reference(), ps, err)
+	}
+	ready, details := getReadyDetails(vmMo)
+	return ready, details, nil
 }
 
-// ShutDown Initiates guest shut down of this VM.
-func (vm *VM) ShutDown() (err error) {
+// getReadyDetails: returns the readiness of the vm and what it is based on
+func getReadyDetails(vmMo *mo.VirtualMachine) (bool, ReadyDetails) {
+	details := ReadyDetails{
+		PowerState:      string(vmMo.Runtime.PowerState),
+		HeartbeatStatus: string(vmMo.GuestHeartbeatStatus),
+		IPs:             getIpFromVmMo(vmMo),
+	}
+	if vmMo.Guest != nil {
+		details.ToolsRunning, _ = getToolsStatus(vmMo)
+	}
+	ready := vmMo.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn &&
+		details.ToolsRunning &&
+		vmMo.GuestHeartbeatStatus == types.ManagedEntityStatusGreen &&
+		len(details.IPs) > 0
+	return ready, details
+}
+
+// RunInGuest starts the program in the guest of this VM with the arguments and
+// the environment variables, in the form "NAME=value", and returns its pid.
+// It doesn't wait for the program to exit, see GetGuestProcessExitCode.
+// VMware Tools needs to be running in the guest.
+func (vm *VM) RunInGuest(auth GuestCredentials, program string, args string, env []string) (int64, error) {
 	if err := SetupSession(vm); err != nil {
-		return err
+		return 0, err
 	}
 	defer vm.cancel()
-	return shutDown(vm)
+
+	vmMo, err := findGuestVM(vm)
+	if err != nil {
+		return 0, err
+	}
+	return startGuestProgram(vm, vmMo.Reference(), auth, types.GuestProgramSpec{
+		ProgramPath:  program,
+		Arguments:    args,
+		EnvVariables: env,
+	})
 }
 
-// Restart Initiates guest reboot of this VM.
-func (vm *VM) Restart() (err error) {
+// GetGuestProcessExitCode returns the exit code of the process started by
+// RunInGuest, or an ErrorGuestProcessRunning if it hasn't exited yet.
+func (vm *VM) GetGuestProcessExitCode(auth GuestCredentials, pid int64) (int32, error) {
 	if err := SetupSession(vm); err != nil {
-		return err
+		return 0, err
 	}
 	defer vm.cancel()
-	return restart(vm)
+
+	vmMo, err := findGuestVM(vm)
+	if err != nil {
+		return 0, err
+	}
+	process, err := getGuestProcess(vm.ctx, vm, vmMo.Reference(), auth, pid)
+	if err != nil {
+		return 0, err
+	}
+	if process.EndTime == nil {
+		return 0, NewErrorGuestProcessRunning(pid)
+	}
+	return process.ExitCode, nil
 }
 
-// Start powers on this VM.
-func (vm *VM) Start() (err error) {
+// RunInGuestAndWait runs the program in the guest like RunInGuest and waits
+// for it to exit, or for ctx to be done, e.g. on its timeout. Returns the exit
+// code of the program.
+func (vm *VM) RunInGuestAndWait(ctx context.Context, auth GuestCredentials, program string, args string, env []string) (int32, error) {
 	if err := SetupSession(vm); err != nil {
-		return err
+		return 0, err
 	}
 	defer vm.cancel()
-	return start(vm)
+	// Stop the calls to vCenter when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			vm.cancel()
+		case <-stop:
+		}
+	}()
+
+	vmMo, err := findGuestVM(vm)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := startGuestProgram(vm, vmMo.Reference(), auth, types.GuestProgramSpec{
+		ProgramPath:  program,
+		Arguments:    args,
+		EnvVariables: env,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pollGuestProcess(ctx, vm, vmMo.Reference(), auth, pid)
 }
 
-// Reset restarts this VM.
-func (vm *VM) Reset() (err error) {
+// GetNetworkInterfaces returns the NICs of this VM with their MAC address,
+// network and IPv4/IPv6 addresses as reported by the guest. VMware Tools needs
+// to be running in the guest.
+func (vm *VM) GetNetworkInterfaces() ([]GuestNic, error) {
 	if err := SetupSession(vm); err != nil {
-		return err
+		return nil, err
 	}
 	defer vm.cancel()
-	return reset(vm)
+
+	vmMo, err := findGuestVM(vm)
+	if err != nil {
+		return nil, err
+	}
+	return getGuestNics(vmMo.Guest.Net), nil
 }
 
-// Resume resumes this VM from a suspended or powered off state.
-func (vm *VM) Resume() (err error) {
-	return vm.Start()
+// getGuestIPStack: converts the ip stacks reported by the guest to
+// GuestIPStack
+func getGuestIPStack(stacks []types.GuestStackInfo) []GuestIPStack {
+	ipStack := make([]GuestIPStack, 0)
+	for _, stack := range stacks {
+		var s GuestIPStack
+		if stack.DnsConfig != nil {
+			s.HostName = stack.DnsConfig.HostName
+			s.DomainName = stack.DnsConfig.DomainName
+			s.DnsServers = stack.DnsConfig.IpAddress
+			s.SearchDomains = stack.DnsConfig.SearchDomain
+		}
+		if stack.IpRouteConfig != nil {
+			for _, route := range stack.IpRouteConfig.IpRoute {
+				// default routes have a zero prefix length
+				if route.PrefixLength != 0 ||
+					route.Gateway.IpAddress == "" {
+					continue
+				}
+				s.DefaultGateways = append(s.DefaultGateways,
+					route.Gateway.IpAddress)
+			}
+		}
+		ipStack = append(ipStack, s)
+	}
+	return ipStack
 }
 
-// GetSSH returns an ssh client configured for this VM.
-func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
-	ips, err := util.GetVMIPs(vm, options)
+// GetCurrentHost returns the name of the host the VM runs on now. It may
+// differ from the host chosen at clone time after DRS migrated the VM.
+func GetCurrentHost(vm *VM) (string, error) {
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return getHostName(vm, vmMo)
+}
 
-	client := ssh.SSHClient{Creds: &vm.Credentials, IP: ips[0], Port: 22, Options: options}
-	return &client, nil
+// GetBiosUUID returns the BIOS UUID of the vm, config.uuid, which the guest
+// sees as its SMBIOS system UUID. The instance UUID is in Summary.
+func GetBiosUUID(vm *VM) (string, error) {
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return "", err
+	}
+	if vmMo.Config == nil {
+		return "", NewErrorConfigNotAvailable(vm.Name)
+	}
+	return vmMo.Config.Uuid, nil
 }
 
-func deleteVM(vm *VM, vmMor *mo.VirtualMachine) error {
-	// create vm object for found vm-template and calls destroy function on the vm
-	vmo := object.NewVirtualMachine(vm.client.Client, vmMor.Reference())
-	task, err := vmo.Destroy(vm.ctx)
+// SetBiosUUID sets the BIOS UUID of the vm, e.g. to keep the UUID of a vm that
+// is re-provisioned. The VM needs to be powered off.
+func SetBiosUUID(vm *VM, uuid string) error {
+	if err := validateBiosUUID(uuid); err != nil {
+		return err
+	}
+	done, err := beginOperation(vm, "reconfigure")
 	if err != nil {
 		return err
 	}
-	// wait for the task to complete and checks for the errors if any
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	if vmMo.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		return ErrorVMNotPoweredOff
+	}
+
+	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	task, err := vmObj.Reconfigure(vm.ctx,
+		types.VirtualMachineConfigSpec{Uuid: uuid})
+	if err != nil {
+		return fmt.Errorf("error creating a reconfigure task: %v", err)
+	}
 	tInfo, err := task.WaitForResult(vm.ctx, nil)
 	if err != nil {
-		return fmt.Errorf("Error waiting for task : %v", err)
+		return fmt.Errorf("error waiting for reconfig task to finish: %v",
+			err)
 	}
 	if tInfo.Error != nil {
-		return fmt.Errorf("Destroy task returned error : %v", tInfo.Error)
+		return fmt.Errorf("reconfig task finished with error: %v",
+			tInfo.Error.LocalizedMessage)
 	}
 	return nil
 }
 
-// DeleteTemplate deletes the vm-template, created during vm provisioning
-func DeleteTemplate(vm *VM) error {
-	// for the templates that do not exist in server
-	missingTemplates := make([]string, 0)
+// ConsolidateToDatastore moves the files and every disk of the VM to the
+// datastore with a storage vMotion, e.g. after a clone scattered the disks
+// over several datastores. The VM may be powered on.
+func ConsolidateToDatastore(vm *VM, datastore string) error {
+	done, err := beginOperation(vm, "relocate")
+	if err != nil {
+		return err
+	}
+	defer done()
 	if err := SetupSession(vm); err != nil {
 		return err
 	}
+	defer vm.cancel()
 
-	// find and delete vm-templates from all provided datastores
-	if !vm.UseLocalTemplates {
-		vmMo, err := findVM(vm, getTempSearchFilter(vm.Template))
-		if err != nil {
-			return err
-		}
-		err = deleteVM(vm, vmMo)
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
 		return err
 	}
-	for _, datastore := range vm.Datastores {
-		// generate template name <provided-name>-<datastore-name>
-		templateCopy := vm.Template
-		templateCopy.Name = createTemplateName(vm.Template.Name, datastore)
-		// finds the template vm in Host specified in vm.Destination in Datacenter dcMo
-		templateVm, err := findVM(vm, getTempSearchFilter(templateCopy))
-		if err != nil {
-			// add to missing templates list if it doesn't exist or in case of error
-			missingTemplates = append(missingTemplates, templateCopy.Name)
+	dsMo, err := findDatastore(vm, dcMo, datastore)
+	if err != nil {
+		return err
+	}
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	spec, err := consolidateRelocateSpec(vmMo, dsMo.Reference())
+	if err != nil {
+		return err
+	}
+
+	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	task, err := vmObj.Relocate(vm.ctx, spec, types.VirtualMachineMovePriorityDefaultPriority)
+	if err != nil {
+		return fmt.Errorf("error creating a relocate task: %v", err)
+	}
+	tInfo, err := task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for relocate task to finish: %v",
+			err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("relocate task finished with error: %v",
+			tInfo.Error.LocalizedMessage)
+	}
+	return nil
+}
+
+// RebaseLinkedClone moves the linked clone vm.Name onto newParentSnapshot, a
+// snapshot of vm.Template. vSphere can't change the parent disks of a linked
+// clone, so the VM is cloned again from the snapshot with the CPUs, memory,
+// networks and MAC addresses of the VM, on its host, resource pool, folder
+// and datastore. The VM is then destroyed and the clone takes its name. The
+// changes made in the guest are lost. The clone is powered on if the VM was.
+// If the clone fails or the VM can't be destroyed, the clone is removed and
+// the VM powered on again if it was. If the clone can't be renamed once the
+// VM is destroyed, it is left as <name>-rebase.
+func RebaseLinkedClone(vm *VM, newParentSnapshot string) error {
+	done, err := beginOperation(vm, "rebase")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	templateMo, err := findVM(vm, getTempSearchFilter(vm.Template))
+	if err != nil {
+		return err
+	}
+	snapshotMo, err := findTemplateSnapshot(vm, templateMo, newParentSnapshot)
+	if err != nil {
+		return err
+	}
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	spec, err := rebaseCloneSpec(vmMo, snapshotMo)
+	if err != nil {
+		return err
+	}
+	parentMo := mo.VirtualMachine{}
+	ps := []string{"parent"}
+	err = vm.collector.RetrieveOne(vm.ctx, vmMo.Reference(), ps, &parentMo)
+	if err != nil {
+		return NewErrorPropertyRetrieval(vmMo.Reference(), ps, err)
+	}
+	if parentMo.Parent == nil {
+		return fmt.Errorf("vm %s has no folder", vm.Name)
+	}
+
+	poweredOn := vmMo.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+	if poweredOn {
+		if err = halt(vm); err != nil {
+			return err
+		}
+	}
+	cloneRef, err := cloneRebase(vm, templateMo.Reference(), *parentMo.Parent,
+		vm.Name+"-rebase", spec)
+	if err != nil {
+		return abortRebase(vm, poweredOn, err)
+	}
+	if err = deleteVM(vm, vmMo); err != nil {
+		return abortRebase(vm, poweredOn, err)
+	}
+	if err = renameVM(vm, cloneRef, vm.Name); err != nil {
+		return err
+	}
+	if poweredOn {
+		return start(vm)
+	}
+	return nil
+}
+
+// cloneRebase: clones the template into the folder with the name and spec of
+// a rebase, and returns the clone
+var cloneRebase = func(vm *VM, templateMor types.ManagedObjectReference,
+	folderMor types.ManagedObjectReference, name string,
+	spec types.VirtualMachineCloneSpec) (types.ManagedObjectReference, error) {
+	templateObj := object.NewVirtualMachine(vm.client.Client, templateMor)
+	folderObj := object.NewFolder(vm.client.Client, folderMor)
+	task, err := templateObj.Clone(vm.ctx, folderObj, name, spec)
+	if err != nil {
+		return types.ManagedObjectReference{},
+			fmt.Errorf("error cloning vm from snapshot: %v", err)
+	}
+	tInfo, err := task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return types.ManagedObjectReference{},
+			fmt.Errorf("error waiting for clone task to finish: %v", err)
+	}
+	if tInfo.Error != nil {
+		return types.ManagedObjectReference{},
+			fmt.Errorf("clone task finished with error: %s",
+				tInfo.Error.LocalizedMessage)
+	}
+	cloneRef, ok := tInfo.Result.(types.ManagedObjectReference)
+	if !ok {
+		return types.ManagedObjectReference{},
+			fmt.Errorf("clone task returned no vm")
+	}
+	return cloneRef, nil
+}
+
+// renameVM: renames the vm behind the reference
+var renameVM = func(vm *VM, vmMor types.ManagedObjectReference, name string) error {
+	vmObj := object.NewVirtualMachine(vm.client.Client, vmMor)
+	task, err := vmObj.Rename(vm.ctx, name)
+	if err != nil {
+		return fmt.Errorf("error creating a rename task: %v", err)
+	}
+	tInfo, err := task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error waiting for rename task to finish: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("rename task finished with error: %s",
+			tInfo.Error.LocalizedMessage)
+	}
+	return nil
+}
+
+// abortRebase: removes the <name>-rebase clone, which a failed clone task
+// may have left behind, and powers the vm on again if it was. The errors of
+// the cleanup are returned along with the error of the rebase.
+func abortRebase(vm *VM, poweredOn bool, err error) error {
+	errs := []error{err}
+	filter := getVMSearchFilter(vm.Name + "-rebase")
+	if exists, err := Exists(vm, filter); err != nil {
+		errs = append(errs, err)
+	} else if exists {
+		cloneMo, err := findVM(vm, filter)
+		if err == nil {
+			err = deleteVM(vm, cloneMo)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error removing the rebase clone: %v", err))
+		}
+	}
+	if poweredOn {
+		if err := start(vm); err != nil {
+			errs = append(errs, fmt.Errorf("error powering the vm on again: %v", err))
+		}
+	}
+	if len(errs) == 1 {
+		return err
+	}
+	return lvm.WrapErrors(errs...)
+}
+
+// ClearEfiNvram deletes the NVRAM file of an EFI VM so that the EFI variables
+// (boot entries etc.) are reset to their defaults on the next power on. The VM
+// needs to be powered off.
+func ClearEfiNvram(vm *VM) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	if vmMo.Config == nil {
+		return NewErrorConfigNotAvailable(vm.Name)
+	}
+	if vmMo.Config.Firmware != string(types.GuestOsDescriptorFirmwareTypeEfi) {
+		return ErrorVMFirmwareNotEfi
+	}
+	if vmMo.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		return ErrorVMNotPoweredOff
+	}
+
+	nvramPath, err := getNvramPath(vmMo)
+	if err != nil {
+		return err
+	}
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
+		return err
+	}
+	dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
+	fileManager := object.NewFileManager(vm.client.Client)
+	task, err := fileManager.DeleteDatastoreFile(vm.ctx, nvramPath, dc)
+	if err != nil {
+		return fmt.Errorf("error creating a delete task for %s: %v",
+			nvramPath, err)
+	}
+	_, err = task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		// The nvram file is created on first power on, nothing to clear
+		if isFileNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error deleting the nvram file %s: %v",
+			nvramPath, err)
+	}
+	return nil
+}
+
+// GetState returns the power state of this VM.
+func (vm *VM) GetState() (state string, err error) {
+	if err := SetupSession(vm); err != nil {
+		return "", lvm.ErrVMInfoFailed
+	}
+	defer vm.cancel()
+
+	state, err = getState(vm)
+	if err != nil {
+		return "", err
+	}
+
+	if state == "running" {
+		return lvm.VMRunning, nil
+	} else if state == "standby" || state == "suspended" {
+		return lvm.VMSuspended, nil
+	} else if state == "shuttingDown" || state == "resetting" || state == "notRunning" {
+		return lvm.VMHalted, nil
+	}
+	// VM state "unknown"
+	return "", lvm.ErrVMInfoFailed
+}
+
+// Suspend suspends this VM.
+func (vm *VM) Suspend() (err error) {
+	done, err := beginOperation(vm, "suspend")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return suspend(vm)
+}
+
+// Halt halts this VM.
+func (vm *VM) Halt() (err error) {
+	done, err := beginOperation(vm, "halt")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return halt(vm)
+}
+
+// ShutDown Initiates guest shut down of this VM.
+func (vm *VM) ShutDown() (err error) {
+	done, err := beginOperation(vm, "shutdown")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	_, err = shutDown(vm)
+	return err
+}
+
+// ShutDownWithResult initiates guest shut down of this VM like ShutDown and
+// returns whether the guest shut down or, with
+// ForcePowerOffOnShutdownTimeout, the VM was powered off.
+func (vm *VM) ShutDownWithResult() (ShutdownResult, error) {
+	done, err := beginOperation(vm, "shutdown")
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+	return shutDown(vm)
+}
+
+// Restart Initiates guest reboot of this VM.
+func (vm *VM) Restart() (err error) {
+	done, err := beginOperation(vm, "restart")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return restart(vm)
+}
+
+// Start powers on this VM. It returns the ErrorIPWaitSkipped warning once
+// powered on if the IP of the VM couldn't be waited for.
+func (vm *VM) Start() (err error) {
+	done, err := beginOperation(vm, "start")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return start(vm)
+}
+
+// PowerOnAll starts the VMs, running at most concurrency power on tasks at a
+// time, or all of them at once if concurrency isn't positive. The errors are
+// aligned with the VMs, nil for the ones started.
+func PowerOnAll(vms []*VM, concurrency int) []error {
+	return forEachVM(vms, concurrency, (*VM).Start)
+}
+
+// PowerOffAll halts the VMs, running at most concurrency power off tasks at a
+// time, or all of them at once if concurrency isn't positive. The errors are
+// aligned with the VMs, nil for the ones halted.
+func PowerOffAll(vms []*VM, concurrency int) []error {
+	return forEachVM(vms, concurrency, (*VM).Halt)
+}
+
+// Reboot restarts this VM with the method. RebootMethodGraceful does what
+// Restart does, RebootMethodHard what Reset does.
+func Reboot(vm *VM, method RebootMethod) error {
+	done, err := beginOperation(vm, "reboot")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return reboot(vm, method)
+}
+
+// Reset restarts this VM.
+func (vm *VM) Reset() (err error) {
+	done, err := beginOperation(vm, "reset")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+	return reset(vm)
+}
+
+// Resume resumes this VM from a suspended or powered off state.
+func (vm *VM) Resume() (err error) {
+	return vm.Start()
+}
+
+// GetNetworkBacking returns the switch and VLAN of the network the NIC with
+// the device key is connected to
+func GetNetworkBacking(vm *VM, deviceKey int32) (NetworkBacking, error) {
+	if err := SetupSession(vm); err != nil {
+		return NetworkBacking{}, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return NetworkBacking{}, err
+	}
+	return getNetworkBacking(vm, vmMo, deviceKey)
+}
+
+// GetRecentTasks returns the recent tasks on the VM
+func GetRecentTasks(vm *VM) ([]TaskInfo, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]TaskInfo, 0)
+	if len(vmMo.RecentTask) == 0 {
+		return tasks, nil
+	}
+	var taskMos []mo.Task
+	err = vm.collector.Retrieve(vm.ctx, vmMo.RecentTask, []string{"info"}, &taskMos)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving the recent tasks: %v", err)
+	}
+	for _, taskMo := range taskMos {
+		info := taskMo.Info
+		task := TaskInfo{
+			Moref:         taskMo.Self.Value,
+			Name:          info.Name,
+			DescriptionId: info.DescriptionId,
+			State:         string(info.State),
+			Progress:      info.Progress,
+			QueueTime:     info.QueueTime,
+			StartTime:     info.StartTime,
+			CompleteTime:  info.CompleteTime,
+		}
+		if info.Error != nil {
+			task.Error = info.Error.LocalizedMessage
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// WaitForTasks waits up to timeout for the queued and running tasks on the VM
+// to finish. The errors of the tasks which failed while waited on are
+// returned together, those of tasks which had finished before are not.
+// Returns ErrorTasksInProgress if tasks are still active after the timeout.
+func WaitForTasks(vm *VM, timeout time.Duration) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	ctx, cancel := context.WithTimeout(vm.ctx, timeout)
+	defer cancel()
+	var errs []error
+	waited := map[types.ManagedObjectReference]bool{}
+	for {
+		vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+		if err != nil {
+			return err
+		}
+		// Tasks started while waiting are waited on as well
+		var tasks []types.ManagedObjectReference
+		for _, t := range vmMo.RecentTask {
+			if !waited[t] {
+				tasks = append(tasks, t)
+			}
+		}
+		tasks = activeTasks(vm, tasks)
+		if len(tasks) == 0 {
+			break
+		}
+		for _, t := range tasks {
+			err := waitForTask(ctx, vm, t)
+			if ctx.Err() == context.DeadlineExceeded {
+				return NewErrorTasksInProgress(vm.Name)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("task %s failed: %v", t.Value, err))
+			}
+			waited[t] = true
+		}
+	}
+	if len(errs) != 0 {
+		return lvm.WrapErrors(errs...)
+	}
+	return nil
+}
+
+// GetSSH returns an ssh client configured for this VM.
+func (vm *VM) GetSSH(options ssh.Options) (ssh.Client, error) {
+	ips, err := util.GetVMIPs(vm, options)
+	if err != nil {
+		return nil, err
+	}
+
+	client := ssh.SSHClient{Creds: &vm.Credentials, IP: ips[0], Port: 22, Options: options}
+	return &client, nil
+}
+
+var deleteVM = func(vm *VM, vmMor *mo.VirtualMachine) error {
+	// create vm object for found vm-template and calls destroy function on the vm
+	vmo := object.NewVirtualMachine(vm.client.Client, vmMor.Reference())
+	task, err := vmo.Destroy(vm.ctx)
+	if err != nil {
+		return err
+	}
+	// wait for the task to complete and checks for the errors if any
+	tInfo, err := task.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error waiting for task : %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("Destroy task returned error : %v", tInfo.Error)
+	}
+	return nil
+}
+
+// DeleteTemplate deletes the vm-template, created during vm provisioning
+func DeleteTemplate(vm *VM) error {
+	// for the templates that do not exist in server
+	missingTemplates := make([]string, 0)
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+
+	// find and delete vm-templates from all provided datastores
+	if !vm.UseLocalTemplates {
+		vmMo, err := findVM(vm, getTempSearchFilter(vm.Template))
+		if err != nil {
+			return err
+		}
+		err = deleteVM(vm, vmMo)
+		return err
+	}
+	for _, datastore := range vm.Datastores {
+		// generate template name <provided-name>-<datastore-name>
+		templateCopy := vm.Template
+		templateCopy.Name = createTemplateName(vm.Template.Name, datastore)
+		// finds the template vm in Host specified in vm.Destination in Datacenter dcMo
+		templateVm, err := findVM(vm, getTempSearchFilter(templateCopy))
+		if err != nil {
+			// add to missing templates list if it doesn't exist or in case of error
+			missingTemplates = append(missingTemplates, templateCopy.Name)
 			continue
 		}
 		err = deleteVM(vm, templateVm)
@@ -1310,7 +3368,8 @@ func GetDatastores(vm *VM) ([]Datastore, error) {
 	// Step 1 Find out cluster of resource pool
 	// Step 2 Find out all datastores with cluster
 
-	if vm.Destination.DestinationType == DestinationTypeResourcePool {
+	if vm.Destination.DestinationType == DestinationTypeResourcePool ||
+		vm.Destination.DestinationType == DestinationTypeDatastoreCluster {
 		dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
 		vm.finder.SetDatacenter(dc)
 		rp, err := findResourcePoolByMOID(vm, vm.Destination.MOID)
@@ -1545,92 +3604,336 @@ func GetDcClusterList(vm *VM) ([]ClusterComputeResource, error) {
 		}
 		return nil, err
 	}
-	var clustersMor []types.ManagedObjectReference
-	for _, cluster := range allClusters {
-		clustersMor = append(clustersMor, cluster.Reference())
+	var clustersMor []types.ManagedObjectReference
+	for _, cluster := range allClusters {
+		clustersMor = append(clustersMor, cluster.Reference())
+	}
+	// get the cluster names
+	var allClustersMo []mo.ClusterComputeResource
+	if len(clustersMor) == 0 {
+		return dcClusterList, nil
+	}
+	err = vm.collector.Retrieve(vm.ctx, clustersMor, []string{"name",
+		"summary", "configuration", "host", "datastore", "network"},
+		&allClustersMo)
+	if err != nil {
+		return nil, err
+	}
+	// generate response for the cluster in datacenter. In the response map
+	// the key is the datacenter name and value is the list of clusters in datacenter
+	for _, cluster := range allClustersMo {
+		cr := ClusterComputeResource{}
+		vm.Destination = Destination{
+			DestinationType: "cluster",
+			DestinationName: cluster.Name,
+		}
+		hosts, err := GetHostList(vm)
+		if err != nil {
+			return nil, err
+		}
+		cr.init(cluster, hosts)
+		dcClusterList = append(dcClusterList, cr)
+	}
+	return dcClusterList, nil
+}
+
+// GetResourcePoolList : GetResourcePoolList returns the resource_pool_list in the datacenter
+func GetResourcePoolList(vm *VM) ([]map[string]interface{}, error) {
+	allRpList := make([]map[string]interface{}, 0)
+	// set up session to vcenter server
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+
+	// get datacenter in the vcenter server
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
+	// Set datacenter
+	vm.finder.SetDatacenter(dc)
+
+	// get resource pool list in the vcenter server
+	prop := []string{"name", "runtime", "summary", "owner", "config", "overallStatus"}
+	allRpMo, err := findAllResourcePools(vm, prop)
+	if err != nil {
+		return nil, err
+	}
+	for _, rp := range allRpMo {
+		cpuAllocation := rp.Config.CpuAllocation.GetResourceAllocationInfo()
+		memAllocation := rp.Config.MemoryAllocation.GetResourceAllocationInfo()
+		cr := mo.ClusterComputeResource{}
+		err := vm.collector.RetrieveOne(vm.ctx, rp.Owner, []string{"name"}, &cr)
+		if err != nil {
+			return nil, err
+		}
+
+		allRpList = append(allRpList, map[string]interface{}{
+			"name":        rp.Name,
+			"respool_ref": rp.Self.Value,
+			"cluster":     cr.Name,
+			"status":      rp.OverallStatus,
+			"cpu": map[string]interface{}{
+				"share":       cpuAllocation.Shares.Shares,
+				"reservation": cpuAllocation.Reservation,
+				"limit":       cpuAllocation.Limit,
+			},
+			"memory": map[string]interface{}{
+				"share":       memAllocation.Shares.Shares,
+				"reservation": memAllocation.Reservation,
+				"limit":       memAllocation.Limit,
+			},
+		})
+	}
+	return allRpList, nil
+
+}
+
+// GetResourcePoolUsage returns the configured and used CPU and memory of the
+// resource pool with the moref poolMOID.
+func GetResourcePoolUsage(vm *VM, poolMOID string) (PoolUsage, error) {
+	if err := SetupSession(vm); err != nil {
+		return PoolUsage{}, err
+	}
+	defer vm.cancel()
+
+	rpMor := types.ManagedObjectReference{
+		Type:  "ResourcePool",
+		Value: poolMOID,
+	}
+	rpMo := mo.ResourcePool{}
+	err := vm.collector.RetrieveOne(vm.ctx, rpMor, []string{"name", "config", "runtime"}, &rpMo)
+	if err != nil {
+		if soap.IsSoapFault(err) && isObjectDeleted(err) {
+			return PoolUsage{}, NewErrorObjectNotFound(err, poolMOID)
+		}
+		return PoolUsage{}, err
+	}
+	return PoolUsage{
+		Name: rpMo.Name,
+		CPU: resourceUsage(rpMo.Config.CpuAllocation,
+			rpMo.Runtime.Cpu, 1),
+		Memory: resourceUsage(rpMo.Config.MemoryAllocation,
+			rpMo.Runtime.Memory, 1024*1024),
+	}, nil
+}
+
+// GetOrCreateResourcePool returns the moref of the resource pool 'name' under
+// the cluster or resource pool at parentPath, creating it with the given
+// allocation if it doesn't exist. parentPath is relative to the host folder of
+// the datacenter, e.g. "cluster1" or "cluster1/Resources/tenants".
+func GetOrCreateResourcePool(vm *VM, parentPath, name string, spec ResourcePoolSpec) (string, error) {
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+
+	dcMo, err := GetDatacenter(vm)
+	if err != nil {
+		return "", err
+	}
+	dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
+	vm.finder.SetDatacenter(dc)
+
+	parent, err := findParentResourcePool(vm, parentPath)
+	if err != nil {
+		return "", err
+	}
+	rp, err := findChildResourcePool(vm, parent, name)
+	if err != nil {
+		return "", err
+	}
+	if rp != nil {
+		return rp.Value, nil
+	}
+	rp, err = createResourcePool(vm, parent, name, spec)
+	if err != nil {
+		if !isDuplicateName(err) {
+			return "", err
+		}
+		// The pool was created concurrently
+		rp, err = findChildResourcePool(vm, parent, name)
+		if err != nil {
+			return "", err
+		}
+		if rp == nil {
+			return "", fmt.Errorf("resource pool %s exists but could not be found", name)
+		}
+	}
+	return rp.Value, nil
+}
+
+// CreateResourcePool creates the resource pool 'name' with the given allocation
+// under the cluster, host or resource pool with the moref id parentMOID and
+// returns the moref id of the new pool. A cluster or host parent creates the
+// pool under its root resource pool. If a pool of that name already exists
+// ErrorResourcePoolExists is returned.
+func (vm *VM) CreateResourcePool(parentMOID, name string, spec ResourcePoolSpec) (string, error) {
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+
+	parent, err := findResourcePoolParent(vm, parentMOID)
+	if err != nil {
+		return "", err
+	}
+	rp, err := createResourcePool(vm, parent, name, spec)
+	if err != nil {
+		if isDuplicateName(err) {
+			return "", NewErrorResourcePoolExists(name, parentMOID)
+		}
+		return "", err
+	}
+	return rp.Value, nil
+}
+
+// AddClusterAntiAffinityRule adds a rule to the cluster keeping the vms on
+// different hosts, e.g. the replicas of a clustered application. DRS needs to
+// be enabled on the cluster to enforce the rule.
+func (vm *VM) AddClusterAntiAffinityRule(cluster string, vmNames []string, ruleName string) error {
+	return addClusterRule(vm, cluster, vmNames, ruleName, true)
+}
+
+// AddClusterAffinityRule adds a rule to the cluster keeping the vms on the
+// same host. DRS needs to be enabled on the cluster to enforce the rule.
+func (vm *VM) AddClusterAffinityRule(cluster string, vmNames []string, ruleName string) error {
+	return addClusterRule(vm, cluster, vmNames, ruleName, false)
+}
+
+// AddClusterHostGroup adds a DRS group of the named hosts of the cluster.
+func (vm *VM) AddClusterHostGroup(cluster string, groupName string, hostNames []string) error {
+	group := &types.ClusterHostGroup{}
+	group.Name = groupName
+	return addClusterGroup(vm, cluster, group, hostNames)
+}
+
+// AddClusterVMGroup adds a DRS group of the named vms to the cluster.
+func (vm *VM) AddClusterVMGroup(cluster string, groupName string, vmNames []string) error {
+	group := &types.ClusterVmGroup{}
+	group.Name = groupName
+	return addClusterGroup(vm, cluster, group, vmNames)
+}
+
+// AddClusterVMHostRule adds a rule to the cluster running the vms of the vm
+// group on the hosts of the host group, e.g. for software licensed per host.
+// A mandatory rule is a "must run on" rule, the vms are never started or
+// migrated elsewhere. Otherwise it is a "should run on" rule DRS follows when
+// it can. DRS needs to be enabled on the cluster to enforce the rule.
+func (vm *VM) AddClusterVMHostRule(cluster string, ruleName string, vmGroup string, hostGroup string, mandatory bool) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	crMo, config, err := findClusterConfig(vm, cluster)
+	if err != nil {
+		return err
+	}
+	spec, err := vmHostRuleSpec(config, cluster, ruleName, vmGroup, hostGroup, mandatory)
+	if err != nil {
+		return err
+	}
+	return reconfigureCluster(vm, crMo, spec)
+}
+
+// GetClusterGroups returns the DRS groups of the cluster.
+func (vm *VM) GetClusterGroups(cluster string) ([]ClusterGroup, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	_, config, err := findClusterConfig(vm, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return clusterGroups(config), nil
+}
+
+// GetClusterRules returns the DRS rules of the cluster.
+func (vm *VM) GetClusterRules(cluster string) ([]ClusterRule, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	_, config, err := findClusterConfig(vm, cluster)
+	if err != nil {
+		return nil, err
 	}
-	// get the cluster names
-	var allClustersMo []mo.ClusterComputeResource
-	if len(clustersMor) == 0 {
-		return dcClusterList, nil
+	return clusterRules(config), nil
+}
+
+// DeleteClusterGroup deletes the DRS group of that name from the cluster. The
+// rules using the group need to be deleted first.
+func (vm *VM) DeleteClusterGroup(cluster string, groupName string) error {
+	if err := SetupSession(vm); err != nil {
+		return err
 	}
-	err = vm.collector.Retrieve(vm.ctx, clustersMor, []string{"name",
-		"summary", "configuration", "host", "datastore", "network"},
-		&allClustersMo)
+	defer vm.cancel()
+
+	crMo, config, err := findClusterConfig(vm, cluster)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// generate response for the cluster in datacenter. In the response map
-	// the key is the datacenter name and value is the list of clusters in datacenter
-	for _, cluster := range allClustersMo {
-		cr := ClusterComputeResource{}
-		vm.Destination = Destination{
-			DestinationType: "cluster",
-			DestinationName: cluster.Name,
-		}
-		hosts, err := GetHostList(vm)
-		if err != nil {
-			return nil, err
-		}
-		cr.init(cluster, hosts)
-		dcClusterList = append(dcClusterList, cr)
+	spec, err := removeClusterGroupSpec(config, cluster, groupName)
+	if err != nil {
+		return err
 	}
-	return dcClusterList, nil
+	return reconfigureCluster(vm, crMo, spec)
 }
 
-// GetResourcePoolList : GetResourcePoolList returns the resource_pool_list in the datacenter
-func GetResourcePoolList(vm *VM) ([]map[string]interface{}, error) {
-	allRpList := make([]map[string]interface{}, 0)
-	// set up session to vcenter server
+// AttachTag attaches the tag of the category to the VM. The tags are managed
+// with the REST API of vCenter, unlike the custom fields. Returns an
+// ErrorTagNotFound if the category or tag doesn't exist.
+func (vm *VM) AttachTag(category string, tag string) error {
+	return changeTag(vm, "attach", category, tag)
+}
+
+// DetachTag detaches the tag of the category from the VM. Returns an
+// ErrorTagNotFound if the category or tag doesn't exist.
+func (vm *VM) DetachTag(category string, tag string) error {
+	return changeTag(vm, "detach", category, tag)
+}
+
+// ListTags returns the tags attached to the VM.
+func (vm *VM) ListTags() ([]Tag, error) {
 	if err := SetupSession(vm); err != nil {
 		return nil, err
 	}
+	defer vm.cancel()
 
-	// get datacenter in the vcenter server
-	dcMo, err := GetDatacenter(vm)
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
 	if err != nil {
 		return nil, err
 	}
+	c, err := newTagClient(vm, restURL(vm.Host))
+	if err != nil {
+		return nil, err
+	}
+	defer c.logout()
+	return c.attachedTags(vmMo.Reference())
+}
 
-	dc := object.NewDatacenter(vm.client.Client, dcMo.Self)
-	// Set datacenter
-	vm.finder.SetDatacenter(dc)
-
-	// get resource pool list in the vcenter server
-	rpListPath := "*/Resources"
-	for n := 0; n < RESOURCE_POOL_DEPTH; n++ {
-		rpListPath = rpListPath + "/*"
-		prop := []string{"name", "runtime", "summary", "owner", "config", "overallStatus"}
-		allRpMo, _ := findResourcePoolListAtPath(vm, rpListPath, prop)
-		for _, rp := range allRpMo {
-			cpuAllocation := rp.Config.CpuAllocation.GetResourceAllocationInfo()
-			memAllocation := rp.Config.MemoryAllocation.GetResourceAllocationInfo()
-			cr := mo.ClusterComputeResource{}
-			err := vm.collector.RetrieveOne(vm.ctx, rp.Owner, []string{"name"}, &cr)
-			if err != nil {
-				return nil, err
-			}
-
-			allRpList = append(allRpList, map[string]interface{}{
-				"name":        rp.Name,
-				"respool_ref": rp.Self.Value,
-				"cluster":     cr.Name,
-				"status":      rp.OverallStatus,
-				"cpu": map[string]interface{}{
-					"share":       cpuAllocation.Shares.Shares,
-					"reservation": cpuAllocation.Reservation,
-					"limit":       cpuAllocation.Limit,
-				},
-				"memory": map[string]interface{}{
-					"share":       memAllocation.Shares.Shares,
-					"reservation": memAllocation.Reservation,
-					"limit":       memAllocation.Limit,
-				},
-			})
-		}
+// DeleteClusterRule deletes the DRS rule of that name from the cluster.
+func (vm *VM) DeleteClusterRule(cluster string, ruleName string) error {
+	if err := SetupSession(vm); err != nil {
+		return err
 	}
-	return allRpList, nil
+	defer vm.cancel()
 
+	crMo, config, err := findClusterConfig(vm, cluster)
+	if err != nil {
+		return err
+	}
+	spec, err := removeClusterRuleSpec(config, cluster, ruleName)
+	if err != nil {
+		return err
+	}
+	return reconfigureCluster(vm, crMo, spec)
 }
 
 // GetDatacenterList : return the list of datacenters in vcenter server
@@ -1755,7 +4058,7 @@ func getOsDetails(vmMo mo.VirtualMachine) map[string]interface{} {
 	}
 
 	guestFullName := vmMo.Guest.GuestFullName
-	if guestFullName == "" {
+	if guestFullName == "" && vmMo.Config != nil {
 		guestFullName = vmMo.Config.GuestFullName
 	}
 	osDetails = map[string]interface{}{
@@ -1777,7 +4080,11 @@ func getVmInfo(vm *VM, vmMo mo.VirtualMachine,
 	)
 	// fetching disk info
 	diskInfo := make([]map[string]interface{}, 0)
-	for _, device := range vmMo.Config.Hardware.Device {
+	var devices []types.BaseVirtualDevice
+	if vmMo.Config != nil {
+		devices = vmMo.Config.Hardware.Device
+	}
+	for _, device := range devices {
 		disk, ok := device.(*types.VirtualDisk)
 		if !ok {
 			continue
@@ -1900,6 +4207,48 @@ func GetVmList(vm *VM, markedTemplate bool, markedVisor bool) (
 	return vmList, nil
 }
 
+// GetVirtualMachinesByTag returns the VMs the tag of the category is attached
+// to. The tag association is looked up on vCenter, the VMs aren't filtered
+// client side. Returns an ErrorTagNotFound if the category or tag doesn't
+// exist.
+func (vm *VM) GetVirtualMachinesByTag(category string, tag string) ([]VmProperties, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	c, err := newTagClient(vm, restURL(vm.Host))
+	if err != nil {
+		return nil, err
+	}
+	defer c.logout()
+	tagID, err := c.tag(category, tag)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := c.attachedObjects(tagID, "VirtualMachine")
+	if err != nil {
+		return nil, err
+	}
+	return getVMProperties(vm, refs)
+}
+
+// GetVirtualMachinesByCustomField returns the VMs in the dc/cluster/host, or
+// the whole inventory if no datacenter is set, whose custom field has the
+// value.
+func (vm *VM) GetVirtualMachinesByCustomField(field string, value string) ([]VmProperties, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	vmProps, err := getVirtualMachines(vm, vm.Datacenter == "")
+	if err != nil {
+		return nil, err
+	}
+	return filterByCustomField(vm, vmProps, field, value)
+}
+
 // isVisor: Returns true if template is Visor i.e. custom field is
 // set to appropriate value
 func isVisor(vmMo mo.VirtualMachine, key int32) (bool, error) {
@@ -1932,7 +4281,7 @@ func ConvertToTemplate(vm *VM) error {
 		return fmt.Errorf("error getting the uploaded VM: %v", err)
 	}
 
-	err = shutDown(vm)
+	_, err = shutDown(vm)
 	if err != nil {
 		return fmt.Errorf("error halting the VM: %v", err)
 	}
@@ -1967,6 +4316,11 @@ func (vm *VM) Reconfigure() error {
 	var (
 		err error
 	)
+	done, err := beginOperation(vm, "reconfigure")
+	if err != nil {
+		return err
+	}
+	defer done()
 	if err = SetupSession(vm); err != nil {
 		return err
 	}
@@ -1989,7 +4343,7 @@ func (vm *VM) Reconfigure() error {
 	if err != nil {
 		return err
 	}
-	deviceChange, err := networkDeviceChangeSpec(vm, vmMo)
+	deviceChange, err := networkDeviceChangeSpec(vm, vmMo, vm.Networks)
 	if err != nil {
 		return err
 	}
@@ -2011,3 +4365,264 @@ func (vm *VM) Reconfigure() error {
 	}
 	return nil
 }
+
+// ReconfigureFlavor resizes the CPUs and memory of the vm to flavor. A powered
+// off vm is resized unconditionally, a powered on vm only when CPU or memory
+// hot add is enabled for the resource that grows. Zero values are left
+// unchanged.
+func (vm *VM) ReconfigureFlavor(flavor Flavor) error {
+	done, err := beginOperation(vm, "reconfigure")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	config, err := flavorConfigSpec(vmMo, flavor)
+	if err != nil {
+		return err
+	}
+
+	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	reconfigTask, err := vmObj.Reconfigure(vm.ctx, config)
+	if err != nil {
+		return err
+	}
+	tInfo, err := reconfigTask.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf(
+			"error waiting for reconfig task to finish: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("reconfig task finished with error: %v",
+			tInfo.Error.LocalizedMessage)
+	}
+	return nil
+}
+
+// Reconfigure applies all the changes in spec to the vm in a single reconfigure
+// task, so either all of them are applied or none is.
+func Reconfigure(vm *VM, spec ReconfigureSpec) error {
+	done, err := beginOperation(vm, "reconfigure")
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	config, err := reconfigureConfigSpec(vm, vmMo, spec)
+	if err != nil {
+		return err
+	}
+
+	vmObj := object.NewVirtualMachine(vm.client.Client, vmMo.Reference())
+	devicesBefore, err := vmObj.Device(vm.ctx)
+	if err != nil {
+		return err
+	}
+	reconfigTask, err := vmObj.Reconfigure(vm.ctx, config)
+	if err != nil {
+		return err
+	}
+	tInfo, err := reconfigTask.WaitForResult(vm.ctx, nil)
+	if err != nil {
+		return fmt.Errorf(
+			"error waiting for reconfig task to finish: %v", err)
+	}
+	if tInfo.Error != nil {
+		return fmt.Errorf("reconfig task finished with error: %v",
+			tInfo.Error)
+	}
+
+	if len(spec.AddDisks) == 0 {
+		return nil
+	}
+	devicesAfter, err := vmObj.Device(vm.ctx)
+	if err != nil {
+		return fmt.Errorf("error getting devices after reconfigure: %v",
+			err)
+	}
+	setAddedDiskFiles(spec.AddDisks, devicesBefore, devicesAfter)
+	return nil
+}
+
+// reconfigureConfigSpec: returns the config spec applying all the changes in
+// spec to the vm. The extra config options are sorted by key.
+func reconfigureConfigSpec(vm *VM, vmMo *mo.VirtualMachine,
+	spec ReconfigureSpec) (types.VirtualMachineConfigSpec, error) {
+	config := types.VirtualMachineConfigSpec{
+		NumCPUs:    spec.NumCPUs,
+		MemoryMB:   spec.MemoryMB,
+		Annotation: spec.Annotation,
+	}
+	keys := make([]string, 0, len(spec.ExtraConfig))
+	for key := range spec.ExtraConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		config.ExtraConfig = append(config.ExtraConfig, &types.OptionValue{
+			Key:   key,
+			Value: spec.ExtraConfig[key],
+		})
+	}
+
+	diskChange, err := diskDeviceChangeSpec(vm, vmMo, spec.AddDisks,
+		spec.RemoveDisks)
+	if err != nil {
+		return config, err
+	}
+	config.DeviceChange = diskChange
+	if len(spec.Networks) > 0 {
+		networkChange, err := networkDeviceChangeSpec(vm, vmMo,
+			spec.Networks)
+		if err != nil {
+			return config, err
+		}
+		config.DeviceChange = append(config.DeviceChange,
+			networkChange...)
+	}
+	return config, nil
+}
+
+// setAddedDiskFiles: sets the DiskFile of the disks to the vmdk files of the
+// disks in after which aren't in before, in order
+func setAddedDiskFiles(disks []Disk, before, after object.VirtualDeviceList) {
+	added := diffDisks(after.SelectByType((*types.VirtualDisk)(nil)), before)
+	for index := range disks {
+		if index < len(added) {
+			disks[index].DiskFile = added[index]
+		}
+	}
+}
+
+// WaitForIP waits until every NIC of the vm has the IPs required by
+// vm.IPWaitPolicy and returns the IPs by NIC MAC address. With
+// vm.PreferredIPNetwork, it waits for an IP inside it and returns only that
+// one.
+func WaitForIP(vm *VM) (map[string][]string, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return nil, err
+	}
+	return waitForIP(vm, vmMo)
+}
+
+// GetConsoleURL returns a VMRC url opening the console of the vm. The url
+// carries a one-time clone ticket of the session, so it has to be used soon.
+func GetConsoleURL(vm *VM) (string, error) {
+	if err := SetupSession(vm); err != nil {
+		return "", err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return "", err
+	}
+	req := types.AcquireCloneTicket{
+		This: *vm.client.ServiceContent.SessionManager,
+	}
+	res, err := methods.AcquireCloneTicket(vm.ctx, vm.client.Client, &req)
+	if err != nil {
+		return "", fmt.Errorf("error acquiring a clone ticket: %v", err)
+	}
+	u := url.URL{
+		Scheme:   "vmrc",
+		User:     url.UserPassword("clone", res.Returnval),
+		Host:     vm.uri.Host,
+		Path:     "/",
+		RawQuery: url.Values{"moid": {vmMo.Self.Value}}.Encode(),
+	}
+	return u.String(), nil
+}
+
+// KeyEventsFromString translates an ASCII string into the key strokes typing
+// it on a US keyboard. Newlines are sent as Enter.
+func KeyEventsFromString(text string) ([]KeyEvent, error) {
+	keys := make([]KeyEvent, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		key, ok := asciiKeyEvents[text[i]]
+		if !ok {
+			return nil, fmt.Errorf("no key stroke for character %q", text[i])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SendKeys sends the key strokes to the guest through the virtual USB
+// keyboard of the vm. It doesn't need the VMware tools, so it can drive an
+// OS installer.
+func SendKeys(vm *VM, keys []KeyEvent) error {
+	if err := SetupSession(vm); err != nil {
+		return err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return err
+	}
+	spec := types.UsbScanCodeSpec{}
+	for _, key := range keys {
+		spec.KeyEvents = append(spec.KeyEvents, types.UsbScanCodeSpecKeyEvent{
+			// The usage id goes in the high bits, the low bits hold the
+			// keyboard usage page.
+			UsbHidCode: key.Code<<16 | 0x0007,
+			Modifiers: &types.UsbScanCodeSpecModifierType{
+				LeftControl: types.NewBool(key.Control),
+				LeftShift:   types.NewBool(key.Shift),
+				LeftAlt:     types.NewBool(key.Alt),
+				LeftGui:     types.NewBool(key.Gui),
+			},
+		})
+	}
+	req := types.PutUsbScanCodes{
+		This: vmMo.Reference(),
+		Spec: spec,
+	}
+	res, err := methods.PutUsbScanCodes(vm.ctx, vm.client.Client, &req)
+	if err != nil {
+		return fmt.Errorf("error sending the key strokes: %v", err)
+	}
+	if int(res.Returnval) != len(keys) {
+		return fmt.Errorf("only %d of %d key strokes were sent",
+			res.Returnval, len(keys))
+	}
+	return nil
+}
+
+// GetDevices returns all the virtual devices of the vm: controllers, disks,
+// CD-ROMs, NICs, serial and parallel ports, the video card...
+func GetDevices(vm *VM) ([]DeviceInfo, error) {
+	if err := SetupSession(vm); err != nil {
+		return nil, err
+	}
+	defer vm.cancel()
+
+	vmMo, err := findVM(vm, getVMSearchFilter(vm.Name))
+	if err != nil {
+		return nil, err
+	}
+	return getDevicesInfo(*vmMo), nil
+}
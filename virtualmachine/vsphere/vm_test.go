@@ -3,23 +3,39 @@
 package vsphere
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/apcera/libretto/virtualmachine"
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
@@ -27,6 +43,7 @@ type mockProgressReader struct {
 	MockRead          func([]byte) (int, error)
 	MockStartProgress func()
 	MockWait          func()
+	MockStop          func()
 }
 
 func (r mockProgressReader) Read(p []byte) (n int, err error) {
@@ -42,27 +59,40 @@ func (r mockProgressReader) StartProgress() {
 	}
 }
 
+func (r mockProgressReader) Track(src io.Reader) io.Reader {
+	return src
+}
+
 func (r mockProgressReader) Wait() {
 	if r.MockWait != nil {
 		r.MockWait()
 	}
 }
 
+func (r mockProgressReader) Stop() {
+	if r.MockStop != nil {
+		r.MockStop()
+	}
+}
+
 type mockFinder struct {
-	MockDatacenterList func(context.Context, string) ([]*object.Datacenter, error)
+	MockDatacenterList   func(context.Context, string) ([]*object.Datacenter, error)
+	MockResourcePoolList func(context.Context, string) ([]*object.ResourcePool, error)
 }
 
 type mockCollector struct {
 	MockRetrieveOne func(context.Context, types.ManagedObjectReference, []string, interface{}) error
+	MockRetrieve    func(context.Context, []types.ManagedObjectReference, []string, interface{}) error
 }
 
 type mockLease struct {
-	MockLeaseProgress func(p int)
+	MockLeaseProgress func(p int32)
 	MockWait          func() (*types.HttpNfcLeaseInfo, error)
 	MockComplete      func() error
+	MockAbort         func(error) error
 }
 
-func (m mockLease) HTTPNfcLeaseProgress(p int) {
+func (m mockLease) HTTPNfcLeaseProgress(p int32) {
 	if m.MockLeaseProgress != nil {
 		m.MockLeaseProgress(p)
 	}
@@ -75,6 +105,13 @@ func (m mockLease) Complete() error {
 	return nil
 }
 
+func (m mockLease) Abort(reason error) error {
+	if m.MockAbort != nil {
+		return m.MockAbort(reason)
+	}
+	return nil
+}
+
 func (m mockLease) Wait() (*types.HttpNfcLeaseInfo, error) {
 	if m.MockWait != nil {
 		return m.MockWait()
@@ -89,6 +126,13 @@ func (m mockCollector) RetrieveOne(c context.Context, mor types.ManagedObjectRef
 	return nil
 }
 
+func (m mockCollector) Retrieve(c context.Context, mors []types.ManagedObjectReference, ps []string, dst interface{}) error {
+	if m.MockRetrieve != nil {
+		return m.MockRetrieve(c, mors, ps, dst)
+	}
+	return nil
+}
+
 func (m mockFinder) DatacenterList(c context.Context, p string) ([]*object.Datacenter, error) {
 	if m.MockDatacenterList != nil {
 		return m.MockDatacenterList(c, p)
@@ -96,6 +140,45 @@ func (m mockFinder) DatacenterList(c context.Context, p string) ([]*object.Datac
 	return []*object.Datacenter{}, nil
 }
 
+func (m mockFinder) ClusterComputeResourceList(context.Context, string) ([]*object.ClusterComputeResource, error) {
+	return []*object.ClusterComputeResource{}, nil
+}
+
+func (m mockFinder) VirtualMachineList(context.Context, string) ([]*object.VirtualMachine, error) {
+	return []*object.VirtualMachine{}, nil
+}
+
+func (m mockFinder) NetworkList(context.Context, string) ([]object.NetworkReference, error) {
+	return []object.NetworkReference{}, nil
+}
+
+func (m mockFinder) ResourcePoolList(c context.Context, p string) ([]*object.ResourcePool, error) {
+	if m.MockResourcePoolList != nil {
+		return m.MockResourcePoolList(c, p)
+	}
+	return []*object.ResourcePool{}, nil
+}
+
+func (m mockFinder) DatastoreClusterList(context.Context, string) ([]*object.StoragePod, error) {
+	return nil, nil
+}
+
+func (m mockFinder) DatastoreList(context.Context, string) ([]*object.Datastore, error) {
+	return []*object.Datastore{}, nil
+}
+
+func (m mockFinder) HostSystemList(context.Context, string) ([]*object.HostSystem, error) {
+	return []*object.HostSystem{}, nil
+}
+
+func (m mockFinder) SetDatacenter(*object.Datacenter) *find.Finder {
+	return nil
+}
+
+func (m mockFinder) ObjectReference(context.Context, types.ManagedObjectReference) (object.Reference, error) {
+	return nil, nil
+}
+
 // Test that VM implements the VirtualMachine interface
 func TestImplementation(t *testing.T) {
 	var _ virtualmachine.VirtualMachine = (*VM)(nil)
@@ -159,7 +242,7 @@ func TestSetupSessionHappyPath(t *testing.T) {
 	newClient = func(vm *VM) (*govmomi.Client, error) {
 		return &govmomi.Client{}, nil
 	}
-	newFinder = func(c *vim25.Client) finder {
+	newFinder = func(c *vim25.Client) Finder {
 		return mockFinder{}
 	}
 	newCollector = func(c *vim25.Client) *property.Collector {
@@ -219,6 +302,39 @@ func TestGetDatacenterFinderError(t *testing.T) {
 	}
 }
 
+func TestGetDatacenterCached(t *testing.T) {
+	lookups := 0
+	f := mockFinder{}
+	f.MockDatacenterList = func(context.Context, string) ([]*object.Datacenter, error) {
+		lookups++
+		return []*object.Datacenter{{}}, nil
+	}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+		dst.(*mo.Datacenter).Name = "test-dc"
+		return nil
+	}
+	vm := &VM{
+		finder:     f,
+		collector:  c,
+		Datacenter: "test-dc",
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := GetDatacenter(vm); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("Expected the datacenter to be looked up once, got %d", lookups)
+	}
+	if _, err := RefreshDatacenter(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if lookups != 2 {
+		t.Fatalf("Expected a refresh to look up the datacenter, got %d lookups", lookups)
+	}
+}
+
 func TestGetDatacenterPropertyError(t *testing.T) {
 	f := mockFinder{}
 	f.MockDatacenterList = func(context.Context, string) ([]*object.Datacenter, error) {
@@ -394,7 +510,7 @@ func TestFindComputeResourceError(t *testing.T) {
 	}()
 	expectedError := "Error finding mob"
 	findMob = func(vm *VM, mor types.ManagedObjectReference, name string) (*types.ManagedObjectReference, error) {
-		return nil, fmt.Errorf(expectedError)
+		return nil, errors.New(expectedError)
 	}
 
 	vm := &VM{
@@ -503,7 +619,7 @@ func TestCreateNetworkMappingPropertyFailed(t *testing.T) {
 	c := mockCollector{}
 	expectedError := "failed to retrieve property"
 	c.MockRetrieveOne = func(c context.Context, t types.ManagedObjectReference, ps []string, dst interface{}) error {
-		return fmt.Errorf(expectedError)
+		return errors.New(expectedError)
 	}
 	vm := &VM{
 		Host:      "1.1.1.1",
@@ -544,10 +660,11 @@ func TestCreateObjectError(t *testing.T) {
 func TestResetUnitNumbers(t *testing.T) {
 	spec := types.OvfCreateImportSpecResult{}
 	vmSpec := &types.VirtualMachineImportSpec{}
+	unitNumber := int32(0)
 	vmSpec.ConfigSpec.DeviceChange = []types.BaseVirtualDeviceConfigSpec{
 		&types.VirtualDeviceConfigSpec{
 			Device: &types.VirtualDevice{
-				UnitNumber: 0,
+				UnitNumber: &unitNumber,
 			},
 		},
 	}
@@ -558,16 +675,21 @@ func TestResetUnitNumbers(t *testing.T) {
 	if len(s.DeviceChange) != 1 {
 		t.Fatalf("Expected only one device, got: %d", len(s.DeviceChange))
 	}
-	if n := s.DeviceChange[0].GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().UnitNumber; n != -1 {
+	if n := *s.DeviceChange[0].GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().UnitNumber; n != -1 {
 		t.Fatalf("Expected to get -1 for the unit number, got: %d", n)
 	}
 }
 
 func TestUploadOvfLeaseWaitError(t *testing.T) {
+	aborted := false
 	l := mockLease{
 		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
 			return nil, fmt.Errorf("Error waiting on the nfc lease")
 		},
+		MockAbort: func(error) error {
+			aborted = true
+			return nil
+		},
 	}
 	vm := VM{}
 	sr := types.OvfCreateImportSpecResult{}
@@ -575,6 +697,9 @@ func TestUploadOvfLeaseWaitError(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Expected to get an error, got: %s", err)
 	}
+	if !aborted || vm.LeaseState() != LeaseStateAborted {
+		t.Fatalf("Expected the lease to be aborted, got %q", vm.LeaseState())
+	}
 }
 
 func TestUploadOvfOpenError(t *testing.T) {
@@ -596,9 +721,9 @@ func TestUploadOvfOpenError(t *testing.T) {
 	}()
 	expectedError := "failed to open file"
 	open = func(name string) (file *os.File, err error) {
-		return nil, fmt.Errorf(expectedError)
+		return nil, errors.New(expectedError)
 	}
-	vm := VM{}
+	vm := VM{Host: "1.1.1.1"}
 	sr := types.OvfCreateImportSpecResult{
 		FileItem: []types.OvfFileItem{
 			{},
@@ -610,6 +735,50 @@ func TestUploadOvfOpenError(t *testing.T) {
 	}
 }
 
+func TestUploadOvfAbortsLease(t *testing.T) {
+	var abortReason error
+	l := mockLease{
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			li := types.HttpNfcLeaseInfo{
+				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+					{
+						Url: "http://*/",
+					},
+				},
+			}
+			return &li, nil
+		},
+		MockAbort: func(reason error) error {
+			abortReason = reason
+			return errors.New("abort failed")
+		},
+	}
+	var oldOpen = open
+	defer func() {
+		open = oldOpen
+	}()
+	expectedError := "failed to open file"
+	open = func(name string) (file *os.File, err error) {
+		return nil, errors.New(expectedError)
+	}
+	vm := VM{Host: "1.1.1.1"}
+	sr := types.OvfCreateImportSpecResult{
+		FileItem: []types.OvfFileItem{
+			{},
+		},
+	}
+	err := uploadOvf(&vm, &sr, l)
+	if abortReason == nil || abortReason.Error() != expectedError {
+		t.Fatalf("Expected the lease to be aborted with %s, got: %v", expectedError, abortReason)
+	}
+	if err == nil || !strings.Contains(err.Error(), "abort failed") {
+		t.Fatalf("Expected to get the abort error, got: %v", err)
+	}
+	if state := vm.LeaseState(); state != LeaseStateAbortFailed {
+		t.Fatalf("Expected the lease abort to have failed, got %q", state)
+	}
+}
+
 func TestUploadOvfCreateRequestError(t *testing.T) {
 	l := mockLease{
 		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
@@ -634,8 +803,8 @@ func TestUploadOvfCreateRequestError(t *testing.T) {
 	open = func(name string) (file *os.File, err error) {
 		return os.Create(fileName)
 	}
-	createRequest = func(r io.Reader, method string, insecure bool, length int64, url string, contentType string) error {
-		return fmt.Errorf(expectedError)
+	createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
+		return errors.New(expectedError)
 	}
 	defer func() {
 		err := os.RemoveAll(fileName)
@@ -643,20 +812,26 @@ func TestUploadOvfCreateRequestError(t *testing.T) {
 			panic("Unable to remove temp file for test")
 		}
 	}()
-	vm := VM{}
+	vm := VM{Host: "1.1.1.1"}
 	sr := types.OvfCreateImportSpecResult{
 		FileItem: []types.OvfFileItem{
-			{},
+			{Path: "disk-0.vmdk"},
 		},
 	}
 	err := uploadOvf(&vm, &sr, l)
-	if err.Error() != expectedError {
-		t.Fatalf("Expected to get an error %s, got: %s", expectedError, err)
+	if err == nil || !strings.Contains(err.Error(), expectedError) ||
+		!strings.Contains(err.Error(), "disk-0.vmdk") {
+		t.Fatalf("Expected to get an error %s naming the file, got: %v", expectedError, err)
 	}
 }
 
 func TestUploadOvfHappyPath(t *testing.T) {
+	completed := false
 	l := mockLease{
+		MockComplete: func() error {
+			completed = true
+			return nil
+		},
 		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
 			li := types.HttpNfcLeaseInfo{
 				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
@@ -680,7 +855,7 @@ func TestUploadOvfHappyPath(t *testing.T) {
 	open = func(name string) (file *os.File, err error) {
 		return os.Create(fileName)
 	}
-	createRequest = func(r io.Reader, method string, insecure bool, length int64, url string, contentType string) error {
+	createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
 		return nil
 	}
 	NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
@@ -692,7 +867,7 @@ func TestUploadOvfHappyPath(t *testing.T) {
 			panic("Unable to remove temp file for test")
 		}
 	}()
-	vm := VM{}
+	vm := VM{Host: "1.1.1.1"}
 	sr := types.OvfCreateImportSpecResult{
 		FileItem: []types.OvfFileItem{
 			{},
@@ -702,16 +877,154 @@ func TestUploadOvfHappyPath(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Expected to get no error, got: %s", err)
 	}
+	if !completed || vm.LeaseState() != LeaseStateCompleted {
+		t.Fatalf("Expected the lease to be completed, got %q", vm.LeaseState())
+	}
+}
+
+func TestUploadOvfCompleteError(t *testing.T) {
+	aborted := false
+	l := mockLease{
+		MockComplete: func() error {
+			return errors.New("complete failed")
+		},
+		MockAbort: func(error) error {
+			aborted = true
+			return nil
+		},
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			li := types.HttpNfcLeaseInfo{
+				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+					{
+						Url: "http://*/",
+					},
+				},
+			}
+			return &li, nil
+		},
+	}
+	fileName := "test"
+	var oldOpen = open
+	var oldCreateRequest = createRequest
+	var oldNewProgressReader = NewProgressReader
+	defer func() {
+		open = oldOpen
+		createRequest = oldCreateRequest
+		NewProgressReader = oldNewProgressReader
+	}()
+	open = func(name string) (file *os.File, err error) {
+		return os.Create(fileName)
+	}
+	createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
+		return nil
+	}
+	NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
+		return mockProgressReader{}
+	}
+	defer func() {
+		err := os.RemoveAll(fileName)
+		if err != nil {
+			panic("Unable to remove temp file for test")
+		}
+	}()
+	vm := VM{Host: "1.1.1.1"}
+	sr := types.OvfCreateImportSpecResult{
+		FileItem: []types.OvfFileItem{
+			{},
+		},
+	}
+	err := uploadOvf(&vm, &sr, l)
+	if err == nil || !strings.Contains(err.Error(), "complete failed") {
+		t.Fatalf("Expected to get the lease completion error, got: %v", err)
+	}
+	if !aborted || vm.LeaseState() != LeaseStateAborted {
+		t.Fatalf("Expected the lease to be aborted, got %q", vm.LeaseState())
+	}
 }
 
 func TestCreateRequestNewRequestError(t *testing.T) {
 	errProtocol := `unsupported protocol scheme ""`
-	err := createRequest(mockProgressReader{}, "foo", true, 0, "", "foo")
+	err := createRequest(context.Background(), &VM{Insecure: true}, mockProgressReader{}, "foo", 0, "", "foo")
 	if !strings.Contains(err.Error(), errProtocol) {
 		t.Fatalf("Expected error to contain %q, got: %q", errProtocol, err)
 	}
 }
 
+func TestCreateRequestInvalidMethod(t *testing.T) {
+	err := createRequest(context.Background(), &VM{}, mockProgressReader{}, "bad method", 0, "http://1.1.1.1/", "foo")
+	if err == nil || !strings.Contains(err.Error(), "invalid method") {
+		t.Fatalf("Expected to get an invalid method error got: %v", err)
+	}
+}
+
+func TestUploadOvfInvalidLeaseURL(t *testing.T) {
+	l := mockLease{
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			li := types.HttpNfcLeaseInfo{
+				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+					{
+						Url: "*/nfc/disk-0.vmdk",
+					},
+				},
+			}
+			return &li, nil
+		},
+	}
+	vm := VM{Host: "1.1.1.1"}
+	sr := types.OvfCreateImportSpecResult{
+		FileItem: []types.OvfFileItem{
+			{},
+		},
+	}
+	err := uploadOvf(&vm, &sr, l)
+	if err == nil || !strings.Contains(err.Error(), "invalid lease url") {
+		t.Fatalf("Expected to get an invalid lease url error, got: %v", err)
+	}
+}
+
+func TestProgressReaderStop(t *testing.T) {
+	r := NewProgressReader(strings.NewReader("foo"), 10, mockLease{})
+	r.StartProgress()
+	r.Stop()
+	r.Stop()
+	// Reads after the progress updates stopped must not block
+	done := make(chan struct{})
+	go func() {
+		r.Read(make([]byte, 1))
+		r.Read(make([]byte, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected reads to not block after Stop")
+	}
+}
+
+func TestSubstituteLeaseHost(t *testing.T) {
+	tests := []struct {
+		url      string
+		host     string
+		expected string
+	}{
+		{"https://*/nfc/disk-0.vmdk", "1.1.1.1", "https://1.1.1.1/nfc/disk-0.vmdk"},
+		{"https://*:8443/nfc/disk-0.vmdk", "1.1.1.1", "https://1.1.1.1:8443/nfc/disk-0.vmdk"},
+		{"https://*:8443/nfc/disk-0.vmdk", "vc.example.com:443", "https://vc.example.com:8443/nfc/disk-0.vmdk"},
+		{"https://*/nfc/disk-0.vmdk", "fe80::1", "https://[fe80::1]/nfc/disk-0.vmdk"},
+		{"https://esx.example.com/nfc/disk-0.vmdk", "1.1.1.1", "https://esx.example.com/nfc/disk-0.vmdk"},
+		{"https://esx.example.com:902/nfc/*.vmdk", "1.1.1.1", "https://esx.example.com:902/nfc/*.vmdk"},
+	}
+	for _, test := range tests {
+		actual, err := substituteHost(test.url, test.host)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got: %v", test.url, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("Expected %s, got: %s", test.expected, actual)
+		}
+	}
+}
+
 func TestCreateRequestBadStatusCode(t *testing.T) {
 	var oldClientDo = clientDo
 	defer func() {
@@ -720,7 +1033,7 @@ func TestCreateRequestBadStatusCode(t *testing.T) {
 	clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
 		return &http.Response{StatusCode: 404}, nil
 	}
-	err := createRequest(mockProgressReader{}, "foo", true, 0, "", "foo")
+	err := createRequest(context.Background(), &VM{Insecure: true}, mockProgressReader{}, "foo", 0, "", "foo")
 	if _, ok := err.(ErrorBadResponse); !ok {
 		t.Fatalf("Expected to get a bad response error got: %s", err)
 	}
@@ -734,12 +1047,28 @@ func TestCreateRequestHappyPath(t *testing.T) {
 	clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
 		return &http.Response{StatusCode: 201}, nil
 	}
-	err := createRequest(mockProgressReader{}, "foo", true, 0, "", "foo")
+	err := createRequest(context.Background(), &VM{Insecure: true}, mockProgressReader{}, "foo", 0, "", "foo")
 	if err != nil {
 		t.Fatalf("Expected to get no errors got: %s", err)
 	}
 }
 
+func TestCreateRequestTimeout(t *testing.T) {
+	var oldClientDo = clientDo
+	defer func() {
+		clientDo = oldClientDo
+	}()
+	clientDo = func(c *http.Client, r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}
+	vm := &VM{UploadTimeout: 10 * time.Millisecond}
+	err := createRequest(context.Background(), vm, mockProgressReader{}, "foo", 0, "", "foo")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected to get a timeout error got: %v", err)
+	}
+}
+
 var vmMo = &mo.VirtualMachine{
 	Runtime: types.VirtualMachineRuntimeInfo{
 		Question: &types.VirtualMachineQuestionInfo{
@@ -825,6 +1154,72 @@ func TestAnswerQuestions_ErrorPath(t *testing.T) {
 	}
 }
 
+func TestAnswerQuestions_Unanswered(t *testing.T) {
+	var oldAnswerQuestion = answerVSphereQuestion
+	defer func() {
+		answerVSphereQuestion = oldAnswerQuestion
+	}()
+
+	var answered string
+	answerVSphereQuestion = func(vm *VM, vmMo *mo.VirtualMachine, questionId, answer string) error {
+		answered = answer
+		return nil
+	}
+	questionMo := &mo.VirtualMachine{
+		Runtime: types.VirtualMachineRuntimeInfo{
+			Question: &types.VirtualMachineQuestionInfo{
+				Id:   "q-1",
+				Text: "This virtual machine might have been moved or copied.",
+				Choice: types.ChoiceOption{
+					ChoiceInfo: []types.BaseElementDescription{
+						&types.ElementDescription{
+							Key: "0",
+							Description: types.Description{
+								Label:   "button.uuid.cancel",
+								Summary: "Cancel",
+							},
+						},
+						&types.ElementDescription{
+							Key: "2",
+							Description: types.Description{
+								Label:   "button.uuid.copiedTheVM",
+								Summary: "I Copied It",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// The default response answers a question no regexp matches
+	vm := VM{
+		QuestionResponses:       map[string]string{"unrelated": "0"},
+		DefaultQuestionResponse: "button.uuid.copiedTheVM",
+	}
+	if err := vm.answerQuestion(questionMo); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if answered != "2" {
+		t.Fatalf("Expected the default answer 2, got %q", answered)
+	}
+
+	// Without a default, the question fails fast
+	answered = ""
+	vm = VM{Name: "vm1", FailOnUnansweredQuestion: true}
+	err := vm.answerQuestion(questionMo)
+	if _, ok := err.(ErrorUnansweredQuestion); !ok {
+		t.Fatalf("Expected an ErrorUnansweredQuestion, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "moved or copied") ||
+		!strings.Contains(err.Error(), "(2) I Copied It") {
+		t.Fatalf("Expected the question and the options in the error, got %v", err)
+	}
+	if answered != "" {
+		t.Fatalf("Expected no answer, got %q", answered)
+	}
+}
+
 func TestResolveAnswerAndOptions(t *testing.T) {
 	testCases := []struct {
 		answer         string
@@ -848,3 +1243,3331 @@ func TestResolveAnswerAndOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestBeginOperationInProgress(t *testing.T) {
+	vm := &VM{Host: "1.1.1.1", Name: "foo"}
+	done, err := beginOperation(vm, "halt")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// A different VM struct for the same vm shares the guard
+	_, err = beginOperation(&VM{Host: "1.1.1.1", Name: "foo"}, "start")
+	if _, ok := err.(ErrorOperationInProgress); !ok {
+		t.Fatalf("Expected to get ErrorOperationInProgress, got: %v", err)
+	}
+	// The guard taken is released even if the name changed meanwhile
+	vm.Name = "bar"
+	done()
+	vm.Name = "foo"
+	done, err = beginOperation(vm, "start")
+	if err != nil {
+		t.Fatalf("Expected no error after the operation ended, got: %v", err)
+	}
+	done()
+}
+
+func TestIsTaskInProgress(t *testing.T) {
+	states := map[string]types.TaskInfoState{
+		"task-1": types.TaskInfoStateSuccess,
+		"task-2": types.TaskInfoStateError,
+		"task-3": types.TaskInfoStateRunning,
+		"task-4": types.TaskInfoStateQueued,
+	}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(_ context.Context, mor types.ManagedObjectReference, _ []string, dst interface{}) error {
+		state, ok := states[mor.Value]
+		if !ok {
+			return errors.New("task not found")
+		}
+		dst.(*mo.Task).Info.State = state
+		return nil
+	}
+	vm := &VM{collector: c}
+	tests := []struct {
+		tasks    []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"task-1", "task-2"}, false},
+		{[]string{"task-1", "task-3"}, true},
+		{[]string{"task-4"}, true},
+		{[]string{"task-5"}, false},
+	}
+	for _, test := range tests {
+		vmMo := &mo.VirtualMachine{}
+		for _, task := range test.tasks {
+			vmMo.RecentTask = append(vmMo.RecentTask,
+				types.ManagedObjectReference{Type: "Task", Value: task})
+		}
+		if actual := isTaskInProgress(vm, vmMo); actual != test.expected {
+			t.Fatalf("Expected %v for tasks %v, got: %v", test.expected, test.tasks, actual)
+		}
+	}
+}
+
+func TestWaitForActiveTasksNoActiveTasks(t *testing.T) {
+	c := mockCollector{}
+	c.MockRetrieveOne = func(_ context.Context, _ types.ManagedObjectReference, _ []string, dst interface{}) error {
+		dst.(*mo.Task).Info.State = types.TaskInfoStateSuccess
+		return nil
+	}
+	vm := &VM{collector: c}
+	vmMo := &mo.VirtualMachine{
+		RecentTask: []types.ManagedObjectReference{{Type: "Task", Value: "task-1"}},
+	}
+	// Finished tasks must not be waited on, vm.client is nil
+	if err := waitForActiveTasks(vm, vmMo); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+}
+
+func TestValidateDiskSharing(t *testing.T) {
+	shared := &types.VirtualLsiLogicController{}
+	shared.SharedBus = types.VirtualSCSISharingPhysicalSharing
+	unshared := &types.VirtualLsiLogicController{}
+	unshared.SharedBus = types.VirtualSCSISharingNoSharing
+	tests := []struct {
+		sharing    string
+		controller types.BaseVirtualController
+		valid      bool
+	}{
+		{"", unshared, true},
+		{"sharingNone", unshared, true},
+		{"sharingMultiWriter", shared, true},
+		{"sharingMultiWriter", unshared, false},
+		{"sharingMultiWriter", &types.VirtualIDEController{}, false},
+		{"foo", shared, false},
+	}
+	for _, test := range tests {
+		err := validateDiskSharing(Disk{Sharing: test.sharing}, test.controller)
+		if (err == nil) != test.valid {
+			t.Fatalf("Expected valid to be %v for %s, got: %v", test.valid, test.sharing, err)
+		}
+	}
+}
+
+func TestResizeAndDeleteVolsNilConfig(t *testing.T) {
+	_, err := resizeAndDeleteVols(mo.VirtualMachine{}, []Disk{{DiskFile: "foo.vmdk"}}, false)
+	if _, ok := err.(ErrorConfigNotAvailable); !ok {
+		t.Fatalf("Expected to get ErrorConfigNotAvailable, got: %v", err)
+	}
+}
+
+// buildOva returns a tar archive of the files with the names and contents.
+func buildOva(names []string, contents []string) []byte {
+	var ova bytes.Buffer
+	tw := tar.NewWriter(&ova)
+	for i, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[i]))})
+		tw.Write([]byte(contents[i]))
+	}
+	tw.Close()
+	return ova.Bytes()
+}
+
+func TestDownloadOvaRetriesAndResumes(t *testing.T) {
+	content := []byte("<Envelope/>")
+	data := buildOva([]string{"vm.ovf"}, []string{string(content)})
+
+	requests := 0
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// Advertise the full length but drop the connection halfway
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+		default:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d",
+				len(data)/2, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[len(data)/2:])
+		}
+	}))
+	defer ts.Close()
+
+	oldBackoff := ovaDownloadBackoff
+	defer func() { ovaDownloadBackoff = oldBackoff }()
+	ovaDownloadBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	progress := make(chan int64, 100)
+	ovf, err := DownloadOva(dir, ts.URL, progress)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests)
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(data)/2); ranges[2] != want {
+		t.Fatalf("Expected range %q, got %q", want, ranges[2])
+	}
+	got, err := ioutil.ReadFile(ovf)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Unexpected ovf content %q, err %v", got, err)
+	}
+	var last int64
+	for len(progress) > 0 {
+		last = <-progress
+	}
+	if last != int64(len(data)) {
+		t.Fatalf("Expected last progress %d, got %d", len(data), last)
+	}
+}
+
+func TestDownloadOvaAuthAndRedirects(t *testing.T) {
+	data := buildOva([]string{"vm.ovf"}, []string{"<Envelope/>"})
+
+	var mirrorAuth string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorAuth = r.Header.Get("Authorization")
+		w.Write(data)
+	}))
+	defer mirror.Close()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, mirror.URL+"/vm.ova", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, _ := url.Parse(ts.URL)
+	u.User = url.UserPassword("user", "secret")
+	if _, err := DownloadOva(dir, u.String(), nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if mirrorAuth != "" {
+		t.Fatalf("Expected no credentials sent to the redirected host, got %q", mirrorAuth)
+	}
+
+	// OvaAuth takes precedence over the credentials in the url
+	u.User = url.UserPassword("user", "wrong")
+	_, resolved, err := downloadOva(context.Background(), dir, u.String(), url.UserPassword("user", "secret"), nil, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resolved != mirror.URL+"/vm.ova" {
+		t.Fatalf("Expected the redirected url, got %s", resolved)
+	}
+
+	requests = 0
+	_, err = DownloadOva(dir, ts.URL, nil)
+	if _, ok := err.(ErrorDownloadUnauthorized); !ok {
+		t.Fatalf("Expected ErrorDownloadUnauthorized, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected an unauthorized download not to be retried, got %d requests", requests)
+	}
+
+	requests = 0
+	if _, err = DownloadOva(dir, ts.URL+"/loop", nil); err == nil {
+		t.Fatal("Expected an error for a redirect loop")
+	}
+	if requests != OVA_MAX_REDIRECTS {
+		t.Fatalf("Expected %d requests, got %d", OVA_MAX_REDIRECTS, requests)
+	}
+}
+
+func TestDownloadOvaTempFile(t *testing.T) {
+	data := buildOva([]string{"vm.ovf", "download.ova"}, []string{"<Envelope/>", "entry"})
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldTmp := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", oldTmp)
+	os.Setenv("TMPDIR", tmp)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry named like the download doesn't clash with it
+	if _, err = DownloadOva(dir, ts.URL, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "download.ova")); err != nil || string(got) != "entry" {
+		t.Fatalf("Expected the extracted entry, got %q %v", got, err)
+	}
+	fail = true
+	if _, err = DownloadOva(dir, ts.URL, nil); err == nil {
+		t.Fatal("Expected an error for a missing ova")
+	}
+	os.RemoveAll(dir)
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Fatalf("Expected the downloads to be removed, got %d files", len(files))
+	}
+}
+
+func TestExtractOvaManifest(t *testing.T) {
+	ovf := "<Envelope/>"
+	sum := sha256.Sum256([]byte(ovf))
+	good := fmt.Sprintf("SHA256(vm.ovf)= %x\n", sum)
+	good512 := fmt.Sprintf("SHA512(vm.ovf)= %x\n", sha512.Sum512([]byte(ovf)))
+	bad := "SHA1(vm.ovf)= 0000000000000000000000000000000000000000\n"
+	bad512 := fmt.Sprintf("SHA512(vm.ovf)= %0128d\n", 0)
+
+	for _, tc := range []struct {
+		manifest string
+		verify   bool
+		mismatch bool
+	}{
+		{good, true, false},
+		{good512, true, false},
+		{bad, true, true},
+		{bad512, true, true},
+		{bad, false, false},
+	} {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := buildOva([]string{"vm.ovf", "vm.mf"}, []string{ovf, tc.manifest})
+		_, err = extractOva(dir, bytes.NewReader(data), tc.verify)
+		os.RemoveAll(dir)
+		if _, ok := err.(ErrorManifestMismatch); ok != tc.mismatch {
+			t.Fatalf("Manifest %q verify %v: unexpected error %v", tc.manifest, tc.verify, err)
+		}
+		if !tc.mismatch && err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+}
+
+func TestExtractOvaUnsafePaths(t *testing.T) {
+	parent, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "ova")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../evil.ovf", "/tmp/evil.ovf", "a/../../evil.ovf"} {
+		data := buildOva([]string{name}, []string{"<Envelope/>"})
+		_, err := extractOva(dir, bytes.NewReader(data), false)
+		if _, ok := err.(ErrorUnsafeArchivePath); !ok {
+			t.Fatalf("Entry %s: expected ErrorUnsafeArchivePath, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.ovf")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file outside the destination, got %v", err)
+	}
+
+	var ova bytes.Buffer
+	tw := tar.NewWriter(&ova)
+	tw.WriteHeader(&tar.Header{Name: "vm.ovf", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.Close()
+	_, err = extractOva(dir, &ova, false)
+	if _, ok := err.(ErrorUnsafeArchivePath); !ok {
+		t.Fatalf("Expected ErrorUnsafeArchivePath for a symlink, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "vm.ovf")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the symlink not to be created, got %v", err)
+	}
+}
+
+func TestUploadOvfMultipleFiles(t *testing.T) {
+	l := mockLease{
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			li := types.HttpNfcLeaseInfo{
+				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+					{ImportKey: "/vm/disk-1", Url: "http://*/disk-1"},
+					{ImportKey: "/vm/disk-0", Url: "http://*/disk-0"},
+				},
+			}
+			return &li, nil
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"disk-0.vmdk", "disk-1.vmdk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var oldCreateRequest = createRequest
+	var oldNewProgressReader = NewProgressReader
+	defer func() {
+		createRequest = oldCreateRequest
+		NewProgressReader = oldNewProgressReader
+	}()
+	var totalBytes int64
+	NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
+		totalBytes = t
+		return mockProgressReader{}
+	}
+	uploaded := map[string]int64{}
+	createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
+		uploaded[url] = length
+		return nil
+	}
+
+	vm := VM{Host: "1.1.1.1", OvfPath: filepath.Join(dir, "vm.ovf")}
+	sr := types.OvfCreateImportSpecResult{
+		FileItem: []types.OvfFileItem{
+			{DeviceId: "/vm/disk-0", Path: "disk-0.vmdk"},
+			{DeviceId: "/vm/disk-1", Path: "disk-1.vmdk"},
+		},
+	}
+	if err := uploadOvf(&vm, &sr, l); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if totalBytes != 22 {
+		t.Fatalf("Expected progress over 22 bytes, got %d", totalBytes)
+	}
+	if len(uploaded) != 2 || uploaded["http://1.1.1.1/disk-0"] != 11 ||
+		uploaded["http://1.1.1.1/disk-1"] != 11 {
+		t.Fatalf("Unexpected uploads %v", uploaded)
+	}
+}
+
+func TestUploadOvfConcurrentCancelsOnError(t *testing.T) {
+	l := mockLease{
+		MockWait: func() (*types.HttpNfcLeaseInfo, error) {
+			li := types.HttpNfcLeaseInfo{
+				DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+					{ImportKey: "/vm/disk-0", Url: "http://*/disk-0"},
+					{ImportKey: "/vm/disk-1", Url: "http://*/disk-1"},
+				},
+			}
+			return &li, nil
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"disk-0.vmdk", "disk-1.vmdk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var oldCreateRequest = createRequest
+	var oldNewProgressReader = NewProgressReader
+	defer func() {
+		createRequest = oldCreateRequest
+		NewProgressReader = oldNewProgressReader
+	}()
+	NewProgressReader = func(r io.Reader, t int64, l Lease) ProgressReader {
+		return mockProgressReader{}
+	}
+	createRequest = func(ctx context.Context, vm *VM, r io.Reader, method string, length int64, url string, contentType string) error {
+		if strings.HasSuffix(url, "disk-0") {
+			// Wait for the other upload to be in flight
+			time.Sleep(10 * time.Millisecond)
+			return errors.New("upload failed")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	vm := VM{Host: "1.1.1.1", OvfPath: filepath.Join(dir, "vm.ovf"), MaxConcurrentUploads: 2}
+	sr := types.OvfCreateImportSpecResult{
+		FileItem: []types.OvfFileItem{
+			{DeviceId: "/vm/disk-0", Path: "disk-0.vmdk"},
+			{DeviceId: "/vm/disk-1", Path: "disk-1.vmdk"},
+		},
+	}
+	err = uploadOvf(&vm, &sr, l)
+	if err == nil || !strings.Contains(err.Error(), "disk-0.vmdk") ||
+		!strings.Contains(err.Error(), "upload failed") {
+		t.Fatalf("Expected the disk-0.vmdk upload error, got: %v", err)
+	}
+}
+
+func TestHostHasCapacity(t *testing.T) {
+	summary := types.HostListSummary{
+		Hardware: &types.HostHardwareSummary{
+			CpuMhz:        2000,
+			NumCpuCores:   4,
+			NumCpuThreads: 8,
+			MemorySize:    16 * 1024 * 1024 * 1024,
+		},
+		QuickStats: types.HostListSummaryQuickStats{
+			OverallCpuUsage:    5000,
+			OverallMemoryUsage: 12 * 1024,
+		},
+	}
+	tests := []struct {
+		flavor   Flavor
+		expected bool
+	}{
+		{Flavor{}, true},
+		{Flavor{NumCPUs: 1, MemoryMB: 4096}, true},
+		{Flavor{NumCPUs: 2}, false},
+		{Flavor{MemoryMB: 4097}, false},
+	}
+	for _, test := range tests {
+		if actual := hostHasCapacity(summary, test.flavor); actual != test.expected {
+			t.Fatalf("Flavor %+v: expected %v, got %v", test.flavor, test.expected, actual)
+		}
+	}
+}
+
+func TestIPsMeetPolicy(t *testing.T) {
+	v4 := []string{"10.0.0.2"}
+	v6 := []string{"2001:db8::2"}
+	linkLocal := []string{"fe80::1"}
+	both := []string{"10.0.0.2", "2001:db8::2"}
+	tests := []struct {
+		ips      []string
+		policy   string
+		expected bool
+	}{
+		{v4, "", true},
+		{v6, "", false},
+		{v6, IPWaitPolicyV6, true},
+		{linkLocal, IPWaitPolicyV6, false},
+		{linkLocal, IPWaitPolicyAny, false},
+		{v4, IPWaitPolicyBoth, false},
+		{both, IPWaitPolicyBoth, true},
+		{v6, IPWaitPolicyAny, true},
+		{nil, IPWaitPolicyAny, false},
+		{[]string{"169.254.10.2"}, "", false},
+	}
+	for _, test := range tests {
+		if actual := ipsMeetPolicy(test.ips, test.policy); actual != test.expected {
+			t.Fatalf("IPs %v policy %q: expected %v, got %v", test.ips, test.policy, test.expected, actual)
+		}
+	}
+}
+
+func TestResizeAndDeleteVolsShrink(t *testing.T) {
+	vmMo := mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				Device: []types.BaseVirtualDevice{
+					&types.VirtualDisk{
+						VirtualDevice: types.VirtualDevice{
+							Backing: &types.VirtualDiskFlatVer2BackingInfo{
+								VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+									FileName: "[ds] vm/vm.vmdk",
+								},
+							},
+						},
+						CapacityInKB: 2 * 1024 * 1024,
+					},
+				},
+			},
+		},
+	}
+	disks := []Disk{{DiskFile: "[ds] vm/vm.vmdk", Size: 1}}
+	_, err := resizeAndDeleteVols(vmMo, disks, false)
+	if _, ok := err.(ErrorDiskShrinkNotAllowed); !ok {
+		t.Fatalf("Expected ErrorDiskShrinkNotAllowed, got %v", err)
+	}
+	_, err = resizeAndDeleteVols(vmMo, disks, true)
+	if _, ok := err.(ErrorDiskShrinkNotSupported); !ok {
+		t.Fatalf("Expected ErrorDiskShrinkNotSupported, got %v", err)
+	}
+}
+
+func TestCreateDiskMode(t *testing.T) {
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = 1000
+	controller.DeviceInfo = &types.Description{Label: "SCSI controller 0"}
+	devices := object.VirtualDeviceList{controller}
+	ds := types.ManagedObjectReference{Type: "Datastore", Value: "ds-1"}
+
+	disk := CreateDisk(devices, controller, ds, "", true, "")
+	if mode := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).DiskMode; mode != string(types.VirtualDiskModePersistent) {
+		t.Fatalf("Expected the persistent mode by default, got %s", mode)
+	}
+
+	// vSphere leaves independent disks out of the snapshots of the vm
+	mode := string(types.VirtualDiskModeIndependent_persistent)
+	if err := validateDiskMode(mode); err != nil {
+		t.Fatalf("Expected %s to be valid, got %v", mode, err)
+	}
+	disk = CreateDisk(devices, controller, ds, "", true, mode)
+	if actual := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).DiskMode; actual != mode {
+		t.Fatalf("Expected the %s mode, got %s", mode, actual)
+	}
+	vmMo := mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				Device: []types.BaseVirtualDevice{controller, disk},
+			},
+		},
+	}
+	disks := getDisksInfo(vmMo)
+	if len(disks) != 1 || disks[0].Mode != mode {
+		t.Fatalf("Expected the disk info to report the %s mode, got %+v", mode, disks)
+	}
+
+	if err := validateDiskMode("snapshotted"); err == nil {
+		t.Fatal("Expected an invalid disk mode error")
+	}
+}
+
+func TestKeyEventsFromString(t *testing.T) {
+	keys, err := KeyEventsFromString("aZ0!\n")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []KeyEvent{
+		{Code: 0x04},
+		{Code: 0x1d, Shift: true},
+		{Code: 0x27},
+		{Code: 0x1e, Shift: true},
+		{Code: 0x28},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+	if _, err := KeyEventsFromString("é"); err == nil {
+		t.Fatal("Expected an error for a non ASCII character")
+	}
+}
+
+func TestRetrieveChildrenSkipsDeleted(t *testing.T) {
+	deleted := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+	notFound := &soap.Fault{}
+	notFound.Detail.Fault = types.ManagedObjectNotFound{Obj: deleted}
+	refs := []types.ManagedObjectReference{
+		{Type: "VirtualMachine", Value: "vm-1"},
+		deleted,
+		{Type: "VirtualMachine", Value: "vm-3"},
+	}
+	retrieveCalls := 0
+	vm := &VM{
+		ctx: context.Background(),
+		collector: mockCollector{
+			MockRetrieve: func(ctx context.Context, mos []types.ManagedObjectReference, ps []string, dst interface{}) error {
+				retrieveCalls++
+				if len(mos) != len(refs) {
+					t.Fatalf("Expected one call for the %d children, got %d", len(refs), len(mos))
+				}
+				return soap.WrapSoapFault(notFound)
+			},
+			MockRetrieveOne: func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+				if mor == deleted {
+					return soap.WrapSoapFault(notFound)
+				}
+				dst.(*mo.VirtualMachine).Self = mor
+				return nil
+			},
+		},
+	}
+	var vmMos []mo.VirtualMachine
+	if err := retrieveChildren(vm, refs, []string{"name"}, &vmMos); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if retrieveCalls != 1 {
+		t.Fatalf("Expected one batched retrieve, got %d", retrieveCalls)
+	}
+	if len(vmMos) != 2 || vmMos[0].Self != refs[0] || vmMos[1].Self != refs[2] {
+		t.Fatalf("Expected the deleted vm to be skipped, got %v", vmMos)
+	}
+
+	// Errors other than soap faults are returned
+	connErr := errors.New("connection reset")
+	vm.collector = mockCollector{
+		MockRetrieve: func(ctx context.Context, mos []types.ManagedObjectReference, ps []string, dst interface{}) error {
+			return soap.WrapSoapFault(notFound)
+		},
+		MockRetrieveOne: func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+			return connErr
+		},
+	}
+	vmMos = nil
+	if err := retrieveChildren(vm, refs, []string{"name"}, &vmMos); err != connErr {
+		t.Fatalf("Expected %v, got %v", connErr, err)
+	}
+}
+
+func TestSysprepCustomSpec(t *testing.T) {
+	sysprep := &Sysprep{
+		JoinDomain:          "corp.example.com",
+		DomainAdmin:         "admin",
+		DomainAdminPassword: "secret",
+	}
+	if err := validateSysprep(sysprep); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	spec := sysprepCustomSpec(sysprep, nil)
+	identity, ok := spec.Identity.(*types.CustomizationSysprep)
+	if !ok {
+		t.Fatalf("Expected a sysprep identity, got %T", spec.Identity)
+	}
+	if identity.Identification.JoinDomain != sysprep.JoinDomain ||
+		identity.Identification.DomainAdminPassword.Value != sysprep.DomainAdminPassword {
+		t.Fatalf("Expected to join the domain, got %+v", identity.Identification)
+	}
+	if len(spec.NicSettingMap) != 1 {
+		t.Fatalf("Expected a DHCP nic setting, got %v", spec.NicSettingMap)
+	}
+	if _, ok := spec.NicSettingMap[0].Adapter.Ip.(*types.CustomizationDhcpIpGenerator); !ok {
+		t.Fatalf("Expected DHCP, got %T", spec.NicSettingMap[0].Adapter.Ip)
+	}
+
+	sysprep.JoinWorkgroup = "WORKGROUP"
+	if err := validateSysprep(sysprep); err == nil {
+		t.Fatal("Expected an error joining a domain and a workgroup")
+	}
+}
+
+func TestUpdateCustomSpecNics(t *testing.T) {
+	vm := &VM{
+		Networks: []Network{{Name: "nw1"}, {Name: "nw2"}, {Name: "nw3"}},
+		NetworkSettings: []virtualmachine.NetworkSetting{
+			{Ip: "10.0.0.10", SubnetMask: "255.255.255.0", Gateway: "10.0.0.1"},
+			{Ip: "10.0.1.10", SubnetMask: "255.255.255.0"},
+		},
+	}
+	spec := updateCustomSpec(vm, &mo.VirtualMachine{}, &types.CustomizationSpec{})
+	if spec == nil || len(spec.NicSettingMap) != 3 {
+		t.Fatalf("Expected an adapter mapping per nic, got %+v", spec)
+	}
+	for i, expected := range []string{"10.0.0.10", "10.0.1.10"} {
+		ip, ok := spec.NicSettingMap[i].Adapter.Ip.(*types.CustomizationFixedIp)
+		if !ok || ip.IpAddress != expected {
+			t.Fatalf("Expected nic %d to get %s, got %+v", i, expected, spec.NicSettingMap[i].Adapter.Ip)
+		}
+	}
+	if gw := spec.NicSettingMap[0].Adapter.Gateway; len(gw) != 1 || gw[0] != "10.0.0.1" {
+		t.Fatalf("Expected the gateway of the first nic, got %v", gw)
+	}
+	if _, ok := spec.NicSettingMap[2].Adapter.Ip.(*types.CustomizationDhcpIpGenerator); !ok {
+		t.Fatalf("Expected the third nic to use DHCP, got %T", spec.NicSettingMap[2].Adapter.Ip)
+	}
+}
+
+func TestUpdateCustomSpecDefaultGateway(t *testing.T) {
+	vm := &VM{
+		NetworkSettings: []virtualmachine.NetworkSetting{
+			{Ip: "10.0.0.10", SubnetMask: "255.255.255.0", Gateway: "10.0.0.1"},
+			{Ip: "10.0.1.10", SubnetMask: "255.255.255.0", Gateway: "10.0.1.1",
+				IsDefaultGateway: true},
+		},
+	}
+	if err := validateDefaultGateway(vm.NetworkSettings); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	spec := updateCustomSpec(vm, &mo.VirtualMachine{}, &types.CustomizationSpec{})
+	if gw := spec.NicSettingMap[0].Adapter.Gateway; len(gw) != 0 {
+		t.Fatalf("Expected no gateway on the first nic, got %v", gw)
+	}
+	if gw := spec.NicSettingMap[1].Adapter.Gateway; len(gw) != 1 || gw[0] != "10.0.1.1" {
+		t.Fatalf("Expected the gateway on the second nic, got %v", gw)
+	}
+
+	vm.NetworkSettings[0].IsDefaultGateway = true
+	if err := validateDefaultGateway(vm.NetworkSettings); err == nil {
+		t.Fatal("Expected an error for two default gateways")
+	}
+}
+
+func TestGetDevicesInfo(t *testing.T) {
+	cdrom := &types.VirtualCdrom{}
+	cdrom.Key = 3000
+	cdrom.DeviceInfo = &types.Description{Label: "CD/DVD drive 1", Summary: "ISO"}
+	cdrom.Backing = &types.VirtualCdromIsoBackingInfo{
+		VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+			FileName: "[ds1] iso/install.iso",
+		},
+	}
+	video := &types.VirtualMachineVideoCard{}
+	video.Key = 500
+	vmMo := mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				Device: []types.BaseVirtualDevice{cdrom, video},
+			},
+		},
+	}
+	devices := getDevicesInfo(vmMo)
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %v", devices)
+	}
+	if devices[0].Type != "cdrom" || devices[0].Label != "CD/DVD drive 1" ||
+		devices[0].Backing != "[ds1] iso/install.iso" {
+		t.Fatalf("Unexpected cdrom info %+v", devices[0])
+	}
+	if devices[1].Key != 500 || devices[1].Backing != "" {
+		t.Fatalf("Unexpected video card info %+v", devices[1])
+	}
+}
+
+func TestUpdateCustomSpecIPv6(t *testing.T) {
+	vm := &VM{
+		NetworkSetting: virtualmachine.NetworkSetting{
+			Ip:               "10.0.0.10",
+			SubnetMask:       "255.255.255.0",
+			Gateway:          "10.0.0.1",
+			IPv6Address:      "2001:db8::10",
+			IPv6PrefixLength: 64,
+			IPv6Gateway:      "2001:db8::1",
+		},
+	}
+	spec := &types.CustomizationSpec{
+		NicSettingMap: []types.CustomizationAdapterMapping{{
+			Adapter: types.CustomizationIPSettings{
+				Ip:      &types.CustomizationFixedIp{IpAddress: "10.10.24.100"},
+				Gateway: []string{"10.10.24.1"},
+			},
+		}},
+	}
+	spec = updateCustomSpec(vm, &mo.VirtualMachine{}, spec)
+	adapter := spec.NicSettingMap[0].Adapter
+	if ip := adapter.Ip.(*types.CustomizationFixedIp).IpAddress; ip != "10.0.0.10" {
+		t.Fatalf("Expected the ipv4 address, got %s", ip)
+	}
+	if adapter.SubnetMask != "255.255.255.0" || len(adapter.Gateway) != 1 ||
+		adapter.Gateway[0] != "10.0.0.1" {
+		t.Fatalf("Expected the ipv4 mask and gateway, got %+v", adapter)
+	}
+	if adapter.IpV6Spec == nil || len(adapter.IpV6Spec.Ip) != 1 {
+		t.Fatalf("Expected the ipv6 settings, got %+v", adapter.IpV6Spec)
+	}
+	ipv6 := adapter.IpV6Spec.Ip[0].(*types.CustomizationFixedIpV6)
+	if ipv6.IpAddress != "2001:db8::10" || ipv6.SubnetMask != 64 ||
+		adapter.IpV6Spec.Gateway[0] != "2001:db8::1" {
+		t.Fatalf("Unexpected ipv6 settings %+v", adapter.IpV6Spec)
+	}
+
+	if err := validateNetworkSetting(vm.NetworkSetting); err != nil {
+		t.Fatalf("Expected dual stack settings to be valid, got %v", err)
+	}
+	if err := validateNetworkSetting(virtualmachine.NetworkSetting{IPv6Address: "2001:db8::10"}); err == nil {
+		t.Fatal("Expected an error for an ipv6 address without prefix length")
+	}
+}
+
+func TestVideoCardDeviceSpec(t *testing.T) {
+	template := &types.VirtualMachineVideoCard{
+		VideoRamSizeInKB: 4096,
+		NumDisplays:      1,
+		UseAutoDetect:    types.NewBool(true),
+	}
+	template.Key = 500
+	vmMo := &mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				Device: []types.BaseVirtualDevice{template},
+			},
+		},
+	}
+	spec, err := videoCardDeviceSpec(vmMo, &VideoCard{
+		NumDisplays: 2,
+		Enable3D:    types.NewBool(true),
+		Renderer:    "hardware",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	card := spec.Device.(*types.VirtualMachineVideoCard)
+	if spec.Operation != types.VirtualDeviceConfigSpecOperationEdit || card.Key != 500 {
+		t.Fatalf("Expected an edit of the video card, got %+v", spec)
+	}
+	if card.VideoRamSizeInKB != 4096 || card.NumDisplays != 2 ||
+		!*card.Enable3DSupport || card.Use3dRenderer != "hardware" ||
+		*card.UseAutoDetect {
+		t.Fatalf("Unexpected video card %+v", card)
+	}
+	if template.NumDisplays != 1 {
+		t.Fatal("Expected the template video card to be left unchanged")
+	}
+	if _, err := videoCardDeviceSpec(vmMo, &VideoCard{Renderer: "gpu"}); err == nil {
+		t.Fatal("Expected an error for an invalid renderer")
+	}
+}
+
+func TestIPInNetwork(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	ipMap := map[string][]string{
+		"00:50:56:00:00:01": {"192.168.1.5", "fe80::1"},
+		"00:50:56:00:00:02": {"169.254.3.4", "10.1.2.3"},
+	}
+	mac, ip := ipInNetwork(ipMap, network)
+	if mac != "00:50:56:00:00:02" || !ip.Equal(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("Expected 10.1.2.3 on the second NIC, got %s on %s", ip, mac)
+	}
+	_, linkLocal, _ := net.ParseCIDR("169.254.0.0/16")
+	if _, ip := ipInNetwork(ipMap, linkLocal); ip != nil {
+		t.Fatalf("Expected link local ips to be skipped, got %s", ip)
+	}
+}
+
+func TestRebootMethod(t *testing.T) {
+	oldRestart, oldReset, oldFindVM := restart, reset, findVM
+	defer func() {
+		restart, reset, findVM = oldRestart, oldReset, oldFindVM
+	}()
+	var called string
+	restart = func(vm *VM) error {
+		called = "restart"
+		return nil
+	}
+	reset = func(vm *VM) error {
+		called = "reset"
+		return nil
+	}
+	toolsStatus := ""
+	findVM = func(vm *VM, filter VMSearchFilter) (*mo.VirtualMachine, error) {
+		return &mo.VirtualMachine{
+			Guest: &types.GuestInfo{ToolsRunningStatus: toolsStatus},
+		}, nil
+	}
+	tests := []struct {
+		method   RebootMethod
+		tools    string
+		expected string
+	}{
+		{RebootMethodGraceful, "", "restart"},
+		{RebootMethodHard, "guestToolsRunning", "reset"},
+		{RebootMethodAuto, "guestToolsRunning", "restart"},
+		{RebootMethodAuto, "guestToolsNotRunning", "reset"},
+	}
+	for _, test := range tests {
+		called, toolsStatus = "", test.tools
+		if err := reboot(&VM{}, test.method); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if called != test.expected {
+			t.Fatalf("Method %s with tools %q: expected %s, got %s", test.method, test.tools, test.expected, called)
+		}
+	}
+	if err := reboot(&VM{}, "soft"); err == nil {
+		t.Fatal("Expected an error for an invalid reboot method")
+	}
+}
+
+func TestGetGuestNicsSplitsFamilies(t *testing.T) {
+	nics := getGuestNics([]types.GuestNicInfo{{
+		Network:    "VM Network",
+		MacAddress: "00:50:56:00:00:01",
+		IpAddress:  []string{"10.0.0.5", "fe80::250:56ff:fe00:1", "bogus"},
+	}})
+	if len(nics) != 1 {
+		t.Fatalf("Expected one nic, got %v", nics)
+	}
+	if len(nics[0].IPv4) != 1 || !nics[0].IPv4[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("Expected the IPv4 address, got %v", nics[0].IPv4)
+	}
+	if len(nics[0].IPv6) != 1 || !nics[0].IPv6[0].Equal(net.ParseIP("fe80::250:56ff:fe00:1")) {
+		t.Fatalf("Expected the IPv6 address, got %v", nics[0].IPv6)
+	}
+}
+
+func TestValidateNicDeviceKey(t *testing.T) {
+	used := map[int32]bool{4000: true}
+	if err := validateNicDeviceKey(4001, used); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, key := range []int32{4000, 3999, 5000, -1} {
+		if err := validateNicDeviceKey(key, used); err == nil {
+			t.Fatalf("Expected an error for the key %d", key)
+		}
+	}
+}
+
+func TestChooseDatastore(t *testing.T) {
+	var selected string
+	vm := &VM{OnDatastoreSelected: func(ds string) error {
+		selected = ds
+		return nil
+	}}
+	if err := chooseDatastore(vm, []string{"ds1"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if selected != "ds1" || vm.datastore != "ds1" {
+		t.Fatalf("Expected ds1 to be selected, got %q", selected)
+	}
+
+	vm.OnDatastoreSelected = func(ds string) error {
+		return errors.New("full")
+	}
+	if err := chooseDatastore(vm, []string{"ds1"}); err == nil {
+		t.Fatal("Expected the rejected datastore to return an error")
+	}
+	if err := chooseDatastore(vm, nil); err != nil {
+		t.Fatalf("Expected no callback without a datastore, got %v", err)
+	}
+}
+
+func TestShutdownTimeouts(t *testing.T) {
+	timeout, interval := shutdownTimeouts(&VM{})
+	if timeout != RETRY_COUNT*SHUTDOWN_POLL_INTERVAL || interval != SHUTDOWN_POLL_INTERVAL {
+		t.Fatalf("Expected the default timeouts, got %v and %v", timeout, interval)
+	}
+	timeout, interval = shutdownTimeouts(&VM{
+		ShutdownTimeout:      10 * time.Minute,
+		ShutdownPollInterval: time.Second,
+	})
+	if timeout != 10*time.Minute || interval != time.Second {
+		t.Fatalf("Expected the configured timeouts, got %v and %v", timeout, interval)
+	}
+}
+
+func TestCreateNetworkMappingQualified(t *testing.T) {
+	networkMors := []types.ManagedObjectReference{
+		{Type: "DistributedVirtualPortgroup", Value: "dvpg-1"},
+		{Type: "DistributedVirtualPortgroup", Value: "dvpg-2"},
+	}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(c context.Context, t types.ManagedObjectReference, ps []string, dst interface{}) error {
+		dst.(*mo.DistributedVirtualPortgroup).Name = "pg"
+		return nil
+	}
+	oldNetworkQualifies := networkQualifies
+	defer func() {
+		networkQualifies = oldNetworkQualifies
+	}()
+	networkQualifies = func(vm *VM, network types.ManagedObjectReference, nw Network) (bool, error) {
+		return network.Value == "dvpg-1" && nw.DVSwitch == "dvs-1", nil
+	}
+	vm := &VM{collector: c}
+
+	mappings, _, err := createNetworkMapping(vm, []Network{{Name: "pg", DVSwitch: "dvs-1"}}, networkMors)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(mappings) != 1 || mappings[0].Network.Value != "dvpg-1" {
+		t.Fatalf("Expected the port group on dvs-1, got %v", mappings)
+	}
+	_, _, err = createNetworkMapping(vm, []Network{{Name: "pg", DVSwitch: "dvs-2"}}, networkMors)
+	if _, ok := err.(ErrorObjectNotFound); !ok {
+		t.Fatalf("Expected an ErrorObjectNotFound, got %v", err)
+	}
+}
+
+func TestFlavorConfigSpec(t *testing.T) {
+	hotAdd := true
+	vmMo := &mo.VirtualMachine{
+		Runtime: types.VirtualMachineRuntimeInfo{
+			PowerState: types.VirtualMachinePowerStatePoweredOff,
+		},
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{NumCPU: 2, MemoryMB: 2048},
+		},
+	}
+	if _, err := flavorConfigSpec(vmMo, Flavor{MemoryMB: 1025}); err == nil {
+		t.Fatal("Expected an error for memory not a multiple of 4MB")
+	}
+	config, err := flavorConfigSpec(vmMo, Flavor{NumCPUs: 1, MemoryMB: 1024})
+	if err != nil {
+		t.Fatalf("Expected no error for a powered off vm, got %v", err)
+	}
+	if config.NumCPUs != 1 || config.MemoryMB != 1024 {
+		t.Fatalf("Unexpected config spec %+v", config)
+	}
+
+	vmMo.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOn
+	if _, err = flavorConfigSpec(vmMo, Flavor{NumCPUs: 4}); err == nil {
+		t.Fatal("Expected an error without CPU hot add")
+	}
+	if _, err = flavorConfigSpec(vmMo, Flavor{MemoryMB: 1024}); err == nil {
+		t.Fatal("Expected an error shrinking the memory of a powered on vm")
+	}
+	vmMo.Config.CpuHotAddEnabled = &hotAdd
+	vmMo.Config.MemoryHotAddEnabled = &hotAdd
+	if _, err = flavorConfigSpec(vmMo, Flavor{NumCPUs: 4, MemoryMB: 4096}); err != nil {
+		t.Fatalf("Expected no error with hot add, got %v", err)
+	}
+}
+
+func TestValidateBiosUUID(t *testing.T) {
+	for _, uuid := range []string{
+		"4211b3f6-7a5e-3f1c-9d2e-0c1b2a3d4e5f",
+		"42 11 b3 f6 7a 5e 3f 1c-9d 2e 0c 1b 2a 3d 4e 5f",
+	} {
+		if err := validateBiosUUID(uuid); err != nil {
+			t.Fatalf("Expected %q to be valid, got %v", uuid, err)
+		}
+	}
+	for _, uuid := range []string{"", "4211b3f6", "4211b3f6-7a5e-3f1c-9d2e-0c1b2a3d4e5g"} {
+		if err := validateBiosUUID(uuid); err == nil {
+			t.Fatalf("Expected %q to be invalid", uuid)
+		}
+	}
+}
+
+func TestStaticIPCustomSpec(t *testing.T) {
+	vm := &VM{NetworkSetting: virtualmachine.NetworkSetting{
+		Ip:         "10.0.0.10",
+		SubnetMask: "255.255.0.0",
+		Gateway:    "10.0.0.1",
+	}}
+	xmlSpec, err := staticIPCustomSpec()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// The spec has the settings of XML_STATIC_IP_SPEC
+	linuxPrep, ok := xmlSpec.Identity.(*types.CustomizationLinuxPrep)
+	if !ok || linuxPrep.Domain != "gsintlab.com" ||
+		!reflect.DeepEqual(xmlSpec.GlobalIPSettings.DnsServerList, []string{"8.8.8.8"}) ||
+		len(xmlSpec.NicSettingMap) != 1 {
+		t.Fatalf("Unexpected spec %+v", xmlSpec)
+	}
+	spec := updateCustomSpec(vm, &mo.VirtualMachine{}, xmlSpec)
+	if spec == nil {
+		t.Fatal("Expected a customization spec")
+	}
+	adapter := spec.NicSettingMap[0].Adapter
+	ip, ok := adapter.Ip.(*types.CustomizationFixedIp)
+	if !ok || ip.IpAddress != "10.0.0.10" || adapter.SubnetMask != "255.255.0.0" ||
+		len(adapter.Gateway) != 1 || adapter.Gateway[0] != "10.0.0.1" {
+		t.Fatalf("Unexpected adapter settings %+v", adapter)
+	}
+	// Every spec is built anew
+	if xmlSpec, _ = staticIPCustomSpec(); xmlSpec.NicSettingMap[0].Adapter.SubnetMask != "255.255.255.0" {
+		t.Fatal("Expected the static ip spec not to be shared")
+	}
+}
+
+func TestSetFlavorAllocation(t *testing.T) {
+	config := types.VirtualMachineConfigSpec{}
+	if err := setFlavorAllocation(&config, Flavor{NumCPUs: 2}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if config.CpuAllocation != nil || config.MemoryAllocation != nil {
+		t.Fatalf("Expected no allocations for an unset flavor, got %+v", config)
+	}
+
+	err := setFlavorAllocation(&config, Flavor{
+		CPUReservationMHz: 1000,
+		CPULimitMHz:       2000,
+		MemoryShares:      Shares{Level: "custom", Count: 2000},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cpu := config.CpuAllocation.GetResourceAllocationInfo()
+	if cpu.Reservation != 1000 || cpu.Limit != 2000 || cpu.Shares != nil {
+		t.Fatalf("Unexpected CPU allocation %+v", cpu)
+	}
+	memory := config.MemoryAllocation.GetResourceAllocationInfo()
+	if memory.Shares == nil || memory.Shares.Level != types.SharesLevelCustom ||
+		memory.Shares.Shares != 2000 {
+		t.Fatalf("Unexpected memory allocation %+v", memory)
+	}
+
+	for _, flavor := range []Flavor{
+		{CPUReservationMHz: 2000, CPULimitMHz: 1000},
+		{CPUShares: Shares{Level: "custom"}},
+		{MemoryShares: Shares{Level: "high", Count: 10}},
+		{MemoryShares: Shares{Level: "max"}},
+	} {
+		if err := setFlavorAllocation(&config, flavor); err == nil {
+			t.Fatalf("Expected an error for %+v", flavor)
+		}
+	}
+}
+
+func TestFindResourcePoolParent(t *testing.T) {
+	notFound := func(ref types.ManagedObjectReference) error {
+		fault := &soap.Fault{}
+		fault.Detail.Fault = types.ManagedObjectNotFound{Obj: ref}
+		return soap.WrapSoapFault(fault)
+	}
+	clusterPool := types.ManagedObjectReference{Type: "ResourcePool", Value: "resgroup-8"}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(c context.Context, ref types.ManagedObjectReference, ps []string, dst interface{}) error {
+		switch {
+		case ref.Type == "ResourcePool" && ref.Value == "resgroup-10":
+			return nil
+		case ref.Type == "HostSystem" && ref.Value == "host-12":
+			dst.(*mo.HostSystem).Parent = &types.ManagedObjectReference{
+				Type: "ClusterComputeResource", Value: "domain-c7"}
+			return nil
+		case ref.Type == "ClusterComputeResource" && ref.Value == "domain-c7":
+			dst.(*mo.ComputeResource).ResourcePool = &clusterPool
+			return nil
+		}
+		return notFound(ref)
+	}
+	vm := &VM{collector: c}
+
+	testCases := []struct {
+		moid     string
+		expected string
+	}{
+		{"resgroup-10", "resgroup-10"},
+		{"domain-c7", "resgroup-8"},
+		{"host-12", "resgroup-8"},
+	}
+	for _, tc := range testCases {
+		ref, err := findResourcePoolParent(vm, tc.moid)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", tc.moid, err)
+		}
+		if ref.Type != "ResourcePool" || ref.Value != tc.expected {
+			t.Fatalf("Expected the pool %s for %s, got %v", tc.expected, tc.moid, ref)
+		}
+	}
+	if _, err := findResourcePoolParent(vm, "domain-c99"); err == nil {
+		t.Fatal("Expected an error for an unknown parent")
+	}
+}
+
+func TestValidateCustomizationOS(t *testing.T) {
+	linux, err := staticIPCustomSpec()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	windows := sysprepCustomSpec(&Sysprep{}, nil)
+	testCases := []struct {
+		spec     *types.CustomizationSpec
+		guestID  string
+		mismatch bool
+	}{
+		{linux, "ubuntu64Guest", false},
+		{linux, "windows9Server64Guest", true},
+		{windows, "windows9Server64Guest", false},
+		{windows, "centos64Guest", true},
+		{windows, "otherGuest64", false},
+		{linux, "", false},
+	}
+	for _, tc := range testCases {
+		err := validateCustomizationOS(tc.spec, tc.guestID)
+		if _, ok := err.(ErrorCustomizationOSMismatch); ok != tc.mismatch {
+			t.Fatalf("Expected mismatch %v for %s, got %v", tc.mismatch, tc.guestID, err)
+		}
+	}
+}
+
+func TestSetProvisioningState(t *testing.T) {
+	vm := &VM{}
+	// Steps of other operations are ignored outside of a provision
+	setProvisioningState(vm, ProvisioningStatePoweringOn)
+	if state := vm.State(); state != ProvisioningStateNone {
+		t.Fatalf("Expected no state, got %q", state)
+	}
+	for _, state := range []ProvisioningState{
+		ProvisioningStateConnecting,
+		ProvisioningStateCloning,
+		ProvisioningStateDone,
+	} {
+		setProvisioningState(vm, state)
+		if vm.State() != state {
+			t.Fatalf("Expected state %q, got %q", state, vm.State())
+		}
+	}
+	setProvisioningState(vm, ProvisioningStateWaitingForIP)
+	if state := vm.State(); state != ProvisioningStateDone {
+		t.Fatalf("Expected the done state to be kept, got %q", state)
+	}
+}
+
+func TestFindResourcePoolByMOIDDeep(t *testing.T) {
+	// A chain of 10 pools under the root pool of a cluster
+	pools := map[types.ManagedObjectReference]mo.ResourcePool{}
+	root := types.ManagedObjectReference{Type: "ResourcePool", Value: "resgroup-root"}
+	parent := root
+	for n := 1; n <= 10; n++ {
+		ref := types.ManagedObjectReference{Type: "ResourcePool", Value: fmt.Sprintf("resgroup-%d", n)}
+		pool := pools[parent]
+		pool.Self = parent
+		pool.ResourcePool = []types.ManagedObjectReference{ref}
+		pools[parent] = pool
+		leaf := mo.ResourcePool{}
+		leaf.Self = ref
+		leaf.Name = fmt.Sprintf("pool%d", n)
+		pools[ref] = leaf
+		parent = ref
+	}
+
+	f := mockFinder{}
+	f.MockResourcePoolList = func(c context.Context, p string) ([]*object.ResourcePool, error) {
+		if p != "*/Resources" {
+			t.Fatalf("Expected only the root pools to be listed, got %s", p)
+		}
+		return []*object.ResourcePool{object.NewResourcePool(nil, root)}, nil
+	}
+	c := mockCollector{}
+	c.MockRetrieve = func(c context.Context, refs []types.ManagedObjectReference, ps []string, dst interface{}) error {
+		rps := dst.(*[]mo.ResourcePool)
+		for _, ref := range refs {
+			*rps = append(*rps, pools[ref])
+		}
+		return nil
+	}
+	vm := &VM{finder: f, collector: c}
+
+	rp, err := findResourcePoolByMOID(vm, "resgroup-10")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rp.Name != "pool10" {
+		t.Fatalf("Expected pool10, got %s", rp.Name)
+	}
+	if _, err = findResourcePoolByMOID(vm, "resgroup-11"); err == nil {
+		t.Fatal("Expected an error for a missing pool")
+	}
+
+	// Errors listing the pools are returned
+	f.MockResourcePoolList = func(c context.Context, p string) ([]*object.ResourcePool, error) {
+		return nil, errors.New("list failed")
+	}
+	vm.finder = f
+	if _, err = findResourcePoolByMOID(vm, "resgroup-10"); err == nil ||
+		err.Error() != "list failed" {
+		t.Fatalf("Expected the list error, got %v", err)
+	}
+}
+
+func TestClusterRuleSpec(t *testing.T) {
+	enabled := true
+	crMo := &mo.ClusterComputeResource{}
+	crMo.Name = "cluster1"
+	crMo.Configuration.DrsConfig.Enabled = &enabled
+	crMo.Configuration.Rule = []types.BaseClusterRuleInfo{
+		&types.ClusterAffinityRuleSpec{
+			ClusterRuleInfo: types.ClusterRuleInfo{Name: "existing"},
+		},
+	}
+	vmRefs := []types.ManagedObjectReference{
+		{Type: "VirtualMachine", Value: "vm-1"},
+		{Type: "VirtualMachine", Value: "vm-2"},
+	}
+
+	spec, err := clusterRuleSpec(crMo, "replicas", vmRefs, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rule, ok := spec.RulesSpec[0].Info.(*types.ClusterAntiAffinityRuleSpec)
+	if !ok || rule.Name != "replicas" || len(rule.Vm) != 2 ||
+		spec.RulesSpec[0].Operation != types.ArrayUpdateOperationAdd {
+		t.Fatalf("Unexpected rule spec %+v", spec.RulesSpec[0])
+	}
+	spec, err = clusterRuleSpec(crMo, "together", vmRefs, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := spec.RulesSpec[0].Info.(*types.ClusterAffinityRuleSpec); !ok {
+		t.Fatalf("Expected an affinity rule, got %T", spec.RulesSpec[0].Info)
+	}
+
+	if _, err = clusterRuleSpec(crMo, "existing", vmRefs, true); err == nil {
+		t.Fatal("Expected an error for an existing rule name")
+	}
+	if _, err = clusterRuleSpec(crMo, "replicas", vmRefs[:1], true); err == nil {
+		t.Fatal("Expected an error for a single vm")
+	}
+	enabled = false
+	if _, err = clusterRuleSpec(crMo, "replicas", vmRefs, true); err == nil {
+		t.Fatal("Expected an error with DRS disabled")
+	}
+}
+
+func TestUpdateCustomSpecWithoutNics(t *testing.T) {
+	vm := &VM{NetworkSetting: virtualmachine.NetworkSetting{
+		Ip:         "10.0.0.10",
+		SubnetMask: "255.255.255.0",
+	}}
+	// A named spec may not map any nic
+	spec := updateCustomSpec(vm, &mo.VirtualMachine{}, &types.CustomizationSpec{
+		Identity: &types.CustomizationLinuxPrep{Domain: "example.com"},
+	})
+	if spec == nil || len(spec.NicSettingMap) != 1 {
+		t.Fatalf("Expected a nic setting to be added, got %+v", spec)
+	}
+	ip, ok := spec.NicSettingMap[0].Adapter.Ip.(*types.CustomizationFixedIp)
+	if !ok || ip.IpAddress != "10.0.0.10" {
+		t.Fatalf("Expected the fixed ip, got %+v", spec.NicSettingMap[0].Adapter.Ip)
+	}
+}
+
+func TestGetDisksInfoDatastore(t *testing.T) {
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = 1000
+	controller.DeviceInfo = &types.Description{Label: "SCSI controller 0"}
+	devices := object.VirtualDeviceList{controller}
+	ds := types.ManagedObjectReference{Type: "Datastore", Value: "ds-1"}
+
+	root := CreateDisk(devices, controller, ds, "", true, "")
+	root.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName = "[ds1] vm1/vm1.vmdk"
+	added := CreateDisk(devices, controller, ds, "", true, "")
+	added.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName = "[ds 2] vm1/vm1_1.vmdk"
+	vmMo := mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				Device: []types.BaseVirtualDevice{controller, root, added},
+			},
+		},
+	}
+	disks := getDisksInfo(vmMo)
+	if len(disks) != 2 || disks[0].Datastore != "ds1" || disks[1].Datastore != "ds 2" {
+		t.Fatalf("Expected the datastores of the disks, got %+v", disks)
+	}
+}
+
+func TestClusterGroupSpecs(t *testing.T) {
+	enabled := true
+	config := &types.ClusterConfigInfoEx{}
+	config.DrsConfig.Enabled = &enabled
+	hosts := &types.ClusterHostGroup{
+		Host: []types.ManagedObjectReference{{Type: "HostSystem", Value: "host-1"}},
+	}
+	hosts.Name = "licensed"
+	vms := &types.ClusterVmGroup{
+		Vm: []types.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}},
+	}
+	vms.Name = "db"
+
+	spec, err := clusterGroupSpec(config, "cluster1", hosts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.GroupSpec[0].Operation != types.ArrayUpdateOperationAdd ||
+		spec.GroupSpec[0].Info != hosts {
+		t.Fatalf("Unexpected group spec %+v", spec.GroupSpec[0])
+	}
+	if _, err = vmHostRuleSpec(config, "cluster1", "pin", "db", "licensed", true); err == nil {
+		t.Fatal("Expected an error for a missing vm group")
+	}
+	config.Group = []types.BaseClusterGroupInfo{hosts, vms}
+	if _, err = clusterGroupSpec(config, "cluster1", hosts); err == nil {
+		t.Fatal("Expected an error for an existing group name")
+	}
+	if _, err = vmHostRuleSpec(config, "cluster1", "pin", "licensed", "db", true); err == nil {
+		t.Fatal("Expected an error for swapped groups")
+	}
+
+	spec, err = vmHostRuleSpec(config, "cluster1", "pin", "db", "licensed", true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rule, ok := spec.RulesSpec[0].Info.(*types.ClusterVmHostRuleInfo)
+	if !ok || rule.VmGroupName != "db" || rule.AffineHostGroupName != "licensed" ||
+		rule.Mandatory == nil || !*rule.Mandatory {
+		t.Fatalf("Unexpected rule spec %+v", spec.RulesSpec[0].Info)
+	}
+
+	rule.Key = 7
+	config.Rule = []types.BaseClusterRuleInfo{rule}
+	expected := []ClusterRule{{Name: "pin", Type: "vm_host", Enabled: true,
+		Mandatory: true, VMGroup: "db", HostGroup: "licensed"}}
+	if actual := clusterRules(config); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected rules %+v, got %+v", expected, actual)
+	}
+	expectedGroups := []ClusterGroup{
+		{Name: "licensed", Type: "host", Members: []string{"host-1"}},
+		{Name: "db", Type: "vm", Members: []string{"vm-1"}},
+	}
+	if actual := clusterGroups(config); !reflect.DeepEqual(actual, expectedGroups) {
+		t.Fatalf("Expected groups %+v, got %+v", expectedGroups, actual)
+	}
+
+	if _, err = removeClusterGroupSpec(config, "cluster1", "db"); err == nil {
+		t.Fatal("Expected an error removing a group used by a rule")
+	}
+	spec, err = removeClusterRuleSpec(config, "cluster1", "pin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.RulesSpec[0].Operation != types.ArrayUpdateOperationRemove ||
+		spec.RulesSpec[0].RemoveKey != int32(7) {
+		t.Fatalf("Unexpected rule spec %+v", spec.RulesSpec[0])
+	}
+	config.Rule = nil
+	spec, err = removeClusterGroupSpec(config, "cluster1", "db")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.GroupSpec[0].RemoveKey != "db" {
+		t.Fatalf("Unexpected group spec %+v", spec.GroupSpec[0])
+	}
+	if _, err = removeClusterRuleSpec(config, "cluster1", "pin"); err == nil {
+		t.Fatal("Expected an error for a missing rule")
+	}
+}
+
+func TestConsolidateRelocateSpec(t *testing.T) {
+	dsMor := types.ManagedObjectReference{Type: "Datastore", Value: "ds-1"}
+	if _, err := consolidateRelocateSpec(&mo.VirtualMachine{}, dsMor); err == nil {
+		t.Fatal("Expected an error without the vm config")
+	}
+
+	vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{}}
+	vmMo.Config.Hardware.Device = []types.BaseVirtualDevice{
+		&types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2000}},
+		&types.VirtualE1000{},
+		&types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2001}},
+	}
+	spec, err := consolidateRelocateSpec(vmMo, dsMor)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.Datastore == nil || *spec.Datastore != dsMor {
+		t.Fatalf("Expected the vm files on %v, got %v", dsMor, spec.Datastore)
+	}
+	expected := []types.VirtualMachineRelocateSpecDiskLocator{
+		{DiskId: 2000, Datastore: dsMor},
+		{DiskId: 2001, Datastore: dsMor},
+	}
+	if !reflect.DeepEqual(spec.Disk, expected) {
+		t.Fatalf("Expected disk locators %v, got %v", expected, spec.Disk)
+	}
+}
+
+func TestTagClient(t *testing.T) {
+	var attached []string
+	var conns, closed int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/com/vmware/cis/session" {
+			if user, pass, ok := r.BasicAuth(); r.Method == "POST" &&
+				(!ok || user != "user" || pass != "pass") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"value": "session-1"}`)
+			return
+		}
+		if r.Header.Get("vmware-api-session-id") != "session-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/rest/com/vmware/cis/tagging/category?":
+			fmt.Fprint(w, `{"value": ["cat-1"]}`)
+		case "/rest/com/vmware/cis/tagging/category/id:cat-1?":
+			fmt.Fprint(w, `{"value": {"id": "cat-1", "name": "env"}}`)
+		case "/rest/com/vmware/cis/tagging/tag/id:cat-1?~action=list-tags-for-category":
+			fmt.Fprint(w, `{"value": ["tag-1", "tag-2"]}`)
+		case "/rest/com/vmware/cis/tagging/tag/id:tag-1?":
+			fmt.Fprint(w, `{"value": {"id": "tag-1", "name": "dev", "category_id": "cat-1"}}`)
+		case "/rest/com/vmware/cis/tagging/tag/id:tag-2?":
+			fmt.Fprint(w, `{"value": {"id": "tag-2", "name": "prod", "category_id": "cat-1"}}`)
+		case "/rest/com/vmware/cis/tagging/tag-association/id:tag-2?~action=attach":
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"object_id":{"id":"vm-1","type":"VirtualMachine"}}` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			attached = append(attached, "tag-2")
+		case "/rest/com/vmware/cis/tagging/tag-association?~action=list-attached-tags":
+			fmt.Fprintf(w, `{"value": ["%s"]}`, strings.Join(attached, `","`))
+		case "/rest/com/vmware/cis/tagging/tag-association/id:tag-2?~action=list-attached-objects":
+			fmt.Fprint(w, `{"value": [{"id": "vm-1", "type": "VirtualMachine"},
+				{"id": "host-1", "type": "HostSystem"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&conns, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	vm := &VM{Username: "user", Password: "pass"}
+	c, err := newTagClient(vm, ts.URL+"/rest")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	vmRef := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	tagID, err := c.tag("env", "prod")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err = c.associate("attach", tagID, vmRef); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tags, err := c.attachedTags(vmRef)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []Tag{{ID: "tag-2", Name: "prod", Category: "env"}}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Expected tags %v, got %v", expected, tags)
+	}
+	refs, err := c.attachedObjects(tagID, "VirtualMachine")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(refs) != 1 || refs[0] != vmRef {
+		t.Fatalf("Expected only the vm, got %v", refs)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Expected the requests to share one connection, got %d", n)
+	}
+
+	if _, err = c.tag("env", "staging"); err != NewErrorTagNotFound("env", "staging") {
+		t.Fatalf("Expected a missing tag error, got %v", err)
+	}
+	if _, err = c.tag("owner", "prod"); err != NewErrorTagNotFound("owner", "") {
+		t.Fatalf("Expected a missing category error, got %v", err)
+	}
+
+	c.logout()
+	for i := 0; atomic.LoadInt32(&closed) != 1; i++ {
+		if i == 100 {
+			t.Fatal("Expected the connection to be closed on logout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	vm.Password = "wrong"
+	if _, err = newTagClient(vm, ts.URL+"/rest"); err == nil {
+		t.Fatal("Expected an error logging in with the wrong password")
+	}
+}
+
+func TestGetHostName(t *testing.T) {
+	hsRef := types.ManagedObjectReference{Type: "HostSystem", Value: "host-2"}
+	vm := &VM{
+		collector: mockCollector{
+			MockRetrieveOne: func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+				if mor != hsRef {
+					return fmt.Errorf("unexpected host %v", mor)
+				}
+				dst.(*mo.HostSystem).Name = "esx2.example.com"
+				return nil
+			},
+		},
+	}
+	vmMo := &mo.VirtualMachine{}
+	if _, err := getHostName(vm, vmMo); err == nil {
+		t.Fatal("Expected an error without a host")
+	}
+	vmMo.Runtime.Host = &hsRef
+	name, err := getHostName(vm, vmMo)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if name != "esx2.example.com" {
+		t.Fatalf("Expected the host esx2.example.com, got %s", name)
+	}
+}
+
+func TestFilterByCustomField(t *testing.T) {
+	fields := []types.CustomFieldDef{{Key: 101, Name: "owner"}, {Key: 102, Name: "team"}}
+	values := map[string][]types.BaseCustomFieldValue{
+		"vm-1": {&types.CustomFieldStringValue{
+			CustomFieldValue: types.CustomFieldValue{Key: 101}, Value: "alice"}},
+		"vm-2": {&types.CustomFieldStringValue{
+			CustomFieldValue: types.CustomFieldValue{Key: 102}, Value: "alice"}},
+		"vm-3": {&types.CustomFieldStringValue{
+			CustomFieldValue: types.CustomFieldValue{Key: 101}, Value: "bob"}},
+	}
+	var vmProps []VmProperties
+	for _, id := range []string{"vm-1", "vm-2", "vm-3"} {
+		vmMo := mo.VirtualMachine{}
+		vmMo.Self = types.ManagedObjectReference{Type: "VirtualMachine", Value: id}
+		vmProps = append(vmProps, VmProperties{Name: id, Properties: vmMo})
+	}
+	retrieveCalls := 0
+	vm := &VM{
+		collector: mockCollector{
+			MockRetrieve: func(ctx context.Context, mos []types.ManagedObjectReference, ps []string, dst interface{}) error {
+				retrieveCalls++
+				vmMos := dst.(*[]mo.VirtualMachine)
+				for _, ref := range mos {
+					vmMo := mo.VirtualMachine{}
+					vmMo.Self = ref
+					vmMo.AvailableField = fields
+					vmMo.CustomValue = values[ref.Value]
+					*vmMos = append(*vmMos, vmMo)
+				}
+				return nil
+			},
+		},
+	}
+	filtered, err := filterByCustomField(vm, vmProps, "owner", "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if retrieveCalls != 1 {
+		t.Fatalf("Expected one retrieve, got %d", retrieveCalls)
+	}
+	if len(filtered) != 1 || filtered[0].Name != "vm-1" {
+		t.Fatalf("Expected only vm-1, got %v", filtered)
+	}
+	filtered, err = filterByCustomField(vm, vmProps, "location", "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(filtered) != 0 {
+		t.Fatalf("Expected no vm for an unknown field, got %v", filtered)
+	}
+}
+
+func TestForEachVM(t *testing.T) {
+	vms := []*VM{{Name: "vm1"}, {Name: "vm2"}, {Name: "vm3"}, {Name: "vm4"}}
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+	)
+	errs := forEachVM(vms, 2, func(vm *VM) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if vm.Name == "vm3" {
+			return errors.New("power on failed")
+		}
+		return nil
+	})
+	if peak > 2 {
+		t.Fatalf("Expected at most 2 concurrent operations, got %d", peak)
+	}
+	if len(errs) != len(vms) {
+		t.Fatalf("Expected %d results, got %d", len(vms), len(errs))
+	}
+	for i, err := range errs {
+		if (i == 2) != (err != nil) {
+			t.Fatalf("Unexpected result %v for %s", err, vms[i].Name)
+		}
+	}
+	if errs := forEachVM(nil, 0, nil); len(errs) != 0 {
+		t.Fatalf("Expected no results, got %v", errs)
+	}
+}
+
+func TestGetFolderPath(t *testing.T) {
+	ref := func(kind, id string) *types.ManagedObjectReference {
+		return &types.ManagedObjectReference{Type: kind, Value: id}
+	}
+	entities := map[types.ManagedObjectReference]mo.ManagedEntity{
+		*ref("VirtualMachine", "vm-1"): {Parent: ref("Folder", "group-3")},
+		*ref("Folder", "group-3"):      {Name: "folder1", Parent: ref("Folder", "group-2")},
+		*ref("Folder", "group-2"):      {Name: "vm", Parent: ref("Datacenter", "dc-1")},
+		*ref("Datacenter", "dc-1"):     {Name: "dc1", Parent: ref("Folder", "group-1")},
+		*ref("Folder", "group-1"):      {Name: "Datacenters"},
+	}
+	vm := &VM{
+		collector: mockCollector{
+			MockRetrieveOne: func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+				entity, ok := entities[mor]
+				if !ok {
+					return fmt.Errorf("unexpected object %v", mor)
+				}
+				*dst.(*mo.ManagedEntity) = entity
+				return nil
+			},
+		},
+	}
+	path, err := getFolderPath(vm, *ref("VirtualMachine", "vm-1"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if path != "/dc1/vm/folder1" {
+		t.Fatalf("Expected the path /dc1/vm/folder1, got %s", path)
+	}
+	if _, err = getFolderPath(vm, *ref("VirtualMachine", "vm-2")); err == nil {
+		t.Fatal("Expected an error for an unknown vm")
+	}
+}
+
+func TestGetVMSummary(t *testing.T) {
+	vmMo := &mo.VirtualMachine{Guest: &types.GuestInfo{
+		GuestState:         "running",
+		ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsRunning),
+		ToolsVersion:       "10304",
+	}}
+	vmMo.Self = types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	vmMo.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOn
+	vmMo.Summary.Config.NumCpu = 2
+	vmMo.Summary.Config.MemorySizeMB = 4096
+	vmMo.Summary.Config.InstanceUuid = "uuid-1"
+
+	info := getVMSummary(vmMo)
+	if info.VMId != "vm-1" || info.InstanceId != "uuid-1" ||
+		info.PowerState != "poweredOn" || info.GuestState != "running" ||
+		info.ToolsVersion != "10304" || !info.ToolsRunningStatus ||
+		info.NumCpu != 2 || info.MemorySizeMB != 4096 {
+		t.Fatalf("Unexpected summary %+v", info)
+	}
+
+	vmMo.Guest = nil
+	info = getVMSummary(vmMo)
+	if info.VMId != "vm-1" || info.GuestState != "" || info.ToolsRunningStatus ||
+		info.ToolsInstalled || len(info.IpAddress) != 0 {
+		t.Fatalf("Expected a summary without guest info, got %+v", info)
+	}
+}
+
+func TestExecuteNameTemplate(t *testing.T) {
+	nameCtx := NameContext{Index: 3, Datastore: "ds1", Host: "esx1"}
+	name, err := executeNameTemplate("web-{{.Index}}-{{.Datastore}}", nameCtx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if name != "web-3-ds1" {
+		t.Fatalf("Expected the name web-3-ds1, got %s", name)
+	}
+	if _, err = executeNameTemplate("web-{{.Index", nameCtx); err == nil {
+		t.Fatal("Expected an error for an invalid template")
+	}
+	if _, err = executeNameTemplate("web-{{.Cluster}}", nameCtx); err == nil {
+		t.Fatal("Expected an error for an unknown field")
+	}
+	if _, err = executeNameTemplate("{{.Host | printf \"%.0s\"}}", nameCtx); err == nil {
+		t.Fatal("Expected an error for an empty name")
+	}
+}
+
+func TestResolveNameCollision(t *testing.T) {
+	existing := map[string]bool{"web": true, "web-1": true}
+	oldExists := Exists
+	defer func() { Exists = oldExists }()
+	Exists = func(vm *VM, searchFilter VMSearchFilter) (bool, error) {
+		return existing[searchFilter.Name], nil
+	}
+
+	vm := &VM{Name: "db"}
+	if reuse, err := resolveNameCollision(vm); reuse || err != nil || vm.Name != "db" {
+		t.Fatalf("Expected a free name to be kept, got %v %v %s", reuse, err, vm.Name)
+	}
+	vm = &VM{Name: "web"}
+	if _, err := resolveNameCollision(vm); err != ErrorVMExists {
+		t.Fatalf("Expected ErrorVMExists by default, got %v", err)
+	}
+	vm = &VM{Name: "web", OnNameCollision: NameCollisionReuse}
+	if reuse, err := resolveNameCollision(vm); !reuse || err != nil || vm.Name != "web" {
+		t.Fatalf("Expected the vm to be reused, got %v %v %s", reuse, err, vm.Name)
+	}
+	vm = &VM{Name: "web", OnNameCollision: NameCollisionSuffix}
+	if reuse, err := resolveNameCollision(vm); reuse || err != nil || vm.Name != "web-2" {
+		t.Fatalf("Expected the name web-2, got %v %v %s", reuse, err, vm.Name)
+	}
+
+	if err := validateNameCollision("rename"); err == nil {
+		t.Fatal("Expected an error for an unknown strategy")
+	}
+	if err := validateNameCollision(""); err != nil {
+		t.Fatalf("Expected no error for the default, got %v", err)
+	}
+}
+
+func TestPollGuestProcess(t *testing.T) {
+	oldGetGuestProcess := getGuestProcess
+	defer func() { getGuestProcess = oldGetGuestProcess }()
+	endTime := time.Now()
+	getGuestProcess = func(ctx context.Context, vm *VM, vmMor types.ManagedObjectReference,
+		auth GuestCredentials, pid int64) (*types.GuestProcessInfo, error) {
+		switch pid {
+		case 1:
+			return &types.GuestProcessInfo{Pid: pid, EndTime: &endTime, ExitCode: 3}, nil
+		case 2:
+			return &types.GuestProcessInfo{Pid: pid}, nil
+		}
+		return nil, fmt.Errorf("guest process %d not found", pid)
+	}
+
+	vm := &VM{}
+	vmMor := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	exitCode, err := pollGuestProcess(context.Background(), vm, vmMor, GuestCredentials{}, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if exitCode != 3 {
+		t.Fatalf("Expected the exit code 3, got %d", exitCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = pollGuestProcess(ctx, vm, vmMor, GuestCredentials{}, 2); err == nil {
+		t.Fatal("Expected an error when the context is done")
+	}
+	if _, err = pollGuestProcess(context.Background(), vm, vmMor, GuestCredentials{}, 4); err == nil {
+		t.Fatal("Expected an error for a missing process")
+	}
+}
+
+func TestGetReadyDetails(t *testing.T) {
+	vmMo := &mo.VirtualMachine{}
+	vmMo.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOff
+	if ready, details := getReadyDetails(vmMo); ready || details.PowerState != "poweredOff" {
+		t.Fatalf("Expected a powered off vm not to be ready, got %v %+v", ready, details)
+	}
+
+	vmMo.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOn
+	vmMo.Guest = &types.GuestInfo{
+		ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsRunning),
+		Net:                []types.GuestNicInfo{{IpAddress: []string{"10.0.0.5"}}},
+	}
+	vmMo.GuestHeartbeatStatus = types.ManagedEntityStatusYellow
+	if ready, details := getReadyDetails(vmMo); ready || !details.ToolsRunning ||
+		details.HeartbeatStatus != "yellow" {
+		t.Fatalf("Expected a yellow heartbeat not to be ready, got %v %+v", ready, details)
+	}
+
+	vmMo.GuestHeartbeatStatus = types.ManagedEntityStatusGreen
+	ready, details := getReadyDetails(vmMo)
+	if !ready || len(details.IPs) != 1 || details.IPs[0].String() != "10.0.0.5" {
+		t.Fatalf("Expected the vm to be ready, got %v %+v", ready, details)
+	}
+
+	vmMo.Guest.Net = nil
+	if ready, _ := getReadyDetails(vmMo); ready {
+		t.Fatal("Expected a vm without an IP not to be ready")
+	}
+}
+
+func TestProvisionEvents(t *testing.T) {
+	events := make(chan ProvisionEvent, 2)
+	vm := &VM{Events: events}
+	setProvisioningState(vm, ProvisioningStateConnecting)
+	lease := eventLease{Lease: mockLease{}, vm: vm}
+	lease.HTTPNfcLeaseProgress(42)
+	// The channel is full, the events are dropped without blocking
+	setProvisioningState(vm, ProvisioningStateCloning)
+	lease.HTTPNfcLeaseProgress(50)
+
+	event := <-events
+	if event.State != ProvisioningStateConnecting || event.Time.IsZero() {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	event = <-events
+	if event.State != ProvisioningStateUploadingTemplate || event.Percent != 42 {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	select {
+	case event = <-events:
+		t.Fatalf("Expected the events to be dropped, got %+v", event)
+	default:
+	}
+	if vm.State() != ProvisioningStateCloning {
+		t.Fatalf("Expected the state to change with a full channel, got %s", vm.State())
+	}
+
+	// Steps outside of a Provision aren't sent
+	vm = &VM{Events: events}
+	setProvisioningState(vm, ProvisioningStateCloning)
+	select {
+	case event = <-events:
+		t.Fatalf("Expected no event, got %+v", event)
+	default:
+	}
+}
+
+func TestTeamingPortGroupSpec(t *testing.T) {
+	failback := false
+	nw := Network{
+		Name:     "pg-teamed",
+		DVSwitch: "dvs1",
+		Teaming: &Teaming{
+			Policy:         "failover_explicit",
+			ActiveUplinks:  []string{"dvUplink1"},
+			StandbyUplinks: []string{"dvUplink2"},
+			Failback:       &failback,
+		},
+	}
+	uplinks := []string{"dvUplink1", "dvUplink2"}
+	if err := validateTeaming(nw.Teaming, uplinks); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	invalid := []Teaming{
+		{Policy: "roundrobin", ActiveUplinks: []string{"dvUplink1"}},
+		{Policy: "loadbalance_ip"},
+		{Policy: "loadbalance_ip", ActiveUplinks: []string{"dvUplink3"}},
+		{Policy: "loadbalance_ip", ActiveUplinks: []string{"dvUplink1"},
+			StandbyUplinks: []string{"dvUplink1"}},
+	}
+	for _, teaming := range invalid {
+		if err := validateTeaming(&teaming, uplinks); err == nil {
+			t.Fatalf("Expected an error for %+v", teaming)
+		}
+	}
+
+	spec := teamingPortGroupSpec(nw)
+	if spec.Name != "pg-teamed" || spec.Type != "ephemeral" {
+		t.Fatalf("Expected an ephemeral pg-teamed port group, got %+v", spec)
+	}
+	policy := spec.DefaultPortConfig.(*types.VMwareDVSPortSetting).UplinkTeamingPolicy
+	if policy.RollingOrder == nil || !*policy.RollingOrder.Value {
+		t.Fatalf("Expected a rolling order without failback, got %+v", policy.RollingOrder)
+	}
+	if policy.NotifySwitches != nil {
+		t.Fatalf("Expected notify switches to be left unset, got %+v", policy.NotifySwitches)
+	}
+	if !teamingMatches(spec.DefaultPortConfig, nw.Teaming) {
+		t.Fatal("Expected the spec to match its teaming policy")
+	}
+	other := *nw.Teaming
+	other.ActiveUplinks = []string{"dvUplink2"}
+	other.StandbyUplinks = []string{"dvUplink1"}
+	if teamingMatches(spec.DefaultPortConfig, &other) {
+		t.Fatal("Expected the spec not to match another uplink order")
+	}
+}
+
+func TestTeamingPortGroupExisting(t *testing.T) {
+	nw := Network{
+		Name:     "pg-teamed",
+		DVSwitch: "dvs1",
+		Teaming: &Teaming{
+			Policy:        "loadbalance_srcid",
+			ActiveUplinks: []string{"dvUplink1"},
+		},
+	}
+	dvsRef := types.ManagedObjectReference{Type: "VmwareDistributedVirtualSwitch", Value: "dvs-1"}
+	pgRef := types.ManagedObjectReference{Type: "DistributedVirtualPortgroup", Value: "dvportgroup-2"}
+	vm := &VM{collector: mockCollector{
+		MockRetrieveOne: func(c context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+			dvsMo := dst.(*mo.DistributedVirtualSwitch)
+			dvsMo.Self = dvsRef
+			dvsMo.Name = "dvs1"
+			dvsMo.Portgroup = []types.ManagedObjectReference{pgRef}
+			dvsMo.Config = &types.VMwareDVSConfigInfo{DVSConfigInfo: types.DVSConfigInfo{
+				UplinkPortPolicy: &types.DVSNameArrayUplinkPortPolicy{
+					UplinkPortName: []string{"dvUplink1", "dvUplink2"},
+				},
+			}}
+			return nil
+		},
+		MockRetrieve: func(c context.Context, mors []types.ManagedObjectReference, ps []string, dst interface{}) error {
+			pgMo := mo.DistributedVirtualPortgroup{}
+			pgMo.Self = mors[0]
+			pgMo.Name = "pg-teamed"
+			pgMo.Config.DistributedVirtualSwitch = &dvsRef
+			pgMo.Config.DefaultPortConfig = teamingPortGroupSpec(nw).DefaultPortConfig
+			*dst.(*[]mo.DistributedVirtualPortgroup) = []mo.DistributedVirtualPortgroup{pgMo}
+			return nil
+		},
+	}}
+	ref, err := teamingPortGroup(vm, nw, []types.ManagedObjectReference{pgRef})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ref != pgRef {
+		t.Fatalf("Expected the existing port group %v, got %v", pgRef, ref)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	oldSetupSession := SetupSession
+	defer func() {
+		SetupSession = oldSetupSession
+	}()
+	SetupSession = NewFakeSession(&mockFinder{}, &mockCollector{})
+
+	vm := &VM{Host: "vcenter"}
+	if err := SetupSession(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	vm.Cancel()
+	if err := sleepContext(vm.ctx, time.Minute); err != context.Canceled {
+		t.Fatalf("Expected the session to be cancelled, got %v", err)
+	}
+	if err := SetupSession(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := vm.ctx.Err(); err != nil {
+		t.Fatalf("Expected the next session not to be cancelled, got %v", err)
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	if err := SetupSessionWithContext(parent, vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	first := vm.ctx
+	if err := SetupSession(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cancel()
+	if first.Err() != context.Canceled || vm.ctx.Err() != context.Canceled {
+		t.Fatal("Expected the sessions to be cancelled with their parent")
+	}
+}
+
+func TestRebaseCloneSpec(t *testing.T) {
+	trees := []types.VirtualMachineSnapshotTree{{
+		Name:     "base",
+		Snapshot: types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-1"},
+		ChildSnapshotList: []types.VirtualMachineSnapshotTree{{
+			Name:     "golden-v2",
+			Snapshot: types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-2"},
+		}},
+	}}
+	ref := findSnapshotByName(trees, "golden-v2")
+	if ref == nil || ref.Value != "snapshot-2" {
+		t.Fatalf("Expected snapshot-2, got %v", ref)
+	}
+	if ref := findSnapshotByName(trees, "golden-v3"); ref != nil {
+		t.Fatalf("Expected no snapshot, got %v", ref)
+	}
+
+	backing := &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "vm-network"},
+	}
+	pool := types.ManagedObjectReference{Type: "ResourcePool", Value: "resgroup-1"}
+	vmMo := &mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{Hardware: types.VirtualHardware{
+			NumCPU:   4,
+			MemoryMB: 8192,
+			Device: []types.BaseVirtualDevice{&types.VirtualVmxnet3{
+				VirtualVmxnet: types.VirtualVmxnet{VirtualEthernetCard: types.VirtualEthernetCard{
+					VirtualDevice: types.VirtualDevice{Key: 4000, Backing: backing},
+					MacAddress:    "00:50:56:00:00:01",
+				}},
+			}},
+		}},
+		ResourcePool: &pool,
+		Datastore:    []types.ManagedObjectReference{{Type: "Datastore", Value: "datastore-1"}},
+	}
+	snapshotMo := &mo.VirtualMachineSnapshot{}
+	snapshotMo.Self = *ref
+	snapshotMo.Config.Hardware.Device = []types.BaseVirtualDevice{
+		&types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2000}},
+		&types.VirtualVmxnet3{VirtualVmxnet: types.VirtualVmxnet{
+			VirtualEthernetCard: types.VirtualEthernetCard{
+				VirtualDevice: types.VirtualDevice{Key: 4000},
+				MacAddress:    "00:50:56:00:00:99",
+			}}},
+	}
+	spec, err := rebaseCloneSpec(vmMo, snapshotMo)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.Snapshot == nil || *spec.Snapshot != *ref {
+		t.Fatalf("Expected a clone from %v, got %v", *ref, spec.Snapshot)
+	}
+	if spec.Location.DiskMoveType != "createNewChildDiskBacking" ||
+		*spec.Location.Pool != pool || spec.Location.Datastore.Value != "datastore-1" {
+		t.Fatalf("Expected a linked clone placed like the vm, got %+v", spec.Location)
+	}
+	if spec.Config.NumCPUs != 4 || spec.Config.MemoryMB != 8192 {
+		t.Fatalf("Expected the CPUs and memory of the vm, got %+v", spec.Config)
+	}
+	if len(spec.Config.DeviceChange) != 1 {
+		t.Fatalf("Expected the NIC to be edited, got %v", spec.Config.DeviceChange)
+	}
+	nic := spec.Config.DeviceChange[0].GetVirtualDeviceConfigSpec().Device.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+	if nic.Backing != backing || nic.MacAddress != "00:50:56:00:00:01" ||
+		nic.AddressType != "manual" {
+		t.Fatalf("Expected the network and MAC of the vm, got %+v", nic)
+	}
+}
+
+func TestSharedSession(t *testing.T) {
+	oldLoginClient, oldSessionActive, oldLogoutClient := loginClient, sessionActive, logoutClient
+	oldKeepAlive := keepAlive
+	defer func() {
+		loginClient, sessionActive, logoutClient = oldLoginClient, oldSessionActive, oldLogoutClient
+		keepAlive = oldKeepAlive
+	}()
+	logins, logouts := 0, 0
+	active := true
+	loggedOut := map[*govmomi.Client]bool{}
+	keptAlive := map[*govmomi.Client]bool{}
+	loginClient = func(vm *VM) (*govmomi.Client, error) {
+		logins++
+		return &govmomi.Client{}, nil
+	}
+	sessionActive = func(vm *VM, client *govmomi.Client) bool {
+		return active
+	}
+	logoutClient = func(client *govmomi.Client) error {
+		logouts++
+		loggedOut[client] = true
+		return nil
+	}
+	keepAlive = func(client *govmomi.Client) func() {
+		keptAlive[client] = true
+		return func() { keptAlive[client] = false }
+	}
+
+	newVM := func(user string) *VM {
+		return &VM{Username: user, Password: "secret", SharedSession: true,
+			uri: &url.URL{Scheme: "https", Host: "vcenter", Path: "/sdk"}}
+	}
+	vm1, vm2, vm3 := newVM("admin"), newVM("admin"), newVM("other")
+	c1, err := newClient(vm1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	c1again, _ := newClient(vm1)
+	c2, _ := newClient(vm2)
+	c3, _ := newClient(vm3)
+	if c1 != c1again || c1 != c2 || c1 == c3 || logins != 2 {
+		t.Fatalf("Expected one session per user, got %d logins", logins)
+	}
+
+	// A different password or TLS setting doesn't get the session
+	wrongPassword, insecure, pinned := newVM("admin"), newVM("admin"), newVM("admin")
+	wrongPassword.Password = "guess"
+	insecure.Insecure = true
+	pinned.CACertPool = x509.NewCertPool()
+	for _, vm := range []*VM{wrongPassword, insecure, pinned} {
+		if c, _ := newClient(vm); c == c1 {
+			t.Fatalf("Expected a session of its own for %+v", vm)
+		}
+		vm.CloseSession()
+	}
+	if logins != 5 || logouts != 3 {
+		t.Fatalf("Expected 5 logins and 3 logouts, got %d and %d", logins, logouts)
+	}
+	logouts = 0
+
+	if err = vm1.CloseSession(); err != nil || logouts != 0 {
+		t.Fatalf("Expected the session to stay in use by vm2, got %d logouts", logouts)
+	}
+	if err = vm2.CloseSession(); err != nil || logouts != 1 {
+		t.Fatalf("Expected the session to be logged out, got %d logouts", logouts)
+	}
+	if err = vm2.CloseSession(); err != nil || logouts != 1 {
+		t.Fatalf("Expected closing twice to do nothing, got %d logouts", logouts)
+	}
+
+	active = false
+	c3again, _ := newClient(vm3)
+	if c3again == c3 || logins != 6 {
+		t.Fatalf("Expected an expired session to be replaced, got %d logins", logins)
+	}
+	if !loggedOut[c3] || keptAlive[c3] || !keptAlive[c3again] {
+		t.Fatal("Expected the expired client to be logged out and no longer kept alive")
+	}
+	vm3.CloseSession()
+	if len(sharedSessions) != 0 {
+		t.Fatalf("Expected no shared session left, got %v", sharedSessions)
+	}
+	if !loggedOut[c3again] || keptAlive[c3again] {
+		t.Fatal("Expected the closed client to be logged out and no longer kept alive")
+	}
+
+	// A failed login doesn't keep a reference to the session
+	loginClient = func(vm *VM) (*govmomi.Client, error) {
+		return nil, errors.New("login failed")
+	}
+	if _, err = newClient(vm1); err == nil || vm1.sessionKey != "" {
+		t.Fatalf("Expected the login to fail without a session, got %v", err)
+	}
+	if len(sharedSessions) != 0 {
+		t.Fatalf("Expected no shared session left, got %v", sharedSessions)
+	}
+}
+
+func TestSharedSessionSlowLogin(t *testing.T) {
+	oldLoginClient, oldSessionActive, oldLogoutClient := loginClient, sessionActive, logoutClient
+	oldKeepAlive := keepAlive
+	defer func() {
+		loginClient, sessionActive, logoutClient = oldLoginClient, oldSessionActive, oldLogoutClient
+		keepAlive = oldKeepAlive
+	}()
+	unblock := make(chan struct{})
+	loginClient = func(vm *VM) (*govmomi.Client, error) {
+		if vm.uri.Host == "slow" {
+			<-unblock
+		}
+		return &govmomi.Client{}, nil
+	}
+	sessionActive = func(vm *VM, client *govmomi.Client) bool {
+		return true
+	}
+	logoutClient = func(client *govmomi.Client) error {
+		return nil
+	}
+	keepAlive = func(client *govmomi.Client) func() {
+		return func() {}
+	}
+
+	newVM := func(host string) *VM {
+		return &VM{Username: "admin", Password: "secret", SharedSession: true,
+			uri: &url.URL{Scheme: "https", Host: host, Path: "/sdk"}}
+	}
+	slow, slowToo, fast := newVM("slow"), newVM("slow"), newVM("fast")
+	clients := make(chan *govmomi.Client, 2)
+	for _, vm := range []*VM{slow, slowToo} {
+		go func(vm *VM) {
+			c, _ := newClient(vm)
+			clients <- c
+		}(vm)
+	}
+
+	// The login to the slow host doesn't block the other sessions
+	done := make(chan error)
+	go func() {
+		_, err := newClient(fast)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the login to the fast host not to wait on the slow one")
+	}
+
+	// The vms of the slow host share one login
+	close(unblock)
+	c1, c2 := <-clients, <-clients
+	if c1 == nil || c1 != c2 {
+		t.Fatalf("Expected one shared client for the slow host, got %p and %p", c1, c2)
+	}
+	for _, vm := range []*VM{slow, slowToo, fast} {
+		vm.CloseSession()
+	}
+	if len(sharedSessions) != 0 {
+		t.Fatalf("Expected no shared session left, got %v", sharedSessions)
+	}
+}
+
+func TestGetTemplateInfo(t *testing.T) {
+	thin := true
+	vmMo := &mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			GuestId:  "ubuntu64Guest",
+			Version:  "vmx-13",
+			Firmware: "bios",
+			Template: true,
+			Hardware: types.VirtualHardware{
+				NumCPU:   2,
+				MemoryMB: 4096,
+				Device: []types.BaseVirtualDevice{
+					&types.VirtualLsiLogicController{VirtualSCSIController: types.VirtualSCSIController{
+						VirtualController: types.VirtualController{VirtualDevice: types.VirtualDevice{
+							Key:        1000,
+							DeviceInfo: &types.Description{Label: "SCSI controller 0"},
+						}},
+					}},
+					&types.VirtualDisk{
+						VirtualDevice: types.VirtualDevice{
+							Key:           2000,
+							ControllerKey: 1000,
+							Backing: &types.VirtualDiskFlatVer2BackingInfo{
+								VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds1] tmpl/tmpl.vmdk"},
+								ThinProvisioned:              &thin,
+							},
+						},
+						CapacityInBytes: 16 << 30,
+					},
+					&types.VirtualVmxnet3{VirtualVmxnet: types.VirtualVmxnet{VirtualEthernetCard: types.VirtualEthernetCard{
+						VirtualDevice: types.VirtualDevice{
+							Key:        4000,
+							DeviceInfo: &types.Description{Label: "Network adapter 1"},
+							Backing: &types.VirtualEthernetCardNetworkBackingInfo{
+								VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "VM Network"},
+							},
+						},
+					}}},
+				},
+			},
+		},
+	}
+	vmMo.Name = "tmpl"
+	info, err := getTemplateInfo(&VM{}, vmMo)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if info.Name != "tmpl" || info.NumCPUs != 2 || info.MemoryMB != 4096 ||
+		info.HardwareVersion != "vmx-13" || !info.IsTemplate {
+		t.Fatalf("Expected the hardware of the template, got %+v", info)
+	}
+	if len(info.Disks) != 1 || info.Disks[0].Datastore != "ds1" ||
+		info.Disks[0].Size != 16<<30 || info.Disks[0].Provisioning != "thin" {
+		t.Fatalf("Expected the thin 16GB disk, got %+v", info.Disks)
+	}
+	if len(info.Networks) != 1 || info.Networks[0] != "VM Network" {
+		t.Fatalf("Expected the VM Network, got %v", info.Networks)
+	}
+
+	if _, err = getTemplateInfo(&VM{}, &mo.VirtualMachine{}); err == nil {
+		t.Fatal("Expected an error without config")
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	var soapCookie, restSession string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/com/vmware/cis/session" {
+			if _, _, ok := r.BasicAuth(); ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			restSession = r.Header.Get("vmware-api-session-id")
+			fmt.Fprint(w, `{"value": "session-1"}`)
+			return
+		}
+		if cookie, err := r.Cookie(SOAP_SESSION_COOKIE); err == nil {
+			soapCookie = cookie.Value
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/sdk")
+	vm := &VM{SessionCookie: "cookie-1", uri: u, ctx: context.Background()}
+	if _, err := newClient(vm); err == nil {
+		t.Fatal("Expected an error from the fake vCenter")
+	}
+	if soapCookie != "cookie-1" {
+		t.Fatalf("Expected the session cookie to be sent, got %q", soapCookie)
+	}
+
+	c, err := newTagClient(vm, ts.URL+"/rest")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if restSession != "cookie-1" || c.session != "session-1" {
+		t.Fatalf("Expected a REST session from the cookie, got %q", restSession)
+	}
+}
+
+func TestSetCloneDiskProvisioning(t *testing.T) {
+	thin := true
+	tmplDs := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}
+	vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		Hardware: types.VirtualHardware{Device: []types.BaseVirtualDevice{
+			&types.VirtualDisk{
+				VirtualDevice: types.VirtualDevice{
+					Key: 2000,
+					Backing: &types.VirtualDiskFlatVer2BackingInfo{
+						VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+							FileName:  "[ds1] tmpl/tmpl.vmdk",
+							Datastore: &tmplDs,
+						},
+						DiskMode:        "persistent",
+						ThinProvisioned: &thin,
+					},
+				},
+			},
+		}},
+	}}
+
+	vm := &VM{CloneDiskProvisioning: "eagerzeroedthick"}
+	spec := types.VirtualMachineRelocateSpec{}
+	if err := setCloneDiskProvisioning(vm, vmMo, &spec); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(spec.Disk) != 1 || spec.Disk[0].DiskId != 2000 || spec.Disk[0].Datastore != tmplDs {
+		t.Fatalf("Expected the disk to stay on its datastore, got %+v", spec.Disk)
+	}
+	backing := spec.Disk[0].DiskBackingInfo.(*types.VirtualDiskFlatVer2BackingInfo)
+	if *backing.ThinProvisioned || !*backing.EagerlyScrub || backing.DiskMode != "persistent" {
+		t.Fatalf("Expected an eager zeroed thick disk, got %+v", backing)
+	}
+
+	dsMor := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-2"}
+	vm.CloneDiskProvisioning = "thick"
+	spec = types.VirtualMachineRelocateSpec{Datastore: &dsMor}
+	if err := setCloneDiskProvisioning(vm, vmMo, &spec); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spec.Disk[0].Datastore != dsMor {
+		t.Fatalf("Expected the disk to move to %v, got %v", dsMor, spec.Disk[0].Datastore)
+	}
+
+	vm.Destination.DestinationType = DestinationTypeDatastoreCluster
+	spec = types.VirtualMachineRelocateSpec{}
+	if err := setCloneDiskProvisioning(vm, vmMo, &spec); err != nil || spec.Transform != "flat" || spec.Disk != nil {
+		t.Fatalf("Expected a flat transform, got %+v, %v", spec, err)
+	}
+	vm.CloneDiskProvisioning = "eagerzeroedthick"
+	if err := setCloneDiskProvisioning(vm, vmMo, &spec); err == nil {
+		t.Fatal("Expected an error for eager zeroing on a datastore cluster")
+	}
+	vm.CloneDiskProvisioning = "sparse"
+	if err := setCloneDiskProvisioning(vm, vmMo, &spec); err == nil {
+		t.Fatal("Expected an error for an invalid provisioning")
+	}
+}
+
+func TestCACertPool(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	body := strings.NewReader("data")
+	err := createRequest(context.Background(), &VM{}, body, "PUT", 4, ts.URL, "application/x-vnd.vmware-streamVmdk")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected a certificate error without the CA, got %v", err)
+	}
+	body = strings.NewReader("data")
+	err = createRequest(context.Background(), &VM{CACertPool: pool}, body, "PUT", 4, ts.URL, "application/x-vnd.vmware-streamVmdk")
+	if err != nil {
+		t.Fatalf("Expected the certificate to be verified with the CA, got %v", err)
+	}
+
+	// The pool takes precedence over Insecure
+	config := tlsConfig(&VM{Insecure: true, CACertPool: pool})
+	if config.InsecureSkipVerify || config.RootCAs != pool {
+		t.Fatalf("Expected verification against the pool, got %+v", config)
+	}
+
+	u, _ := url.Parse(ts.URL + "/sdk")
+	_, err = newVimClient(&VM{uri: u, ctx: context.Background()}, nil)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected a certificate error without the CA, got %v", err)
+	}
+	_, err = newVimClient(&VM{uri: u, ctx: context.Background(), CACertPool: pool}, nil)
+	if err == nil || strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected the fake vCenter to fail after the handshake, got %v", err)
+	}
+}
+
+func TestUploadTransport(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/stall" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "ok")
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	vm := &VM{UploadResponseTimeout: 50 * time.Millisecond}
+	defer closeUploadTransport(vm)
+	for i := 0; i < 3; i++ {
+		err := createRequest(context.Background(), vm, strings.NewReader("data"), "PUT", 4,
+			ts.URL+"/disk", "application/x-vnd.vmware-streamVmdk")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Expected the uploads to reuse one connection, got %d", n)
+	}
+
+	err := createRequest(context.Background(), vm, strings.NewReader("data"), "PUT", 4,
+		ts.URL+"/stall", "application/x-vnd.vmware-streamVmdk")
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("Expected the upload to stall, got %v", err)
+	}
+}
+
+func TestPlaceFixedDisks(t *testing.T) {
+	vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		Hardware: types.VirtualHardware{Device: []types.BaseVirtualDevice{
+			&types.VirtualDisk{VirtualDevice: types.VirtualDevice{
+				Key: 2000,
+				Backing: &types.VirtualDiskFlatVer2BackingInfo{
+					VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds1] tmpl/tmpl.vmdk"},
+				},
+			}},
+			&types.VirtualDisk{VirtualDevice: types.VirtualDevice{
+				Key: 2001,
+				Backing: &types.VirtualDiskFlatVer2BackingInfo{
+					VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds1] tmpl/tmpl_1.vmdk"},
+				},
+			}},
+			&types.VirtualDisk{VirtualDevice: types.VirtualDevice{
+				Key: 2002,
+				Backing: &types.VirtualDiskFlatVer2BackingInfo{
+					VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds1] tmpl/tmpl_2.vmdk"},
+				},
+			}},
+		}},
+	}}
+	ssd := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-ssd"}
+	hdd := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-hdd"}
+	vmDs := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-vm"}
+	disks := []Disk{
+		{DiskFile: "[ds1] tmpl/tmpl.vmdk", Datastore: "ssd"},
+		{DiskFile: "[ds1] tmpl/tmpl_1.vmdk", Datastore: "hdd"},
+		{DiskFile: "[ds1] tmpl/tmpl_2.vmdk"},
+	}
+	// The second disk already has a locator from the disk provisioning
+	spec := types.VirtualMachineRelocateSpec{
+		Datastore: &vmDs,
+		Disk: []types.VirtualMachineRelocateSpecDiskLocator{
+			{DiskId: 2001, Datastore: vmDs},
+		},
+	}
+	placeFixedDisks(vmMo, disks, map[string]types.ManagedObjectReference{
+		"ssd": ssd, "hdd": hdd}, &spec)
+	expected := map[int32]types.ManagedObjectReference{2000: ssd, 2001: hdd}
+	if len(spec.Disk) != len(expected) {
+		t.Fatalf("Expected %d disk locators, got %+v", len(expected), spec.Disk)
+	}
+	for _, locator := range spec.Disk {
+		if expected[locator.DiskId] != locator.Datastore {
+			t.Fatalf("Expected disk %d on %v, got %v", locator.DiskId,
+				expected[locator.DiskId], locator.Datastore)
+		}
+	}
+
+	vm := &VM{FixedDisks: disks}
+	vm.Destination.DestinationType = DestinationTypeDatastoreCluster
+	err := setFixedDiskDatastores(vm, &mo.Datacenter{}, vmMo, &types.VirtualMachineRelocateSpec{})
+	if err == nil {
+		t.Fatal("Expected an error for a datastore cluster")
+	}
+}
+
+func TestVerifyGuestDisks(t *testing.T) {
+	oldStart, oldWait, oldPeriod := startGuestProgram, waitForGuestProcess, guestDiskPollPeriod
+	defer func() {
+		startGuestProgram, waitForGuestProcess, guestDiskPollPeriod = oldStart, oldWait, oldPeriod
+	}()
+	guestDiskPollPeriod = time.Millisecond
+	var specs []types.GuestProgramSpec
+	startGuestProgram = func(vm *VM, vmMor types.ManagedObjectReference,
+		auth GuestCredentials, spec types.GuestProgramSpec) (int64, error) {
+		specs = append(specs, spec)
+		return int64(len(specs)), nil
+	}
+	seenAfter := int64(2)
+	waitForGuestProcess = func(vm *VM, vmMor types.ManagedObjectReference,
+		auth GuestCredentials, pid int64, timeout time.Duration) (int32, error) {
+		if pid < seenAfter {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		GuestId: "ubuntu64Guest",
+		Hardware: types.VirtualHardware{Device: []types.BaseVirtualDevice{
+			&types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2000}},
+			&types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2001}},
+		}},
+	}}
+	vm := &VM{Name: "vm1", ctx: context.Background()}
+	if err := verifyGuestDisks(vm, vmMo); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(specs) != 2 || specs[0].ProgramPath != "/bin/sh" ||
+		!strings.Contains(specs[0].Arguments, "-ge 2") {
+		t.Fatalf("Expected two checks for 2 disks, got %+v", specs)
+	}
+
+	seenAfter = 100
+	vm.GuestDiskTimeout = 5 * time.Millisecond
+	err := verifyGuestDisks(vm, vmMo)
+	if _, ok := err.(ErrorGuestDisksMissing); !ok {
+		t.Fatalf("Expected ErrorGuestDisksMissing, got %v", err)
+	}
+
+	vmMo.Config.GuestId = "windows9Server64Guest"
+	spec := guestDiskCheck(vmMo, 3)
+	if !strings.HasSuffix(spec.ProgramPath, "powershell.exe") ||
+		!strings.Contains(spec.Arguments, "-ge 3") {
+		t.Fatalf("Expected a powershell check for 3 disks, got %+v", spec)
+	}
+}
+
+func TestProvisionNameTemplateGuard(t *testing.T) {
+	oldExists := Exists
+	defer func() { Exists = oldExists }()
+	Exists = func(vm *VM, searchFilter VMSearchFilter) (bool, error) {
+		return false, nil
+	}
+
+	provision := func(vm *VM) error {
+		done, err := beginProvision(vm)
+		if err != nil {
+			return err
+		}
+		defer done()
+		if _, err = renderVMName(vm, types.ManagedObjectReference{}); err != nil {
+			return err
+		}
+		return guardProvisionName(vm)
+	}
+	vm := &VM{Host: "1.1.1.1", NameTemplate: "web-{{.Index}}"}
+	for i := 0; i < 2; i++ {
+		if err := provision(vm); err != nil {
+			t.Fatalf("Expected no error provisioning %d times, got %v", i+1, err)
+		}
+	}
+
+	// The VMs of a ProvisionAll don't share a guard until their names are
+	// rendered
+	vm1 := &VM{Host: "1.1.1.1", NameTemplate: "web-{{.Index}}"}
+	vm2 := &VM{Host: "1.1.1.1", NameTemplate: "web-{{.Index}}", NameIndex: 1}
+	done1, err := beginProvision(vm1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	done2, err := beginProvision(vm2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, vm := range []*VM{vm1, vm2} {
+		if _, err = renderVMName(vm, types.ManagedObjectReference{}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err = guardProvisionName(vm); err != nil {
+			t.Fatalf("Expected no error for %s, got %v", vm.Name, err)
+		}
+	}
+	done1()
+	done2()
+
+	vmOperationsMutex.Lock()
+	defer vmOperationsMutex.Unlock()
+	if len(vmOperations) != 0 {
+		t.Fatalf("Expected every guard to be released, got %v", vmOperations)
+	}
+}
+
+func TestProvisionNameCollisionGuard(t *testing.T) {
+	oldExists := Exists
+	defer func() { Exists = oldExists }()
+	Exists = func(vm *VM, searchFilter VMSearchFilter) (bool, error) {
+		return searchFilter.Name == "web", nil
+	}
+
+	vm := &VM{Host: "1.1.1.1", Name: "web", OnNameCollision: NameCollisionSuffix}
+	done, err := beginProvision(vm)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err = resolveNameCollision(vm); err != nil || vm.Name != "web-1" {
+		t.Fatalf("Expected the name web-1, got %s %v", vm.Name, err)
+	}
+	if err = guardProvisionName(vm); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// Both names are guarded while the provision runs
+	for _, name := range []string{"web", "web-1"} {
+		_, err = beginOperation(&VM{Host: "1.1.1.1", Name: name}, "start")
+		if _, ok := err.(ErrorOperationInProgress); !ok {
+			t.Fatalf("Expected ErrorOperationInProgress for %s, got %v", name, err)
+		}
+	}
+	done()
+	for _, name := range []string{"web", "web-1"} {
+		done, err = beginOperation(&VM{Host: "1.1.1.1", Name: name}, "start")
+		if err != nil {
+			t.Fatalf("Expected the guard of %s to be released, got %v", name, err)
+		}
+		done()
+	}
+}
+
+func TestWaitForIPOrSkip(t *testing.T) {
+	oldWaitForIP := waitForIP
+	defer func() { waitForIP = oldWaitForIP }()
+	var waitErr error
+	waitForIP = func(vm *VM, vmMo *mo.VirtualMachine) (map[string][]string, error) {
+		return nil, waitErr
+	}
+
+	vm := &VM{Name: "vm"}
+	waitErr = NewErrorIPWaitSkipped(vm.Name)
+	warning, err := waitForIPOrSkip(vm, &mo.VirtualMachine{})
+	if _, ok := warning.(ErrorIPWaitSkipped); !ok || err != nil {
+		t.Fatalf("Expected the skipped wait as a warning, got %v %v", warning, err)
+	}
+	waitErr = ErrorVMPowerStateChanging
+	warning, err = waitForIPOrSkip(vm, &mo.VirtualMachine{})
+	if warning != nil || err != ErrorVMPowerStateChanging {
+		t.Fatalf("Expected the error, got %v %v", warning, err)
+	}
+}
+
+func TestPowerStateChangingGuard(t *testing.T) {
+	oldFindVM, oldWaitForActiveTasks := findVM, waitForActiveTasks
+	defer func() { findVM, waitForActiveTasks = oldFindVM, oldWaitForActiveTasks }()
+	vmMo := &mo.VirtualMachine{Guest: &types.GuestInfo{}}
+	findVM = func(vm *VM, searchFilter VMSearchFilter) (*mo.VirtualMachine, error) {
+		return vmMo, nil
+	}
+	waitForActiveTasks = func(vm *VM, vmMo *mo.VirtualMachine) error {
+		return nil
+	}
+
+	for _, state := range []types.VirtualMachineGuestState{
+		types.VirtualMachineGuestStateShuttingDown,
+		types.VirtualMachineGuestStateResetting,
+	} {
+		vmMo.Guest.GuestState = string(state)
+		if err := start(&VM{}); err != ErrorVMPowerStateChanging {
+			t.Fatalf("Expected start to be refused while %s, got %v", state, err)
+		}
+		if err := suspend(&VM{}); err != ErrorVMPowerStateChanging {
+			t.Fatalf("Expected suspend to be refused while %s, got %v", state, err)
+		}
+	}
+
+	for _, guest := range []*types.GuestInfo{nil, {GuestState: "running"}, {GuestState: "notRunning"}} {
+		if err := checkPowerStateChanging(&mo.VirtualMachine{Guest: guest}); err != nil {
+			t.Fatalf("Expected no error for %+v, got %v", guest, err)
+		}
+	}
+}
+
+func TestDownloadOvaCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	oldBackoff := ovaDownloadBackoff
+	defer func() { ovaDownloadBackoff = oldBackoff }()
+	ovaDownloadBackoff = time.Hour
+	if delay := ovaRetryDelay(100); delay != OVA_DOWNLOAD_MAX_BACKOFF {
+		t.Fatalf("Expected the delay to be capped at %v, got %v", OVA_DOWNLOAD_MAX_BACKOFF, delay)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = downloadOva(ctx, dir, ts.URL, nil, nil, true)
+	if err != context.Canceled {
+		t.Fatalf("Expected the download to be cancelled, got %v", err)
+	}
+	if time.Since(start) > time.Minute {
+		t.Fatal("Expected the cancel to interrupt the backoff")
+	}
+}
+
+func TestPostCloneScriptSpec(t *testing.T) {
+	spec, err := postCloneScriptSpec(false, "/usr/bin/env bash", "/tmp/it's here.sh", "/tmp/out $(id)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `-c 'exec "$0" "$1" > "$2" 2>&1' '/usr/bin/env bash' '/tmp/it'\''s here.sh' '/tmp/out $(id)'`
+	if spec.ProgramPath != "/bin/sh" || spec.Arguments != expected {
+		t.Fatalf("Expected /bin/sh %s, got %s %s", expected, spec.ProgramPath, spec.Arguments)
+	}
+
+	spec, err = postCloneScriptSpec(true, "", `C:\Temp\my script.ps1`, `C:\Temp\out.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `/s /c ""C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe" -NoProfile ` +
+		`-NonInteractive -ExecutionPolicy Bypass -File "C:\Temp\my script.ps1" > "C:\Temp\out.txt" 2>&1"`
+	if spec.ProgramPath != `C:\Windows\System32\cmd.exe` || spec.Arguments != expected {
+		t.Fatalf("Expected cmd.exe %s, got %s %s", expected, spec.ProgramPath, spec.Arguments)
+	}
+	if _, err = postCloneScriptSpec(true, "", `C:\Temp\%PATH%.ps1`, `C:\Temp\out.txt`); err == nil {
+		t.Fatal("Expected an error for a path cmd.exe can't quote")
+	}
+
+	if suffix := postCloneScriptSuffix(true, `C:\Python\python.exe`); suffix != ".cmd" {
+		t.Fatalf("Expected the .cmd suffix, got %s", suffix)
+	}
+	if !isWindowsGuest(&mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{GuestId: "windows9Server64Guest"}}) {
+		t.Fatal("Expected the guest id to identify a Windows guest")
+	}
+}
+
+func TestRebaseLinkedCloneFailure(t *testing.T) {
+	oldSetupSession, oldFindVM, oldFindTemplateSnapshot := SetupSession, findVM, findTemplateSnapshot
+	oldHalt, oldStart, oldCloneRebase, oldDeleteVM, oldRenameVM := halt, start, cloneRebase, deleteVM, renameVM
+	defer func() {
+		SetupSession, findVM, findTemplateSnapshot = oldSetupSession, oldFindVM, oldFindTemplateSnapshot
+		halt, start, cloneRebase, deleteVM, renameVM = oldHalt, oldStart, oldCloneRebase, oldDeleteVM, oldRenameVM
+	}()
+	folder := types.ManagedObjectReference{Type: "Folder", Value: "group-v1"}
+	SetupSession = NewFakeSession(&mockFinder{}, mockCollector{
+		MockRetrieveOne: func(c context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+			dst.(*mo.VirtualMachine).Parent = &folder
+			return nil
+		},
+	})
+	findTemplateSnapshot = func(vm *VM, templateMo *mo.VirtualMachine, name string) (*mo.VirtualMachineSnapshot, error) {
+		return &mo.VirtualMachineSnapshot{}, nil
+	}
+	var started, cloned bool
+	var deleted []string
+	halt = func(vm *VM) error { return nil }
+	start = func(vm *VM) error {
+		started = true
+		return nil
+	}
+	findVM = func(vm *VM, filter VMSearchFilter) (*mo.VirtualMachine, error) {
+		if filter.Name == "vm-rebase" && !cloned {
+			return nil, NewErrorObjectNotFound(errors.New("not found"), filter.Name)
+		}
+		vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{}}
+		vmMo.Name = filter.Name
+		vmMo.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOn
+		return vmMo, nil
+	}
+	renameVM = func(vm *VM, vmMor types.ManagedObjectReference, name string) error {
+		t.Fatal("Expected no rename after a failure")
+		return nil
+	}
+	cloneErr, destroyErr := errors.New("clone failed"), errors.New("destroy failed")
+
+	// The clone task fails after creating a partial clone
+	cloneRebase = func(vm *VM, templateMor, folderMor types.ManagedObjectReference,
+		name string, spec types.VirtualMachineCloneSpec) (types.ManagedObjectReference, error) {
+		cloned = true
+		return types.ManagedObjectReference{}, cloneErr
+	}
+	deleteVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
+		deleted = append(deleted, vmMo.Name)
+		return nil
+	}
+	vm := &VM{Name: "vm", Template: Template{Name: "template"}}
+	if err := RebaseLinkedClone(vm, "golden-v2"); err != cloneErr {
+		t.Fatalf("Expected the clone error, got %v", err)
+	}
+	if !started || !reflect.DeepEqual(deleted, []string{"vm-rebase"}) {
+		t.Fatalf("Expected the partial clone to be removed and the vm started, got %v, %t", deleted, started)
+	}
+
+	// The vm can't be destroyed
+	started, deleted = false, nil
+	cloneRebase = func(vm *VM, templateMor, folderMor types.ManagedObjectReference,
+		name string, spec types.VirtualMachineCloneSpec) (types.ManagedObjectReference, error) {
+		cloned = true
+		return types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}, nil
+	}
+	deleteVM = func(vm *VM, vmMo *mo.VirtualMachine) error {
+		deleted = append(deleted, vmMo.Name)
+		if vmMo.Name == "vm" {
+			return destroyErr
+		}
+		return nil
+	}
+	if err := RebaseLinkedClone(vm, "golden-v2"); err != destroyErr {
+		t.Fatalf("Expected the destroy error, got %v", err)
+	}
+	if !started || !reflect.DeepEqual(deleted, []string{"vm", "vm-rebase"}) {
+		t.Fatalf("Expected the clone to be removed and the vm started, got %v, %t", deleted, started)
+	}
+}
+
+func TestGuestTransferClient(t *testing.T) {
+	vm := &VM{Insecure: true}
+	first := guestTransferClient(vm).Transport
+	if guestTransferClient(vm).Transport != first {
+		t.Fatal("Expected the guest transfers to share their transport")
+	}
+	closeGuestTransport(vm)
+	if guestTransferClient(vm).Transport == first {
+		t.Fatal("Expected a new transport once the transport is closed")
+	}
+	closeGuestTransport(vm)
+}
+
+func TestShutDownTimeout(t *testing.T) {
+	oldFindVM, oldWaitForActiveTasks, oldShutdownGuest, oldHalt := findVM, waitForActiveTasks, shutdownGuest, halt
+	defer func() {
+		findVM, waitForActiveTasks, shutdownGuest, halt = oldFindVM, oldWaitForActiveTasks, oldShutdownGuest, oldHalt
+	}()
+	findVM = func(vm *VM, filter VMSearchFilter) (*mo.VirtualMachine, error) {
+		return &mo.VirtualMachine{Guest: &types.GuestInfo{GuestState: "running"}}, nil
+	}
+	waitForActiveTasks = func(vm *VM, vmMo *mo.VirtualMachine) error { return nil }
+	shutdownGuest = func(vm *VM, vmMor types.ManagedObjectReference) error { return nil }
+	halted := false
+	halt = func(vm *VM) error {
+		halted = true
+		return nil
+	}
+
+	vm := &VM{
+		Name:                 "vm",
+		ctx:                  context.Background(),
+		ShutdownTimeout:      20 * time.Millisecond,
+		ShutdownPollInterval: 5 * time.Millisecond,
+	}
+	result, err := shutDown(vm)
+	if err != NewErrorGuestShutdownTimeout("vm", 20*time.Millisecond) || result != "" {
+		t.Fatalf("Expected the shutdown to time out, got %q, %v", result, err)
+	}
+	if halted {
+		t.Fatal("Expected the vm not to be powered off")
+	}
+
+	vm.ForcePowerOffOnShutdownTimeout = true
+	result, err = shutDown(vm)
+	if err != nil || result != ShutdownForced {
+		t.Fatalf("Expected the vm to be powered off, got %q, %v", result, err)
+	}
+	if !halted {
+		t.Fatal("Expected the vm to be halted")
+	}
+}
+
+func TestMinHardwareVersionDestinations(t *testing.T) {
+	oldQuery := queryConfigOptionDescriptors
+	defer func() { queryConfigOptionDescriptors = oldQuery }()
+	envRef := types.ManagedObjectReference{Type: "EnvironmentBrowser", Value: "envbrowser-1"}
+	queryConfigOptionDescriptors = func(vm *VM, browser types.ManagedObjectReference) (
+		[]types.VirtualMachineConfigOptionDescriptor, error) {
+		if browser != envRef {
+			t.Fatalf("Expected the browser of the cluster, got %v", browser)
+		}
+		notSupported := false
+		return []types.VirtualMachineConfigOptionDescriptor{
+			{Key: "vmx-13", Host: []types.ManagedObjectReference{{Type: "HostSystem", Value: "host-1"}}},
+			{Key: "vmx-14", Host: []types.ManagedObjectReference{{Type: "HostSystem", Value: "host-2"}}},
+			{Key: "vmx-15", CreateSupported: &notSupported},
+		}, nil
+	}
+
+	clusterRef := types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c1"}
+	hostRef := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	rootRef := types.ManagedObjectReference{Type: "ResourcePool", Value: "resgroup-1"}
+	poolRef := types.ManagedObjectReference{Type: "ResourcePool", Value: "resgroup-10"}
+	f := mockFinder{}
+	f.MockResourcePoolList = func(c context.Context, p string) ([]*object.ResourcePool, error) {
+		return []*object.ResourcePool{object.NewResourcePool(nil, rootRef)}, nil
+	}
+	c := mockCollector{}
+	c.MockRetrieve = func(c context.Context, refs []types.ManagedObjectReference, ps []string, dst interface{}) error {
+		rpMo := mo.ResourcePool{}
+		if refs[0] == rootRef {
+			rpMo.Self = rootRef
+			rpMo.ResourcePool = []types.ManagedObjectReference{poolRef}
+		} else {
+			rpMo.Self = poolRef
+			rpMo.Owner = clusterRef
+		}
+		*dst.(*[]mo.ResourcePool) = []mo.ResourcePool{rpMo}
+		return nil
+	}
+	c.MockRetrieveOne = func(c context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+		switch moDst := dst.(type) {
+		case *mo.HostSystem:
+			moDst.Parent = &clusterRef
+		case *mo.ResourcePool:
+			if mor != poolRef {
+				t.Fatalf("Expected the pool of the location, got %v", mor)
+			}
+			moDst.Owner = clusterRef
+		case *mo.ClusterComputeResource:
+			moDst.Host = []types.ManagedObjectReference{hostRef}
+		case *mo.ComputeResource:
+			if mor != clusterRef {
+				t.Fatalf("Expected the cluster, got %v", mor)
+			}
+			moDst.EnvironmentBrowser = &envRef
+		}
+		return nil
+	}
+	vm := &VM{
+		MinHardwareVersion: "vmx-14",
+		client:             &govmomi.Client{Client: &vim25.Client{}},
+		finder:             f,
+		collector:          c,
+	}
+
+	// A host is limited to its own hardware versions
+	_, err := minHardwareVersion(vm, location{Host: hostRef, ResourcePool: rootRef})
+	if err != NewErrorHardwareVersionNotSupported("vmx-14", "vmx-13") {
+		t.Fatalf("Expected vmx-14 not to be supported on the host, got %v", err)
+	}
+
+	// Without a host, the cluster of the pool is browsed
+	for _, destType := range []string{DestinationTypeResourcePool, DestinationTypeDatastoreCluster} {
+		vm.Destination = Destination{DestinationType: destType, MOID: "resgroup-10"}
+		l, err := getVMLocation(vm, &mo.Datacenter{})
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", destType, err)
+		}
+		if l.Host.Value != "" || l.ResourcePool != poolRef {
+			t.Fatalf("Expected only the pool for %s, got %+v", destType, l)
+		}
+		version, err := minHardwareVersion(vm, l)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", destType, err)
+		}
+		if version != 14 {
+			t.Fatalf("Expected vmx-14 for %s, got %d", destType, version)
+		}
+	}
+}
+
+func TestReconfigureConfigSpec(t *testing.T) {
+	disk := func(key int32, file string) *types.VirtualDisk {
+		return &types.VirtualDisk{VirtualDevice: types.VirtualDevice{
+			Key: key,
+			Backing: &types.VirtualDiskFlatVer2BackingInfo{
+				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: file},
+			},
+		}}
+	}
+	vmMo := &mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{}}
+	vmMo.Config.Hardware.Device = []types.BaseVirtualDevice{disk(2000, "[ds1] vm/vm.vmdk"),
+		disk(2001, "[ds1] vm/vm_1.vmdk")}
+	vm := &VM{Name: "vm"}
+	spec := ReconfigureSpec{
+		NumCPUs:     4,
+		MemoryMB:    8192,
+		Annotation:  "resized",
+		ExtraConfig: map[string]string{"b.option": "2", "a.option": ""},
+		RemoveDisks: []Disk{{DiskFile: "[ds1] vm/vm_1.vmdk"}},
+	}
+	config, err := reconfigureConfigSpec(vm, vmMo, spec)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if config.NumCPUs != 4 || config.MemoryMB != 8192 || config.Annotation != "resized" {
+		t.Fatalf("Expected the CPUs, memory and annotation of the spec, got %+v", config)
+	}
+	expected := []types.BaseOptionValue{
+		&types.OptionValue{Key: "a.option", Value: ""},
+		&types.OptionValue{Key: "b.option", Value: "2"},
+	}
+	if !reflect.DeepEqual(config.ExtraConfig, expected) {
+		t.Fatalf("Expected the extra config sorted by key, got %v", config.ExtraConfig)
+	}
+	if len(config.DeviceChange) != 1 {
+		t.Fatalf("Expected one disk to be removed, got %v", config.DeviceChange)
+	}
+	change := config.DeviceChange[0].GetVirtualDeviceConfigSpec()
+	if change.Operation != types.VirtualDeviceConfigSpecOperationRemove ||
+		change.FileOperation != types.VirtualDeviceConfigSpecFileOperationDestroy ||
+		change.Device.GetVirtualDevice().Key != 2001 {
+		t.Fatalf("Expected the vmdk of disk 2001 to be deleted, got %+v", change)
+	}
+
+	spec.RemoveDisks = []Disk{{DiskFile: "[ds1] vm/missing.vmdk"}}
+	if _, err = reconfigureConfigSpec(vm, vmMo, spec); err == nil {
+		t.Fatal("Expected an error for a missing disk")
+	} else if _, ok := err.(ErrorObjectNotFound); !ok {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+
+	before := object.VirtualDeviceList(vmMo.Config.Hardware.Device)
+	after := append(before, disk(2002, "[ds1] vm/vm_2.vmdk"), disk(2003, "[ds2] vm/vm.vmdk"))
+	added := []Disk{{Size: 1024}, {Size: 2048}}
+	setAddedDiskFiles(added, before, after)
+	if added[0].DiskFile != "[ds1] vm/vm_2.vmdk" || added[1].DiskFile != "[ds2] vm/vm.vmdk" {
+		t.Fatalf("Expected the files of the new disks, got %+v", added)
+	}
+}
+
+func TestWaitForTasks(t *testing.T) {
+	oldSetupSession, oldFindVM, oldWaitForTask := SetupSession, findVM, waitForTask
+	defer func() {
+		SetupSession, findVM, waitForTask = oldSetupSession, oldFindVM, oldWaitForTask
+	}()
+	oldFailed := types.ManagedObjectReference{Type: "Task", Value: "task-1"}
+	running := types.ManagedObjectReference{Type: "Task", Value: "task-2"}
+	failing := types.ManagedObjectReference{Type: "Task", Value: "task-3"}
+	states := map[types.ManagedObjectReference]types.TaskInfoState{
+		oldFailed: types.TaskInfoStateError,
+		running:   types.TaskInfoStateRunning,
+		failing:   types.TaskInfoStateQueued,
+	}
+	SetupSession = NewFakeSession(&mockFinder{}, mockCollector{
+		MockRetrieveOne: func(c context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+			dst.(*mo.Task).Info.State = states[mor]
+			return nil
+		},
+	})
+	recent := []types.ManagedObjectReference{oldFailed, running}
+	findVM = func(vm *VM, filter VMSearchFilter) (*mo.VirtualMachine, error) {
+		return &mo.VirtualMachine{RecentTask: recent}, nil
+	}
+	var waited []string
+	waitForTask = func(ctx context.Context, vm *VM, task types.ManagedObjectReference) error {
+		waited = append(waited, task.Value)
+		states[task] = types.TaskInfoStateSuccess
+		if task == failing {
+			states[task] = types.TaskInfoStateError
+			return errors.New("disk full")
+		}
+		return nil
+	}
+
+	vm := &VM{Name: "vm"}
+	if err := WaitForTasks(vm, time.Minute); err != nil {
+		t.Fatalf("Expected the old failed task to be ignored, got %v", err)
+	}
+	if !reflect.DeepEqual(waited, []string{"task-2"}) {
+		t.Fatalf("Expected only the running task to be waited on, got %v", waited)
+	}
+
+	waited = nil
+	recent = append(recent, failing)
+	err := WaitForTasks(vm, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Expected the error of the failing task, got %v", err)
+	}
+	if !reflect.DeepEqual(waited, []string{"task-3"}) {
+		t.Fatalf("Expected only the queued task to be waited on, got %v", waited)
+	}
+}
+
+// guestSession: returns a fake session finding the vm "vm" in the vm folder of
+// the datacenter "dc1", with the guest info
+func guestSession(guest *types.GuestInfo) func(vm *VM) error {
+	f := mockFinder{}
+	f.MockDatacenterList = func(context.Context, string) ([]*object.Datacenter, error) {
+		return []*object.Datacenter{{}}, nil
+	}
+	folderRef := types.ManagedObjectReference{Type: "Folder", Value: "group-v1"}
+	c := mockCollector{}
+	c.MockRetrieveOne = func(ctx context.Context, mor types.ManagedObjectReference, ps []string, dst interface{}) error {
+		switch moDst := dst.(type) {
+		case *mo.Datacenter:
+			moDst.Name = "dc1"
+			moDst.VmFolder = folderRef
+		case *mo.Folder:
+			moDst.ChildEntity = []types.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		case *mo.VirtualMachine:
+			moDst.Name = "vm"
+			moDst.Guest = guest
+		}
+		return nil
+	}
+	return NewFakeSession(f, c)
+}
+
+func TestGetGuestDiskUsage(t *testing.T) {
+	oldSetupSession := SetupSession
+	defer func() {
+		SetupSession = oldSetupSession
+	}()
+	vm := &VM{Name: "vm", Datacenter: "dc1"}
+
+	SetupSession = guestSession(nil)
+	if _, err := GetGuestDiskUsage(vm); err != NewErrorToolsNotRunning("vm", "") {
+		t.Fatalf("Expected tools not to be running without guest info, got %v", err)
+	}
+
+	notRunning := string(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning)
+	SetupSession = guestSession(&types.GuestInfo{ToolsRunningStatus: notRunning})
+	if _, err := GetGuestDiskUsage(vm); err != NewErrorToolsNotRunning("vm", notRunning) {
+		t.Fatalf("Expected tools not to be running, got %v", err)
+	}
+
+	SetupSession = guestSession(&types.GuestInfo{
+		ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsRunning),
+		Disk: []types.GuestDiskInfo{
+			{DiskPath: "/", Capacity: 10 << 30, FreeSpace: 4 << 30},
+			{DiskPath: "/data", Capacity: 100 << 30, FreeSpace: 90 << 30},
+		},
+	})
+	disks, err := GetGuestDiskUsage(vm)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []GuestDisk{
+		{DiskPath: "/", Capacity: 10 << 30, FreeSpace: 4 << 30},
+		{DiskPath: "/data", Capacity: 100 << 30, FreeSpace: 90 << 30},
+	}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("Expected disks %v, got %v", expected, disks)
+	}
+}
+
+func TestGetGuestInfo(t *testing.T) {
+	oldSetupSession := SetupSession
+	defer func() {
+		SetupSession = oldSetupSession
+	}()
+	vm := &VM{Name: "vm", Datacenter: "dc1"}
+
+	SetupSession = guestSession(nil)
+	if _, err := GetGuestInfo(vm); err != NewErrorToolsNotRunning("vm", "") {
+		t.Fatalf("Expected tools not to be running without guest info, got %v", err)
+	}
+
+	SetupSession = guestSession(&types.GuestInfo{
+		HostName:      "web-1",
+		GuestId:       "ubuntu64Guest",
+		GuestFullName: "Ubuntu Linux (64-bit)",
+		Net: []types.GuestNicInfo{{
+			Network:    "VM Network",
+			MacAddress: "00:50:56:00:00:01",
+			Connected:  true,
+			IpAddress:  []string{"10.0.0.5", "fe80::1", "invalid"},
+		}},
+		IpStack: []types.GuestStackInfo{{
+			DnsConfig: &types.NetDnsConfigInfo{
+				HostName:     "web-1",
+				DomainName:   "example.com",
+				IpAddress:    []string{"10.0.0.2"},
+				SearchDomain: []string{"example.com"},
+			},
+			IpRouteConfig: &types.NetIpRouteConfigInfo{IpRoute: []types.NetIpRouteConfigInfoIpRoute{
+				{Network: "0.0.0.0", PrefixLength: 0,
+					Gateway: types.NetIpRouteConfigInfoGateway{IpAddress: "10.0.0.1"}},
+				{Network: "10.0.0.0", PrefixLength: 24},
+			}},
+		}},
+	})
+	info, err := GetGuestInfo(vm)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if info.HostName != "web-1" || info.GuestId != "ubuntu64Guest" ||
+		info.GuestFullName != "Ubuntu Linux (64-bit)" {
+		t.Fatalf("Expected the identity of the guest, got %+v", info)
+	}
+	expectedStack := []GuestIPStack{{
+		HostName:        "web-1",
+		DomainName:      "example.com",
+		DnsServers:      []string{"10.0.0.2"},
+		SearchDomains:   []string{"example.com"},
+		DefaultGateways: []string{"10.0.0.1"},
+	}}
+	if !reflect.DeepEqual(info.IpStack, expectedStack) {
+		t.Fatalf("Expected the ip stack %+v, got %+v", expectedStack, info.IpStack)
+	}
+	if len(info.Nics) != 1 {
+		t.Fatalf("Expected one nic, got %+v", info.Nics)
+	}
+	nic := info.Nics[0]
+	if nic.Network != "VM Network" || !nic.Connected || len(nic.IpAddresses) != 3 ||
+		len(nic.IPv4) != 1 || !nic.IPv4[0].Equal(net.ParseIP("10.0.0.5")) ||
+		len(nic.IPv6) != 1 || !nic.IPv6[0].Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("Expected the addresses of the nic by family, got %+v", nic)
+	}
+}